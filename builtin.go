@@ -5,6 +5,9 @@
 package girc
 
 import (
+	"context"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,6 +23,11 @@ func (c *Client) registerBuiltins() {
 	c.Handlers.register(true, false, PING, HandlerFunc(handlePING))
 	c.Handlers.register(true, false, PONG, HandlerFunc(handlePONG))
 
+	// IRCv3 standard replies.
+	c.Handlers.register(true, false, FAIL, HandlerFunc(handleStandardReply))
+	c.Handlers.register(true, false, WARN, HandlerFunc(handleStandardReply))
+	c.Handlers.register(true, false, NOTE, HandlerFunc(handleStandardReply))
+
 	if !c.Config.disableTracking {
 		// Joins/parts/anything that may add/remove/rename users.
 		c.Handlers.register(true, false, JOIN, HandlerFunc(handleJOIN))
@@ -29,17 +37,38 @@ func (c *Client) registerBuiltins() {
 		c.Handlers.register(true, false, NICK, HandlerFunc(handleNICK))
 		c.Handlers.register(true, false, RPL_NAMREPLY, HandlerFunc(handleNAMES))
 
+		// Invites to us, or others (with invite-notify).
+		c.Handlers.register(true, false, INVITE, HandlerFunc(handleINVITE))
+
+		// Rejoining channels after reconnecting, and regaining our nick.
+		c.Handlers.register(true, false, CONNECTED, HandlerFunc(handleAutoRejoin))
+		c.Handlers.register(true, false, CONNECTED, HandlerFunc(handleRegainNick))
+		c.Handlers.register(true, false, CONNECTED, HandlerFunc(handleAdvertiseBot))
+
 		// Modes.
 		c.Handlers.register(true, false, MODE, HandlerFunc(handleMODE))
 		c.Handlers.register(true, false, RPL_CHANNELMODEIS, HandlerFunc(handleMODE))
+		c.Handlers.register(true, false, RPL_UMODEIS, HandlerFunc(handleUMODEIS))
 
 		// WHO/WHOX responses.
 		c.Handlers.register(true, false, RPL_WHOREPLY, HandlerFunc(handleWHO))
 		c.Handlers.register(true, false, RPL_WHOSPCRPL, HandlerFunc(handleWHO))
+		c.Handlers.register(true, false, RPL_AWAY, HandlerFunc(handleRPLAWAY))
+		c.Handlers.register(true, false, RPL_WHOISACCOUNT, HandlerFunc(handleWHOISACCOUNT))
+
+		// Our own away status.
+		c.Handlers.register(true, false, RPL_NOWAWAY, HandlerFunc(handleSelfAway))
+		c.Handlers.register(true, false, RPL_UNAWAY, HandlerFunc(handleSelfAway))
+
+		// OPER responses.
+		c.Handlers.register(true, false, RPL_YOUREOPER, HandlerFunc(handleOPER))
+		c.Handlers.register(true, false, ERR_NOOPERHOST, HandlerFunc(handleOPER))
+		c.Handlers.register(true, false, ERR_PASSWDMISMATCH, HandlerFunc(handleOPER))
 
 		// Other misc. useful stuff.
 		c.Handlers.register(true, false, TOPIC, HandlerFunc(handleTOPIC))
 		c.Handlers.register(true, false, RPL_TOPIC, HandlerFunc(handleTOPIC))
+		c.Handlers.register(true, false, RPL_TOPICWHOTIME, HandlerFunc(handleTOPICWHOTIME))
 		c.Handlers.register(true, false, RPL_MYINFO, HandlerFunc(handleMYINFO))
 		c.Handlers.register(true, false, RPL_ISUPPORT, HandlerFunc(handleISUPPORT))
 		c.Handlers.register(true, false, RPL_MOTDSTART, HandlerFunc(handleMOTD))
@@ -56,11 +85,14 @@ func (c *Client) registerBuiltins() {
 		c.Handlers.register(true, false, CAP_CHGHOST, HandlerFunc(handleCHGHOST))
 		c.Handlers.register(true, false, CAP_AWAY, HandlerFunc(handleAWAY))
 		c.Handlers.register(true, false, CAP_ACCOUNT, HandlerFunc(handleACCOUNT))
+		c.Handlers.register(true, false, CAP_SETNAME, HandlerFunc(handleSETNAME))
 		c.Handlers.register(true, false, ALL_EVENTS, HandlerFunc(handleTags))
+		c.Handlers.register(true, false, ALL_EVENTS, HandlerFunc(handleBatch))
 
 		// SASL IRCv3 support.
 		c.Handlers.register(true, false, AUTHENTICATE, HandlerFunc(handleSASL))
 		c.Handlers.register(true, false, RPL_SASLSUCCESS, HandlerFunc(handleSASL))
+		c.Handlers.register(true, false, ERR_SASLALREADY, HandlerFunc(handleSASL))
 		c.Handlers.register(true, false, RPL_NICKLOCKED, HandlerFunc(handleSASLError))
 		c.Handlers.register(true, false, ERR_SASLFAIL, HandlerFunc(handleSASLError))
 		c.Handlers.register(true, false, ERR_SASLTOOLONG, HandlerFunc(handleSASLError))
@@ -68,6 +100,9 @@ func (c *Client) registerBuiltins() {
 		c.Handlers.register(true, false, RPL_SASLMECHS, HandlerFunc(handleSASLError))
 	}
 
+	// Identifying with NickServ.
+	c.Handlers.register(true, false, CONNECTED, HandlerFunc(handleNickServ))
+
 	// Nickname collisions.
 	c.Handlers.register(true, false, ERR_NICKNAMEINUSE, HandlerFunc(nickCollisionHandler))
 	c.Handlers.register(true, false, ERR_NICKCOLLISION, HandlerFunc(nickCollisionHandler))
@@ -92,25 +127,146 @@ func handleConnect(c *Client, e Event) {
 		c.state.notify(c, UPDATE_GENERAL)
 	}
 
+	// The server may not support capability negotiation at all.
+	c.state.Lock()
+	negotiated := !c.state.capsNegotiated
+	c.state.capsNegotiated = true
+	c.state.Unlock()
+
+	if negotiated {
+		c.capsNegotiated()
+	}
+
 	time.Sleep(2 * time.Second)
 
 	c.mu.RLock()
 	server := c.server()
 	c.mu.RUnlock()
+
 	c.RunHandlers(&Event{Command: CONNECTED, Params: []string{server}})
+
+	// Only notify Client.WaitForConnect() once the (non-background) CONNECTED
+	// handlers have completed.
+	c.state.Lock()
+	select {
+	case <-c.state.ready:
+	default:
+		close(c.state.ready)
+	}
+	c.state.Unlock()
 }
 
 // nickCollisionHandler helps prevent the client from having conflicting
 // nicknames with another bot, user, etc.
 func nickCollisionHandler(c *Client, e Event) {
+	// Failed attempts to regain our nick once connected shouldn't change our
+	// current nick.
+	if c.Config.RegainNick && len(e.Params) > 1 && c.CaseMap(e.Params[1]) == c.CaseMap(c.Config.Nick) {
+		c.state.RLock()
+		registered := c.state.nick != ""
+		c.state.RUnlock()
+
+		if registered {
+			return
+		}
+	}
+
+	var newNick string
 	if c.Config.HandleNickCollide == nil {
-		c.Cmd.Nick(c.GetNick() + "_")
+		newNick = c.GetNick() + "_"
+
+		// Keep within the servers nickname length, replacing the last
+		// character rather than appending, as otherwise it would be
+		// rejected by Commands.Nick().
+		if max := c.ISupportInt("NICKLEN", 0); c.Config.ValidateLimits && max > 0 && len(newNick) > max {
+			newNick = newNick[:max-1] + "_"
+		}
+
+		if newNick == c.GetNick() {
+			c.debug.Printf("unable to find an alternative nickname for %s", newNick)
+			return
+		}
+	} else {
+		newNick = c.Config.HandleNickCollide(c.GetNick())
+	}
+
+	if newNick == "" {
 		return
 	}
 
-	newNick := c.Config.HandleNickCollide(c.GetNick())
-	if newNick != "" {
-		c.Cmd.Nick(newNick)
+	if err := c.Cmd.Nick(newNick); err != nil {
+		c.debug.Printf("unable to change nickname to %s: %s", newNick, err)
+	}
+}
+
+// handleNickServ identifies with NickServ once connected, see
+// Config.NickServ.
+func handleNickServ(c *Client, e Event) {
+	if c.Config.NickServ.Password == "" {
+		return
+	}
+
+	c.Send(&Event{Command: PRIVMSG, Params: c.Config.NickServ.Params(), Sensitive: true})
+}
+
+// handleAdvertiseBot sets the bot user mode advertised by the server once
+// connected, see Config.AdvertiseBot.
+func handleAdvertiseBot(c *Client, e Event) {
+	if !c.Config.AdvertiseBot {
+		return
+	}
+
+	mode, ok := c.GetServerOption("BOT")
+	if !ok || len(mode) != 1 {
+		return
+	}
+
+	c.Cmd.Mode(c.GetNick(), "+"+mode)
+}
+
+// defaultRegainNickInterval is the default for Config.RegainNickInterval.
+const defaultRegainNickInterval = 30 * time.Second
+
+// handleRegainNick starts attempting to regain our configured nick once
+// connected, see Config.RegainNick.
+func handleRegainNick(c *Client, e Event) {
+	if !c.Config.RegainNick {
+		return
+	}
+
+	go c.regainNick(c.context())
+}
+
+// regainNick periodically attempts to change our nick to Config.Nick, until
+// it's been confirmed by the server, or we disconnect.
+func (c *Client) regainNick(ctx context.Context) {
+	interval := c.Config.RegainNickInterval
+	if interval <= 0 {
+		interval = defaultRegainNickInterval
+	}
+
+	var ghosted bool
+	for {
+		if c.GetID() == c.CaseMap(c.Config.Nick) {
+			return
+		}
+
+		if c.Config.NickServGhost != "" && !ghosted {
+			c.Cmd.Message("NickServ", c.Config.NickServGhost+" "+c.Config.Nick)
+			ghosted = true
+		}
+
+		c.debug.Printf("attempting to regain nick %s", c.Config.Nick)
+		if err := c.Cmd.Nick(c.Config.Nick); err != nil {
+			c.debug.Printf("unable to regain nick %s: %s", c.Config.Nick, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
@@ -122,7 +278,27 @@ func handlePING(c *Client, e Event) {
 func handlePONG(c *Client, e Event) {
 	c.conn.mu.Lock()
 	c.conn.lastPong = time.Now()
+	latency := c.conn.lastPong.Sub(c.conn.lastPing)
 	c.conn.mu.Unlock()
+
+	if latency >= 0 {
+		c.metrics().OnLatency(latency)
+	}
+}
+
+// handleStandardReply fires a STANDARD_REPLY event for IRCv3 standard
+// replies (FAIL, WARN and NOTE).
+func handleStandardReply(c *Client, e Event) {
+	if _, ok := e.StandardReply(); !ok {
+		return
+	}
+
+	c.RunHandlers(&Event{
+		Source:  e.Source,
+		Tags:    e.Tags,
+		Command: STANDARD_REPLY,
+		Params:  append([]string{e.Command}, e.Params...),
+	})
 }
 
 // handleJOIN ensures that the state has updated users and channels.
@@ -171,10 +347,10 @@ func handleJOIN(c *Client, e Event) {
 	}
 	c.state.Unlock()
 
-	if e.Source.ID() == c.GetID() {
+	if c.IsSelf(e.Source) {
 		// If it's us, don't just add our user to the list. Run a WHO which
 		// will tell us who exactly is in the entire channel.
-		c.Send(&Event{Command: WHO, Params: []string{channelName, "%tacuhnr,1"}})
+		c.Send(&Event{Command: WHO, Params: []string{channelName, whoxTrackingFields.query(whoxTrackingToken)}})
 
 		// Also send a MODE to obtain the list of channel modes.
 		c.Send(&Event{Command: MODE, Params: []string{channelName}})
@@ -189,7 +365,7 @@ func handleJOIN(c *Client, e Event) {
 	}
 
 	// Only WHO the user, which is more efficient.
-	c.Send(&Event{Command: WHO, Params: []string{e.Source.Name, "%tacuhnr,1"}})
+	c.Send(&Event{Command: WHO, Params: []string{e.Source.Name, whoxTrackingFields.query(whoxTrackingToken)}})
 }
 
 // handlePART ensures that the state is clean of old user and channel entries.
@@ -208,7 +384,7 @@ func handlePART(c *Client, e Event) {
 
 	defer c.state.notify(c, UPDATE_STATE)
 
-	if e.Source.ID() == c.GetID() {
+	if c.IsSelf(e.Source) {
 		c.state.Lock()
 		c.state.deleteChannel(channel)
 		c.state.Unlock()
@@ -216,7 +392,7 @@ func handlePART(c *Client, e Event) {
 	}
 
 	c.state.Lock()
-	c.state.deleteUser(channel, e.Source.ID())
+	c.state.deleteUser(channel, e.Source.Name)
 	c.state.Unlock()
 }
 
@@ -224,12 +400,14 @@ func handlePART(c *Client, e Event) {
 // updated with the latest channel topic.
 func handleTOPIC(c *Client, e Event) {
 	var name string
-	switch len(e.Params) {
-	case 0:
+	switch {
+	case len(e.Params) == 0:
 		return
-	case 1:
+	case e.Command == TOPIC || len(e.Params) == 1:
+		// TOPIC <channel> :<topic>
 		name = e.Params[0]
 	default:
+		// RPL_TOPIC: <client> <channel> :<topic>
 		name = e.Params[1]
 	}
 
@@ -241,6 +419,36 @@ func handleTOPIC(c *Client, e Event) {
 	}
 
 	channel.Topic = e.Last()
+	if e.Command == TOPIC && e.Source != nil {
+		channel.TopicSetBy = e.Source.Name
+		channel.TopicSetAt = e.Timestamp
+	}
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+}
+
+// handleTOPICWHOTIME handles incoming RPL_TOPICWHOTIME events, which contain
+// who set the channel topic, and when.
+func handleTOPICWHOTIME(c *Client, e Event) {
+	// <client> <channel> <nick> <setat>
+	if len(e.Params) < 4 {
+		return
+	}
+
+	ts, err := strconv.ParseInt(e.Params[3], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.state.Lock()
+	channel := c.state.lookupChannel(e.Params[1])
+	if channel == nil {
+		c.state.Unlock()
+		return
+	}
+
+	channel.TopicSetBy = e.Params[2]
+	channel.TopicSetAt = time.Unix(ts, 0)
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
@@ -248,28 +456,33 @@ func handleTOPIC(c *Client, e Event) {
 // handlWHO updates our internal tracking of users/channels with WHO/WHOX
 // information.
 func handleWHO(c *Client, e Event) {
-	var ident, host, nick, account, realname string
+	var ident, host, nick, flags, account, realname string
 
 	// Assume WHOX related.
 	if e.Command == RPL_WHOSPCRPL {
-		if len(e.Params) != 8 {
+		reply, ok := ParseWHOX(&e, whoxTrackingFields)
+		if !ok {
 			// Assume there was some form of error or invalid WHOX response.
 			return
 		}
 
-		if e.Params[1] != "1" {
+		if reply.Token != whoxTrackingToken {
 			// We should always be sending 1, and we should receive 1. If this
 			// is anything but, then we didn't send the request and we can
 			// ignore it.
 			return
 		}
 
-		ident, host, nick, account = e.Params[3], e.Params[4], e.Params[5], e.Params[6]
-		realname = e.Last()
+		ident, host, nick, flags, account = reply.User, reply.Host, reply.Nick, reply.Flags, reply.Account
+		realname = reply.Realname
 	} else {
+		if len(e.Params) < 8 {
+			return
+		}
+
 		// Assume RPL_WHOREPLY.
 		// format: "<client> <channel> <user> <host> <server> <nick> <H|G>[*][@|+] :<hopcount> <real_name>"
-		ident, host, nick, realname = e.Params[2], e.Params[3], e.Params[5], e.Last()
+		ident, host, nick, flags, realname = e.Params[2], e.Params[3], e.Params[5], e.Params[6], e.Last()
 
 		// Strip the numbers from "<hopcount> <realname>"
 		for i := 0; i < len(realname); i++ {
@@ -301,8 +514,104 @@ func handleWHO(c *Client, e Event) {
 		user.Extras.Account = account
 	}
 
+	away := user.Extras.Away
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
+
+	// "G" is gone (away), "H" is here. WHO replies don't include the away
+	// message, so keep the existing one if we already know it.
+	switch {
+	case strings.HasPrefix(flags, "G") && away == "":
+		c.setAway(nick, unknownAwayMessage)
+	case strings.HasPrefix(flags, "H") && away != "":
+		c.setAway(nick, "")
+	}
+}
+
+// handleRPLAWAY updates the away message of a user from RPL_AWAY, which is
+// sent in response to a WHOIS, or when messaging a user who is away.
+func handleRPLAWAY(c *Client, e Event) {
+	// format: "<client> <nick> :<message>"
+	if len(e.Params) < 3 || e.Last() == "" {
+		return
+	}
+
+	c.setAway(e.Params[1], e.Last())
+}
+
+// handleWHOISACCOUNT updates the account of a user from RPL_WHOISACCOUNT,
+// which is sent in response to a WHOIS if the user is logged in. This allows
+// tracking accounts on servers which don't support account-notify, etc.
+func handleWHOISACCOUNT(c *Client, e Event) {
+	// format: "<client> <nick> <account> :is logged in as"
+	if len(e.Params) < 3 || e.Params[2] == "" {
+		return
+	}
+
+	c.state.Lock()
+	user := c.state.lookupUser(e.Params[1])
+	if user == nil || user.Extras.Account == e.Params[2] {
+		c.state.Unlock()
+		return
+	}
+	user.Extras.Account = e.Params[2]
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+}
+
+// handleSelfAway tracks our own away status from RPL_NOWAWAY and
+// RPL_UNAWAY, firing SELF_AWAY or SELF_BACK.
+func handleSelfAway(c *Client, e Event) {
+	c.state.Lock()
+	if e.Command == RPL_NOWAWAY {
+		c.state.away = true
+		c.state.awayMessage = c.state.awayPending
+	} else {
+		c.state.away = false
+		c.state.awayMessage = ""
+	}
+	c.state.awayPending = ""
+	message := c.state.awayMessage
+	nick := c.state.nick
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_GENERAL)
+
+	if e.Command == RPL_UNAWAY {
+		c.setAway(nick, "")
+		c.RunHandlers(&Event{Command: SELF_BACK})
+		return
+	}
+
+	if message == "" {
+		c.setAway(nick, unknownAwayMessage)
+	} else {
+		c.setAway(nick, message)
+	}
+	c.RunHandlers(&Event{Command: SELF_AWAY, Params: []string{message}})
+}
+
+// handleOPER handles responses to OPER, tracking if we're an IRC operator,
+// and firing OPER_UP or OPER_FAILED.
+func handleOPER(c *Client, e Event) {
+	c.state.Lock()
+	pending := c.state.operPending
+	c.state.operPending = false
+
+	if e.Command == RPL_YOUREOPER {
+		c.state.oper = true
+		c.state.Unlock()
+		c.state.notify(c, UPDATE_GENERAL)
+
+		c.RunHandlers(&Event{Command: OPER_UP, Params: []string{e.Last()}})
+		return
+	}
+	c.state.Unlock()
+
+	// ERR_PASSWDMISMATCH is also sent when the server password is incorrect,
+	// so only treat errors as OPER failures if we're waiting on OPER.
+	if pending {
+		c.RunHandlers(&Event{Command: OPER_FAILED, Params: []string{e.Command, e.Last()}})
+	}
 }
 
 // handleKICK ensures that users are cleaned up after being kicked from the
@@ -317,8 +626,16 @@ func handleKICK(c *Client, e Event) {
 
 	if e.Params[1] == c.GetNick() {
 		c.state.Lock()
+		var key string
+		if ch := c.state.lookupChannel(e.Params[0]); ch != nil {
+			key, _ = ch.Key()
+		}
 		c.state.deleteChannel(e.Params[0])
 		c.state.Unlock()
+
+		if c.Config.AutoRejoinOnKick {
+			c.rejoinAfterKick(e.Params[0], key)
+		}
 		return
 	}
 
@@ -328,6 +645,100 @@ func handleKICK(c *Client, e Event) {
 	c.state.Unlock()
 }
 
+const (
+	// defaultAutoRejoinDelay is the default for Config.AutoRejoinDelay.
+	defaultAutoRejoinDelay = 5 * time.Second
+	// maxKickRejoins is the maximum number of times we will rejoin a channel
+	// after being kicked, within kickRejoinWindow.
+	maxKickRejoins   = 3
+	kickRejoinWindow = 5 * time.Minute
+)
+
+// rejoinAfterKick rejoins channel (with key, if not empty) after
+// Config.AutoRejoinDelay, unless we've already rejoined the channel too many
+// times recently, or we disconnect in the meantime.
+func (c *Client) rejoinAfterKick(channel, key string) {
+	c.state.Lock()
+	id := c.state.id(channel)
+
+	var recent []time.Time
+	for _, t := range c.state.kickRejoins[id] {
+		if time.Since(t) < kickRejoinWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= maxKickRejoins {
+		c.state.kickRejoins[id] = recent
+		c.state.Unlock()
+		c.debug.Printf("not rejoining %s after kick, already rejoined %d times recently", channel, len(recent))
+		return
+	}
+
+	c.state.kickRejoins[id] = append(recent, time.Now())
+	c.state.Unlock()
+
+	delay := c.Config.AutoRejoinDelay
+	if delay <= 0 {
+		delay = defaultAutoRejoinDelay
+	}
+
+	// Servers may hide the key from users who aren't channel operators.
+	if key == "*" {
+		key = ""
+	}
+
+	ctx := c.context()
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		var err error
+		if key != "" {
+			err = c.Cmd.JoinKey(channel, key)
+		} else {
+			err = c.Cmd.Join(channel)
+		}
+
+		if err != nil {
+			c.debug.Printf("unable to rejoin %s: %s", channel, err)
+		}
+	}()
+}
+
+// handleAutoRejoin rejoins the channels we were in before we were last
+// disconnected, see Config.AutoRejoin.
+func handleAutoRejoin(c *Client, e Event) {
+	c.state.Lock()
+	rejoin := c.state.rejoin
+	c.state.rejoin = nil
+	c.state.Unlock()
+
+	if !c.Config.AutoRejoin || len(rejoin) == 0 {
+		return
+	}
+
+	var channels []string
+	for channel, key := range rejoin {
+		if key != "" {
+			if err := c.Cmd.JoinKey(channel, key); err != nil {
+				c.debug.Printf("unable to rejoin %s: %s", channel, err)
+			}
+			continue
+		}
+
+		channels = append(channels, channel)
+	}
+
+	sort.Strings(channels)
+	if err := c.Cmd.Join(channels...); err != nil {
+		c.debug.Printf("unable to rejoin %v: %s", channels, err)
+	}
+}
+
 // handleNICK ensures that users are renamed in state, or the client name is
 // up to date.
 func handleNICK(c *Client, e Event) {
@@ -338,7 +749,7 @@ func handleNICK(c *Client, e Event) {
 	c.state.Lock()
 	// renameUser updates the LastActive time automatically.
 	if len(e.Params) >= 1 {
-		c.state.renameUser(e.Source.ID(), e.Last())
+		c.state.renameUser(e.Source.Name, e.Last())
 	}
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
@@ -350,12 +761,12 @@ func handleQUIT(c *Client, e Event) {
 		return
 	}
 
-	if e.Source.ID() == c.GetID() {
+	if c.IsSelf(e.Source) {
 		return
 	}
 
 	c.state.Lock()
-	c.state.deleteUser("", e.Source.ID())
+	c.state.deleteUser("", e.Source.Name)
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
@@ -417,26 +828,21 @@ func handleISUPPORT(c *Client, e Event) {
 	maxUserLength := defaultUserLength
 	maxHostLength := defaultHostLength
 
-	var ok bool
-	var tmp int
-
-	if tmp, ok = c.GetServerOptionInt("LINELEN"); ok {
-		maxLineLength = tmp
+	if tmp := c.ISupportInt("LINELEN", 0); tmp > 2 {
+		maxLineLength = tmp - 2 // -2 for CR-LF.
 		c.state.Lock()
-		c.state.maxLineLength = maxTagLength - 2 // -2 for CR-LF.
+		c.state.maxLineLength = maxLineLength
 		c.state.Unlock()
 	}
 
-	if tmp, ok = c.GetServerOptionInt("NICKLEN"); ok {
-		maxNickLength = tmp
-	}
-	if tmp, ok = c.GetServerOptionInt("MAXNICKLEN"); ok && tmp > maxNickLength {
+	maxNickLength = c.ISupportInt("NICKLEN", maxNickLength)
+	if tmp := c.ISupportInt("MAXNICKLEN", 0); tmp > maxNickLength {
 		maxNickLength = tmp
 	}
-	if tmp, ok = c.GetServerOptionInt("USERLEN"); ok && tmp > maxUserLength {
+	if tmp := c.ISupportInt("USERLEN", 0); tmp > maxUserLength {
 		maxUserLength = tmp
 	}
-	if tmp, ok = c.GetServerOptionInt("HOSTLEN"); ok && tmp > maxHostLength {
+	if tmp := c.ISupportInt("HOSTLEN", 0); tmp > maxHostLength {
 		maxHostLength = tmp
 	}
 
@@ -453,6 +859,40 @@ func handleISUPPORT(c *Client, e Event) {
 	c.state.notify(c, UPDATE_GENERAL)
 }
 
+// handleINVITE handles incoming INVITE events, firing INVITED when we're
+// the one being invited, or CHANNEL_INVITE when someone else is invited to a
+// channel we're in. The latter requires the invite-notify capability, and
+// servers usually only send these to channel operators.
+func handleINVITE(c *Client, e Event) {
+	// :<inviter> INVITE <invitee> <channel>
+	if e.Source == nil || len(e.Params) < 2 {
+		return
+	}
+
+	params := []string{e.Source.Name, e.Params[0], e.Params[1]}
+
+	if c.CaseMap(e.Params[0]) == c.GetID() {
+		c.RunHandlers(&Event{Command: INVITED, Source: e.Source.Copy(), Params: params})
+		return
+	}
+
+	// Only channel operators are notified of invites by others.
+	c.state.RLock()
+	_, notify := c.state.enabledCap["invite-notify"]
+	joined := c.state.lookupChannel(e.Params[1]) != nil
+
+	var op bool
+	if user := c.state.lookupUser(c.state.nick); user != nil {
+		perms, _ := user.Perms.Lookup(e.Params[1])
+		op = perms.IsAdmin()
+	}
+	c.state.RUnlock()
+
+	if notify && joined && op {
+		c.RunHandlers(&Event{Command: CHANNEL_INVITE, Source: e.Source.Copy(), Params: params})
+	}
+}
+
 // handleMOTD handles incoming MOTD messages and buffers them up for use with
 // Client.ServerMOTD().
 func handleMOTD(c *Client, e Event) {
@@ -526,7 +966,7 @@ func handleNAMES(c *Client, e Event) {
 		}
 
 		user.addChannel(channel.Name)
-		channel.addUser(s.ID())
+		channel.addUser(s.Name)
 
 		// Don't append modes, overwrite them.
 		perms, _ := user.Perms.Lookup(channel.Name)
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,25 +23,30 @@ var possibleCap = map[string][]string{
 	"chghost":           nil,
 	"extended-join":     nil,
 	"invite-notify":     nil,
+	"labeled-response":  nil,
 	"message-tags":      nil,
 	"msgid":             nil,
 	"multi-prefix":      nil,
 	"server-time":       nil,
+	"setname":           nil,
 	"userhost-in-names": nil,
 
 	// Supported draft versions, some may be duplicated above, this is for backwards
 	// compatibility.
+	"draft/chathistory":      nil,
 	"draft/message-tags-0.2": nil,
 	"draft/msgid":            nil,
 
 	// sts, sasl, etc are enabled dynamically/depending on client configuration,
 	// so aren't included on this list.
 
-	// "echo-message" is supported, but it's not enabled by default. This is
-	// to prevent unwanted confusion and utilize less traffic if it's not needed.
+	// "echo-message" is supported, but it's not enabled by default (see
+	// Config.RequestEcho). This is to prevent unwanted confusion and utilize
+	// less traffic if it's not needed.
 	// echo messages aren't sent to girc.PRIVMSG and girc.NOTICE handlers,
-	// rather they are only sent to girc.ALL_EVENTS handlers (this is to prevent
-	// each handler to have to check these types of things for each message).
+	// rather they are only sent to girc.ALL_EVENTS and girc.ECHO handlers (this
+	// is to prevent each handler to have to check these types of things for
+	// each message).
 	// You can compare events using Event.Equals() to see if they are the same.
 }
 
@@ -48,6 +54,26 @@ var possibleCap = map[string][]string{
 // <value> ::= YYYY-MM-DDThh:mm:ss.sssZ
 const capServerTimeFormat = "2006-01-02T15:04:05.999Z"
 
+// ErrCapNotEnabled is returned when a method requires an IRCv3 capability
+// which hasn't been negotiated with the server.
+type ErrCapNotEnabled struct {
+	Cap string
+}
+
+func (e ErrCapNotEnabled) Error() string {
+	return fmt.Sprintf("capability %q is not enabled", e.Cap)
+}
+
+// requireCap returns ErrCapNotEnabled if the given capability hasn't been
+// negotiated with the server (or tracking is disabled).
+func (c *Client) requireCap(name string) error {
+	if c.Config.disableTracking || !c.HasCapability(name) {
+		return ErrCapNotEnabled{Cap: name}
+	}
+
+	return nil
+}
+
 func (c *Client) listCAP() {
 	if !c.Config.disableTracking {
 		c.write(&Event{Command: CAP, Params: []string{CAP_LS, "302"}})
@@ -72,6 +98,10 @@ func possibleCapList(c *Client) map[string][]string {
 		}
 	}
 
+	if c.Config.RequestEcho && !c.Config.disableTracking {
+		out["echo-message"] = nil
+	}
+
 	for k := range c.Config.SupportedCaps {
 		out[k] = c.Config.SupportedCaps[k]
 	}
@@ -118,6 +148,14 @@ func parseCap(raw string) map[string]map[string]string {
 // This will lock further registration until we have acknowledged (or denied)
 // the capabilities.
 func handleCAP(c *Client, e Event) {
+	// Handlers must be executed after the state has been unlocked.
+	var negotiated bool
+	defer func() {
+		if negotiated {
+			c.capsNegotiated()
+		}
+	}()
+
 	c.state.Lock()
 	defer c.state.Unlock()
 
@@ -133,7 +171,7 @@ func handleCAP(c *Client, e Event) {
 	// We can assume there was a failure attempting to enable a capability.
 	if len(e.Params) >= 2 && e.Params[1] == CAP_NAK {
 		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		negotiated = c.endCAP()
 		return
 	}
 
@@ -177,7 +215,7 @@ func handleCAP(c *Client, e Event) {
 		if len(e.Params) == 3 {
 			// If we support no caps, just ack the CAP message and END.
 			if len(c.state.tmpCap) == 0 {
-				c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+				negotiated = c.endCAP()
 				return
 			}
 
@@ -273,6 +311,10 @@ func handleCAP(c *Client, e Event) {
 				return
 			}
 
+			if hasTLSConnection {
+				c.saveSTSPolicy()
+			}
+
 			// Only upgrade if not already upgraded.
 			if !hasTLSConnection {
 				c.state.sts.beginUpgrade = true
@@ -288,18 +330,50 @@ func handleCAP(c *Client, e Event) {
 		// due to cap-notify, we can re-evaluate what we can support.
 		c.state.tmpCap = make(map[string]map[string]string)
 
-		if _, ok := c.state.enabledCap["sasl"]; ok && c.Config.SASL != nil {
-			c.write(&Event{Command: AUTHENTICATE, Params: []string{c.Config.SASL.Method()}})
-			// Don't "CAP END", since we want to authenticate.
-			return
+		// Only authenticate if sasl has just been enabled (which may also be
+		// mid-session, via cap-notify "CAP NEW"), and we haven't already
+		// authenticated, so we don't authenticate twice.
+		if c.Config.SASL != nil && !c.state.authenticated {
+			for _, cap := range enabled {
+				if cap == "sasl" {
+					c.write(&Event{Command: AUTHENTICATE, Params: []string{c.Config.SASL.Method()}})
+					// Don't "CAP END", since we want to authenticate.
+					return
+				}
+			}
 		}
 
 		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		negotiated = c.endCAP()
 		return
 	}
 }
 
+// endCAP ends capability negotiation with the server. Returns true if this
+// is the first time negotiation has ended for the current connection (and
+// as such, CAPS_NEGOTIATED should be fired with Client.capsNegotiated()).
+// Unsafe (you must lock c.state yourself!)
+func (c *Client) endCAP() (first bool) {
+	c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+
+	first = !c.state.capsNegotiated
+	c.state.capsNegotiated = true
+	return first
+}
+
+// capsNegotiated fires CAPS_NEGOTIATED, with the enabled capabilities.
+func (c *Client) capsNegotiated() {
+	c.state.RLock()
+	caps := make([]string, 0, len(c.state.enabledCap))
+	for name := range c.state.enabledCap {
+		caps = append(caps, name)
+	}
+	c.state.RUnlock()
+
+	sort.Strings(caps)
+	c.RunHandlers(&Event{Command: CAPS_NEGOTIATED, Params: caps})
+}
+
 // handleCHGHOST handles incoming IRCv3 hostname change events. CHGHOST is
 // what occurs (when enabled) when a servers services change the hostname of
 // a user. Traditionally, this was simply resolved with a quick QUIT and JOIN,
@@ -322,13 +396,45 @@ func handleCHGHOST(c *Client, e Event) {
 // handleAWAY handles incoming IRCv3 AWAY events, for which are sent both
 // when users are no longer away, or when they are away.
 func handleAWAY(c *Client, e Event) {
+	if e.Source == nil {
+		return
+	}
+
+	var message string
+	if len(e.Params) > 0 {
+		message = e.Last()
+	}
+
+	c.setAway(e.Source.Name, message)
+}
+
+// unknownAwayMessage is used as the away message of a user, when we know
+// they are away, however we don't know their away message (e.g. from a WHO
+// reply).
+const unknownAwayMessage = "away"
+
+// setAway updates the away status of a tracked user, and fires USER_AWAY or
+// USER_BACK if the status of the user changed. An empty message means the
+// user is no longer away.
+func (c *Client) setAway(nick, message string) {
 	c.state.Lock()
-	user := c.state.lookupUser(e.Source.Name)
-	if user != nil {
-		user.Extras.Away = e.Last()
+	user := c.state.lookupUser(nick)
+	if user == nil || user.Extras.Away == message {
+		c.state.Unlock()
+		return
 	}
+
+	wasAway := user.Extras.Away != ""
+	user.Extras.Away = message
+	source := &Source{Name: user.Nick, Ident: user.Ident, Host: user.Host}
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
+
+	if message != "" {
+		c.RunHandlers(&Event{Command: USER_AWAY, Source: source, Params: []string{source.Name, message}})
+	} else if wasAway {
+		c.RunHandlers(&Event{Command: USER_BACK, Source: source, Params: []string{source.Name}})
+	}
 }
 
 // handleACCOUNT handles incoming IRCv3 ACCOUNT events. ACCOUNT is sent when
@@ -353,3 +459,19 @@ func handleACCOUNT(c *Client, e Event) {
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
+
+// handleSETNAME handles incoming IRCv3 SETNAME events, which are sent when a
+// user (including ourselves) changes their realname.
+func handleSETNAME(c *Client, e Event) {
+	if e.Source == nil || len(e.Params) != 1 {
+		return
+	}
+
+	c.state.Lock()
+	user := c.state.lookupUser(e.Source.Name)
+	if user != nil {
+		user.Extras.Name = e.Params[0]
+	}
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+}
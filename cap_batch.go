@@ -0,0 +1,111 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+// Batch represents a group of events sent by the server using the IRCv3
+// "batch" capability (e.g. a netsplit, netjoin, or chathistory playback).
+// See https://ircv3.net/specs/extensions/batch for more information.
+type Batch struct {
+	// Ref is the reference tag which the server used to identify the batch.
+	Ref string `json:"ref"`
+	// Type is the type of the batch, e.g. "netsplit", "netjoin", or
+	// "chathistory".
+	Type string `json:"type"`
+	// Params are any additional parameters supplied with the batch type.
+	Params []string `json:"params"`
+	// Source is the origin of the batch, if supplied.
+	Source *Source `json:"source"`
+	// Tags are the message tags supplied when the batch was started.
+	Tags Tags `json:"tags"`
+	// Events are the events which were sent within the batch, in the order
+	// they were received. This includes the events of any nested batches,
+	// along with the BATCH events which started and ended them.
+	Events []*Event `json:"events"`
+
+	// parent is the reference tag of the batch this batch is nested within,
+	// if any.
+	parent string
+}
+
+// handleBatch collects the events which are sent within an IRCv3 batch, and
+// fires a BATCH_COMPLETE event once the batch has ended. Nested batches are
+// merged into the batch they are nested within, so BATCH_COMPLETE only fires
+// for the outermost batch. Events within a batch are still handled as they
+// are received, so that state tracking is unaffected.
+func handleBatch(c *Client, e Event) {
+	c.state.Lock()
+
+	if _, ok := c.state.enabledCap["batch"]; !ok {
+		c.state.Unlock()
+		return
+	}
+
+	if e.Command != BATCH || len(e.Params) < 1 || len(e.Params[0]) < 2 {
+		c.state.collectBatchEvent(&e)
+		c.state.Unlock()
+		return
+	}
+
+	ref := e.Params[0][1:]
+
+	switch e.Params[0][0] {
+	case '+':
+		c.state.collectBatchEvent(&e)
+
+		if len(e.Params) < 2 {
+			break
+		}
+
+		batch := &Batch{
+			Ref:    ref,
+			Type:   e.Params[1],
+			Params: append([]string{}, e.Params[2:]...),
+			Source: e.Source.Copy(),
+			Tags:   e.Copy().Tags,
+		}
+		batch.parent, _ = e.Tags.Get("batch")
+
+		c.state.batches[ref] = batch
+	case '-':
+		batch, ok := c.state.batches[ref]
+		if !ok {
+			c.state.collectBatchEvent(&e)
+			break
+		}
+		delete(c.state.batches, ref)
+
+		if parent, ok := c.state.batches[batch.parent]; ok {
+			parent.Events = append(parent.Events, batch.Events...)
+			c.state.collectBatchEvent(&e)
+			break
+		}
+
+		c.state.Unlock()
+
+		c.RunHandlers(&Event{
+			Source:  batch.Source,
+			Tags:    batch.Tags,
+			Command: BATCH_COMPLETE,
+			Params:  append([]string{batch.Ref, batch.Type}, batch.Params...),
+			Batch:   batch,
+		})
+		return
+	}
+
+	c.state.Unlock()
+}
+
+// collectBatchEvent adds the event to the batch referenced by its "batch"
+// tag, if the batch is known. state must be locked.
+func (s *state) collectBatchEvent(e *Event) {
+	ref, ok := e.Tags.Get("batch")
+	if !ok {
+		return
+	}
+
+	if batch, ok := s.batches[ref]; ok {
+		batch.Events = append(batch.Events, e.Copy())
+	}
+}
@@ -83,7 +83,14 @@ const saslChunkSize = 400
 func handleSASL(c *Client, e Event) {
 	if e.Command == RPL_SASLSUCCESS || e.Command == ERR_SASLALREADY {
 		// Let the server know that we're done.
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		c.state.Lock()
+		c.state.authenticated = true
+		negotiated := c.endCAP()
+		c.state.Unlock()
+
+		if negotiated {
+			c.capsNegotiated()
+		}
 		return
 	}
 
@@ -124,7 +131,24 @@ func handleSASL(c *Client, e Event) {
 
 func handleSASLError(c *Client, e Event) {
 	if c.Config.SASL == nil {
-		c.write(&Event{Command: CAP, Params: []string{CAP_END}})
+		c.state.Lock()
+		negotiated := c.endCAP()
+		c.state.Unlock()
+
+		if negotiated {
+			c.capsNegotiated()
+		}
+		return
+	}
+
+	// If we're already registered, we were authenticating mid-session (see
+	// handleCAP), so there's no need to disconnect.
+	c.state.RLock()
+	registered := c.state.nick != ""
+	c.state.RUnlock()
+
+	if registered {
+		c.debug.Printf("sasl authentication failed: %s", e.Last())
 		return
 	}
 
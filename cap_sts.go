@@ -0,0 +1,77 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "time"
+
+// STSPolicy is a strict transport security persistence policy, provided by
+// a server with the IRCv3 "sts" capability. See:
+// https://ircv3.net/specs/extensions/sts
+type STSPolicy struct {
+	// Port is the port which secure connections should be made on.
+	Port int `json:"port"`
+	// Duration is how long the policy should be enforced for, starting from
+	// Received.
+	Duration time.Duration `json:"duration"`
+	// Received is when the policy was last received (or when the last
+	// secure connection was closed), from which Duration is calculated.
+	Received time.Time `json:"received"`
+	// Preload is true if the server has consented to the policy being
+	// preloaded by clients.
+	Preload bool `json:"preload"`
+}
+
+// Expired returns true if the policy is no longer being enforced.
+func (p STSPolicy) Expired() bool {
+	return time.Since(p.Received) > p.Duration
+}
+
+// STSStore is used to persist strict transport security policies, keyed by
+// the hostname of the server (Config.Server), so that they can be enforced
+// across restarts of the application. Without persistence, a fresh client
+// could be downgraded to an insecure connection on its first connection.
+// Implementations must be safe for concurrent use, if the store is shared
+// between multiple clients.
+type STSStore interface {
+	// Get returns the policy for the given host, if one exists.
+	Get(host string) (policy STSPolicy, ok bool)
+	// Set stores the policy for the given host, replacing any existing
+	// policy.
+	Set(host string, policy STSPolicy)
+}
+
+// loadSTSPolicy loads the persisted strict transport policy for the server
+// from Config.STSStore, if the client doesn't already have one in memory.
+// Must lock state mu first!
+func (c *Client) loadSTSPolicy() {
+	if c.Config.STSStore == nil || c.Config.DisableSTS || c.Config.SSL || c.state.sts.enabled() {
+		return
+	}
+
+	policy, ok := c.Config.STSStore.Get(c.Config.Server)
+	if !ok || policy.Port <= 0 || policy.Expired() {
+		return
+	}
+
+	c.state.sts.upgradePort = policy.Port
+	c.state.sts.persistenceDuration = int(policy.Duration.Seconds())
+	c.state.sts.persistenceReceived = policy.Received
+	c.state.sts.preload = policy.Preload
+}
+
+// saveSTSPolicy saves the current strict transport policy for the server to
+// Config.STSStore, if it's enforceable. Must lock state mu first!
+func (c *Client) saveSTSPolicy() {
+	if c.Config.STSStore == nil || !c.state.sts.enabled() || c.state.sts.persistenceDuration < 0 {
+		return
+	}
+
+	c.Config.STSStore.Set(c.Config.Server, STSPolicy{
+		Port:     c.state.sts.upgradePort,
+		Duration: time.Duration(c.state.sts.persistenceDuration) * time.Second,
+		Received: c.state.sts.persistenceReceived,
+		Preload:  c.state.sts.preload,
+	})
+}
@@ -13,22 +13,27 @@ import (
 )
 
 // handleTags handles any messages that have tags that will affect state. (e.g.
-// 'account' tags.)
+// 'account' tags.) This allows the account of a user to be known as soon as
+// they send a message (e.g. PRIVMSG/NOTICE), rather than only from
+// extended-join or WHOX.
 func handleTags(c *Client, e Event) {
-	if len(e.Tags) == 0 {
+	if len(e.Tags) == 0 || e.Source == nil || e.Source.IsServer() {
 		return
 	}
 
-	account, ok := e.Tags.Get("account")
+	account, ok := e.Account()
 	if !ok {
 		return
 	}
 
 	c.state.Lock()
-	user := c.state.lookupUser(e.Source.ID())
-	if user != nil {
-		user.Extras.Account = account
+	user := c.state.lookupUser(e.Source.Name)
+	if user == nil || user.Extras.Account == account {
+		c.state.Unlock()
+		return
 	}
+
+	user.Extras.Account = account
 	c.state.Unlock()
 	c.state.notify(c, UPDATE_STATE)
 }
@@ -84,12 +89,8 @@ func ParseTags(raw string) (t Tags) {
 			continue
 		}
 
-		// Check if tag key or decoded value are invalid.
-		// if !validTag(parts[i][:hasValue]) || !validTagValue(tagDecoder.Replace(parts[i][hasValue+1:])) {
-		// 	continue
-		// }
-
-		t[parts[i][:hasValue]] = tagDecoder.Replace(parts[i][hasValue+1:])
+		// Values are stored encoded, and decoded with Tags.Get().
+		t[parts[i][:hasValue]] = parts[i][hasValue+1:]
 	}
 
 	return t
@@ -277,6 +278,26 @@ func (t Tags) Set(key, value string) error {
 	return nil
 }
 
+// clientOnly returns a copy of the tags, only containing client-only tags
+// (those prefixed with "+", e.g. "+draft/react"). Returns nil if there are no
+// client-only tags.
+func (t Tags) clientOnly() Tags {
+	var out Tags
+
+	for key, value := range t {
+		if len(key) < 2 || key[0] != prefixUserTag {
+			continue
+		}
+
+		if out == nil {
+			out = make(Tags)
+		}
+		out[key] = value
+	}
+
+	return out
+}
+
 // Remove deletes the tag frwom the tag map.
 func (t Tags) Remove(key string) (success bool) {
 	if t == nil {
@@ -311,12 +332,13 @@ func validTag(name string) bool {
 	return true
 }
 
-// validTagValue valids a decoded IRC tag value. If the value is not decoded
-// with tagDecoder first, it may be seen as invalid.
+// validTagValue validates an encoded IRC tag value. Values may contain any
+// UTF-8 characters, other than control characters, spaces and semicolons,
+// which must be escaped with tagEncoder first.
 func validTagValue(value string) bool {
 	for i := 0; i < len(value); i++ {
 		// Don't allow any invisible chars within the tag, or semicolons.
-		if value[i] < '!' || value[i] > '~' || value[i] == ';' {
+		if value[i] < '!' || value[i] == 0x7f || value[i] == ';' {
 			return false
 		}
 	}
@@ -6,7 +6,10 @@ package girc
 
 import (
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCapSupported(t *testing.T) {
@@ -33,6 +36,23 @@ func TestCapSupported(t *testing.T) {
 	}
 }
 
+func TestCapRequestEcho(t *testing.T) {
+	c := New(Config{Server: "irc.example.com", Nick: "test", User: "user"})
+	if _, ok := possibleCapList(c)["echo-message"]; ok {
+		t.Fatal("possibleCapList() has echo-message cap without Config.RequestEcho")
+	}
+
+	c.Config.RequestEcho = true
+	if _, ok := possibleCapList(c)["echo-message"]; !ok {
+		t.Fatal("possibleCapList() missing echo-message cap with Config.RequestEcho")
+	}
+
+	c.DisableTracking()
+	if _, ok := possibleCapList(c)["echo-message"]; ok {
+		t.Fatal("possibleCapList() has echo-message cap with tracking disabled")
+	}
+}
+
 var testsParseCap = []struct {
 	in   string
 	want map[string]map[string]string
@@ -118,3 +138,463 @@ func TestTagGetSetCount(t *testing.T) {
 		t.Fatal("tag set of invalid value should have returned error")
 	}
 }
+
+func TestTagEncoding(t *testing.T) {
+	tags := Tags{}
+	if err := tags.Set("+draft/react", "👍 yes; no\\"); err != nil {
+		t.Fatalf("Tags.Set() returned error: %s", err)
+	}
+	if err := tags.Set("+example.com/empty", ""); err != nil {
+		t.Fatalf("Tags.Set() returned error: %s", err)
+	}
+
+	want := "@+draft/react=👍\\syes\\:\\sno\\\\;+example.com/empty"
+	if got := tags.String(); got != want {
+		t.Fatalf("Tags.String() == %q, want %q", got, want)
+	}
+
+	// Parsing the encoded tags should result in the same encoded values, and
+	// the same decoded values.
+	parsed := ParseTags(want)
+	if got := parsed.String(); got != want {
+		t.Fatalf("ParseTags(%q).String() == %q, want %q", want, got, want)
+	}
+
+	if v, _ := parsed.Get("+draft/react"); v != "👍 yes; no\\" {
+		t.Fatalf("Tags.Get(+draft/react) == %q, want %q", v, "👍 yes; no\\")
+	}
+
+	client := Tags{"+draft/reply": "abc", "label": "123", "msgid": "456"}.clientOnly()
+	if len(client) != 1 || client["+draft/reply"] != "abc" {
+		t.Fatalf("Tags.clientOnly() == %v, want only +draft/reply", client)
+	}
+
+	if client := (Tags{"label": "123"}).clientOnly(); client != nil {
+		t.Fatalf("Tags.clientOnly() == %v, want nil", client)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	var batches []*Batch
+	c.Handlers.Add(BATCH_COMPLETE, func(c *Client, e Event) {
+		batches = append(batches, e.Batch)
+	})
+
+	lines := []string{
+		":irc.host BATCH +outer netsplit irc.hub other.host",
+		"@batch=outer :nick1!user@host QUIT :irc.hub other.host",
+		"@batch=outer :irc.host BATCH +inner example.com/nested",
+		"@batch=inner :nick2!user@host PRIVMSG #channel :hello",
+		"@batch=outer :irc.host BATCH -inner",
+		"@batch=outer :nick3!user@host QUIT :irc.hub other.host",
+		":irc.host BATCH -outer",
+		":nick4!user@host PRIVMSG #channel :not in a batch",
+	}
+
+	run := func() {
+		for _, line := range lines {
+			c.RunHandlers(ParseEvent(line))
+		}
+	}
+
+	// Without the batch capability, events should pass through as-is.
+	run()
+	if len(batches) != 0 {
+		t.Fatalf("got %d batches without batch capability enabled, want 0", len(batches))
+	}
+
+	c.state.Lock()
+	c.state.enabledCap["batch"] = nil
+	c.state.Unlock()
+
+	run()
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(batches))
+	}
+
+	batch := batches[0]
+	if batch.Ref != "outer" || batch.Type != "netsplit" || !reflect.DeepEqual(batch.Params, []string{"irc.hub", "other.host"}) {
+		t.Fatalf("Batch == %#v, want ref outer, type netsplit, and params", batch)
+	}
+
+	want := []string{
+		"QUIT nick1",
+		"BATCH irc.host",
+		"PRIVMSG nick2",
+		"BATCH irc.host",
+		"QUIT nick3",
+	}
+
+	if len(batch.Events) != len(want) {
+		t.Fatalf("got %d events in batch, want %d: %#v", len(batch.Events), len(want), batch.Events)
+	}
+
+	for i, e := range batch.Events {
+		if got := e.Command + " " + e.Source.Name; got != want[i] {
+			t.Fatalf("Batch.Events[%d] == %q, want %q", i, got, want[i])
+		}
+	}
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+	if len(c.state.batches) != 0 {
+		t.Fatalf("%d batches still tracked after all batches ended", len(c.state.batches))
+	}
+}
+
+func TestAwayTracking(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	events := make(chan Event, 10)
+	c.Handlers.Add(USER_AWAY, func(c *Client, e Event) { events <- e })
+	c.Handlers.Add(USER_BACK, func(c *Client, e Event) { events <- e })
+
+	expect := func(command string, params ...string) {
+		t.Helper()
+
+		select {
+		case e := <-events:
+			if e.Command != command || !reflect.DeepEqual(e.Params, params) {
+				t.Fatalf("got event %s %v, want %s %v", e.Command, e.Params, command, params)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", command)
+		}
+	}
+
+	c.state.Lock()
+	c.state.createUser(&Source{Name: "nick1", Ident: "user", Host: "host"})
+	c.state.createUser(&Source{Name: "nick2", Ident: "user", Host: "host"})
+	c.state.createUser(&Source{Name: "nick3", Ident: "user", Host: "host"})
+	c.state.Unlock()
+
+	// away-notify.
+	c.RunHandlers(ParseEvent(":nick1!user@host AWAY :gone fishing"))
+	expect(USER_AWAY, "nick1", "gone fishing")
+
+	// WHO replies only include whether the user is away.
+	c.RunHandlers(ParseEvent(":dummy.int 354 test 1 #channel user host nick2 G* 0 :realname"))
+	expect(USER_AWAY, "nick2", unknownAwayMessage)
+
+	// RPL_AWAY includes the away message.
+	c.RunHandlers(ParseEvent(":dummy.int 301 test nick2 :be right back"))
+	expect(USER_AWAY, "nick2", "be right back")
+
+	users := c.AwayUsers()
+	if len(users) != 2 || users[0].Nick != "nick1" || users[1].Nick != "nick2" {
+		t.Fatalf("Client.AwayUsers() == %v, want nick1 and nick2", users)
+	}
+
+	if users[1].Extras.Away != "be right back" {
+		t.Fatalf("User.Extras.Away == %q, want %q", users[1].Extras.Away, "be right back")
+	}
+
+	c.RunHandlers(ParseEvent(":nick1!user@host AWAY"))
+	expect(USER_BACK, "nick1")
+
+	c.RunHandlers(ParseEvent(":dummy.int 352 test #channel user host dummy.int nick2 H :0 realname"))
+	expect(USER_BACK, "nick2")
+
+	if users := c.AwayUsers(); len(users) != 0 {
+		t.Fatalf("Client.AwayUsers() == %v, want none", users)
+	}
+}
+
+func TestAccountTag(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	cases := []struct {
+		in      string
+		account string
+		ok      bool
+	}{
+		{in: "@account=bob :nick1!user@host PRIVMSG #channel :hello", account: "bob", ok: true},
+		{in: "@account=* :nick1!user@host PRIVMSG #channel :hello", ok: false},
+		{in: "@msgid=abc :nick1!user@host PRIVMSG #channel :hello", ok: false},
+		{in: ":nick1!user@host PRIVMSG #channel :hello", ok: false},
+	}
+
+	for _, tt := range cases {
+		account, ok := ParseEvent(tt.in).Account()
+		if account != tt.account || ok != tt.ok {
+			t.Fatalf("Event.Account() == (%q, %t), want (%q, %t) from %q", account, ok, tt.account, tt.ok, tt.in)
+		}
+	}
+
+	c.state.Lock()
+	c.state.createUser(&Source{Name: "nick1", Ident: "user", Host: "host"})
+	c.state.Unlock()
+
+	// Should be ignored, as there is no source.
+	c.RunHandlers(ParseEvent("@account=bob NOTICE #channel :hello"))
+
+	c.RunHandlers(ParseEvent("@account=bob :nick1!user@host NOTICE #channel :hello"))
+	if user := c.LookupUser("nick1"); user == nil || user.Extras.Account != "bob" {
+		t.Fatalf("User.Extras.Account not updated from account tag: %#v", user)
+	}
+}
+
+type mockSTSStore map[string]STSPolicy
+
+func (s mockSTSStore) Get(host string) (STSPolicy, bool) {
+	policy, ok := s[host]
+	return policy, ok
+}
+
+func (s mockSTSStore) Set(host string, policy STSPolicy) { s[host] = policy }
+
+func TestSTSStore(t *testing.T) {
+	store := mockSTSStore{}
+	conf := Config{
+		Server:   "irc.example.com",
+		Port:     6667,
+		Nick:     "test",
+		User:     "user",
+		STSStore: store,
+	}
+
+	c := New(conf)
+	c.state.Lock()
+	c.state.sts.upgradePort = 6697
+	c.state.sts.persistenceDuration = 3600
+	c.state.sts.persistenceReceived = time.Now()
+	c.saveSTSPolicy()
+	c.state.Unlock()
+
+	policy, ok := store.Get("irc.example.com")
+	if !ok || policy.Port != 6697 || policy.Duration != time.Hour || policy.Expired() {
+		t.Fatalf("STSStore.Get() == (%#v, %t), want saved policy", policy, ok)
+	}
+
+	// A new client should enforce the persisted policy.
+	c = New(conf)
+	c.state.Lock()
+	c.loadSTSPolicy()
+	c.state.Unlock()
+
+	if server := c.Server(); server != "irc.example.com:6697" {
+		t.Fatalf("Client.Server() == %q, want %q", server, "irc.example.com:6697")
+	}
+
+	// Expired policies should be ignored.
+	policy.Received = time.Now().Add(-2 * time.Hour)
+	store.Set("irc.example.com", policy)
+
+	c = New(conf)
+	c.state.Lock()
+	c.loadSTSPolicy()
+	c.state.Unlock()
+
+	if server := c.Server(); server != "irc.example.com:6667" {
+		t.Fatalf("Client.Server() == %q, want %q", server, "irc.example.com:6667")
+	}
+}
+
+func TestEchoMessage(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	var echoes, messages int32
+	c.Handlers.Add(ECHO, func(c *Client, e Event) {
+		if !e.Echo || e.Command != PRIVMSG {
+			t.Errorf("ECHO handler got %q (echo: %t), want echoed PRIVMSG", e.String(), e.Echo)
+		}
+		atomic.AddInt32(&echoes, 1)
+	})
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { atomic.AddInt32(&messages, 1) })
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Without echo-message enabled, echoes only go to ALL_EVENTS.
+	conn.Write([]byte(":test!user@host.com PRIVMSG #channel :first\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	if got := atomic.LoadInt32(&echoes); got != 0 {
+		t.Fatalf("ECHO handler executed %d times without echo-message, want 0", got)
+	}
+
+	c.state.Lock()
+	c.state.enabledCap["echo-message"] = nil
+	c.state.Unlock()
+
+	conn.Write([]byte(":test!user@host.com PRIVMSG #channel :second\r\n"))
+	conn.Write([]byte(":nick!user@host.com PRIVMSG #channel :not an echo\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	if got := atomic.LoadInt32(&echoes); got != 1 {
+		t.Fatalf("ECHO handler executed %d times, want 1", got)
+	}
+
+	if got := atomic.LoadInt32(&messages); got != 1 {
+		t.Fatalf("PRIVMSG handler executed %d times, want 1", got)
+	}
+}
+
+func TestSASLCapNew(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.SASL = &SASLPlain{User: "test", Pass: "example"}
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// expectNoAuth fails if we try to authenticate before the server
+	// responds to the sync PING.
+	expectNoAuth := func() {
+		t.Helper()
+
+		conn.Write([]byte("PING :sync\r\n"))
+		for {
+			select {
+			case line := <-lines:
+				if strings.HasPrefix(line, AUTHENTICATE) {
+					t.Fatalf("unexpected authentication attempt: %q", line)
+				}
+
+				if line == "PONG sync" {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for PONG")
+			}
+		}
+	}
+
+	// Registered without sasl being available (e.g. services were down).
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	expectNoAuth()
+
+	// Services came back.
+	conn.Write([]byte(":dummy.int CAP test NEW :sasl\r\n"))
+	expectLine(t, lines, "CAP REQ sasl")
+	conn.Write([]byte(":dummy.int CAP test ACK :sasl\r\n"))
+	expectLine(t, lines, "AUTHENTICATE PLAIN")
+	conn.Write([]byte("AUTHENTICATE +\r\n"))
+	expectLine(t, lines, "AUTHENTICATE "+c.Config.SASL.Encode([]string{"+"}))
+	conn.Write([]byte(":dummy.int 903 test :SASL authentication successful\r\n"))
+	expectLine(t, lines, "CAP END")
+
+	// Other caps, and sasl being re-advertised, shouldn't cause us to
+	// authenticate again.
+	conn.Write([]byte(":dummy.int CAP test NEW :away-notify\r\n"))
+	expectLine(t, lines, "CAP REQ away-notify")
+	conn.Write([]byte(":dummy.int CAP test ACK :away-notify\r\n"))
+	expectNoAuth()
+
+	conn.Write([]byte(":dummy.int CAP test DEL :sasl\r\n"))
+	conn.Write([]byte(":dummy.int CAP test NEW :sasl\r\n"))
+	expectLine(t, lines, "CAP REQ sasl")
+	conn.Write([]byte(":dummy.int CAP test ACK :sasl\r\n"))
+	expectNoAuth()
+
+	if !c.IsConnected() {
+		t.Fatal("client disconnected after re-authenticating")
+	}
+}
+
+func TestCapsNegotiated(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.DisableSTS = true
+	c.Config.SASL = &SASLPlain{User: "test", Pass: "example"}
+	lines := mockReadLines(conn)
+
+	events := make(chan Event, 5)
+	c.Handlers.Add(CAPS_NEGOTIATED, func(c *Client, e Event) { events <- e })
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int CAP * LS :sasl multi-prefix\r\n"))
+	for line := range lines {
+		if strings.HasPrefix(line, "CAP REQ ") {
+			break
+		}
+	}
+
+	conn.Write([]byte(":dummy.int CAP * ACK :sasl multi-prefix\r\n"))
+	expectLine(t, lines, "AUTHENTICATE PLAIN")
+
+	select {
+	case e := <-events:
+		t.Fatalf("CAPS_NEGOTIATED fired before SASL completed: %v", e.Params)
+	default:
+	}
+
+	conn.Write([]byte("AUTHENTICATE +\r\n"))
+	conn.Write([]byte(":dummy.int 903 test :SASL authentication successful\r\n"))
+	expectLine(t, lines, "CAP END")
+
+	select {
+	case e := <-events:
+		if want := []string{"multi-prefix", "sasl"}; !reflect.DeepEqual(e.Params, want) {
+			t.Fatalf("CAPS_NEGOTIATED params == %q, want %q", e.Params, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for CAPS_NEGOTIATED")
+	}
+
+	// Neither registering, or later negotiation (e.g. cap-notify), should
+	// fire it again.
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	conn.Write([]byte(":dummy.int CAP test NEW :away-notify\r\n"))
+	expectLine(t, lines, "CAP REQ away-notify")
+	conn.Write([]byte(":dummy.int CAP test ACK :away-notify\r\n"))
+	expectLine(t, lines, "CAP END")
+
+	select {
+	case e := <-events:
+		t.Fatalf("CAPS_NEGOTIATED fired more than once: %v", e.Params)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCapsNegotiatedUnsupported(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	mockReadLines(conn)
+
+	events := make(chan Event, 5)
+	c.Handlers.Add(CAPS_NEGOTIATED, func(c *Client, e Event) { events <- e })
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Servers without capability negotiation just register us.
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+
+	select {
+	case e := <-events:
+		if len(e.Params) != 0 {
+			t.Fatalf("CAPS_NEGOTIATED params == %q, want none", e.Params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for CAPS_NEGOTIATED")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -46,9 +47,17 @@ type Client struct {
 	// so multiple threads aren't trying to connect at the same time, and
 	// vice versa.
 	mu sync.RWMutex
+	// sendMu ensures events sent with Client.SendBulk() are queued
+	// together. It's only held while queueing events (never while rate
+	// limiting, or calling user callbacks), and is held for reading when
+	// queueing individual events.
+	sendMu sync.RWMutex
 	// stop is used to communicate with Connect(), letting it know that the
 	// client wishes to cancel/close.
 	stop context.CancelFunc
+	// ctx is the context of the current (or last) connection, which is
+	// cancelled when stop is called. This should be guarded with Client.mu.
+	ctx context.Context
 	// conn is a net.Conn reference to the IRC server. If this is nil, it is
 	// safe to assume that we're not connected. If this is not nil, this
 	// means we're either connected, connecting, or cleaning up. This should
@@ -56,6 +65,11 @@ type Client struct {
 	conn *ircConn
 	// debug is used if a writer is supplied for Client.Config.Debugger.
 	debug *log.Logger
+	// ignoreMu guards ignores.
+	ignoreMu sync.RWMutex
+	// ignores are the hostmasks of users which are ignored, see
+	// Client.Ignore().
+	ignores []string
 }
 
 // Config contains configuration options for an IRC client
@@ -78,11 +92,20 @@ type Config struct {
 	// Name is the "realname" that's used during connection. This only has an
 	// affect during the dial process.
 	Name string
+	// UserModes are the user modes to request during registration, via the
+	// mode field of the USER command (see RFC 2812, section 3.1.3). Only "i"
+	// (invisible) and "w" (wallops) can be requested this way, e.g. "iw".
+	// This only has an affect during the dial process.
+	UserModes string
 	// SASL contains the necessary authentication data to authenticate
 	// with SASL. See the documentation for SASLMech for what is currently
 	// supported. Capability tracking must be enabled for this to work, as
 	// this requires IRCv3 CAP handling.
 	SASL SASLMech
+	// NickServ allows identifying to services with NickServ once connected,
+	// on networks which don't support SASL. See the NickServ type for more
+	// information.
+	NickServ NickServ
 	// WebIRC allows forwarding source user hostname/ip information to the server
 	// (if supported by the server) to ensure the source machine doesn't show as
 	// the source. See the WebIRC type for more information.
@@ -92,11 +115,46 @@ type Config struct {
 	// resolve to an IPv4/IPv6 address bindable on your system. Otherwise,
 	// you can simply use a IPv4/IPv6 address directly. This only has an
 	// affect during the dial process and will not work with DialerConnect().
+	// The address family of Bind must match IPVersion, if set.
 	Bind string
+	// IPVersion forces connecting over IPv4 or IPv6. Defaults to IPAuto,
+	// which will try both when the server is dual-stack. Without a custom
+	// Dialer, both are tried in parallel (happy-eyeballs style, preferring
+	// the first address the server resolves to), as done by net.Dialer.
+	// When using DialerConnect(), the network passed to the Dialer will be
+	// "tcp4", "tcp6" or "tcp" respectively, and it's up to the Dialer how
+	// "tcp" is handled.
+	IPVersion IPVersion
 	// SSL allows dialing via TLS. See TLSConfig to set your own TLS
 	// configuration (e.g. to not force hostname checking). This only has an
 	// affect during the dial process.
 	SSL bool
+	// UseSTARTTLS upgrades a plaintext connection to TLS before registration,
+	// using the STARTTLS extension, as an alternative to connecting to a TLS
+	// port directly (see SSL). TLSConfig is used for the handshake. If the
+	// server rejects the upgrade, the connection fails with
+	// ErrSTARTTLSFailed, unless STARTTLSFallback is enabled. Has no effect
+	// if the connection is already using TLS.
+	UseSTARTTLS bool
+	// STARTTLSFallback continues registration over the plaintext connection
+	// if the server doesn't support STARTTLS (see UseSTARTTLS).
+	STARTTLSFallback bool
+	// OnConnect is an optional callback, called with the underlying
+	// connection once it has been established (already wrapped in TLS, if
+	// SSL is enabled, or upgraded with STARTTLS, if UseSTARTTLS is enabled),
+	// but before registration. This allows performing custom
+	// pre-registration handshakes, e.g. sending a PROXY protocol header.
+	// Note that with UseSTARTTLS, the STARTTLS negotiation has already been
+	// sent over the plaintext connection, so anything which must be sent
+	// before any IRC traffic should be done with a custom Dialer instead
+	// (see DialerConnect()). If it returns an error, the connection is
+	// closed and the error is returned by Connect(). The client isn't
+	// reported as connected while the hook is running, and it must not send
+	// events with the client (e.g. with Client.Send()), as they would be sent
+	// before registration. Calling Client.Close() from the hook (or
+	// elsewhere, while it's running) aborts the connection, in which case
+	// Connect() returns nil.
+	OnConnect func(conn net.Conn) error
 	// DisableSTS disables the use of automatic STS connection upgrades
 	// when the server supports STS. STS can also be disabled using the environment
 	// variable "GIRC_DISABLE_STS=true". As many clients may not propagate options
@@ -107,13 +165,50 @@ type Config struct {
 	// strict transport policy expires and the first attempt to reconnect back to
 	// the tls version fails.
 	DisableSTSFallback bool
+	// STSStore is an optional user-supplied store, used to persist strict
+	// transport security policies provided by the server (e.g. to disk), so
+	// that they are enforced across restarts. If nil, policies are only
+	// stored in memory for the lifetime of the client. Has no effect if STS
+	// is disabled.
+	STSStore STSStore
 	// TLSConfig is an optional user-supplied tls configuration, used during
 	// socket creation to the server. SSL must be enabled for this to be used.
-	// This only has an affect during the dial process.
+	// This only has an affect during the dial process. If ServerName isn't
+	// set, it defaults to Server (used for SNI and certificate verification).
 	TLSConfig *tls.Config
+	// ALPN is an optional list of application protocols to advertise during
+	// the TLS handshake (e.g. "irc"). If set, this overrides NextProtos in
+	// TLSConfig.
+	ALPN []string
 	// AllowFlood allows the client to bypass the rate limit of outbound
 	// messages.
 	AllowFlood bool
+	// RateLimit allows overriding the default rate limiting of outbound
+	// messages. It's called before each event is sent, with the length of
+	// the event and the current rate limiting state, and should return how
+	// long to wait before sending the event. If set, this is used instead
+	// of the default rate limiter. If nil, the default rate limiter is used.
+	// This has no effect if AllowFlood is enabled.
+	RateLimit func(chars int, state RateState) time.Duration
+	// SendQueueSize is the number of outbound events which can be queued
+	// before sending blocks (and eventually times out, see
+	// ErrSendTimedOut). Larger queues allow more buffering during bursts
+	// (e.g. when rate limited), at the cost of memory, and events
+	// potentially being sent long after they were queued. Defaults to 25.
+	SendQueueSize int
+	// SendQueuePolicy controls what happens when sending an event while the
+	// send queue is full. Defaults to SendQueueBlock.
+	SendQueuePolicy SendQueuePolicy
+	// OnDrop is an optional callback, called with each outbound event which
+	// is dropped because the send queue is full (see SendQueuePolicy). It's
+	// called synchronously while sending (without any locks held, so it may
+	// send the event again), so it shouldn't block.
+	OnDrop func(event *Event)
+	// RecvQueueSize is the number of incoming events which can be queued
+	// before they are handled. Larger queues allow slow handlers to fall
+	// further behind before reading from the server is blocked, at the cost
+	// of memory. Defaults to 25.
+	RecvQueueSize int
 	// GlobalFormat enables passing through all events which have trailing
 	// text through the color Fmt() function, so you don't have to wrap
 	// every response in the Fmt() method.
@@ -121,6 +216,56 @@ type Config struct {
 	// Note that this only actually applies to PRIVMSG, NOTICE and TOPIC
 	// events, to ensure it doesn't clobber unwanted events.
 	GlobalFormat bool
+	// AutoRejoinOnKick enables automatically rejoining channels that we've
+	// been kicked from, after AutoRejoinDelay, using the channels key if
+	// known. To prevent rejoin loops, rejoins are limited to a few per channel
+	// within a short window. Requires tracking to be enabled.
+	AutoRejoinOnKick bool
+	// AutoRejoinDelay is the delay before rejoining a channel we've been
+	// kicked from, when AutoRejoinOnKick is enabled. Defaults to 5 seconds.
+	AutoRejoinDelay time.Duration
+	// AutoRejoin enables automatically rejoining the channels we were in
+	// (using their keys, if known) once connected again after a disconnect.
+	// Channels we've parted or been kicked from before the disconnect are
+	// not rejoined. Requires tracking to be enabled.
+	AutoRejoin bool
+	// Metrics is an optional user-supplied implementation of Metrics, which
+	// is notified of events sent and received, latency, and reconnects.
+	// Defaults to NopMetrics.
+	Metrics Metrics
+	// EventFilter is an optional function called with each event (including
+	// virtual events, e.g. CONNECTED) before any handlers are run. If it
+	// returns false, the event is dropped entirely: no handlers are run for
+	// it, including the clients internal handlers used for state tracking,
+	// CTCP, PING replies, etc. As such, be careful to only filter events
+	// which are safe to ignore (e.g. messages from ignored users, or noisy
+	// numerics). The event must not be modified.
+	EventFilter func(e *Event) bool
+	// StructuredLogger is an optional user-supplied logger, which receives
+	// connection lifecycle and error events (e.g. connecting, disconnects,
+	// reconnects, STS upgrades and ping timeouts), with levels and fields.
+	// See NewSlogLogger() for use with log/slog. Defaults to NopLogger.
+	StructuredLogger StructuredLogger
+	// ShareEventPointers disables copying of incoming events before they are
+	// passed to each set of handlers, which reduces allocations for clients
+	// handling a large amount of traffic. When enabled, all handlers for an
+	// event share the same underlying Params, Tags and Source, and as such,
+	// handlers MUST treat events as read-only.
+	ShareEventPointers bool
+	// StrictOutbound enables validation of all outbound events with
+	// Event.IsValid(), prior to sending them. Invalid events are dropped
+	// (and logged to Debug) rather than potentially being corrupted when
+	// written to the server. Client.SendBulk() will return the validation
+	// error.
+	StrictOutbound bool
+	// ValidateLimits enables validation of nicknames and channels against
+	// the limits supplied by the server via ISUPPORT (NICKLEN and
+	// CHANNELLEN), in Commands.Nick(), Commands.Join() and
+	// Commands.JoinKey(), which return ErrTooLong rather than letting the
+	// server reject or truncate them. The nickname used after a collision
+	// (when HandleNickCollide is unset) is also trimmed to fit NICKLEN.
+	// Limits which the server hasn't supplied aren't checked.
+	ValidateLimits bool
 	// Debug is an optional, user supplied location to log the raw lines
 	// sent from the server, or other useful debug logs. Defaults to
 	// ioutil.Discard. For quick debugging, this could be set to os.Stdout.
@@ -138,16 +283,36 @@ type Config struct {
 	// DefaultRecoverHandler will log the panic to Debug or os.Stdout if
 	// Debug is unset.
 	RecoverFunc func(c *Client, e *HandlerError)
+	// HandlerTimeout, if set, is the maximum amount of time to wait for each
+	// non-background handler added by the user to complete (builtin handlers
+	// are always waited on). Handlers which take longer are left running in
+	// the background, and a warning is logged, so that a single slow handler
+	// doesn't stall the processing of further events. Note that this means
+	// events may be processed before the slow handler has completed.
+	HandlerTimeout time.Duration
 	// SupportedCaps are the IRCv3 capabilities you would like the client to
 	// support on top of the ones which the client already supports (see
 	// cap.go for which ones the client enables by default). Only use this
 	// if you have not called DisableTracking(). The keys value gets passed
 	// to the server if supported.
 	SupportedCaps map[string][]string
+	// RequestEcho requests the "echo-message" capability, if supported by
+	// the server. When enabled, the server echoes back each PRIVMSG and
+	// NOTICE we send, which are passed to ALL_EVENTS and ECHO handlers (with
+	// Event.Echo set), rather than PRIVMSG and NOTICE handlers. This has no
+	// effect if tracking is disabled (see Client.DisableTracking()), as
+	// echoes can't be told apart from other messages without it.
+	RequestEcho bool
 	// Version is the application version information that will be used in
 	// response to a CTCP VERSION, if default CTCP replies have not been
 	// overwritten or a VERSION handler was already supplied.
 	Version string
+	// CTCPReplyRate is the maximum number of CTCP replies (see
+	// Commands.SendCTCPReply(), which is used by the default CTCP handlers)
+	// sent to a single target per minute. Replies over the limit are
+	// dropped, preventing users from making the client flood NOTICEs and
+	// get disconnected for excess flood. Defaults to 0 (unlimited).
+	CTCPReplyRate int
 	// PingDelay is the frequency between when the client sends a keep-alive
 	// PING to the server, and awaits a response (and times out if the server
 	// doesn't respond in time). This should be between 20-600 seconds. See
@@ -157,7 +322,10 @@ type Config struct {
 	PingDelay time.Duration
 	// PingTimeout specifies the duration at which girc will assume
 	// that the connection to the server has been lost if no PONG
-	// message has been received in reply to an outstanding PING.
+	// message has been received in reply to an outstanding PING. The
+	// connection is considered dead once PingDelay+PingTimeout has passed
+	// since the last successful PONG. Defaults to 60 seconds, and should be
+	// between 5-600 seconds.
 	PingTimeout time.Duration
 
 	// disableTracking disables all channel and user-level tracking. Useful
@@ -175,6 +343,34 @@ type Config struct {
 	// If HandleNickCollide returns an empty string, the client will not
 	// attempt to fix nickname collisions, and you must handle this yourself.
 	HandleNickCollide func(oldNick string) (newNick string)
+	// AdvertiseBot sets the bot user mode once connected, as advertised by
+	// the server with the "BOT" ISUPPORT token (commonly +B), marking the
+	// client as a bot to other users. Has no effect if the server doesn't
+	// advertise a bot mode. Requires tracking to be enabled.
+	AdvertiseBot bool
+	// RegainNick enables periodically attempting to regain Nick once
+	// connected, if we ended up using a different nickname (e.g. because
+	// of a nick collision), until successful. Requires tracking to be
+	// enabled.
+	RegainNick bool
+	// RegainNickInterval is the delay between attempts to regain Nick,
+	// when RegainNick is enabled. Defaults to 30 seconds.
+	RegainNickInterval time.Duration
+	// NickServGhost is an optional services command (e.g. "GHOST",
+	// "RELEASE" or "REGAIN") sent to NickServ before the first attempt to
+	// regain Nick, to disconnect or release whoever is using it. This
+	// usually requires that we're already identified to services (e.g.
+	// using SASL).
+	NickServGhost string
+	// AutoAwayAfter, if set, marks the client as away (with AutoAwayMessage)
+	// once nothing has been sent to the server for the given duration,
+	// excluding background commands like PING and WHO. The client is marked
+	// as back before the next message is sent. Has no effect if we've
+	// already marked ourselves as away with Commands.Away().
+	AutoAwayAfter time.Duration
+	// AutoAwayMessage is the away message used when AutoAwayAfter is set.
+	// Defaults to "idle".
+	AutoAwayMessage string
 }
 
 // WebIRC is useful when a user connects through an indirect method, such web
@@ -210,6 +406,64 @@ func (w WebIRC) Params() []string {
 	return []string{w.Password, w.Gateway, w.Hostname, w.Address}
 }
 
+// Validate checks that all WEBIRC fields are set, and that Address is a valid
+// IPv4 or IPv6 address (and not an IPv4-in-IPv6 address).
+func (w WebIRC) Validate() error {
+	if w.Password == "" || w.Gateway == "" || w.Hostname == "" || w.Address == "" {
+		return errors.New("webirc password, gateway, hostname and address are required")
+	}
+
+	if strings.ContainsAny(w.Gateway+w.Hostname, " \r\n") {
+		return errors.New("webirc gateway and hostname must not contain spaces")
+	}
+
+	ip := net.ParseIP(w.Address)
+	if ip == nil {
+		return fmt.Errorf("webirc address %q is not a valid ip address", w.Address)
+	}
+
+	if ip.To4() != nil && strings.Contains(w.Address, ":") {
+		return fmt.Errorf("webirc address %q must not be an ipv4-in-ipv6 address", w.Address)
+	}
+
+	return nil
+}
+
+// NickServ is used to identify to services by messaging NickServ once
+// connected, i.e. "PRIVMSG NickServ :IDENTIFY [nick] <password>". This is
+// only used if Password is set. SASL should be preferred when supported by
+// the network, as it identifies before we join any channels.
+type NickServ struct {
+	// Nick is the account to identify as. If empty, the account is based
+	// on our current nick.
+	Nick string
+	// Password is the account password.
+	Password string
+	// Service is the nick of the services bot to message. Defaults to
+	// "NickServ".
+	Service string
+	// Command is the identify command. Defaults to "IDENTIFY".
+	Command string
+}
+
+// Params returns the arguments for the PRIVMSG to send to services to
+// identify.
+func (n NickServ) Params() []string {
+	service, command := n.Service, n.Command
+	if service == "" {
+		service = "NickServ"
+	}
+	if command == "" {
+		command = "IDENTIFY"
+	}
+
+	if n.Nick != "" {
+		return []string{service, command + " " + n.Nick + " " + n.Password}
+	}
+
+	return []string{service, command + " " + n.Password}
+}
+
 // ErrInvalidConfig is returned when the configuration passed to the client
 // is invalid.
 type ErrInvalidConfig struct {
@@ -241,19 +495,123 @@ func (conf *Config) isValid() error {
 		return &ErrInvalidConfig{Conf: *conf, err: errors.New("bad user/ident specified")}
 	}
 
+	if conf.WebIRC.Password != "" {
+		if err := conf.WebIRC.Validate(); err != nil {
+			return &ErrInvalidConfig{Conf: *conf, err: err}
+		}
+	}
+
+	if _, err := userModeMask(conf.UserModes); err != nil {
+		return &ErrInvalidConfig{Conf: *conf, err: err}
+	}
+
+	if conf.IPVersion < IPAuto || conf.IPVersion > IPv6 {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("invalid ip version")}
+	}
+
+	if conf.CTCPReplyRate < 0 {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("ctcp reply rate must be positive")}
+	}
+
+	if conf.SendQueueSize < 0 || conf.RecvQueueSize < 0 {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("queue sizes must be positive")}
+	}
+
+	if conf.PingDelay > 0 && conf.PingTimeout <= 0 {
+		return &ErrInvalidConfig{Conf: *conf, err: errors.New("ping timeout must be positive when pings are enabled")}
+	}
+
 	return nil
 }
 
+// userModeMask returns the USER command mode field for the given user modes,
+// as the RFC 2812 bitmask. If no modes are given, or any of the modes can't
+// be requested via USER, this returns "*".
+func userModeMask(modes string) (string, error) {
+	if modes == "" {
+		return "*", nil
+	}
+
+	var mask int
+	for _, mode := range strings.TrimPrefix(modes, "+") {
+		switch mode {
+		case 'w':
+			mask |= 4
+		case 'i':
+			mask |= 8
+		default:
+			return "*", fmt.Errorf("unsupported user mode %q (only i and w are supported)", mode)
+		}
+	}
+
+	return strconv.Itoa(mask), nil
+}
+
+// IPVersion is the IP version used when connecting to the server. See
+// Config.IPVersion.
+type IPVersion int
+
+const (
+	// IPAuto uses either IPv4 or IPv6, whichever connects first.
+	IPAuto IPVersion = iota
+	// IPv4 forces the use of IPv4.
+	IPv4
+	// IPv6 forces the use of IPv6.
+	IPv6
+)
+
 // ErrNotConnected is returned if a method is used when the client isn't
 // connected.
 var ErrNotConnected = errors.New("client is not connected to server")
 
+// ErrSendTimedOut is returned when an event couldn't be queued to be sent
+// to the server in time, e.g. if the connection is stalled.
+var ErrSendTimedOut = errors.New("timed out queuing event to be sent")
+
+// ErrSendQueueFull is returned when an event couldn't be queued to be sent
+// because the send queue is full, and Config.SendQueuePolicy is
+// SendQueueError.
+var ErrSendQueueFull = errors.New("send queue is full")
+
+// SendQueuePolicy controls what happens when sending an event while the send
+// queue is full (see Config.SendQueueSize), e.g. if the client is being rate
+// limited, or the connection is stalled.
+type SendQueuePolicy int
+
+const (
+	// SendQueueBlock blocks until there is space in the queue. If there's
+	// still no space after 30 seconds, the event is dropped and
+	// ErrSendTimedOut is returned.
+	SendQueueBlock SendQueuePolicy = iota
+	// SendQueueDropNewest drops the event being sent.
+	SendQueueDropNewest
+	// SendQueueDropOldest drops the oldest queued event, to make space for
+	// the event being sent.
+	SendQueueDropOldest
+	// SendQueueError drops the event being sent, and returns
+	// ErrSendQueueFull.
+	SendQueueError
+)
+
+// defaultQueueSize is the default for Config.SendQueueSize and
+// Config.RecvQueueSize.
+const defaultQueueSize = 25
+
+// queueSize returns size, or defaultQueueSize if size isn't positive.
+func queueSize(size int) int {
+	if size <= 0 {
+		return defaultQueueSize
+	}
+
+	return size
+}
+
 // New creates a new IRC client with the specified server, name and config.
 func New(config Config) *Client {
 	c := &Client{
 		Config:   config,
-		rx:       make(chan *Event, 25),
-		tx:       make(chan *Event, 25),
+		rx:       make(chan *Event, queueSize(config.RecvQueueSize)),
+		tx:       make(chan *Event, queueSize(config.SendQueueSize)),
 		CTCP:     newCTCP(),
 		initTime: time.Now(),
 	}
@@ -266,8 +624,12 @@ func New(config Config) *Client {
 		c.Config.PingDelay = 600 * time.Second
 	}
 
-	if c.Config.PingTimeout == 0 {
+	if c.Config.PingTimeout <= 0 {
 		c.Config.PingTimeout = 60 * time.Second
+	} else if c.Config.PingTimeout < (5 * time.Second) {
+		c.Config.PingTimeout = 5 * time.Second
+	} else if c.Config.PingTimeout > (600 * time.Second) {
+		c.Config.PingTimeout = 600 * time.Second
 	}
 
 	envDebug, _ := strconv.ParseBool(os.Getenv("GIRC_DEBUG"))
@@ -361,6 +723,38 @@ func (c *Client) TLSConnectionState() (*tls.ConnectionState, error) {
 // the connection to the server wasn't made with TLS.
 var ErrConnNotTLS = errors.New("underlying connection is not tls")
 
+// RemoteAddr returns the remote network address of the underlying connection
+// to the server, e.g. to find out which server IP was connected to. Returns
+// ErrNotConnected if the client isn't connected.
+func (c *Client) RemoteAddr() (net.Addr, error) {
+	return c.sockAddr(func(sock net.Conn) net.Addr { return sock.RemoteAddr() })
+}
+
+// LocalAddr returns the local network address of the underlying connection
+// to the server. Returns ErrNotConnected if the client isn't connected.
+func (c *Client) LocalAddr() (net.Addr, error) {
+	return c.sockAddr(func(sock net.Conn) net.Addr { return sock.LocalAddr() })
+}
+
+// sockAddr returns the address fn reads from the underlying connection, if
+// the client is connected.
+func (c *Client) sockAddr(fn func(sock net.Conn) net.Addr) (net.Addr, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	c.conn.mu.RLock()
+	defer c.conn.mu.RUnlock()
+
+	if !c.conn.connected || c.conn.sock == nil {
+		return nil, ErrNotConnected
+	}
+
+	return fn(c.conn.sock), nil
+}
+
 // Close closes the network connection to the server, and sends a CLOSED
 // event. This should cause Connect() to return with nil. This should be
 // safe to call multiple times. See Connect()'s documentation on how
@@ -374,6 +768,20 @@ func (c *Client) Close() {
 	c.mu.RUnlock()
 }
 
+// context returns the context of the current connection, which is cancelled
+// when the client is closed, or the connection is torn down. If the client
+// has never connected, a non-cancelled context is returned.
+func (c *Client) context() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.ctx == nil {
+		return context.Background()
+	}
+
+	return c.ctx
+}
+
 // Quit sends a QUIT message to the server with a given reason to close the
 // connection. Underlying this event being sent, Client.Close() is called as well.
 // This is different than just calling Client.Close() in that it provides a reason
@@ -386,11 +794,50 @@ func (c *Client) Quit(reason string) {
 	c.Send(&Event{Command: QUIT, Params: []string{reason}})
 }
 
+// QuitWithTimeout is similar to Client.Quit(), however rather than closing
+// the connection as soon as the QUIT has been sent, it waits for the server to
+// acknowledge the QUIT and close the connection itself. This helps ensure
+// that the quit reason is actually shown to other users. If the server hasn't
+// closed the connection once timeout has elapsed, Client.Close() is called.
+// QuitWithTimeout blocks until the client has disconnected, or the timeout
+// has elapsed. If timeout is <= 0, this is the same as calling Client.Quit().
+func (c *Client) QuitWithTimeout(reason string, timeout time.Duration) {
+	if timeout <= 0 {
+		c.Quit(reason)
+		return
+	}
+
+	c.mu.RLock()
+	if c.conn == nil {
+		c.mu.RUnlock()
+		return
+	}
+
+	c.conn.mu.Lock()
+	c.conn.quitting = true
+	c.conn.mu.Unlock()
+	c.mu.RUnlock()
+
+	_, done := c.Handlers.addTmp(true, DISCONNECTED, timeout, func(c *Client, e Event) bool {
+		return true
+	})
+
+	c.Send(&Event{Command: QUIT, Params: []string{reason}})
+
+	<-done
+	c.Close()
+}
+
 // ErrEvent is an error returned when the server (or library) sends an ERROR
 // message response. The string returned contains the trailing text from the
 // message.
 type ErrEvent struct {
 	Event *Event
+
+	// registering is true if the ERROR was received before registration
+	// completed (RPL_WELCOME), and banned is true if the server sent
+	// ERR_YOUREBANNEDCREEP or ERR_YOUWILLBEBANNED beforehand, see IsFatal().
+	registering, banned bool
 }
 
 func (e *ErrEvent) Error() string {
@@ -401,12 +848,66 @@ func (e *ErrEvent) Error() string {
 	return e.Event.Last()
 }
 
+// fatalErrorReasons are (lowercase) substrings of server ERROR messages,
+// sent while registering, which indicate that reconnecting is unlikely to
+// succeed.
+var fatalErrorReasons = []string{
+	"k-lined", "g-lined", "z-lined", "d-lined",
+	"k-line", "g-line", "z-line", "d-line",
+	"klined", "glined", "zlined", "dlined",
+	"banned", "throttled", "throttling",
+}
+
+// IsFatal is a heuristic which returns true if the server ERROR indicates
+// that the client shouldn't reconnect right away (or at all), for example
+// if the client has been K-Lined, G-Lined, banned, or throttled. Other
+// errors (e.g. ping timeouts) are considered safe to retry.
+//
+// An ERROR is fatal if the server sent ERR_YOUREBANNEDCREEP (465) or
+// ERR_YOUWILLBEBANNED (466) beforehand, or if it was sent while
+// registering, and its text mentions being banned or throttled. Once
+// registered, the text isn't considered, as it may contain text from other
+// users (e.g. a kill or quit reason). As the text of an ERROR isn't
+// standardized, this may not be accurate on all networks.
+func (e *ErrEvent) IsFatal() bool {
+	if e.banned {
+		return true
+	}
+
+	if e.Event == nil || !e.registering {
+		return false
+	}
+
+	reason := strings.ToLower(e.Event.Last())
+	for _, fatal := range fatalErrorReasons {
+		if strings.Contains(reason, fatal) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsFatalError returns true if err is an ErrEvent (e.g. as returned by
+// Client.Connect()) which is considered fatal. See ErrEvent.IsFatal().
+func IsFatalError(err error) bool {
+	var eerr *ErrEvent
+	if errors.As(err, &eerr) {
+		return eerr.IsFatal()
+	}
+
+	return false
+}
+
 func (c *Client) execLoop(ctx context.Context) error {
 	c.debug.Print("starting execLoop")
 	defer c.debug.Print("closing execLoop")
 
 	var event *Event
 
+	// Used to classify ERROR responses, see ErrEvent.IsFatal().
+	var registered, banned bool
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -428,7 +929,16 @@ func (c *Client) execLoop(ctx context.Context) error {
 		case event = <-c.rx:
 			c.RunHandlers(event)
 
-			if event != nil && event.Command == ERROR {
+			if event != nil {
+				switch event.Command {
+				case RPL_WELCOME:
+					registered = true
+				case ERR_YOUREBANNEDCREEP, ERR_YOUWILLBEBANNED:
+					banned = true
+				}
+			}
+
+			if event != nil && event.Command == ERROR && !c.isQuitting() {
 				// Handles incoming ERROR responses. These are only ever sent
 				// by the server (with the exception that this library may use
 				// them as a lower level way of signalling to disconnect due
@@ -437,8 +947,11 @@ func (c *Client) execLoop(ctx context.Context) error {
 				// some reason the server doesn't disconnect the client, or
 				// if this library is the source of the error, this should
 				// signal back up to the main connect loop, to disconnect.
+				//
+				// If we've requested a graceful quit, an ERROR is expected,
+				// and readLoop will handle the server closing the connection.
 
-				return &ErrEvent{Event: event}
+				return &ErrEvent{Event: event, registering: !registered, banned: banned}
 			}
 		}
 	}
@@ -515,6 +1028,25 @@ func (c *Client) ConnSince() (since *time.Duration, err error) {
 	return &timeSince, nil
 }
 
+// WaitForConnect blocks until the client has connected to the server and
+// the CONNECTED event has fired, and its handlers (excluding background
+// handlers) have completed (i.e. it's ready to send channel commands),
+// or until ctx is cancelled, in which case the context error is returned.
+// This can be called before Client.Connect(), or while reconnecting, and
+// returns immediately if the client is already connected.
+func (c *Client) WaitForConnect(ctx context.Context) error {
+	c.state.RLock()
+	ready := c.state.ready
+	c.state.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // IsConnected returns true if the client is connected to the server.
 func (c *Client) IsConnected() bool {
 	c.mu.RLock()
@@ -545,10 +1077,83 @@ func (c *Client) GetNick() string {
 	return c.state.nick
 }
 
-// GetID returns an RFC1459 compliant version of the current nickname. Panics
-// if tracking is disabled.
+// GetID returns the current nickname, normalized with the casemapping
+// advertised by the server (see Client.CaseMap()). Panics if tracking is
+// disabled.
 func (c *Client) GetID() string {
-	return ToRFC1459(c.GetNick())
+	return c.CaseMap(c.GetNick())
+}
+
+// IsSelf returns true if source is us, comparing the nickname of source
+// with our current nickname (see Client.GetNick()) using the casemapping
+// advertised by the server. Use this instead of comparing Source.ID() with
+// Client.GetID(). Panics if tracking is disabled.
+func (c *Client) IsSelf(source *Source) bool {
+	if source == nil || source.Name == "" {
+		return false
+	}
+
+	return c.CaseMap(source.Name) == c.GetID()
+}
+
+// CaseMap normalizes a nickname or channel name with the casemapping
+// advertised by the server via ISUPPORT (rfc1459 if not advertised), so
+// that two nicknames or channels can be compared. See ToCaseMapping().
+func (c *Client) CaseMap(input string) string {
+	c.state.RLock()
+	casemapping := c.state.casemapping()
+	c.state.RUnlock()
+
+	return ToCaseMapping(casemapping, input)
+}
+
+// IsOper returns true if we've successfully authenticated as an IRC operator
+// using OPER (see Commands.Oper()). Panics if tracking is disabled.
+func (c *Client) IsOper() bool {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.oper
+}
+
+// IsAway returns true if the server has marked us as away (e.g. after
+// Commands.Away()). Panics if tracking is disabled.
+func (c *Client) IsAway() bool {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.away
+}
+
+// AwayMessage returns our current away message, if we're marked as away (see
+// Client.IsAway()) and the message was set with Commands.Away(). Panics if
+// tracking is disabled.
+func (c *Client) AwayMessage() string {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	return c.state.awayMessage
+}
+
+// UserModes returns our own current user modes (e.g. "+iw"), as tracked
+// from RPL_UMODEIS, and MODE changes targeting us. Returns an empty string if
+// no user modes are known. Panics if tracking is disabled.
+func (c *Client) UserModes() string {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	if c.state.userModes == "" {
+		return ""
+	}
+	return "+" + c.state.userModes
 }
 
 // GetIdent returns the current ident of the active connection. Panics if
@@ -644,6 +1249,28 @@ func (c *Client) Users() []*User {
 	return users
 }
 
+// AwayUsers returns the (sorted) users that the client is tracking, which
+// are known to be away. Whether users are known to be away depends on the
+// server supporting away-notify, WHO replies, or RPL_AWAY replies. See also
+// USER_AWAY and USER_BACK. Panics if tracking is disabled.
+func (c *Client) AwayUsers() []*User {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	var users []*User
+	for user := range c.state.users {
+		if c.state.users[user].Extras.Away != "" {
+			users = append(users, c.state.users[user].Copy())
+		}
+	}
+	c.state.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Nick < users[j].Nick
+	})
+	return users
+}
+
 // LookupChannel looks up a given channel in state. If the channel doesn't
 // exist, nil is returned. Panics if tracking is disabled.
 func (c *Client) LookupChannel(name string) (channel *Channel) {
@@ -678,7 +1305,7 @@ func (c *Client) IsInChannel(channel string) (in bool) {
 	c.panicIfNotTracking()
 
 	c.state.RLock()
-	_, in = c.state.channels[ToRFC1459(channel)]
+	_, in = c.state.channels[c.state.id(channel)]
 	c.state.RUnlock()
 	return in
 }
@@ -701,21 +1328,148 @@ func (c *Client) GetServerOption(key string) (result string, ok bool) {
 // retrieved during client connection. This is also known as ISUPPORT (or RPL_PROTOCTL).
 // Will panic if used when tracking has been disabled. Examples of usage:
 //
-//	nickLen, success := GetServerOption("MAXNICKLEN")
+//	nickLen, success := GetServerOptionInt("MAXNICKLEN")
 func (c *Client) GetServerOptionInt(key string) (result int, ok bool) {
-	var data string
-	var err error
+	c.panicIfNotTracking()
+
+	return c.isupportInt(key)
+}
+
+// ISupportInt returns the integer value of an ISUPPORT token (e.g. NICKLEN,
+// CHANNELLEN, TOPICLEN), or def if the server did not supply the token, or
+// its value is not a valid integer. Unlike GetServerOption, this will not
+// panic if tracking has been disabled, and will instead return def.
+func (c *Client) ISupportInt(key string, def int) int {
+	if result, ok := c.isupportInt(key); ok {
+		return result
+	}
+
+	return def
+}
 
-	data, ok = c.GetServerOption(key)
+// isupportInt parses the integer value of an ISUPPORT token. ok is false if
+// the server did not supply the token, or its value is not a valid integer.
+func (c *Client) isupportInt(key string) (result int, ok bool) {
+	c.state.RLock()
+	data, ok := c.state.serverOptions[key]
+	c.state.RUnlock()
 	if !ok {
-		return result, ok
+		return 0, false
 	}
-	result, err = strconv.Atoi(data)
+
+	result, err := strconv.Atoi(data)
 	if err != nil {
-		ok = false
+		return 0, false
 	}
 
-	return result, ok
+	return result, true
+}
+
+// ISupportBool returns true if the server supplied the ISUPPORT token with
+// the given key (e.g. "WHOX", "EXCEPTS"). Tokens with an explicit false value
+// (e.g. "KEY=0" or "KEY=false") are treated as unsupported. Unlike
+// GetServerOption, this will not panic if tracking has been disabled.
+func (c *Client) ISupportBool(key string) bool {
+	c.state.RLock()
+	data, ok := c.state.serverOptions[key]
+	c.state.RUnlock()
+	if !ok {
+		return false
+	}
+
+	if v, err := strconv.ParseBool(data); err == nil {
+		return v
+	}
+
+	return true
+}
+
+// ISupportPrefix returns the user modes and their respective prefix symbols,
+// as supplied by the ISUPPORT PREFIX token. For example, a PREFIX of
+// "(ov)@+" returns modes "ov" and prefixes "@+". Falls back to
+// DefaultPrefixes if the server did not supply a valid PREFIX token.
+func (c *Client) ISupportPrefix() (modes, prefixes string) {
+	c.state.RLock()
+	raw := c.state.userPrefixes()
+	c.state.RUnlock()
+
+	return parsePrefixes(raw)
+}
+
+// ModePrefix is a channel user mode, and the prefix symbol which represents
+// it in NAMES and WHO replies (e.g. mode 'o' and prefix '@').
+type ModePrefix struct {
+	Mode   byte
+	Prefix byte
+}
+
+// Prefixes returns the channel user modes and their respective prefix
+// symbols, as supplied by the ISUPPORT PREFIX token, ordered from the
+// highest rank to the lowest. Falls back to DefaultPrefixes if the server did
+// not supply a valid PREFIX token. See also Client.ISupportPrefix().
+func (c *Client) Prefixes() []ModePrefix {
+	modes, prefixes := c.ISupportPrefix()
+
+	out := make([]ModePrefix, 0, len(modes))
+	for i := 0; i < len(modes) && i < len(prefixes); i++ {
+		out = append(out, ModePrefix{Mode: modes[i], Prefix: prefixes[i]})
+	}
+
+	return out
+}
+
+// ChannelModeTypes returns the channel modes supported by the server, split
+// by type, as supplied by the ISUPPORT CHANMODES token. Falls back to
+// ModeDefaults if the server did not supply a valid CHANMODES token:
+//
+//   - listArgs are list modes which always take an argument (e.g. "b").
+//   - args are modes which always take an argument (e.g. "k").
+//   - setArgs are modes which only take an argument when set (e.g. "l").
+//   - noArgs are modes which never take an argument (e.g. "m").
+func (c *Client) ChannelModeTypes() (listArgs, args, setArgs, noArgs string) {
+	c.state.RLock()
+	modes := NewCModes(c.state.chanModes(), "")
+	c.state.RUnlock()
+
+	return modes.modesListArgs, modes.modesArgs, modes.modesSetArgs, modes.modesNoArgs
+}
+
+// targetLimit returns the maximum number of (comma-separated) targets that
+// the server supports for the given command, from the TARGMAX ISUPPORT
+// token (e.g. "TARGMAX=PRIVMSG:3,NOTICE:3,JOIN:"), falling back to
+// MAXTARGETS. Returns 0 if the server supports an unlimited number of
+// targets, and 1 if the server hasn't supplied any limits for the command.
+func (c *Client) targetLimit(command string) int {
+	c.state.RLock()
+	targmax, ok := c.state.serverOptions["TARGMAX"]
+	maxtargets, mok := c.state.serverOptions["MAXTARGETS"]
+	c.state.RUnlock()
+
+	if ok {
+		for _, entry := range strings.Split(targmax, ",") {
+			name, limit, _ := strings.Cut(entry, ":")
+			if !strings.EqualFold(name, command) {
+				continue
+			}
+
+			if limit == "" {
+				return 0
+			}
+
+			if max, err := strconv.Atoi(limit); err == nil && max > 0 {
+				return max
+			}
+			return 1
+		}
+	}
+
+	if mok {
+		if max, err := strconv.Atoi(maxtargets); err == nil && max > 0 {
+			return max
+		}
+	}
+
+	return 1
 }
 
 // MaxEventLength returns the maximum supported server length of an event. This is the
@@ -723,6 +1477,15 @@ func (c *Client) GetServerOptionInt(key string) (result int, ok bool) {
 // by the protocol. If state tracking is enabled, this will utilize ISUPPORT/IRCv3
 // information to more accurately calculate the maximum supported length (i.e. extended
 // length events).
+//
+// This is calculated as the line length (512, or LINELEN if supported), minus the
+// CR-LF line ending, minus the longest ":nick!user@host " prefix the server may
+// prepend when relaying the event (using NICKLEN, USERLEN and HOSTLEN if supported).
+// Outgoing events are split based on this length.
+//
+// Message tags are not included, as IRCv3 gives tags their own separate length
+// budget (see maxTagLength), and they are stripped before sending if the server
+// does not support them. As such, tagged events can use the full length.
 func (c *Client) MaxEventLength() (max int) {
 	if !c.Config.disableTracking {
 		c.state.RLock()
@@ -770,6 +1533,11 @@ func (c *Client) ServerMOTD() (motd string) {
 // when we receive a pong.
 func (c *Client) Latency() (delta time.Duration) {
 	c.mu.RLock()
+	if c.conn == nil {
+		c.mu.RUnlock()
+		return 0
+	}
+
 	c.conn.mu.RLock()
 	delta = c.conn.lastPong.Sub(c.conn.lastPing)
 	c.conn.mu.RUnlock()
@@ -782,6 +1550,145 @@ func (c *Client) Latency() (delta time.Duration) {
 	return delta
 }
 
+// BytesRead returns the number of bytes received from the server during the
+// current connection. This is reset on each new connection, and is 0 if the
+// client isn't connected.
+func (c *Client) BytesRead() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&c.conn.bytesRead)
+}
+
+// BytesWritten returns the number of bytes sent to the server during the
+// current connection. This is reset on each new connection, and is 0 if the
+// client isn't connected.
+func (c *Client) BytesWritten() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&c.conn.bytesWritten)
+}
+
+// Ignore adds mask (e.g. "*!*@host.example.com", see MatchMask()) to the
+// ignore list. PRIVMSG, NOTICE and TAGMSG events from users matching an
+// ignored mask aren't passed to user handlers (including CTCP handlers),
+// though the clients internal handlers (e.g. state tracking) still process
+// them. The ignore list is kept across reconnects.
+func (c *Client) Ignore(mask string) {
+	c.ignoreMu.Lock()
+	defer c.ignoreMu.Unlock()
+
+	for _, m := range c.ignores {
+		if ToRFC1459(m) == ToRFC1459(mask) {
+			return
+		}
+	}
+
+	c.ignores = append(c.ignores, mask)
+}
+
+// Unignore removes mask from the ignore list, see Client.Ignore().
+func (c *Client) Unignore(mask string) {
+	c.ignoreMu.Lock()
+	defer c.ignoreMu.Unlock()
+
+	for i, m := range c.ignores {
+		if ToRFC1459(m) == ToRFC1459(mask) {
+			c.ignores = append(c.ignores[:i], c.ignores[i+1:]...)
+			return
+		}
+	}
+}
+
+// IsIgnored returns true if src matches a mask in the ignore list, see
+// Client.Ignore().
+func (c *Client) IsIgnored(src *Source) bool {
+	if src == nil {
+		return false
+	}
+
+	c.ignoreMu.RLock()
+	defer c.ignoreMu.RUnlock()
+
+	if len(c.ignores) == 0 {
+		return false
+	}
+
+	target := src.String()
+	for _, mask := range c.ignores {
+		if MatchMask(mask, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stats is a snapshot of runtime statistics of the client, see
+// Client.Stats().
+type Stats struct {
+	// Connected is true if the client is connected to the server.
+	Connected bool `json:"connected"`
+	// Users and Channels are the number of tracked users and channels. These
+	// are 0 if tracking is disabled.
+	Users    int `json:"users"`
+	Channels int `json:"channels"`
+	// Handlers is the number of registered external handlers (see
+	// Caller.Len()).
+	Handlers int `json:"handlers"`
+	// Caps is the number of capabilities enabled for the connection.
+	Caps int `json:"caps"`
+	// Latency is the latency to the server, see Client.Latency().
+	Latency time.Duration `json:"latency"`
+	// Uptime is how long the client has been connected to the server, or 0
+	// if it isn't connected.
+	Uptime time.Duration `json:"uptime"`
+	// BytesRead and BytesWritten are the number of bytes received from, and
+	// sent to, the server during the current connection.
+	BytesRead    uint64 `json:"bytes_read"`
+	BytesWritten uint64 `json:"bytes_written"`
+}
+
+// Stats returns a snapshot of runtime statistics of the client, e.g. for
+// health checks, or bot commands.
+func (c *Client) Stats() Stats {
+	stats := Stats{
+		Handlers: c.Handlers.Len(),
+		Latency:  c.Latency(),
+	}
+
+	c.mu.RLock()
+	if c.conn != nil {
+		c.conn.mu.RLock()
+		stats.Connected = c.conn.connected
+		if c.conn.connected && c.conn.connTime != nil {
+			stats.Uptime = time.Since(*c.conn.connTime)
+		}
+		c.conn.mu.RUnlock()
+
+		stats.BytesRead = atomic.LoadUint64(&c.conn.bytesRead)
+		stats.BytesWritten = atomic.LoadUint64(&c.conn.bytesWritten)
+	}
+	c.mu.RUnlock()
+
+	c.state.RLock()
+	if !c.Config.disableTracking {
+		stats.Users = len(c.state.users)
+		stats.Channels = len(c.state.channels)
+	}
+	stats.Caps = len(c.state.enabledCap)
+	c.state.RUnlock()
+
+	return stats
+}
+
 // HasCapability checks if the client connection has the given capability. If
 // you want the full list of capabilities, listen for the girc.CAP_ACK event.
 // Will panic if used when tracking has been disabled.
@@ -832,12 +1739,12 @@ func (c *Client) debugLogEvent(e *Event, dropped bool) {
 	}
 
 	if e.Sensitive {
-		c.debug.Printf(prefix, " %s ***redacted***", e.Command)
+		c.debug.Printf("%s %s ***redacted***", prefix, e.Command)
 	} else {
 		c.debug.Print(prefix, " ", StripRaw(e.String()))
 	}
 
-	if c.Config.Out != nil {
+	if c.Config.Out != nil && !e.Sensitive {
 		if pretty, ok := e.Pretty(); ok {
 			fmt.Fprintln(c.Config.Out, StripRaw(pretty))
 		}
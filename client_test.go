@@ -5,7 +5,13 @@
 package girc
 
 import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -65,6 +71,30 @@ func TestConfigValid(t *testing.T) {
 		t.Fatal("irc port was not defaulted to 6667")
 	}
 
+	conf.SendQueueSize = -1
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("invalid send queue size passed validation check: %s", err)
+	}
+	conf.SendQueueSize = 0
+
+	conf.RecvQueueSize = -1
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("invalid receive queue size passed validation check: %s", err)
+	}
+	conf.RecvQueueSize = 100
+	if err = conf.isValid(); err != nil {
+		t.Fatalf("valid receive queue size failed validation check: %s", err)
+	}
+
+	conf.UserModes = "o"
+	if err = conf.isValid(); err == nil {
+		t.Fatalf("invalid user modes passed validation check: %s", err)
+	}
+	conf.UserModes = "+iw"
+	if err = conf.isValid(); err != nil {
+		t.Fatalf("valid user modes failed validation check: %s", err)
+	}
+
 	conf.Nick = "invalid nick"
 	if err = conf.isValid(); err == nil {
 		t.Fatalf("invalid nick passed validation check: %s", err)
@@ -78,6 +108,80 @@ func TestConfigValid(t *testing.T) {
 	conf.User = "test"
 }
 
+func TestWebIRCValidate(t *testing.T) {
+	valid := WebIRC{Password: "secret", Gateway: "cgiirc", Hostname: "user.example.com", Address: "192.0.2.1"}
+
+	tests := []struct {
+		name    string
+		mod     func(w *WebIRC)
+		wantErr bool
+	}{
+		{"ipv4", func(w *WebIRC) {}, false},
+		{"ipv6", func(w *WebIRC) { w.Address = "2001:db8::1" }, false},
+		{"missing password", func(w *WebIRC) { w.Password = "" }, true},
+		{"missing hostname", func(w *WebIRC) { w.Hostname = "" }, true},
+		{"hostname with space", func(w *WebIRC) { w.Hostname = "user example" }, true},
+		{"invalid address", func(w *WebIRC) { w.Address = "192.0.2" }, true},
+		{"hostname as address", func(w *WebIRC) { w.Address = "user.example.com" }, true},
+		{"ipv4-in-ipv6", func(w *WebIRC) { w.Address = "::ffff:192.0.2.1" }, true},
+	}
+
+	for _, tt := range tests {
+		w := valid
+		tt.mod(&w)
+
+		if err := w.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: WebIRC.Validate() = %v, wantErr %t", tt.name, err, tt.wantErr)
+		}
+	}
+
+	conf := Config{Server: "irc.example.com", Nick: "test", User: "test", WebIRC: valid}
+	conf.WebIRC.Address = "::ffff:192.0.2.1"
+
+	err := conf.isValid()
+	if _, ok := err.(*ErrInvalidConfig); !ok {
+		t.Fatalf("Config.isValid() with invalid WebIRC = %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestUserModes(t *testing.T) {
+	tests := []struct {
+		modes string
+		want  string
+	}{
+		{"", "USER test * * Testing123"},
+		{"w", "USER test 4 * Testing123"},
+		{"i", "USER test 8 * Testing123"},
+		{"iw", "USER test 12 * Testing123"},
+		{"+wi", "USER test 12 * Testing123"},
+	}
+
+	for _, tt := range tests {
+		c, conn, server := genMockConn()
+		c.Config.UserModes = tt.modes
+
+		lines := mockReadLines(conn)
+		mockConnect(t, c, server)
+		expectLine(t, lines, tt.want)
+
+		c.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClientQueueSize(t *testing.T) {
+	c := New(Config{Server: "irc.example.com", Nick: "test", User: "test"})
+	if cap(c.tx) != defaultQueueSize || cap(c.rx) != defaultQueueSize {
+		t.Fatalf("queue sizes == (%d, %d), want default of %d", cap(c.tx), cap(c.rx), defaultQueueSize)
+	}
+
+	c = New(Config{Server: "irc.example.com", Nick: "test", User: "test", SendQueueSize: 100, RecvQueueSize: 5})
+	if cap(c.tx) != 100 || cap(c.rx) != 5 {
+		t.Fatalf("queue sizes == (%d, %d), want (100, 5)", cap(c.tx), cap(c.rx))
+	}
+}
+
 func TestClientLifetime(t *testing.T) {
 	client := New(Config{
 		Server: "dummy.int",
@@ -139,6 +243,41 @@ func TestClientUptime(t *testing.T) {
 	}
 }
 
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestClientAddr(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	if _, err := c.RemoteAddr(); err != ErrNotConnected {
+		t.Fatalf("Client.RemoteAddr() while disconnected = %v, want ErrNotConnected", err)
+	}
+	if _, err := c.LocalAddr(); err != ErrNotConnected {
+		t.Fatalf("Client.LocalAddr() while disconnected = %v, want ErrNotConnected", err)
+	}
+
+	local := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6697}
+
+	mockConnect(t, c, &addrConn{Conn: server, local: local, remote: remote})
+	defer c.Close()
+
+	if addr, err := c.RemoteAddr(); err != nil || addr.String() != remote.String() {
+		t.Fatalf("Client.RemoteAddr() = %v, %v, want %v", addr, err, remote)
+	}
+	if addr, err := c.LocalAddr(); err != nil || addr.String() != local.String() {
+		t.Fatalf("Client.LocalAddr() = %v, %v, want %v", addr, err, local)
+	}
+}
+
 func TestClientGet(t *testing.T) {
 	c, conn, server := genMockConn()
 	defer conn.Close()
@@ -202,3 +341,465 @@ func TestClientClose(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestClientQuitWithTimeout(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	errchan := make(chan error, 1)
+	done := make(chan struct{}, 1)
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+
+	go func() { errchan <- c.MockConnect(server) }()
+	defer c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		c.QuitWithTimeout("bye", 10*time.Second)
+		close(quit)
+	}()
+
+	expectLine(t, lines, "QUIT bye")
+
+	// The client should still be waiting for the server to close the
+	// connection.
+	select {
+	case <-quit:
+		t.Fatal("Client.QuitWithTimeout() returned before the server closed the connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Write([]byte("ERROR :Closing link (Quit: bye)\r\n"))
+	conn.Close()
+
+	select {
+	case <-quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.QuitWithTimeout() didn't return once the server closed the connection")
+	}
+
+	select {
+	case err := <-errchan:
+		if err != nil {
+			t.Fatalf("Client.MockConnect() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.MockConnect() didn't return after quit")
+	}
+}
+
+func TestClientQuitWithTimeoutExpired(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	errchan := make(chan error, 1)
+	done := make(chan struct{}, 1)
+	c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+
+	go func() { errchan <- c.MockConnect(server) }()
+	defer c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	// The server never closes the connection, so the client should close it
+	// once the timeout has elapsed.
+	c.QuitWithTimeout("bye", 200*time.Millisecond)
+
+	select {
+	case err := <-errchan:
+		if err != nil {
+			t.Fatalf("Client.MockConnect() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.MockConnect() didn't return after quit timeout")
+	}
+
+	// The connection has been torn down, which shouldn't panic.
+	if c.isQuitting() {
+		t.Fatal("Client.isQuitting() == true after disconnect")
+	}
+}
+
+func TestClientISupport(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	c.state.Lock()
+	c.state.serverOptions["NICKLEN"] = "30"
+	c.state.serverOptions["TOPICLEN"] = "invalid"
+	c.state.serverOptions["WHOX"] = ""
+	c.state.serverOptions["EXCEPTS"] = "e"
+	c.state.serverOptions["SAFELIST"] = "0"
+	c.state.serverOptions["PREFIX"] = "(qaohv)~&@%+"
+	c.state.Unlock()
+
+	if got := c.ISupportInt("NICKLEN", 9); got != 30 {
+		t.Fatalf("Client.ISupportInt(NICKLEN) == %d, want %d", got, 30)
+	}
+	if got := c.ISupportInt("TOPICLEN", 390); got != 390 {
+		t.Fatalf("Client.ISupportInt(TOPICLEN) == %d, want %d", got, 390)
+	}
+	if got := c.ISupportInt("CHANNELLEN", 50); got != 50 {
+		t.Fatalf("Client.ISupportInt(CHANNELLEN) == %d, want %d", got, 50)
+	}
+
+	if got, ok := c.GetServerOptionInt("NICKLEN"); !ok || got != 30 {
+		t.Fatalf("Client.GetServerOptionInt(NICKLEN) == (%d, %t), want (30, true)", got, ok)
+	}
+	if got, ok := c.GetServerOptionInt("TOPICLEN"); ok {
+		t.Fatalf("Client.GetServerOptionInt(TOPICLEN) == (%d, %t), want (0, false)", got, ok)
+	}
+
+	for key, want := range map[string]bool{"WHOX": true, "EXCEPTS": true, "SAFELIST": false, "INVEX": false} {
+		if got := c.ISupportBool(key); got != want {
+			t.Fatalf("Client.ISupportBool(%s) == %t, want %t", key, got, want)
+		}
+	}
+
+	if modes, prefixes := c.ISupportPrefix(); modes != "qaohv" || prefixes != "~&@%+" {
+		t.Fatalf("Client.ISupportPrefix() == (%q, %q), want (%q, %q)", modes, prefixes, "qaohv", "~&@%+")
+	}
+
+	c.state.Lock()
+	c.state.serverOptions["PREFIX"] = "invalid"
+	c.state.Unlock()
+
+	if modes, prefixes := c.ISupportPrefix(); modes != "ov" || prefixes != "@+" {
+		t.Fatalf("Client.ISupportPrefix() == (%q, %q), want defaults", modes, prefixes)
+	}
+}
+
+func TestClientModeTypes(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	if got, want := c.Prefixes(), []ModePrefix{{'o', '@'}, {'v', '+'}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Client.Prefixes() == %q, want defaults %q", got, want)
+	}
+
+	if l, a, s, n := c.ChannelModeTypes(); l+","+a+","+s+","+n != ModeDefaults {
+		t.Fatalf("Client.ChannelModeTypes() == (%q, %q, %q, %q), want defaults", l, a, s, n)
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 005 test PREFIX=(Yqaohv)!~&@%+ CHANMODES=beIq,k,lfj,CimnpstT :are supported by this server\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	want := []ModePrefix{{'Y', '!'}, {'q', '~'}, {'a', '&'}, {'o', '@'}, {'h', '%'}, {'v', '+'}}
+	if got := c.Prefixes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Client.Prefixes() == %q, want %q", got, want)
+	}
+
+	l, a, s, n := c.ChannelModeTypes()
+	if l != "beIq" || a != "k" || s != "lfj" || n != "CimnpstT" {
+		t.Fatalf("Client.ChannelModeTypes() == (%q, %q, %q, %q), want (beIq, k, lfj, CimnpstT)", l, a, s, n)
+	}
+}
+
+func TestErrEventIsFatal(t *testing.T) {
+	cases := []struct {
+		in          string
+		registering bool
+		banned      bool
+		fatal       bool
+	}{
+		{in: "ERROR :Closing Link: test[127.0.0.1] (K-Lined: spamming)", registering: true, fatal: true},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (G-Lined)", registering: true, fatal: true},
+		{in: "ERROR :Closing Link: 127.0.0.1 (You are banned from this server)", registering: true, fatal: true},
+		{in: "ERROR :Trying to reconnect too fast, throttled", registering: true, fatal: true},
+		{in: "ERROR :Your host is trying to (re)connect too fast -- throttled", registering: true, fatal: true},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (K-Lined)", banned: true, fatal: true},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Ping timeout: 240 seconds)", registering: true, fatal: false},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Ping timeout: 240 seconds)", fatal: false},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Quit: bye)", fatal: false},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Excess Flood)", fatal: false},
+		// Once registered, the text may be from other users.
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Quit: got banned, throttled)", fatal: false},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (Killed (oper (you're banned from #chan)))", fatal: false},
+		{in: "ERROR :Closing Link: test[127.0.0.1] (K-Lined)", fatal: false},
+	}
+
+	for _, tt := range cases {
+		err := &ErrEvent{Event: ParseEvent(tt.in), registering: tt.registering, banned: tt.banned}
+		if got := err.IsFatal(); got != tt.fatal {
+			t.Fatalf("ErrEvent.IsFatal() == %t, want %t, for %q", got, tt.fatal, tt.in)
+		}
+
+		if got := IsFatalError(err); got != tt.fatal {
+			t.Fatalf("IsFatalError() == %t, want %t, for %q", got, tt.fatal, tt.in)
+		}
+	}
+
+	if IsFatalError(ErrNotConnected) || (&ErrEvent{}).IsFatal() {
+		t.Fatal("IsFatalError() returned true for non-fatal error")
+	}
+}
+
+func TestErrEventIsFatalConnect(t *testing.T) {
+	for _, tt := range []struct {
+		lines []string
+		fatal bool
+	}{
+		{[]string{":dummy.int 465 * :You are banned from this server", "ERROR :Closing Link: 127.0.0.1"}, true},
+		{[]string{"ERROR :Closing Link: 127.0.0.1 (Throttled: reconnecting too fast)"}, true},
+		{[]string{":dummy.int 001 test :Welcome", "ERROR :Closing Link: test (Quit: banned and throttled)"}, false},
+	} {
+		c, conn, server := genMockConn()
+		go mockReadBuffer(conn)
+
+		errchan := mockConnect(t, c, server)
+		for _, line := range tt.lines {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		select {
+		case err := <-errchan:
+			if got := IsFatalError(err); got != tt.fatal {
+				t.Errorf("IsFatalError(%v) == %t, want %t, after %q", err, got, tt.fatal, tt.lines)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for Connect() to return after %q", tt.lines)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClientMaxEventLength(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	want := DefaultMaxLineLength - DefaultMaxPrefixLength
+	if got := c.MaxEventLength(); got != want {
+		t.Fatalf("Client.MaxEventLength() == %d, want %d", got, want)
+	}
+
+	handleISUPPORT(c, Event{Command: RPL_ISUPPORT, Params: []string{"test", "NICKLEN=50", "HOSTLEN=100", "are supported by this server"}})
+
+	want = DefaultMaxLineLength - (defaultPrefixPadding + 50 + defaultUserLength + 100)
+	if got := c.MaxEventLength(); got != want {
+		t.Fatalf("Client.MaxEventLength() with NICKLEN/HOSTLEN == %d, want %d", got, want)
+	}
+
+	handleISUPPORT(c, Event{Command: RPL_ISUPPORT, Params: []string{"test", "LINELEN=1024", "are supported by this server"}})
+
+	want = 1024 - 2 - (defaultPrefixPadding + 50 + defaultUserLength + 100)
+	if got := c.MaxEventLength(); got != want {
+		t.Fatalf("Client.MaxEventLength() with LINELEN == %d, want %d", got, want)
+	}
+}
+
+// syncBuffer is a bytes.Buffer which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNickServ(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	debug, out := &syncBuffer{}, &syncBuffer{}
+	c.Config.Debug, c.Config.Out = debug, out
+	c.Config.NickServ = NickServ{Password: "hunter2"}
+	c = New(c.Config)
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	expectLine(t, lines, "PRIVMSG NickServ :IDENTIFY hunter2")
+
+	waitFor(t, "debug output", func() bool { return strings.Contains(debug.String(), "PRIVMSG ***redacted***") })
+	if strings.Contains(debug.String(), "hunter2") || strings.Contains(out.String(), "hunter2") {
+		t.Fatal("NickServ password was logged")
+	}
+
+	params := NickServ{Nick: "account", Password: "secret", Service: "AuthServ", Command: "AUTH"}.Params()
+	if len(params) != 2 || params[0] != "AuthServ" || params[1] != "AUTH account secret" {
+		t.Fatalf("NickServ.Params() = %q", params)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	if stats := c.Stats(); stats.Connected || stats.Uptime != 0 || stats.BytesRead != 0 {
+		t.Fatalf("Client.Stats() while disconnected = %+v", stats)
+	}
+
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":test!user@host.com JOIN #channel\r\n"))
+	conn.Write([]byte(":nick1!user@host.com JOIN #channel\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	stats := c.Stats()
+	if !stats.Connected || stats.Uptime <= 0 {
+		t.Fatalf("Client.Stats() = %+v, want connected with uptime", stats)
+	}
+	if stats.Users != 2 || stats.Channels != 1 || stats.Handlers != 1 {
+		t.Fatalf("Client.Stats() = %+v, want 2 users, 1 channel and 1 handler", stats)
+	}
+	if stats.BytesRead == 0 || stats.BytesWritten == 0 {
+		t.Fatalf("Client.Stats() = %+v, want bytes read and written", stats)
+	}
+}
+
+func TestClientBytes(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	errchan := mockConnect(t, c, server)
+	conn.Write([]byte("PING :first\r\n"))
+	expectLine(t, lines, "PONG first")
+
+	read, written := c.BytesRead(), c.BytesWritten()
+
+	in := ":nick!user@host.com NOTICE test :hello\r\nPING :sync\r\n"
+	conn.Write([]byte(in))
+	expectLine(t, lines, "PONG sync")
+
+	if got := c.BytesRead() - read; got != uint64(len(in)) {
+		t.Fatalf("Client.BytesRead() increased by %d, want %d", got, len(in))
+	}
+
+	c.Cmd.Message("#channel", "hello")
+	expectLine(t, lines, "PRIVMSG #channel hello")
+
+	// The PONG, and the PRIVMSG.
+	if got, want := c.BytesWritten()-written, uint64(len("PONG sync\r\nPRIVMSG #channel hello\r\n")); got != want {
+		t.Fatalf("Client.BytesWritten() increased by %d, want %d", got, want)
+	}
+
+	// Counters are reset on reconnect.
+	conn.Close()
+	select {
+	case <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+	server.Close()
+
+	if c.BytesRead() != 0 || c.BytesWritten() != 0 {
+		t.Fatalf("Client.BytesRead(), Client.BytesWritten() = %d, %d after disconnect, want 0", c.BytesRead(), c.BytesWritten())
+	}
+
+	_, conn, server = genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if got := c.BytesRead(); got != 0 {
+		t.Fatalf("Client.BytesRead() after reconnect = %d, want 0", got)
+	}
+}
+
+func TestAdvertiseBot(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AdvertiseBot = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	conn.Write([]byte(":dummy.int 005 test BOT=B NICKLEN=30 :are supported by this server\r\n"))
+	expectLine(t, lines, "MODE test +B")
+}
+
+func TestWaitForConnect(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	mockReadLines(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.WaitForConnect(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Client.WaitForConnect() before connecting == %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	var handled int32
+	c.Handlers.Add(CONNECTED, func(c *Client, e Event) {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&handled, 1)
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errs <- c.WaitForConnect(ctx)
+	}()
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Client.WaitForConnect() == %v, want nil", err)
+		}
+
+		if atomic.LoadInt32(&handled) != 1 {
+			t.Fatal("Client.WaitForConnect() returned before CONNECTED handlers completed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.WaitForConnect()")
+	}
+
+	if err := c.WaitForConnect(context.Background()); err != nil {
+		t.Fatalf("Client.WaitForConnect() once connected == %v, want nil", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // Commands holds a large list of useful methods to interact with the server,
@@ -16,14 +17,29 @@ type Commands struct {
 	c *Client
 }
 
-// Nick changes the client nickname.
-func (cmd *Commands) Nick(name string) {
+// Nick changes the client nickname. If Config.ValidateLimits is enabled,
+// returns ErrTooLong if the nickname is longer than the server supports
+// (NICKLEN).
+func (cmd *Commands) Nick(name string) error {
+	if err := cmd.checkLimit("nickname", "NICKLEN", name); err != nil {
+		return err
+	}
+
 	cmd.c.Send(&Event{Command: NICK, Params: []string{name}})
+	return nil
 }
 
 // Join attempts to enter a list of IRC channels, at bulk if possible to
-// prevent sending extensive JOIN commands.
-func (cmd *Commands) Join(channels ...string) {
+// prevent sending extensive JOIN commands. If Config.ValidateLimits is
+// enabled, returns ErrTooLong if any of the channels are longer than the
+// server supports (CHANNELLEN), in which case none are joined.
+func (cmd *Commands) Join(channels ...string) error {
+	for _, channel := range channels {
+		if err := cmd.checkLimit("channel", "CHANNELLEN", channel); err != nil {
+			return err
+		}
+	}
+
 	// We can join multiple channels at once, however we need to ensure that
 	// we are not exceeding the line length (see Client.MaxEventLength()).
 	max := cmd.c.MaxEventLength() - len(JOIN) - 1
@@ -45,14 +61,23 @@ func (cmd *Commands) Join(channels ...string) {
 
 		if i == len(channels)-1 {
 			cmd.c.Send(&Event{Command: JOIN, Params: []string{buffer}})
-			return
+			return nil
 		}
 	}
+
+	return nil
 }
 
-// JoinKey attempts to enter an IRC channel with a password.
-func (cmd *Commands) JoinKey(channel, password string) {
+// JoinKey attempts to enter an IRC channel with a password. If
+// Config.ValidateLimits is enabled, returns ErrTooLong if the channel is
+// longer than the server supports (CHANNELLEN).
+func (cmd *Commands) JoinKey(channel, password string) error {
+	if err := cmd.checkLimit("channel", "CHANNELLEN", channel); err != nil {
+		return err
+	}
+
 	cmd.c.Send(&Event{Command: JOIN, Params: []string{channel, password}})
+	return nil
 }
 
 // Part leaves an IRC channel.
@@ -94,13 +119,19 @@ func (cmd *Commands) SendCTCPReplyf(target, ctcpType, format string, a ...interf
 }
 
 // SendCTCPReply sends a CTCP response to target. Note that this method uses
-// NOTICE specifically.
+// NOTICE specifically. The reply is dropped if it would exceed
+// Config.CTCPReplyRate.
 func (cmd *Commands) SendCTCPReply(target, ctcpType, message string) {
 	out := EncodeCTCPRaw(ctcpType, message)
 	if out == "" {
 		panic(fmt.Sprintf("invalid CTCP: %s -> %s: %s", target, ctcpType, message))
 	}
 
+	if !cmd.c.state.allowCTCPReply(target, cmd.c.Config.CTCPReplyRate) {
+		cmd.c.debug.Printf("dropping ctcp %s reply to %s, over the reply rate", ctcpType, target)
+		return
+	}
+
 	cmd.Notice(target, out)
 }
 
@@ -109,6 +140,52 @@ func (cmd *Commands) Message(target, message string) {
 	cmd.c.Send(&Event{Command: PRIVMSG, Params: []string{target, message}})
 }
 
+// MessageMany sends a PRIVMSG to multiple targets (channels, services, or
+// users), combining the targets into as few messages as possible, while
+// respecting the servers TARGMAX limit for PRIVMSG, and the maximum line
+// length. Returns ErrInvalidTarget for the first invalid target, in which
+// case nothing is sent.
+func (cmd *Commands) MessageMany(message string, targets ...string) error {
+	for _, target := range targets {
+		if !IsValidChannel(target) && !IsValidNick(target) {
+			return ErrInvalidTarget{Target: target}
+		}
+	}
+
+	limit := cmd.c.targetLimit(PRIVMSG)
+	maxLength := cmd.c.MaxEventLength()
+
+	var events []*Event
+	var group []string
+
+	for _, target := range targets {
+		if len(group) > 0 {
+			next := &Event{Command: PRIVMSG, Params: []string{strings.Join(append(group, target), ","), message}}
+
+			if (limit > 0 && len(group) >= limit) || next.LenOpts(false) > maxLength {
+				events = append(events, &Event{Command: PRIVMSG, Params: []string{strings.Join(group, ","), message}})
+				group = nil
+			}
+		}
+
+		group = append(group, target)
+	}
+
+	if len(group) > 0 {
+		events = append(events, &Event{Command: PRIVMSG, Params: []string{strings.Join(group, ","), message}})
+	}
+
+	return cmd.c.SendBulk(events...)
+}
+
+// MessageTags sends a PRIVMSG to target (either channel, service, or user),
+// with the supplied client-only message tags (those prefixed with "+", e.g.
+// "+draft/reply"). All other tags are ignored. Tags are silently dropped if
+// the server doesn't support the message-tags capability.
+func (cmd *Commands) MessageTags(target, message string, tags Tags) {
+	cmd.c.Send(&Event{Command: PRIVMSG, Params: []string{target, message}, Tags: tags.clientOnly()})
+}
+
 // Messagef sends a formated PRIVMSG to target (either channel, service, or
 // user).
 func (cmd *Commands) Messagef(target, format string, a ...interface{}) {
@@ -120,20 +197,78 @@ func (cmd *Commands) Messagef(target, format string, a ...interface{}) {
 // server.)
 var ErrInvalidSource = errors.New("event has nil or invalid source address")
 
-// Reply sends a reply to channel or user, based on where the supplied event
-// originated from. See also ReplyTo(). Panics if the incoming event has no
-// source.
-func (cmd *Commands) Reply(event Event, message string) {
+// replyTarget returns the channel or user that a reply to event should be
+// sent to. Panics if the event has no source.
+func replyTarget(event Event) string {
 	if event.Source == nil {
 		panic(ErrInvalidSource)
 	}
 
-	if len(event.Params) > 0 && IsValidChannel(event.Params[0]) {
-		cmd.Message(event.Params[0], message)
+	return event.Target()
+}
+
+// Reply sends a reply to channel or user, based on where the supplied event
+// originated from. If the event has a "msgid" tag, the reply will reference
+// it with the "+draft/reply" client-only tag (when the server supports
+// message-tags). See also ReplyTo(). Panics if the incoming event has no
+// source.
+func (cmd *Commands) Reply(event Event, message string) {
+	target := replyTarget(event)
+
+	if msgid, ok := event.Tags.Get("msgid"); ok && msgid != "" {
+		cmd.MessageTags(target, message, Tags{"+draft/reply": event.Tags["msgid"]})
 		return
 	}
 
-	cmd.Message(event.Source.Name, message)
+	cmd.Message(target, message)
+}
+
+// Respond responds to the supplied event with message, using the same
+// command as the event for NOTICEs (i.e. a NOTICE is responded to with a
+// NOTICE, which clients and bots must never automatically respond to,
+// preventing loops), and PRIVMSG otherwise. The response is sent to the
+// originating channel, or to the source user if the event wasn't sent to a
+// channel. Returns ErrInvalidSource if the event has no source, or was sent
+// by the server, as they shouldn't be responded to.
+func (cmd *Commands) Respond(to Event, message string) error {
+	if to.Source == nil || to.Source.IsServer() {
+		return ErrInvalidSource
+	}
+
+	target := to.Source.Name
+	if to.IsFromChannel() {
+		target = to.Params[0]
+	}
+
+	if to.Command == NOTICE {
+		cmd.Notice(target, message)
+		return nil
+	}
+
+	cmd.Message(target, message)
+	return nil
+}
+
+// React reacts to the supplied event with emoji (or any other short text),
+// using a TAGMSG with the "+draft/react" client-only tag. If the event has no
+// "msgid" tag, or the server doesn't support message-tags, this falls back to
+// replying with emoji as a plain message. Panics if the incoming event has
+// no source.
+func (cmd *Commands) React(event Event, emoji string) {
+	target := replyTarget(event)
+
+	if msgid, ok := event.Tags.Get("msgid"); ok && msgid != "" {
+		tags := Tags{}
+		if err := tags.Set("+draft/react", emoji); err == nil {
+			tags["+draft/reply"] = event.Tags["msgid"]
+
+			if cmd.Tagmsg(target, tags) == nil {
+				return
+			}
+		}
+	}
+
+	cmd.Message(target, emoji)
 }
 
 // Replyf sends a reply to channel or user with a format string, based on
@@ -188,6 +323,50 @@ func (cmd *Commands) Notice(target, message string) {
 	cmd.c.Send(&Event{Command: NOTICE, Params: []string{target, message}})
 }
 
+// NoticeTags sends a NOTICE to target (either channel, service, or user),
+// with the supplied client-only message tags. See MessageTags() for details.
+func (cmd *Commands) NoticeTags(target, message string, tags Tags) {
+	cmd.c.Send(&Event{Command: NOTICE, Params: []string{target, message}, Tags: tags.clientOnly()})
+}
+
+// ErrNoClientTags is returned when a command requires client-only message
+// tags (those prefixed with "+"), however none were supplied.
+var ErrNoClientTags = errors.New("no client-only message tags supplied")
+
+// Tagmsg sends a TAGMSG to target (either channel or user), which is a
+// message containing only client-only message tags (those prefixed with "+",
+// e.g. "+draft/react"), without any text. All other tags are ignored. Returns
+// ErrCapNotEnabled if the server doesn't support the message-tags capability,
+// or ErrNoClientTags if there are no client-only tags to send.
+func (cmd *Commands) Tagmsg(target string, tags Tags) error {
+	if err := cmd.c.requireCap("message-tags"); err != nil {
+		return err
+	}
+
+	if !IsValidChannel(target) && !IsValidNick(target) {
+		return ErrInvalidTarget{Target: target}
+	}
+
+	tags = tags.clientOnly()
+	if tags == nil {
+		return ErrNoClientTags
+	}
+
+	cmd.c.Send(&Event{Command: CAP_TAGMSG, Params: []string{target}, Tags: tags})
+	return nil
+}
+
+// SetName changes our realname without reconnecting. Returns
+// ErrCapNotEnabled if the server doesn't support the setname capability.
+func (cmd *Commands) SetName(realname string) error {
+	if err := cmd.c.requireCap("setname"); err != nil {
+		return err
+	}
+
+	cmd.c.Send(&Event{Command: CAP_SETNAME, Params: []string{realname}})
+	return nil
+}
+
 // Noticef sends a formated NOTICE to target (either channel, service, or
 // user).
 func (cmd *Commands) Noticef(target, format string, a ...interface{}) {
@@ -218,22 +397,92 @@ func (cmd *Commands) SendRawf(format string, a ...interface{}) error {
 	return cmd.SendRaw(fmt.Sprintf(format, a...))
 }
 
-// Topic sets the topic of channel to message. Does not verify the length
-// of the topic.
-func (cmd *Commands) Topic(channel, message string) {
-	cmd.c.Send(&Event{Command: TOPIC, Params: []string{channel, message}})
+// ErrTooLong is returned when a command is supplied with text which is
+// longer than the server supports, which would otherwise be truncated.
+type ErrTooLong struct {
+	// Name is the name of what is too long (e.g. "topic").
+	Name string
+	// Length is the length of the supplied text, in bytes.
+	Length int
+	// Max is the maximum length the server supports, in bytes.
+	Max int
+}
+
+func (e ErrTooLong) Error() string {
+	return fmt.Sprintf("%s too long: %d bytes, max %d", e.Name, e.Length, e.Max)
+}
+
+// checkLength returns ErrTooLong if text is longer than the ISUPPORT limit
+// with the given key (e.g. TOPICLEN), or if event is longer than the
+// maximum event length the server supports.
+func (cmd *Commands) checkLength(name, key, text string, event *Event) error {
+	if max := cmd.c.ISupportInt(key, 0); max > 0 && len(text) > max {
+		return ErrTooLong{Name: name, Length: len(text), Max: max}
+	}
+
+	if max := cmd.c.MaxEventLength(); event.LenOpts(false) > max {
+		return ErrTooLong{Name: name, Length: len(text), Max: max - (event.LenOpts(false) - len(text))}
+	}
+
+	return nil
 }
 
+// checkLimit returns ErrTooLong if Config.ValidateLimits is enabled, and
+// text is longer than the ISUPPORT limit with the given key (e.g. NICKLEN).
+func (cmd *Commands) checkLimit(name, key, text string) error {
+	if !cmd.c.Config.ValidateLimits {
+		return nil
+	}
+
+	if max := cmd.c.ISupportInt(key, 0); max > 0 && len(text) > max {
+		return ErrTooLong{Name: name, Length: len(text), Max: max}
+	}
+
+	return nil
+}
+
+// Topic sets the topic of channel to message. Returns ErrTooLong if the
+// topic is longer than the server supports (TOPICLEN), rather than letting
+// the server truncate it.
+func (cmd *Commands) Topic(channel, message string) error {
+	event := &Event{Command: TOPIC, Params: []string{channel, message}}
+	if err := cmd.checkLength("topic", "TOPICLEN", message, event); err != nil {
+		return err
+	}
+
+	cmd.c.Send(event)
+	return nil
+}
+
+// whoDefaultFields are the WHOX fields requested by Commands.Who().
+var whoDefaultFields = WHOXFields{WHOXChannel, WHOXUser, WHOXHost, WHOXNick, WHOXRealname}
+
 // Who sends a WHO query to the server, which will attempt WHOX by default.
 // See http://faerion.sourceforge.net/doc/irc/whox.var for more details. This
 // sends "%tcuhnr,2" per default. Do not use "1" as this will conflict with
-// girc's builtin tracking functionality.
+// girc's builtin tracking functionality. See also WhoX().
 func (cmd *Commands) Who(users ...string) {
 	for i := 0; i < len(users); i++ {
-		cmd.c.Send(&Event{Command: WHO, Params: []string{users[i], "%tcuhnr,2"}})
+		cmd.c.Send(&Event{Command: WHO, Params: []string{users[i], whoDefaultFields.query(whoxUserToken)}})
 	}
 }
 
+// WhoX sends a WHOX query to the server for target (e.g. a channel, nickname
+// or mask), requesting the supplied fields. Replies use the token "2", and
+// can be parsed with ParseWHOX() using the same fields. For example:
+//
+//	fields := girc.WHOXFields{girc.WHOXNick, girc.WHOXIdle, girc.WHOXAccount}
+//	c.Cmd.WhoX("#channel", fields)
+//
+//	c.Handlers.Add(girc.RPL_WHOSPCRPL, func(c *girc.Client, e girc.Event) {
+//		if reply, ok := girc.ParseWHOX(&e, fields); ok && reply.Token == "2" {
+//			fmt.Printf("%s has been idle for %ds\n", reply.Nick, reply.Idle)
+//		}
+//	})
+func (cmd *Commands) WhoX(target string, fields WHOXFields) {
+	cmd.c.Send(&Event{Command: WHO, Params: []string{target, fields.query(whoxUserToken)}})
+}
+
 // Whois sends a WHOIS query to the server, targeted at a specific user (or
 // set of users). As WHOIS is a bit slower, you may want to use WHO for brief
 // user info.
@@ -256,8 +505,16 @@ func (cmd *Commands) Pong(id string) {
 }
 
 // Oper sends a OPER authentication query to the server, with a username
-// and password.
+// and password. If tracking is enabled, OPER_UP or OPER_FAILED will be fired
+// depending on the result, and Client.IsOper() will return true once
+// successful.
 func (cmd *Commands) Oper(user, pass string) {
+	if !cmd.c.Config.disableTracking {
+		cmd.c.state.Lock()
+		cmd.c.state.operPending = true
+		cmd.c.state.Unlock()
+	}
+
 	cmd.c.Send(&Event{Command: OPER, Params: []string{user, pass}, Sensitive: true})
 }
 
@@ -267,19 +524,145 @@ func (cmd *Commands) Oper(user, pass string) {
 func (cmd *Commands) Kick(channel, user, reason string) {
 	if reason != "" {
 		cmd.c.Send(&Event{Command: KICK, Params: []string{channel, user, reason}})
+		return
 	}
 
 	cmd.c.Send(&Event{Command: KICK, Params: []string{channel, user}})
 }
 
-// Ban adds the +b mode on the given mask on a channel.
-func (cmd *Commands) Ban(channel, mask string) {
+// KickMany kicks multiple users from a channel, with an optional reason,
+// combining the users into as few KICK commands as possible, while
+// respecting the servers TARGMAX limit for KICK, and the maximum line
+// length. Returns ErrInvalidTarget for the channel or the first invalid
+// nick, in which case nothing is sent.
+func (cmd *Commands) KickMany(channel, reason string, nicks ...string) error {
+	if !IsValidChannel(channel) {
+		return ErrInvalidTarget{Target: channel}
+	}
+
+	for _, nick := range nicks {
+		if !IsValidNick(nick) {
+			return ErrInvalidTarget{Target: nick}
+		}
+	}
+
+	kick := func(group []string) *Event {
+		if reason != "" {
+			return &Event{Command: KICK, Params: []string{channel, strings.Join(group, ","), reason}}
+		}
+
+		return &Event{Command: KICK, Params: []string{channel, strings.Join(group, ",")}}
+	}
+
+	limit := cmd.c.targetLimit(KICK)
+	maxLength := cmd.c.MaxEventLength()
+
+	var events []*Event
+	var group []string
+
+	for _, nick := range nicks {
+		if len(group) > 0 {
+			if (limit > 0 && len(group) >= limit) || kick(append(group, nick)).LenOpts(false) > maxLength {
+				events = append(events, kick(group))
+				group = nil
+			}
+		}
+
+		group = append(group, nick)
+	}
+
+	if len(group) > 0 {
+		events = append(events, kick(group))
+	}
+
+	return cmd.c.SendBulk(events...)
+}
+
+// ErrInvalidTarget is returned when a command is supplied with a target (e.g.
+// a channel, nickname, or mask) which isn't valid.
+type ErrInvalidTarget struct {
+	Target string
+}
+
+func (e ErrInvalidTarget) Error() string { return "invalid target: " + e.Target }
+
+// isValidMask checks if mask can be safely used as a single parameter to a
+// MODE query (e.g. a ban mask). Extended bans are allowed, and as such, the
+// mask isn't required to be in the "nick!user@host" format.
+func isValidMask(mask string) bool {
+	if mask == "" || mask[0] == ':' {
+		return false
+	}
+
+	for i := 0; i < len(mask); i++ {
+		switch mask[i] {
+		case ' ', ',', '\r', '\n', 0x00:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Ban adds the +b mode on the given mask on a channel. Returns
+// ErrInvalidTarget if the channel or mask is invalid.
+func (cmd *Commands) Ban(channel, mask string) error {
+	if !IsValidChannel(channel) {
+		return ErrInvalidTarget{Target: channel}
+	}
+
+	if !isValidMask(mask) {
+		return ErrInvalidTarget{Target: mask}
+	}
+
 	cmd.Mode(channel, "+b", mask)
+	return nil
 }
 
-// Unban removes the +b mode on the given mask on a channel.
-func (cmd *Commands) Unban(channel, mask string) {
+// Unban removes the +b mode on the given mask on a channel. Returns
+// ErrInvalidTarget if the channel or mask is invalid.
+func (cmd *Commands) Unban(channel, mask string) error {
+	if !IsValidChannel(channel) {
+		return ErrInvalidTarget{Target: channel}
+	}
+
+	if !isValidMask(mask) {
+		return ErrInvalidTarget{Target: mask}
+	}
+
 	cmd.Mode(channel, "-b", mask)
+	return nil
+}
+
+// KickBan bans nick from channel, and then kicks them with the given reason.
+// The ban mask is based on the host of the user if they are being tracked
+// (e.g. "*!*@host"), otherwise it falls back to "nick!*@*". Returns
+// ErrInvalidTarget if the channel or nick is invalid.
+func (cmd *Commands) KickBan(channel, nick, reason string) error {
+	if !IsValidChannel(channel) {
+		return ErrInvalidTarget{Target: channel}
+	}
+
+	if !IsValidNick(nick) {
+		return ErrInvalidTarget{Target: nick}
+	}
+
+	mask := nick + "!*@*"
+
+	if !cmd.c.Config.disableTracking {
+		cmd.c.state.RLock()
+		if user := cmd.c.state.lookupUser(nick); user != nil && user.Host != "" {
+			mask = "*!*@" + user.Host
+		}
+		cmd.c.state.RUnlock()
+	}
+
+	if err := cmd.Ban(channel, mask); err != nil {
+		return err
+	}
+
+	cmd.Kick(channel, nick, reason)
+	return nil
 }
 
 // Mode sends a mode change to the server which should be applied to target
@@ -293,6 +676,24 @@ func (cmd *Commands) Mode(target, modes string, params ...string) {
 	cmd.c.Send(&Event{Command: MODE, Params: out})
 }
 
+// SetMode sets (or unsets) modes on target (a channel, or our own nick),
+// e.g. SetMode("#channel", "+ov", "nick1", "nick2"), or SetMode(nick, "+i").
+// Unlike Mode(), this validates the target and mode string first, returning
+// ErrInvalidTarget if target isn't a valid channel or nickname, or an error
+// if modes doesn't start with "+" or "-".
+func (cmd *Commands) SetMode(target, modes string, args ...string) error {
+	if !IsValidChannel(target) && !IsValidNick(target) {
+		return ErrInvalidTarget{Target: target}
+	}
+
+	if len(modes) < 2 || (modes[0] != '+' && modes[0] != '-') {
+		return fmt.Errorf("invalid mode string %q: must start with + or -", modes)
+	}
+
+	cmd.Mode(target, modes, args...)
+	return nil
+}
+
 // Invite sends a INVITE query to the server, to invite nick to channel.
 func (cmd *Commands) Invite(channel string, users ...string) {
 	for i := 0; i < len(users); i++ {
@@ -301,15 +702,29 @@ func (cmd *Commands) Invite(channel string, users ...string) {
 }
 
 // Away sends a AWAY query to the server, suggesting that the client is no
-// longer active. If reason is blank, Client.Back() is called. Also see
-// Client.Back().
-func (cmd *Commands) Away(reason string) {
+// longer active. If reason is blank, Client.Back() is called. Returns
+// ErrTooLong if the reason is longer than the server supports (AWAYLEN).
+// If tracking is enabled, SELF_AWAY will be fired, and Client.IsAway() will
+// return true, once the server has marked us as away. Also see Client.Back().
+func (cmd *Commands) Away(reason string) error {
 	if reason == "" {
 		cmd.Back()
-		return
+		return nil
+	}
+
+	event := &Event{Command: AWAY, Params: []string{reason}}
+	if err := cmd.checkLength("away reason", "AWAYLEN", reason, event); err != nil {
+		return err
+	}
+
+	if !cmd.c.Config.disableTracking {
+		cmd.c.state.Lock()
+		cmd.c.state.awayPending = reason
+		cmd.c.state.Unlock()
 	}
 
-	cmd.c.Send(&Event{Command: AWAY, Params: []string{reason}})
+	cmd.c.Send(event)
+	return nil
 }
 
 // Back sends a AWAY query to the server, however the query is blank,
@@ -360,6 +775,34 @@ func (cmd *Commands) Whowas(user string, amount int) {
 	cmd.c.Send(&Event{Command: WHOWAS, Params: []string{user, strconv.Itoa(amount)}})
 }
 
+// ChatHistoryLatest requests the latest messages sent to target (up to
+// limit) from the server, using the IRCv3 "draft/chathistory" capability.
+// The messages are sent back within a single "chathistory" batch, see
+// BATCH_COMPLETE and Event.Batch. Returns ErrCapNotEnabled if the capability
+// isn't enabled.
+func (cmd *Commands) ChatHistoryLatest(target string, limit int) error {
+	if err := cmd.c.requireCap("draft/chathistory"); err != nil {
+		return err
+	}
+
+	cmd.c.Send(&Event{Command: CHATHISTORY, Params: []string{"LATEST", target, "*", strconv.Itoa(limit)}})
+	return nil
+}
+
+// ChatHistoryBefore requests the messages sent to target before the message
+// with the given msgid (up to limit) from the server, using the IRCv3
+// "draft/chathistory" capability. The messages are sent back within a single
+// "chathistory" batch, see BATCH_COMPLETE and Event.Batch. Returns
+// ErrCapNotEnabled if the capability isn't enabled.
+func (cmd *Commands) ChatHistoryBefore(target, msgid string, limit int) error {
+	if err := cmd.c.requireCap("draft/chathistory"); err != nil {
+		return err
+	}
+
+	cmd.c.Send(&Event{Command: CHATHISTORY, Params: []string{"BEFORE", target, "msgid=" + msgid, strconv.Itoa(limit)}})
+	return nil
+}
+
 // Monitor sends a MONITOR query to the server. The results of the query
 // depends on the given modifier, see https://ircv3.net/specs/core/monitor-3.2.html
 func (cmd *Commands) Monitor(modifier rune, args ...string) {
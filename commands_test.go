@@ -0,0 +1,503 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKickBan(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.KickBan("invalid", "nick", "bye"); err == nil {
+		t.Fatal("Commands.KickBan() with invalid channel returned nil error")
+	}
+
+	if err := c.Cmd.KickBan("#channel", "invalid nick", "bye"); err == nil {
+		t.Fatal("Commands.KickBan() with invalid nick returned nil error")
+	}
+
+	// Not tracked, so it should fall back to banning the nickname.
+	if err := c.Cmd.KickBan("#channel", "nick1", "bye"); err != nil {
+		t.Fatalf("Commands.KickBan() returned error: %s", err)
+	}
+
+	expectLine(t, lines, "MODE #channel +b nick1!*@*")
+	expectLine(t, lines, "KICK #channel nick1 bye")
+
+	c.state.Lock()
+	c.state.createUser(&Source{Name: "nick2", Ident: "~user", Host: "host.example.com"})
+	c.state.Unlock()
+
+	if err := c.Cmd.KickBan("#channel", "nick2", ""); err != nil {
+		t.Fatalf("Commands.KickBan() returned error: %s", err)
+	}
+
+	expectLine(t, lines, "MODE #channel +b *!*@host.example.com")
+	expectLine(t, lines, "KICK #channel nick2")
+}
+
+func TestBanValidation(t *testing.T) {
+	c, _, _ := genMockConn()
+
+	if err := c.Cmd.Ban("#channel", "bad mask"); err == nil {
+		t.Fatal("Commands.Ban() with invalid mask returned nil error")
+	}
+
+	if err := c.Cmd.Unban("channel", "*!*@host"); err == nil {
+		t.Fatal("Commands.Unban() with invalid channel returned nil error")
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.ChatHistoryLatest("#channel", 50); err == nil {
+		t.Fatal("Commands.ChatHistoryLatest() without draft/chathistory returned nil error")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap["draft/chathistory"] = nil
+	c.state.Unlock()
+
+	if err := c.Cmd.ChatHistoryLatest("#channel", 50); err != nil {
+		t.Fatalf("Commands.ChatHistoryLatest() returned error: %s", err)
+	}
+	expectLine(t, lines, "CHATHISTORY LATEST #channel * 50")
+
+	if err := c.Cmd.ChatHistoryBefore("nick", "abc123", 10); err != nil {
+		t.Fatalf("Commands.ChatHistoryBefore() returned error: %s", err)
+	}
+	expectLine(t, lines, "CHATHISTORY BEFORE nick msgid=abc123 10")
+}
+
+func TestTagmsg(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	tags := Tags{"+draft/react": "lol", "label": "abc"}
+
+	if err := c.Cmd.Tagmsg("#channel", tags); err == nil {
+		t.Fatal("Commands.Tagmsg() without message-tags returned nil error")
+	}
+
+	// Tags should be stripped when the server doesn't support message-tags.
+	c.Cmd.MessageTags("#channel", "no tags", tags)
+	expectLine(t, lines, "PRIVMSG #channel :no tags")
+
+	c.state.Lock()
+	c.state.enabledCap["message-tags"] = nil
+	c.state.Unlock()
+
+	if err := c.Cmd.Tagmsg("#channel", Tags{"label": "abc"}); err != ErrNoClientTags {
+		t.Fatalf("Commands.Tagmsg() without client-only tags = %v, want ErrNoClientTags", err)
+	}
+
+	if err := c.Cmd.Tagmsg("#channel", tags); err != nil {
+		t.Fatalf("Commands.Tagmsg() returned error: %s", err)
+	}
+	expectLine(t, lines, "@+draft/react=lol TAGMSG #channel")
+
+	c.Cmd.MessageTags("#channel", "with tags", tags)
+	expectLine(t, lines, "@+draft/react=lol PRIVMSG #channel :with tags")
+}
+
+func TestReplyReact(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	withID := *ParseEvent("@msgid=abc123 :nick!user@host PRIVMSG #channel :hello")
+	withoutID := *ParseEvent(":nick!user@host PRIVMSG test :hello")
+
+	// Without a msgid, both should fall back to plain messages.
+	c.Cmd.Reply(withoutID, "plain reply")
+	expectLine(t, lines, "PRIVMSG nick :plain reply")
+
+	c.Cmd.React(withoutID, "👍")
+	expectLine(t, lines, "PRIVMSG nick 👍")
+
+	// Without message-tags, react should fall back to a plain message.
+	c.Cmd.React(withID, "👍")
+	expectLine(t, lines, "PRIVMSG #channel 👍")
+
+	c.state.Lock()
+	c.state.enabledCap["message-tags"] = nil
+	c.state.Unlock()
+
+	c.Cmd.Reply(withID, "tagged reply")
+	expectLine(t, lines, "@+draft/reply=abc123 PRIVMSG #channel :tagged reply")
+
+	c.Cmd.React(withID, "👍")
+	expectLine(t, lines, "@+draft/react=👍;+draft/reply=abc123 TAGMSG #channel")
+}
+
+func TestPart(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	c.Cmd.Part("#x", "#y")
+	expectLine(t, lines, "PART #x")
+	expectLine(t, lines, "PART #y")
+
+	c.Cmd.PartMessage("#x", "bye")
+	expectLine(t, lines, "PART #x bye")
+
+	c.Cmd.PartMessage("#x", "see you")
+	expectLine(t, lines, "PART #x :see you")
+}
+
+func TestRespond(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: ":nick!user@host PRIVMSG #channel :hello", want: "PRIVMSG #channel :test response"},
+		{in: ":nick!user@host PRIVMSG test :hello", want: "PRIVMSG nick :test response"},
+		{in: ":nick!user@host NOTICE #channel :hello", want: "NOTICE #channel :test response"},
+		{in: ":nick!user@host NOTICE test :hello", want: "NOTICE nick :test response"},
+	}
+
+	for _, tt := range cases {
+		if err := c.Cmd.Respond(*ParseEvent(tt.in), "test response"); err != nil {
+			t.Fatalf("Commands.Respond() returned error: %s", err)
+		}
+		expectLine(t, lines, tt.want)
+	}
+
+	if err := c.Cmd.Respond(*ParseEvent(":dummy.int NOTICE test :server notice"), "test"); err != ErrInvalidSource {
+		t.Fatalf("Commands.Respond() to server = %v, want ErrInvalidSource", err)
+	}
+
+	if err := c.Cmd.Respond(*ParseEvent("NOTICE test :no source"), "test"); err != ErrInvalidSource {
+		t.Fatalf("Commands.Respond() without source = %v, want ErrInvalidSource", err)
+	}
+}
+
+func TestMessageMany(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.MessageMany("hello", "#a", "bad nick", "#b"); err == nil {
+		t.Fatal("Commands.MessageMany() with invalid target returned nil error")
+	}
+
+	// Without TARGMAX, targets should be sent individually.
+	if err := c.Cmd.MessageMany("hello", "#a", "#b"); err != nil {
+		t.Fatalf("Commands.MessageMany() returned error: %s", err)
+	}
+	expectLine(t, lines, "PRIVMSG #a hello")
+	expectLine(t, lines, "PRIVMSG #b hello")
+
+	c.state.Lock()
+	c.state.serverOptions["TARGMAX"] = "NAMES:1,PRIVMSG:3,NOTICE:3,JOIN:"
+	c.state.Unlock()
+
+	if err := c.Cmd.MessageMany("hello", "#a", "#b", "nick1", "#d", "#e", "nick2", "#g"); err != nil {
+		t.Fatalf("Commands.MessageMany() returned error: %s", err)
+	}
+	expectLine(t, lines, "PRIVMSG #a,#b,nick1 hello")
+	expectLine(t, lines, "PRIVMSG #d,#e,nick2 hello")
+	expectLine(t, lines, "PRIVMSG #g hello")
+
+	if limit := c.targetLimit(JOIN); limit != 0 {
+		t.Fatalf("Client.targetLimit(JOIN) == %d, want 0", limit)
+	}
+	if limit := c.targetLimit(KICK); limit != 1 {
+		t.Fatalf("Client.targetLimit(KICK) == %d, want 1", limit)
+	}
+}
+
+func TestKickMany(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.KickMany("#channel", "", "nick1", "bad nick"); err == nil {
+		t.Fatal("Commands.KickMany() with invalid nick returned nil error")
+	}
+
+	if err := c.Cmd.KickMany("channel", "", "nick1"); err == nil {
+		t.Fatal("Commands.KickMany() with invalid channel returned nil error")
+	}
+
+	// Without TARGMAX, nicks should be kicked individually.
+	if err := c.Cmd.KickMany("#channel", "", "nick1", "nick2"); err != nil {
+		t.Fatalf("Commands.KickMany() returned error: %s", err)
+	}
+	expectLine(t, lines, "KICK #channel nick1")
+	expectLine(t, lines, "KICK #channel nick2")
+
+	c.state.Lock()
+	c.state.serverOptions["TARGMAX"] = "PRIVMSG:3,KICK:2"
+	c.state.Unlock()
+
+	if err := c.Cmd.KickMany("#channel", "go away", "nick1", "nick2", "nick3"); err != nil {
+		t.Fatalf("Commands.KickMany() returned error: %s", err)
+	}
+	expectLine(t, lines, "KICK #channel nick1,nick2 :go away")
+	expectLine(t, lines, "KICK #channel nick3 :go away")
+
+	// Long lines are split, even without a limit.
+	c.state.Lock()
+	c.state.serverOptions["TARGMAX"] = "KICK:"
+	c.state.Unlock()
+
+	var nicks []string
+	for i := 0; i < 100; i++ {
+		nicks = append(nicks, fmt.Sprintf("nickname%02d", i))
+	}
+
+	if err := c.Cmd.KickMany("#channel", "", nicks...); err != nil {
+		t.Fatalf("Commands.KickMany() returned error: %s", err)
+	}
+
+	var kicked []string
+	for len(kicked) < len(nicks) {
+		select {
+		case line := <-lines:
+			if len(line) > c.MaxEventLength() {
+				t.Fatalf("Commands.KickMany() sent %d character line, want <= %d", len(line), c.MaxEventLength())
+			}
+
+			kicked = append(kicked, strings.Split(strings.TrimPrefix(line, "KICK #channel "), ",")...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for KICK, got %d of %d nicks", len(kicked), len(nicks))
+		}
+	}
+
+	if !reflect.DeepEqual(kicked, nicks) {
+		t.Fatalf("Commands.KickMany() kicked %v, want %v", kicked, nicks)
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Without limits from the server, nothing should be validated.
+	c.Config.ValidateLimits = true
+	if err := c.Cmd.Nick("averyveryverylongnickname"); err != nil {
+		t.Fatalf("Commands.Nick() without NICKLEN returned error: %s", err)
+	}
+	expectLine(t, lines, "NICK averyveryverylongnickname")
+
+	c.state.Lock()
+	c.state.serverOptions["NICKLEN"] = "9"
+	c.state.serverOptions["CHANNELLEN"] = "10"
+	c.state.serverOptions["TOPICLEN"] = "5"
+	c.state.Unlock()
+
+	err := c.Cmd.Nick("toolongnick")
+	if e, ok := err.(ErrTooLong); !ok || e.Max != 9 || e.Length != 11 {
+		t.Fatalf("Commands.Nick() with long nick = %v, want ErrTooLong", err)
+	}
+
+	err = c.Cmd.Join("#short", "#waytoolong")
+	if e, ok := err.(ErrTooLong); !ok || e.Max != 10 {
+		t.Fatalf("Commands.Join() with long channel = %v, want ErrTooLong", err)
+	}
+
+	err = c.Cmd.JoinKey("#waytoolong", "key")
+	if e, ok := err.(ErrTooLong); !ok || e.Max != 10 {
+		t.Fatalf("Commands.JoinKey() with long channel = %v, want ErrTooLong", err)
+	}
+
+	if err = c.Cmd.Topic("#short", "too long"); err == nil {
+		t.Fatal("Commands.Topic() with long topic returned nil error")
+	}
+
+	if err = c.Cmd.Nick("nick"); err != nil {
+		t.Fatalf("Commands.Nick() returned error: %s", err)
+	}
+	expectLine(t, lines, "NICK nick")
+
+	if err = c.Cmd.Join("#short", "#chan"); err != nil {
+		t.Fatalf("Commands.Join() returned error: %s", err)
+	}
+	expectLine(t, lines, "JOIN #short,#chan")
+
+	// Limits are only enforced when enabled.
+	c.Config.ValidateLimits = false
+	if err = c.Cmd.Nick("toolongnick"); err != nil {
+		t.Fatalf("Commands.Nick() without Config.ValidateLimits returned error: %s", err)
+	}
+	expectLine(t, lines, "NICK toolongnick")
+}
+
+func TestTopicAwayLength(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	c.state.Lock()
+	c.state.serverOptions["TOPICLEN"] = "10"
+	c.state.serverOptions["AWAYLEN"] = "5"
+	c.state.Unlock()
+
+	err := c.Cmd.Topic("#channel", "this topic is too long")
+	if e, ok := err.(ErrTooLong); !ok || e.Max != 10 {
+		t.Fatalf("Commands.Topic() with long topic = %v, want ErrTooLong", err)
+	}
+
+	if err = c.Cmd.Away("gone fishing"); err == nil {
+		t.Fatal("Commands.Away() with long reason returned nil error")
+	}
+
+	c.state.Lock()
+	delete(c.state.serverOptions, "TOPICLEN")
+	c.state.Unlock()
+
+	// Without TOPICLEN, the line length limit still applies.
+	if err = c.Cmd.Topic("#channel", strings.Repeat("a", 600)); err == nil {
+		t.Fatal("Commands.Topic() with topic longer than the line length returned nil error")
+	}
+
+	if err = c.Cmd.Topic("#channel", "new topic"); err != nil {
+		t.Fatalf("Commands.Topic() returned error: %s", err)
+	}
+	expectLine(t, lines, "TOPIC #channel :new topic")
+
+	if err = c.Cmd.Away("gone"); err != nil {
+		t.Fatalf("Commands.Away() returned error: %s", err)
+	}
+	expectLine(t, lines, "AWAY gone")
+}
+
+func TestSetName(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.SetName("new name"); err == nil {
+		t.Fatal("Commands.SetName() without setname returned nil error")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap["setname"] = nil
+	c.state.createUser(&Source{Name: "test", Ident: "user", Host: "host.com"})
+	c.state.Unlock()
+
+	if err := c.Cmd.SetName("new name"); err != nil {
+		t.Fatalf("Commands.SetName() returned error: %s", err)
+	}
+	expectLine(t, lines, "SETNAME :new name")
+
+	conn.Write([]byte(":test!user@host.com SETNAME :new name\r\n"))
+
+	waitFor(t, "realname to be updated", func() bool {
+		user := c.LookupUser("test")
+		return user != nil && user.Extras.Name == "new name"
+	})
+}
+
+func TestSetMode(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.Cmd.SetMode("bad target", "+i"); err == nil {
+		t.Fatal("Commands.SetMode() with invalid target returned nil error")
+	}
+	if err := c.Cmd.SetMode("#channel", "ov", "nick"); err == nil {
+		t.Fatal("Commands.SetMode() with invalid modes returned nil error")
+	}
+
+	if err := c.Cmd.SetMode("#channel", "+ov", "nick1", "nick2"); err != nil {
+		t.Fatalf("Commands.SetMode() returned error: %s", err)
+	}
+	expectLine(t, lines, "MODE #channel +ov nick1 nick2")
+
+	if err := c.Cmd.SetMode("test", "-w"); err != nil {
+		t.Fatalf("Commands.SetMode() returned error: %s", err)
+	}
+	expectLine(t, lines, "MODE test -w")
+
+	// Our own user modes are tracked from RPL_UMODEIS, and MODE events
+	// targeting us.
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	conn.Write([]byte(":dummy.int 221 test +w\r\n"))
+	waitFor(t, "user modes from RPL_UMODEIS", func() bool { return c.UserModes() == "+w" })
+
+	conn.Write([]byte(":test MODE test :+iw\r\n"))
+	waitFor(t, "user modes from MODE", func() bool { return c.UserModes() == "+iw" })
+
+	conn.Write([]byte(":test MODE test :-w\r\n"))
+	waitFor(t, "user modes from MODE", func() bool { return c.UserModes() == "+i" })
+}
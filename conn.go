@@ -8,9 +8,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lrstanley/girc/internal/ctxgroup"
@@ -25,6 +29,11 @@ var endline = []byte("\r\n")
 // ircConn represents an IRC network protocol connection, it consists of an
 // Encoder and Decoder to manage i/o.
 type ircConn struct {
+	// bytesRead and bytesWritten are the number of bytes read from, and
+	// written to, the connection. These must be accessed atomically, and
+	// are kept first in the struct for 64-bit alignment on 32-bit platforms.
+	bytesRead, bytesWritten uint64
+
 	io   *bufio.ReadWriter
 	sock net.Conn
 
@@ -34,6 +43,10 @@ type ircConn struct {
 	// lastActive is the last time the client was interacting with the server,
 	// excluding a few background commands (PING, PONG, WHO, etc).
 	lastActive time.Time
+	// autoAway is true if we've been marked as away by autoAwayLoop, and
+	// should be marked as back before the next active event is sent.
+	// autoAwayPending is true while the AWAY from autoAwayLoop is queued.
+	autoAway, autoAwayPending bool
 	// writeDelay is used to keep track of rate limiting of events sent to
 	// the server.
 	writeDelay time.Duration
@@ -46,6 +59,9 @@ type ircConn struct {
 	// lastPong is the last successful time that we pinged the server and
 	// received a successful pong back.
 	lastPong time.Time
+	// quitting is true if we've sent a QUIT with Client.QuitWithTimeout(),
+	// and are waiting for the server to close the connection.
+	quitting bool
 }
 
 // Dialer is an interface implementation of net.Dialer. Use this if you would
@@ -67,12 +83,16 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 	var conn net.Conn
 	var err error
 
+	network := dialNetwork(conf.IPVersion)
+
 	if dialer == nil {
+		// When dialing "tcp", net.Dialer races IPv4 and IPv6 connections
+		// (RFC 6555) by default.
 		netDialer := &net.Dialer{Timeout: 5 * time.Second}
 
 		if conf.Bind != "" {
 			var local *net.TCPAddr
-			local, err = net.ResolveTCPAddr("tcp", conf.Bind+":0")
+			network, local, err = resolveBind(conf.IPVersion, conf.Bind)
 			if err != nil {
 				return nil, err
 			}
@@ -83,7 +103,7 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 		dialer = netDialer
 	}
 
-	if conn, err = dialer.Dial("tcp", addr); err != nil {
+	if conn, err = dialer.Dial(network, addr); err != nil {
 		if sts.enabled() {
 			err = &ErrSTSUpgradeFailed{Err: err}
 		}
@@ -97,7 +117,7 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 
 	if conf.SSL || sts.enabled() {
 		var tlsConn net.Conn
-		tlsConn, err = tlsHandshake(conn, conf.TLSConfig, conf.Server, true)
+		tlsConn, err = tlsHandshake(conn, tlsConfig(conf, true))
 		if err != nil {
 			if sts.enabled() {
 				err = &ErrSTSUpgradeFailed{Err: err}
@@ -125,6 +145,41 @@ func newConn(conf Config, dialer Dialer, addr string, sts *strictTransport) (*ir
 	return c, nil
 }
 
+// dialNetwork returns the network to dial for the given IP version.
+func dialNetwork(version IPVersion) string {
+	switch version {
+	case IPv4:
+		return "tcp4"
+	case IPv6:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// resolveBind resolves the local address to bind to, with an address family
+// matching the given IP version. With IPAuto, the returned network is
+// narrowed to the family of the resolved address, as the remote address
+// must be of the same family.
+func resolveBind(version IPVersion, bind string) (network string, local *net.TCPAddr, err error) {
+	network = dialNetwork(version)
+
+	local, err = net.ResolveTCPAddr(network, net.JoinHostPort(bind, "0"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if version == IPAuto {
+		if local.IP.To4() != nil {
+			network = "tcp4"
+		} else if local.IP != nil {
+			network = "tcp6"
+		}
+	}
+
+	return network, local, nil
+}
+
 func newMockConn(conn net.Conn) *ircConn {
 	ctime := time.Now()
 	c := &ircConn{
@@ -155,50 +210,235 @@ func (c *ircConn) decode() <-chan decodedEvent {
 	go func() {
 		defer close(ch)
 
-		line, err := c.io.ReadString(delim)
-		if err != nil {
-			ch <- decodedEvent{err: err}
-			return
-		}
-
-		event := ParseEvent(line)
-		if event == nil {
-			ch <- decodedEvent{err: ErrParseEvent{Line: line}}
+		if c.io == nil {
+			ch <- decodedEvent{err: io.ErrClosedPipe}
 			return
 		}
 
-		ch <- decodedEvent{event: event}
+		event, line, err := readEvent(c.io.Reader)
+		atomic.AddUint64(&c.bytesRead, uint64(len(line)))
+		ch <- decodedEvent{event: event, err: err}
 	}()
 
 	return ch
 }
 
 func (c *ircConn) encode(event *Event) error {
-	if _, err := c.io.Write(event.Bytes()); err != nil {
+	n, err := writeEvent(c.io.Writer, event)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	if err != nil {
 		return err
 	}
-	if _, err := c.io.Write(endline); err != nil {
+
+	return c.io.Flush()
+}
+
+// readEvent reads and parses a single event from r. line is the raw line
+// that was read, which may be partial if an error occurred while reading.
+func readEvent(r *bufio.Reader) (event *Event, line string, err error) {
+	line, err = r.ReadString(delim)
+	if err != nil {
+		return nil, line, err
+	}
+
+	event = ParseEvent(line)
+	if event == nil {
+		return nil, line, ErrParseEvent{Line: line}
+	}
+
+	return event, line, nil
+}
+
+// writeEvent writes event, followed by a CR-LF, to w. n is the number of
+// bytes written. The caller is responsible for flushing w.
+func writeEvent(w *bufio.Writer, event *Event) (n int, err error) {
+	n, err = w.Write(event.Bytes())
+	if err != nil {
+		return n, err
+	}
+
+	nn, err := w.Write(endline)
+	return n + nn, err
+}
+
+// Decoder reads and parses events from a stream of raw IRC lines, e.g. to
+// replay or analyze a raw IRC capture or log offline. See NewDecoder().
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a new Decoder which reads events from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads and returns the next event. Blank lines are skipped, and the
+// last line doesn't require a trailing newline. io.EOF is returned once
+// there are no more events, and ErrParseEvent if a line couldn't be parsed,
+// after which decoding can continue with the next line.
+func (d *Decoder) Decode() (*Event, error) {
+	for {
+		event, line, err := readEvent(d.r)
+
+		if strings.TrimSpace(line) == "" {
+			if _, ok := err.(ErrParseEvent); ok {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if err == io.EOF {
+			// The last line may not have a trailing newline.
+			if event = ParseEvent(line); event == nil {
+				return nil, ErrParseEvent{Line: line}
+			}
+
+			return event, nil
+		}
+
+		return event, err
+	}
+}
+
+// Encoder writes events to a stream as raw IRC lines. See NewEncoder().
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns a new Encoder which writes events to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes event to the stream, followed by a CR-LF.
+func (e *Encoder) Encode(event *Event) error {
+	if event == nil {
+		return ErrInvalidEvent{Reason: "nil event"}
+	}
+
+	if _, err := writeEvent(e.w, event); err != nil {
 		return err
 	}
 
-	return c.io.Flush()
+	return e.w.Flush()
 }
 
 func (c *ircConn) newReadWriter() {
 	c.io = bufio.NewReadWriter(bufio.NewReader(c.sock), bufio.NewWriter(c.sock))
 }
 
-func tlsHandshake(conn net.Conn, conf *tls.Config, server string, validate bool) (net.Conn, error) {
-	if conf == nil {
-		conf = &tls.Config{ServerName: server, InsecureSkipVerify: !validate}
-	}
-
+func tlsHandshake(conn net.Conn, conf *tls.Config) (net.Conn, error) {
 	tlsConn := tls.Client(conn, conf)
 	return net.Conn(tlsConn), nil
 }
 
+// tlsConfig returns the tls configuration to use when connecting, based on
+// Config.TLSConfig, Config.Server and Config.ALPN. The user-supplied
+// configuration is copied, rather than modified.
+func tlsConfig(conf Config, validate bool) *tls.Config {
+	var tconf *tls.Config
+	if conf.TLSConfig == nil {
+		tconf = &tls.Config{InsecureSkipVerify: !validate}
+	} else {
+		tconf = conf.TLSConfig.Clone()
+	}
+
+	if tconf.ServerName == "" {
+		tconf.ServerName = conf.Server
+	}
+
+	if len(conf.ALPN) > 0 {
+		tconf.NextProtos = append([]string(nil), conf.ALPN...)
+	}
+
+	return tconf
+}
+
+// startTLSTimeout is how long to wait for the server to respond to STARTTLS,
+// and to complete the TLS handshake.
+const startTLSTimeout = 30 * time.Second
+
+// ErrSTARTTLSFailed is returned when upgrading the connection with STARTTLS
+// failed, see Config.UseSTARTTLS.
+type ErrSTARTTLSFailed struct {
+	Err error
+}
+
+func (e ErrSTARTTLSFailed) Error() string {
+	return fmt.Sprintf("fail to upgrade connection with starttls: %v", e.Err)
+}
+
+// startTLS upgrades the plaintext connection to TLS, using the STARTTLS
+// extension. This must be called before the read and send loops have been
+// started, as it reads from the connection directly, and without c.mu held,
+// as it waits on the server.
+func (c *Client) startTLS(conn *ircConn) error {
+	if _, ok := conn.sock.(*tls.Conn); ok {
+		return nil
+	}
+
+	c.debug.Print("upgrading connection with starttls")
+
+	plain := conn.sock
+	_ = plain.SetDeadline(time.Now().Add(startTLSTimeout))
+	defer func() { _ = plain.SetDeadline(time.Time{}) }()
+
+	if err := conn.encode(&Event{Command: STARTTLS}); err != nil {
+		return &ErrSTARTTLSFailed{Err: err}
+	}
+
+	for {
+		line, err := conn.io.ReadString(delim)
+		if err != nil {
+			return &ErrSTARTTLSFailed{Err: err}
+		}
+
+		event := ParseEvent(line)
+		if event == nil {
+			continue
+		}
+
+		switch event.Command {
+		case RPL_STARTTLS:
+			sock, _ := tlsHandshake(plain, tlsConfig(c.Config, true))
+			if err = sock.(*tls.Conn).Handshake(); err != nil {
+				return &ErrSTARTTLSFailed{Err: err}
+			}
+
+			conn.mu.Lock()
+			conn.sock = sock
+			conn.newReadWriter()
+			conn.mu.Unlock()
+			return nil
+		case ERR_UNKNOWNCOMMAND:
+			// Only a rejection if it's STARTTLS that's unknown, e.g.
+			// "421 * STARTTLS :Unknown command".
+			if len(event.Params) < 2 || !strings.EqualFold(event.Params[1], STARTTLS) {
+				continue
+			}
+
+			fallthrough
+		case ERR_STARTTLS:
+			if c.Config.STARTTLSFallback {
+				c.debug.Printf("starttls rejected, continuing without tls: %s", event.Last())
+				return nil
+			}
+
+			return &ErrSTARTTLSFailed{Err: errors.New(event.Last())}
+		}
+
+		// Anything else (e.g. NOTICE AUTH) sent before the upgrade is
+		// ignored.
+	}
+}
+
 // Close closes the underlying socket.
 func (c *ircConn) Close() error {
+	if c.sock == nil {
+		return nil
+	}
+
 	return c.sock.Close()
 }
 
@@ -289,19 +529,28 @@ startConn:
 	// Reset the state.
 	c.state.reset(false)
 
+	c.state.Lock()
+	c.loadSTSPolicy()
 	addr := c.server()
+	c.state.Unlock()
 
 	if mock == nil {
 		// Validate info, and actually make the connection.
 		c.debug.Printf("connecting to %s... (sts: %v, config-ssl: %v)", addr, c.state.sts.enabled(), c.Config.SSL)
+		c.logger().Info("connecting", "server", addr, "sts", c.state.sts.enabled(), "ssl", c.Config.SSL)
 		conn, err := newConn(c.Config, dialer, addr, &c.state.sts)
 		if err != nil {
+			c.mu.Unlock()
+			c.logger().Error("connection failed", "server", addr, "error", err)
+
+			// Handlers are run without the lock held, as they may use the
+			// client (e.g. to check if it's connected).
 			if _, ok := err.(*ErrSTSUpgradeFailed); ok {
 				if !c.state.sts.enabled() {
+					c.logger().Warn("sts upgrade failed, falling back to previous connection settings", "server", addr, "error", err)
 					c.RunHandlers(&Event{Command: STS_ERR_FALLBACK})
 				}
 			}
-			c.mu.Unlock()
 			return err
 		}
 
@@ -309,10 +558,65 @@ startConn:
 	} else {
 		c.conn = newMockConn(mock)
 	}
-	c.mu.Unlock()
 
-	var ctx context.Context
-	ctx, c.stop = context.WithCancel(context.Background())
+	// We've previously been connected.
+	reconnect := c.ctx != nil
+
+	// The context is created before upgrading with STARTTLS and calling
+	// Config.OnConnect, so that Client.Close() can abort the connection
+	// attempt.
+	ctx, stop := context.WithCancel(context.Background())
+	c.ctx, c.stop = ctx, stop
+
+	if c.Config.UseSTARTTLS || c.Config.OnConnect != nil {
+		// Neither is done with the lock held, as STARTTLS waits on the
+		// server, and the hook may use the client. Nothing else reads from
+		// or writes to the connection until the loops below have been
+		// started, and until then, the client isn't reported as connected.
+		conn := c.conn
+		conn.mu.Lock()
+		conn.connected = false
+		conn.mu.Unlock()
+		c.mu.Unlock()
+
+		var err error
+		if c.Config.UseSTARTTLS {
+			if err = c.startTLS(conn); err != nil {
+				c.logger().Error("starttls failed", "server", addr, "error", err)
+			}
+		}
+
+		if err == nil && ctx.Err() == nil && c.Config.OnConnect != nil {
+			conn.mu.RLock()
+			sock := conn.sock
+			conn.mu.RUnlock()
+
+			err = c.Config.OnConnect(sock)
+		}
+
+		c.mu.Lock()
+		if err != nil || ctx.Err() != nil {
+			if err == nil {
+				c.debug.Print("client closed before registration, aborting connection")
+			}
+
+			stop()
+			_ = conn.Close()
+			c.conn = nil
+			c.mu.Unlock()
+			return err
+		}
+
+		conn.mu.Lock()
+		conn.connected = true
+		conn.mu.Unlock()
+	}
+
+	if reconnect {
+		c.metrics().OnReconnect()
+		c.logger().Info("reconnected", "server", addr)
+	}
+	c.mu.Unlock()
 
 	group := ctxgroup.New(ctx)
 
@@ -320,6 +624,7 @@ startConn:
 	group.Go(c.readLoop)
 	group.Go(c.sendLoop)
 	group.Go(c.pingLoop)
+	group.Go(c.autoAwayLoop)
 
 	// Passwords first.
 
@@ -347,18 +652,25 @@ startConn:
 		c.Config.Name = c.Config.User
 	}
 
-	c.write(&Event{Command: USER, Params: []string{c.Config.User, "*", "*", c.Config.Name}})
+	// Invalid user modes are rejected by Config.isValid() when dialing.
+	mask, _ := userModeMask(c.Config.UserModes)
+	c.write(&Event{Command: USER, Params: []string{c.Config.User, mask, "*", c.Config.Name}})
 
 	// Send a virtual event allowing hooks for successful socket connection.
+	c.logger().Info("connected", "server", addr)
 	c.RunHandlers(&Event{Command: INITIALIZED, Params: []string{addr}})
 
 	// Wait for the first error.
 	err := group.Wait()
 	if err != nil {
 		c.debug.Printf("received error, beginning cleanup: %v", err)
+		c.logger().Error("disconnected", "server", addr, "error", err)
 	} else {
-		if !c.state.sts.beginUpgrade {
+		if c.state.sts.beginUpgrade {
+			c.logger().Info("upgrading connection via sts", "server", addr)
+		} else {
 			c.debug.Print("received request to close, beginning clean up")
+			c.logger().Info("disconnected", "server", addr)
 		}
 
 		c.RunHandlers(&Event{Command: CLOSED, Params: []string{addr}})
@@ -375,6 +687,14 @@ startConn:
 	c.conn.mu.Unlock()
 	c.mu.RUnlock()
 
+	if c.Config.AutoRejoin && !c.Config.disableTracking {
+		c.state.saveRejoin()
+	}
+
+	c.state.Lock()
+	c.state.resetReady()
+	c.state.Unlock()
+
 	c.RunHandlers(&Event{Command: DISCONNECTED, Params: []string{addr}})
 
 	// This helps ensure that the end user isn't improperly using the client
@@ -391,7 +711,10 @@ startConn:
 		}
 
 		if c.state.sts.enabled() {
+			c.state.Lock()
 			c.state.sts.persistenceReceived = time.Now()
+			c.saveSTSPolicy()
+			c.state.Unlock()
 		}
 	}
 	c.mu.Unlock()
@@ -405,6 +728,17 @@ func (c *Client) readLoop(ctx context.Context) error {
 	c.debug.Print("starting readLoop")
 	defer c.debug.Print("closing readLoop")
 
+	// Keep a reference to the connection we were started with, so that it
+	// being torn down (and c.conn being cleared) while we're blocked on a
+	// read can't cause a nil dereference.
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil || conn.sock == nil {
+		return ErrNotConnected
+	}
+
 	var de decodedEvent
 
 	for {
@@ -412,22 +746,31 @@ func (c *Client) readLoop(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		default:
-			_ = c.conn.sock.SetReadDeadline(time.Now().Add(300 * time.Second))
+			_ = conn.sock.SetReadDeadline(time.Now().Add(300 * time.Second))
 
 			select {
 			case <-ctx.Done():
 				return nil
-			case de = <-c.conn.decode():
+			case de = <-conn.decode():
 			}
 
 			if de.err != nil {
+				// The server closing the connection is expected after a
+				// graceful quit.
+				if c.isQuitting() {
+					c.Close()
+					return nil
+				}
+
 				return de.err
 			}
 
+			c.metrics().OnEventReceived(de.event.Command)
+
 			// Check if it's an echo-message.
 			if !c.Config.disableTracking {
 				de.event.Echo = (de.event.Command == PRIVMSG || de.event.Command == NOTICE) &&
-					de.event.Source != nil && de.event.Source.ID() == c.GetID()
+					c.IsSelf(de.event.Source)
 			}
 
 			c.receive(de.event)
@@ -438,51 +781,223 @@ func (c *Client) readLoop(ctx context.Context) error {
 // Send sends an event to the server. Send will split events if the event is longer
 // than what the server supports, and is an event that supports splitting. Use
 // Client.RunHandlers() if you are simply looking to trigger handlers with an event.
+// See Client.SendE() if you need to know if the event was sent. nil events, and
+// events without a command, are dropped (and logged).
 func (c *Client) Send(event *Event) {
+	if err := c.SendE(event); err != nil {
+		c.debug.Printf("unable to send event: %s", err)
+		c.logger().Warn("unable to send event", "error", err)
+	}
+}
+
+// SendE is the same as Client.Send(), however it returns an error if the
+// event could not be queued to be sent, e.g. ErrNotConnected if the client
+// is disconnected, or ErrSendTimedOut if the event couldn't be queued in
+// time. If the event is split into multiple events, some of them may have
+// been sent before the error occurred.
+func (c *Client) SendE(event *Event) error {
+	events, err := c.prepareEvent(event)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		if err = c.sendRated(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendBulk sends multiple events to the server in order, ensuring that no
+// other events sent with Client.Send() (or any method which uses it) are
+// interleaved between them. The events are still split and rate limited,
+// the same as with Client.Send(), however the rate limit delay of all of the
+// events is waited for up front, after which they are queued together.
+// Returns the first error encountered, after which the remaining events are
+// not sent.
+func (c *Client) SendBulk(events ...*Event) error {
+	var bulk []*Event
+	for _, event := range events {
+		split, err := c.prepareEvent(event)
+		if err != nil {
+			return err
+		}
+
+		bulk = append(bulk, split...)
+	}
+
 	var delay time.Duration
+	for _, e := range bulk {
+		d, err := c.rateDelay(e)
+		if err != nil {
+			return err
+		}
+		delay += d
+	}
+
+	<-time.After(delay)
+
+	// Only the queueing itself needs to be exclusive, to ensure the events
+	// aren't interleaved with others.
+	var dropped []*Event
+	var err error
+
+	c.sendMu.Lock()
+	for _, e := range bulk {
+		var d []*Event
+		d, err = c.enqueue(e)
+		dropped = append(dropped, d...)
+
+		if err != nil {
+			break
+		}
+	}
+	c.sendMu.Unlock()
+
+	c.dropped(dropped)
+	return err
+}
+
+// prepareEvent applies any global formatting to the event, and splits it if
+// it's longer than what the server supports. If Config.StrictOutbound is
+// enabled, the event is also validated with Event.IsValid().
+func (c *Client) prepareEvent(event *Event) ([]*Event, error) {
+	if event == nil {
+		return nil, ErrInvalidEvent{Reason: "nil event"}
+	}
+
+	if event.Command == "" {
+		return nil, ErrInvalidEvent{Reason: "empty command"}
+	}
 
 	if c.Config.GlobalFormat && len(event.Params) > 0 && event.Params[len(event.Params)-1] != "" &&
 		(event.Command == PRIVMSG || event.Command == TOPIC || event.Command == NOTICE) {
 		event.Params[len(event.Params)-1] = Fmt(event.Params[len(event.Params)-1])
 	}
 
-	var events []*Event
-	events = event.split(c.MaxEventLength())
+	if c.Config.StrictOutbound {
+		if err := event.IsValid(); err != nil {
+			return nil, err
+		}
+	}
 
-	for _, e := range events {
-		if !c.Config.AllowFlood {
-			c.mu.RLock()
-
-			// Drop the event early as we're disconnected, this way we don't have to wait
-			// the (potentially long) rate limit delay before dropping.
-			if c.conn == nil {
-				c.debugLogEvent(e, true)
-				c.mu.RUnlock()
-				return
-			}
+	return event.split(c.MaxEventLength()), nil
+}
 
-			c.conn.mu.Lock()
-			delay = c.conn.rate(e.Len())
-			c.conn.mu.Unlock()
-			c.mu.RUnlock()
-		}
+// sendRated writes the event after waiting for the rate limit delay (unless
+// Config.AllowFlood is enabled).
+func (c *Client) sendRated(e *Event) error {
+	delay, err := c.rateDelay(e)
+	if err != nil {
+		return err
+	}
+
+	<-time.After(delay)
+	return c.write(e)
+}
+
+// rateDelay returns how long to wait before sending the event, using
+// Config.RateLimit if set, otherwise the default rate limiter. Returns 0 if
+// Config.AllowFlood is enabled.
+func (c *Client) rateDelay(e *Event) (time.Duration, error) {
+	if c.Config.AllowFlood {
+		return 0, nil
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
 
-		<-time.After(delay)
-		c.write(e)
+	// Drop the event early as we're disconnected, this way we don't have to wait
+	// the (potentially long) rate limit delay before dropping.
+	if conn == nil {
+		c.debugLogEvent(e, true)
+		return 0, ErrNotConnected
 	}
+
+	conn.mu.Lock()
+	if c.Config.RateLimit == nil {
+		delay := conn.rate(e.Len())
+		conn.mu.Unlock()
+		return delay, nil
+	}
+
+	state := RateState{LastWrite: conn.lastWrite, WriteDelay: conn.writeDelay - time.Since(conn.lastWrite)}
+	if state.WriteDelay < 0 {
+		state.WriteDelay = 0
+	}
+	conn.mu.Unlock()
+
+	// The hook is called without any locks held, so it's free to use the
+	// client.
+	delay := c.Config.RateLimit(e.Len(), state)
+
+	conn.mu.Lock()
+	conn.writeDelay = state.WriteDelay + delay
+	conn.mu.Unlock()
+
+	return delay, nil
 }
 
 // write is the lower level function to write an event. It does not have a
 // write-delay when sending events. write will timeout after 30s if the event
 // can't be sent.
-func (c *Client) write(event *Event) {
+func (c *Client) write(event *Event) error {
+	if event == nil {
+		c.debug.Print("dropping nil event")
+		return ErrInvalidEvent{Reason: "nil event"}
+	}
+
+	c.sendMu.RLock()
+	dropped, err := c.enqueue(event)
+	c.sendMu.RUnlock()
+
+	c.dropped(dropped)
+	return err
+}
+
+// enqueue adds the event to the send queue, handling a full queue as per
+// Config.SendQueuePolicy. Any events which were dropped are returned, and
+// should be passed to Client.dropped() once no locks are held. Client.sendMu
+// should be held by the caller.
+func (c *Client) enqueue(event *Event) (dropped []*Event, err error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	if c.conn == nil {
 		// Drop the event if disconnected.
 		c.debugLogEvent(event, true)
-		return
+		return nil, ErrNotConnected
+	}
+
+	select {
+	case c.tx <- event:
+		return nil, nil
+	default:
+	}
+
+	// The queue is full.
+	switch c.Config.SendQueuePolicy {
+	case SendQueueDropNewest:
+		return []*Event{event}, nil
+	case SendQueueError:
+		return []*Event{event}, ErrSendQueueFull
+	case SendQueueDropOldest:
+		for {
+			select {
+			case c.tx <- event:
+				return dropped, nil
+			default:
+			}
+
+			select {
+			case oldest := <-c.tx:
+				dropped = append(dropped, oldest)
+			default:
+			}
+		}
 	}
 
 	t := time.NewTimer(30 * time.Second)
@@ -490,11 +1005,36 @@ func (c *Client) write(event *Event) {
 
 	select {
 	case c.tx <- event:
+		return nil, nil
 	case <-t.C:
+		return []*Event{event}, ErrSendTimedOut
+	}
+}
+
+// dropped logs outbound events which were dropped, and passes them to
+// Config.OnDrop. This must be called without any locks held, as OnDrop may
+// use the client (e.g. to send the event again).
+func (c *Client) dropped(events []*Event) {
+	for _, event := range events {
 		c.debugLogEvent(event, true)
+
+		if c.Config.OnDrop != nil {
+			c.Config.OnDrop(event)
+		}
 	}
 }
 
+// RateState is the rate limiting state of the connection, passed to
+// Config.RateLimit.
+type RateState struct {
+	// LastWrite is the last time an event was written to the server.
+	LastWrite time.Time
+	// WriteDelay is the accumulated delay previously returned by
+	// Config.RateLimit for recently sent events (excluding the event about to
+	// be sent). This decreases as time passes without events being sent.
+	WriteDelay time.Duration
+}
+
 // rate allows limiting events based on how frequent the event is being sent,
 // as well as how many characters each event has.
 func (c *ircConn) rate(chars int) time.Duration {
@@ -511,6 +1051,22 @@ func (c *ircConn) rate(chars int) time.Duration {
 	return 0
 }
 
+// isQuitting returns true if a graceful quit is in progress. See
+// Client.QuitWithTimeout() for more information.
+func (c *Client) isQuitting() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.conn == nil {
+		return false
+	}
+
+	c.conn.mu.RLock()
+	defer c.conn.mu.RUnlock()
+
+	return c.conn.quitting
+}
+
 func (c *Client) sendLoop(ctx context.Context) error {
 	c.debug.Print("starting sendLoop")
 	defer c.debug.Print("closing sendLoop")
@@ -521,20 +1077,22 @@ func (c *Client) sendLoop(ctx context.Context) error {
 		select {
 		case event := <-c.tx:
 			// Check if tags exist on the event. If they do, and message-tags
-			// isn't a supported capability, remove them from the event.
+			// isn't a supported capability, remove them from the event. The
+			// label tag is kept if labeled-response is supported, as it
+			// doesn't require message-tags.
 			if event.Tags != nil {
 				c.state.RLock()
-				var in bool
-				for i := 0; i < len(c.state.enabledCap); i++ {
-					if _, ok := c.state.enabledCap["message-tags"]; ok {
-						in = true
-						break
-					}
-				}
+				_, ok := c.state.enabledCap["message-tags"]
+				_, labeled := c.state.enabledCap["labeled-response"]
 				c.state.RUnlock()
 
-				if !in {
-					event.Tags = Tags{}
+				if !ok {
+					label, hasLabel := event.Tags.Get("label")
+					event.Tags = nil
+
+					if labeled && hasLabel {
+						event.Tags = Tags{"label": label}
+					}
 				}
 			}
 
@@ -543,23 +1101,43 @@ func (c *Client) sendLoop(ctx context.Context) error {
 			c.conn.mu.Lock()
 			c.conn.lastWrite = time.Now()
 
-			if event.Command != PING && event.Command != PONG && event.Command != WHO {
+			// AWAY is excluded from activity, so that it doesn't reset
+			// the idle time used by Config.AutoAwayAfter.
+			if event.Command == AWAY {
+				c.conn.autoAway = c.conn.autoAwayPending && len(event.Params) > 0
+				c.conn.autoAwayPending = false
+			}
+
+			var back bool
+			if event.Command != PING && event.Command != PONG && event.Command != WHO && event.Command != AWAY {
 				c.conn.lastActive = c.conn.lastWrite
+				back = c.conn.autoAway
+				c.conn.autoAway = false
 			}
 			c.conn.mu.Unlock()
 
-			// Write the raw line.
-			_, err = c.conn.io.Write(event.Bytes())
-			if err == nil {
-				// And the \r\n.
-				_, err = c.conn.io.Write(endline)
-				if err == nil {
-					// Lastly, flush everything to the socket.
-					err = c.conn.io.Flush()
+			// We were marked as away by autoAwayLoop, so mark ourselves as
+			// back before sending anything else.
+			if back {
+				backEvent := &Event{Command: AWAY}
+				c.debugLogEvent(backEvent, false)
+
+				if err = c.conn.encode(backEvent); err != nil {
+					return err
 				}
+				c.metrics().OnEventSent(AWAY)
+			}
+
+			// Write the raw line, and flush it to the socket.
+			err = c.conn.encode(event)
+
+			if err == nil {
+				c.metrics().OnEventSent(event.Command)
 			}
 
-			if event.Command == QUIT {
+			// Wait for the server to close the connection if the quit is
+			// graceful, otherwise close it ourselves.
+			if event.Command == QUIT && !c.isQuitting() {
 				c.Close()
 				return nil
 			}
@@ -573,6 +1151,75 @@ func (c *Client) sendLoop(ctx context.Context) error {
 	}
 }
 
+// defaultAutoAwayMessage is the default for Config.AutoAwayMessage.
+const defaultAutoAwayMessage = "idle"
+
+// autoAwayLoop marks us as away once nothing has been sent to the server for
+// Config.AutoAwayAfter. sendLoop marks us as back before the next active
+// event is sent.
+func (c *Client) autoAwayLoop(ctx context.Context) error {
+	if c.Config.AutoAwayAfter <= 0 {
+		return nil
+	}
+
+	c.debug.Print("starting autoAwayLoop")
+	defer c.debug.Print("closing autoAwayLoop")
+
+	message := c.Config.AutoAwayMessage
+	if message == "" {
+		message = defaultAutoAwayMessage
+	}
+
+	started := time.Now()
+	timer := time.NewTimer(c.Config.AutoAwayAfter)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			c.conn.mu.RLock()
+			last := c.conn.lastActive
+			away := c.conn.autoAway || c.conn.autoAwayPending
+			c.conn.mu.RUnlock()
+
+			if last.Before(started) {
+				last = started
+			}
+
+			if idle := time.Since(last); idle < c.Config.AutoAwayAfter {
+				timer.Reset(c.Config.AutoAwayAfter - idle)
+				continue
+			}
+			timer.Reset(c.Config.AutoAwayAfter)
+
+			// Only mark ourselves as away once registered, and if we
+			// haven't already been marked as away by the user.
+			c.state.RLock()
+			registered := c.state.nick != ""
+			away = away || c.state.away
+			c.state.RUnlock()
+
+			if !registered || away {
+				continue
+			}
+
+			c.conn.mu.Lock()
+			c.conn.autoAwayPending = true
+			c.conn.mu.Unlock()
+
+			if err := c.Cmd.Away(message); err != nil {
+				c.debug.Printf("unable to mark as away: %v", err)
+
+				c.conn.mu.Lock()
+				c.conn.autoAwayPending = false
+				c.conn.mu.Unlock()
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
 // ErrTimedOut is returned when we attempt to ping the server, and timed out
 // before receiving a PONG back.
 type ErrTimedOut struct {
@@ -613,9 +1260,14 @@ func (c *Client) pingLoop(ctx context.Context) error {
 		select {
 		case <-tick.C:
 			// Delay during connect to wait for the client to register, otherwise
-			// some ircd's will not respond (e.g. during SASL negotiation).
+			// some ircd's will not respond (e.g. during SASL negotiation). Our
+			// nickname is only tracked once registration has completed.
 			if !past {
-				if time.Since(started) < 30*time.Second {
+				c.state.RLock()
+				registered := c.state.nick != ""
+				c.state.RUnlock()
+
+				if !registered && time.Since(started) < 30*time.Second {
 					continue
 				}
 
@@ -633,6 +1285,7 @@ func (c *Client) pingLoop(ctx context.Context) error {
 				}
 
 				c.conn.mu.RUnlock()
+				c.logger().Warn("ping timeout", "since_last_pong", err.TimeSinceSuccess, "delay", err.Delay)
 				return err
 			}
 			c.conn.mu.RUnlock()
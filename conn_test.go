@@ -7,7 +7,19 @@ package girc
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -111,3 +123,1010 @@ func mockReadBuffer(conn net.Conn) {
 		}
 	}
 }
+
+// mockReadLines accepts all outgoing writes from the client, and sends each
+// line (without the line ending) on the returned channel.
+func mockReadLines(conn net.Conn) <-chan string {
+	lines := make(chan string, 100)
+
+	go func() {
+		defer close(lines)
+
+		b := bufio.NewReader(conn)
+		for {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			line, err := b.ReadString(byte('\n'))
+			if err != nil {
+				return
+			}
+
+			lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+
+	return lines
+}
+
+// expectLine waits for the client to write the wanted line, skipping any
+// other lines written before it.
+func expectLine(t *testing.T, lines <-chan string, want string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %q", want)
+			}
+
+			if line == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+// mockConnect connects the client to the server end of a mock connection in
+// the background, and waits for the client to be initialized. The returned
+// channel receives the result of Client.MockConnect().
+func mockConnect(t *testing.T, c *Client, server net.Conn) <-chan error {
+	t.Helper()
+
+	errchan := make(chan error, 1)
+	done := make(chan struct{})
+
+	cuid := c.Handlers.Add(INITIALIZED, func(c *Client, e Event) { close(done) })
+	defer c.Handlers.Remove(cuid)
+
+	go func() { errchan <- c.MockConnect(server) }()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out during connect")
+	}
+
+	return errchan
+}
+
+// waitFor polls fn until it returns true, failing the test if it doesn't
+// within 5 seconds. Useful for waiting on state to be updated by handlers.
+func waitFor(t *testing.T, desc string, fn func() bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for !fn() {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", desc)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestAutoAway(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AutoAwayAfter = 100 * time.Millisecond
+	c.Config.AutoAwayMessage = "brb"
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	expectLine(t, lines, "AWAY brb")
+	conn.Write([]byte(":dummy.int 306 test :You have been marked as being away\r\n"))
+	waitFor(t, "auto-away", c.IsAway)
+
+	if got := c.AwayMessage(); got != "brb" {
+		t.Fatalf("Client.AwayMessage() = %q, want %q", got, "brb")
+	}
+
+	// The next message should mark us as back first.
+	c.Cmd.Message("#channel", "hello")
+	expectLine(t, lines, "AWAY")
+	expectLine(t, lines, "PRIVMSG #channel hello")
+	conn.Write([]byte(":dummy.int 305 test :You are no longer marked as being away\r\n"))
+	waitFor(t, "back from auto-away", func() bool { return !c.IsAway() })
+
+	// Idle again, so should be marked as away again.
+	expectLine(t, lines, "AWAY brb")
+}
+
+func TestPingTimeout(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	// Bypass the clamping done in New(), so the test doesn't take minutes.
+	c.Config.PingDelay = 100 * time.Millisecond
+	c.Config.PingTimeout = 100 * time.Millisecond
+
+	errchan := make(chan error, 1)
+	go func() { errchan <- c.MockConnect(server) }()
+	defer c.Close()
+
+	// Register, but never respond to any PING requests.
+	conn.Write([]byte(":dummy.int 001 test :Welcome to the network\r\n"))
+
+	select {
+	case err := <-errchan:
+		if _, ok := err.(ErrTimedOut); !ok {
+			t.Fatalf("Client.MockConnect() = %v, want ErrTimedOut", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ping timeout")
+	}
+}
+
+func TestSendBulk(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Cmd.Message("#other", "noise")
+			}
+		}
+	}()
+
+	err := c.SendBulk(
+		&Event{Command: PRIVMSG, Params: []string{"#channel", "line 1"}},
+		&Event{Command: PRIVMSG, Params: []string{"#channel", "line 2"}},
+		&Event{Command: PRIVMSG, Params: []string{"#channel", "line 3"}},
+	)
+	if err != nil {
+		t.Fatalf("Client.SendBulk() returned error: %s", err)
+	}
+
+	expectLine(t, lines, "PRIVMSG #channel :line 1")
+
+	for _, want := range []string{"PRIVMSG #channel :line 2", "PRIVMSG #channel :line 3"} {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Fatalf("Client.SendBulk() interleaved with other events, got %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestSendBulkRateLimited(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	slow := &Event{Command: PRIVMSG, Params: []string{"#channel", "a slow, rate limited message"}}
+	c.Config.RateLimit = func(chars int, state RateState) time.Duration {
+		if chars == slow.Len() {
+			return 500 * time.Millisecond
+		}
+		return 0
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	result := make(chan error, 1)
+	go func() { result <- c.SendBulk(slow, slow) }()
+
+	// Other events shouldn't have to wait for the bulk events to be rate
+	// limited.
+	time.Sleep(50 * time.Millisecond)
+	c.Cmd.Message("#other", "fast")
+	expectLine(t, lines, "PRIVMSG #other fast")
+
+	select {
+	case err := <-result:
+		t.Fatalf("Client.SendBulk() returned before being rate limited: %v", err)
+	default:
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("Client.SendBulk() returned error: %s", err)
+	}
+	expectLine(t, lines, "PRIVMSG #channel :a slow, rate limited message")
+	expectLine(t, lines, "PRIVMSG #channel :a slow, rate limited message")
+}
+
+func TestRateLimitHook(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	type call struct {
+		chars int
+		state RateState
+	}
+
+	calls := make(chan call, 10)
+	c.Config.RateLimit = func(chars int, state RateState) time.Duration {
+		// Using the client from the hook shouldn't deadlock.
+		if !c.IsConnected() {
+			t.Error("Client.IsConnected() == false from Config.RateLimit")
+		}
+
+		calls <- call{chars: chars, state: state}
+
+		if len(calls) == 1 {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	event := &Event{Command: PRIVMSG, Params: []string{"#channel", "test message"}}
+	c.Send(event)
+	expectLine(t, lines, "PRIVMSG #channel :test message")
+	c.Send(event)
+	expectLine(t, lines, "PRIVMSG #channel :test message")
+
+	first, second := <-calls, <-calls
+
+	if first.chars != event.Len() {
+		t.Fatalf("Config.RateLimit called with %d chars, want %d", first.chars, event.Len())
+	}
+
+	// The default rate limiter shouldn't be used alongside the hook.
+	if first.state.WriteDelay != 0 {
+		t.Fatalf("RateState.WriteDelay == %s for the first event, want 0", first.state.WriteDelay)
+	}
+
+	if second.state.WriteDelay <= 0 || second.state.WriteDelay > 200*time.Millisecond {
+		t.Fatalf("RateState.WriteDelay == %s for the second event, want the delay of the first event", second.state.WriteDelay)
+	}
+}
+
+func TestStrictOutbound(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.StrictOutbound = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	err := c.SendBulk(&Event{Command: PRIVMSG, Params: []string{"#channel", "test\r\nQUIT :injected"}})
+	if _, ok := err.(ErrInvalidEvent); !ok {
+		t.Fatalf("Client.SendBulk() with invalid event = %v, want ErrInvalidEvent", err)
+	}
+
+	c.Send(&Event{Command: PRIVMSG, Params: []string{"#bad channel", "dropped"}})
+	c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "valid message"}})
+
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "injected") || strings.Contains(line, "dropped") {
+				t.Fatalf("Client.Send() sent invalid event: %q", line)
+			}
+
+			if line == "PRIVMSG #channel :valid message" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for valid event")
+		}
+	}
+}
+
+func TestSendE(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	if err := c.SendE(&Event{Command: PRIVMSG, Params: []string{"#channel", "test"}}); err != ErrNotConnected {
+		t.Fatalf("Client.SendE() while disconnected = %v, want ErrNotConnected", err)
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.SendE(&Event{Command: PRIVMSG, Params: []string{"#channel", "test message"}}); err != nil {
+		t.Fatalf("Client.SendE() returned error: %s", err)
+	}
+	expectLine(t, lines, "PRIVMSG #channel :test message")
+}
+
+func TestSendInvalidEvent(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.GlobalFormat = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if err := c.SendE(nil); err == nil {
+		t.Fatal("Client.SendE(nil) returned nil error")
+	}
+
+	if err := c.SendE(&Event{Params: []string{"#channel", "test"}}); err == nil {
+		t.Fatal("Client.SendE() with empty command returned nil error")
+	}
+
+	if err := c.write(nil); err == nil {
+		t.Fatal("Client.write(nil) returned nil error")
+	}
+
+	c.Send(nil)
+	c.Send(&Event{Command: PRIVMSG})
+	c.Send(&Event{Command: PRIVMSG, Params: []string{}})
+	c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", ""}})
+	c.Send(&Event{Command: QUIT})
+
+	expectLine(t, lines, "PRIVMSG")
+	expectLine(t, lines, "PRIVMSG #channel :")
+	expectLine(t, lines, "QUIT")
+
+	// Dropped events should be logged.
+	logger := &recordingLogger{}
+	c.Config.StructuredLogger = logger
+	c.Send(&Event{Params: []string{"#channel", "test"}})
+
+	if !logger.has("WARN unable to send event [error invalid event: empty command]") {
+		t.Fatalf("missing dropped event log entry, got: %q", logger.entries)
+	}
+}
+
+func TestSendQueuePolicy(t *testing.T) {
+	// newStalled returns a client which appears connected, but has no
+	// sendLoop draining the send queue.
+	newStalled := func(policy SendQueuePolicy, dropped *[]string) *Client {
+		c := New(Config{
+			Server:          "irc.example.com",
+			Nick:            "test",
+			User:            "user",
+			SendQueueSize:   2,
+			SendQueuePolicy: policy,
+			OnDrop:          func(e *Event) { *dropped = append(*dropped, e.Last()) },
+		})
+		c.conn = &ircConn{}
+
+		for _, msg := range []string{"first", "second"} {
+			if err := c.write(&Event{Command: PRIVMSG, Params: []string{"#channel", msg}}); err != nil {
+				t.Fatalf("Client.write() with space in the queue returned error: %s", err)
+			}
+		}
+
+		return c
+	}
+
+	queued := func(c *Client) (out []string) {
+		for len(c.tx) > 0 {
+			out = append(out, (<-c.tx).Last())
+		}
+		return out
+	}
+
+	third := &Event{Command: PRIVMSG, Params: []string{"#channel", "third"}}
+
+	tests := []struct {
+		policy  SendQueuePolicy
+		err     error
+		dropped []string
+		queued  []string
+	}{
+		{policy: SendQueueDropNewest, dropped: []string{"third"}, queued: []string{"first", "second"}},
+		{policy: SendQueueDropOldest, dropped: []string{"first"}, queued: []string{"second", "third"}},
+		{policy: SendQueueError, err: ErrSendQueueFull, dropped: []string{"third"}, queued: []string{"first", "second"}},
+	}
+
+	for _, tt := range tests {
+		var dropped []string
+		c := newStalled(tt.policy, &dropped)
+
+		if err := c.write(third); err != tt.err {
+			t.Fatalf("policy %d: Client.write() with a full queue = %v, want %v", tt.policy, err, tt.err)
+		}
+
+		if !reflect.DeepEqual(dropped, tt.dropped) {
+			t.Fatalf("policy %d: dropped %v, want %v", tt.policy, dropped, tt.dropped)
+		}
+
+		if got := queued(c); !reflect.DeepEqual(got, tt.queued) {
+			t.Fatalf("policy %d: queued %v, want %v", tt.policy, got, tt.queued)
+		}
+	}
+
+	// SendQueueBlock should wait for space in the queue.
+	var dropped []string
+	c := newStalled(SendQueueBlock, &dropped)
+
+	result := make(chan error, 1)
+	go func() { result <- c.write(third) }()
+
+	select {
+	case err := <-result:
+		t.Fatalf("Client.write() with a full queue returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-c.tx
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Client.write() returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.write() didn't unblock once the queue had space")
+	}
+
+	if got := queued(c); !reflect.DeepEqual(got, []string{"second", "third"}) || len(dropped) != 0 {
+		t.Fatalf("queued %v and dropped %v, want second and third queued", got, dropped)
+	}
+}
+
+func TestSendQueuePolicyStalled(t *testing.T) {
+	tests := []struct {
+		policy  SendQueuePolicy
+		err     error
+		dropped []string
+		queued  []string
+	}{
+		// OnDrop sends the first dropped event again, which itself may cause
+		// another event to be dropped.
+		{policy: SendQueueDropNewest, dropped: []string{"third", "third"}, queued: []string{"first", "second"}},
+		{policy: SendQueueDropOldest, dropped: []string{"first", "second"}, queued: []string{"third", "first"}},
+		{policy: SendQueueError, err: ErrSendQueueFull, dropped: []string{"third", "third"}, queued: []string{"first", "second"}},
+		{policy: SendQueueBlock, queued: []string{"second", "third"}},
+	}
+
+	for _, tt := range tests {
+		c, conn, server := genMockConn()
+		c.Config.AllowFlood = true
+		c.tx = make(chan *Event, 2)
+
+		var mu sync.Mutex
+		var dropped []string
+		c.Config.OnDrop = func(e *Event) {
+			mu.Lock()
+			dropped = append(dropped, e.Last())
+			retry := len(dropped) == 1
+			mu.Unlock()
+
+			// Sending from OnDrop shouldn't deadlock.
+			if retry {
+				c.Send(e)
+			}
+		}
+
+		mockConnect(t, c, server)
+
+		// Read the registration, then stop reading, which stalls the
+		// sendLoop on the next event it writes.
+		b := bufio.NewReader(conn)
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := b.ReadString(byte('\n'))
+			if err != nil {
+				t.Fatalf("policy %d: failed reading registration: %s", tt.policy, err)
+			}
+
+			if strings.HasPrefix(line, "USER ") {
+				break
+			}
+		}
+
+		// Registration is done, so the policy won't affect it.
+		c.Config.SendQueuePolicy = tt.policy
+
+		c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "stalled"}})
+		waitFor(t, "sendLoop to stall", func() bool { return len(c.tx) == 0 })
+
+		c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "first"}})
+		c.Send(&Event{Command: PRIVMSG, Params: []string{"#channel", "second"}})
+
+		result := make(chan error, 1)
+		go func() { result <- c.SendE(&Event{Command: PRIVMSG, Params: []string{"#channel", "third"}}) }()
+
+		if tt.policy == SendQueueBlock {
+			select {
+			case err := <-result:
+				t.Fatalf("policy %d: Client.SendE() with a full queue returned early: %v", tt.policy, err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			<-c.tx
+		}
+
+		select {
+		case err := <-result:
+			if err != tt.err {
+				t.Fatalf("policy %d: Client.SendE() with a full queue = %v, want %v", tt.policy, err, tt.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("policy %d: Client.SendE() with a full queue deadlocked", tt.policy)
+		}
+
+		var queued []string
+		for len(c.tx) > 0 {
+			queued = append(queued, (<-c.tx).Last())
+		}
+
+		mu.Lock()
+		if !reflect.DeepEqual(dropped, tt.dropped) {
+			t.Fatalf("policy %d: dropped %v, want %v", tt.policy, dropped, tt.dropped)
+		}
+		mu.Unlock()
+
+		if !reflect.DeepEqual(queued, tt.queued) {
+			t.Fatalf("policy %d: queued %v, want %v", tt.policy, queued, tt.queued)
+		}
+
+		c.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+type recordDialer struct {
+	network string
+	address string
+}
+
+func (d *recordDialer) Dial(network, address string) (net.Conn, error) {
+	d.network = network
+	d.address = address
+	return nil, errors.New("dial disabled")
+}
+
+func TestNewConnIPVersion(t *testing.T) {
+	tests := []struct {
+		version IPVersion
+		want    string
+	}{
+		{IPAuto, "tcp"},
+		{IPv4, "tcp4"},
+		{IPv6, "tcp6"},
+	}
+
+	for _, tt := range tests {
+		conf := Config{Server: "irc.example.com", Port: 6667, Nick: "test", User: "test", IPVersion: tt.version}
+		dialer := &recordDialer{}
+
+		if _, err := newConn(conf, dialer, "irc.example.com:6667", &strictTransport{}); err == nil {
+			t.Fatalf("newConn(%d): expected dial error", tt.version)
+		}
+
+		if dialer.network != tt.want {
+			t.Errorf("newConn(%d) dialed network %q, want %q", tt.version, dialer.network, tt.want)
+		}
+	}
+
+	conf := Config{Server: "irc.example.com", Port: 6667, Nick: "test", User: "test", IPVersion: 3}
+	dialer := &recordDialer{}
+
+	_, err := newConn(conf, dialer, "irc.example.com:6667", &strictTransport{})
+	if _, ok := err.(*ErrInvalidConfig); !ok || !strings.Contains(err.Error(), "invalid ip version") {
+		t.Fatalf("newConn with invalid IPVersion = %v, want ErrInvalidConfig for the ip version", err)
+	}
+
+	if dialer.network != "" {
+		t.Fatalf("newConn with invalid IPVersion dialed network %q, want no dial", dialer.network)
+	}
+}
+
+func TestResolveBind(t *testing.T) {
+	tests := []struct {
+		version IPVersion
+		bind    string
+		want    string
+		wantErr bool
+	}{
+		{IPAuto, "127.0.0.1", "tcp4", false},
+		{IPAuto, "::1", "tcp6", false},
+		{IPv4, "127.0.0.1", "tcp4", false},
+		{IPv6, "::1", "tcp6", false},
+		{IPv4, "::1", "", true},
+		{IPv6, "127.0.0.1", "", true},
+	}
+
+	for _, tt := range tests {
+		network, local, err := resolveBind(tt.version, tt.bind)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveBind(%d, %q): expected error, got %q (%v)", tt.version, tt.bind, network, local)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("resolveBind(%d, %q): unexpected error: %v", tt.version, tt.bind, err)
+			continue
+		}
+
+		if network != tt.want {
+			t.Errorf("resolveBind(%d, %q) network = %q, want %q", tt.version, tt.bind, network, tt.want)
+		}
+
+		if !local.IP.Equal(net.ParseIP(tt.bind)) || local.Port != 0 {
+			t.Errorf("resolveBind(%d, %q) local = %v", tt.version, tt.bind, local)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	conf := Config{Server: "irc.example.com"}
+
+	tconf := tlsConfig(conf, true)
+	if tconf.ServerName != "irc.example.com" || tconf.InsecureSkipVerify {
+		t.Fatalf("tlsConfig(nil) = {ServerName: %q, InsecureSkipVerify: %t}", tconf.ServerName, tconf.InsecureSkipVerify)
+	}
+
+	conf.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	conf.ALPN = []string{"irc"}
+
+	tconf = tlsConfig(conf, true)
+	if tconf.ServerName != "irc.example.com" || tconf.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("tlsConfig(partial) = {ServerName: %q, MinVersion: %d}", tconf.ServerName, tconf.MinVersion)
+	}
+	if !reflect.DeepEqual(tconf.NextProtos, []string{"irc"}) {
+		t.Fatalf("tlsConfig(partial) NextProtos = %q, want [irc]", tconf.NextProtos)
+	}
+	if conf.TLSConfig.ServerName != "" || conf.TLSConfig.NextProtos != nil {
+		t.Fatal("tlsConfig() modified the user-supplied TLSConfig")
+	}
+
+	conf.TLSConfig.ServerName = "other.example.com"
+	if tconf = tlsConfig(conf, true); tconf.ServerName != "other.example.com" {
+		t.Fatalf("tlsConfig() ServerName = %q, want user-supplied other.example.com", tconf.ServerName)
+	}
+}
+
+// genTestCert generates a self-signed certificate for testing TLS.
+func genTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dummy.int"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSTARTTLS(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.UseSTARTTLS = true
+	c.Config.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+	// OnConnect should be called once the connection has been upgraded.
+	upgraded := make(chan bool, 1)
+	c.Config.OnConnect = func(sock net.Conn) error {
+		_, ok := sock.(*tls.Conn)
+		upgraded <- ok
+		return nil
+	}
+
+	cert := genTestCert(t)
+	tlsServer := make(chan net.Conn, 1)
+
+	go func() {
+		b := bufio.NewReader(conn)
+		if line, err := b.ReadString('\n'); err != nil || line != "STARTTLS\r\n" {
+			t.Errorf("expected STARTTLS, got %q (%v)", line, err)
+			return
+		}
+
+		// The client shouldn't be locked while waiting on the server.
+		if c.IsConnected() {
+			t.Error("Client.IsConnected() == true during STARTTLS")
+		}
+
+		// Unrelated errors shouldn't be treated as STARTTLS being rejected.
+		conn.Write([]byte(":dummy.int NOTICE * :*** Looking up your hostname...\r\n"))
+		conn.Write([]byte(":dummy.int 421 * FOO :Unknown command\r\n"))
+		conn.Write([]byte(":dummy.int 670 * :STARTTLS successful, go ahead with TLS handshake\r\n"))
+
+		sconn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := sconn.Handshake(); err != nil {
+			t.Errorf("server handshake failed: %v", err)
+			return
+		}
+		tlsServer <- sconn
+	}()
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	var sconn net.Conn
+	select {
+	case sconn = <-tlsServer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for TLS handshake")
+	}
+
+	expectLine(t, mockReadLines(sconn), "NICK test")
+
+	if _, err := c.TLSConnectionState(); err != nil {
+		t.Fatalf("Client.TLSConnectionState() after STARTTLS = %v", err)
+	}
+
+	if ok := <-upgraded; !ok {
+		t.Fatal("Config.OnConnect called before STARTTLS")
+	}
+}
+
+func TestSTARTTLSRejected(t *testing.T) {
+	for _, tt := range []struct {
+		fallback bool
+		reply    string
+	}{
+		{false, ":dummy.int 691 * :STARTTLS failed"},
+		{false, ":dummy.int 421 * STARTTLS :Unknown command"},
+		{true, ":dummy.int 691 * :STARTTLS failed"},
+		{true, ":dummy.int 421 * STARTTLS :Unknown command"},
+	} {
+		fallback := tt.fallback
+		c, conn, server := genMockConn()
+		c.Config.UseSTARTTLS = true
+		c.Config.STARTTLSFallback = fallback
+
+		b := bufio.NewReader(conn)
+		errchan := make(chan error, 1)
+		go func() { errchan <- c.MockConnect(server) }()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if line, err := b.ReadString('\n'); err != nil || line != "STARTTLS\r\n" {
+			t.Fatalf("expected STARTTLS, got %q (%v)", line, err)
+		}
+		conn.Write([]byte(tt.reply + "\r\n"))
+
+		if !fallback {
+			select {
+			case err := <-errchan:
+				if _, ok := err.(*ErrSTARTTLSFailed); !ok {
+					t.Fatalf("MockConnect() = %v, want ErrSTARTTLSFailed", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for MockConnect() to fail")
+			}
+			conn.Close()
+			continue
+		}
+
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				t.Fatalf("expected NICK after fallback: %v", err)
+			}
+			if line == "NICK test\r\n" {
+				break
+			}
+		}
+
+		c.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	c.Config.OnConnect = func(sock net.Conn) error {
+		// Using the client from the hook shouldn't deadlock, and it shouldn't
+		// be reported as connected until registration has started.
+		if c.IsConnected() || c.Server() == "" {
+			t.Error("Client.IsConnected() == true from Config.OnConnect")
+		}
+
+		_, err := sock.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 54321 6667\r\n"))
+		return err
+	}
+
+	lines := mockReadLines(conn)
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	select {
+	case line := <-lines:
+		if line != "PROXY TCP4 192.0.2.1 192.0.2.2 54321 6667" {
+			t.Fatalf("first line written = %q, want PROXY header", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for PROXY header")
+	}
+	expectLine(t, lines, "NICK test")
+
+	c, conn, server = genMockConn()
+	defer conn.Close()
+	defer server.Close()
+
+	wantErr := errors.New("handshake failed")
+	c.Config.OnConnect = func(sock net.Conn) error { return wantErr }
+
+	if err := c.MockConnect(server); err != wantErr {
+		t.Fatalf("MockConnect() = %v, want %v", err, wantErr)
+	}
+	if c.IsConnected() {
+		t.Fatal("Client.IsConnected() = true after OnConnect error")
+	}
+
+	// Closing the client from the hook should abort the connection, without
+	// registering.
+	c, conn, server = genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines = mockReadLines(conn)
+
+	c.Config.OnConnect = func(sock net.Conn) error {
+		c.Close()
+		return nil
+	}
+
+	if err := c.MockConnect(server); err != nil {
+		t.Fatalf("MockConnect() after Client.Close() from OnConnect = %v, want nil", err)
+	}
+	if c.IsConnected() {
+		t.Fatal("Client.IsConnected() = true after Client.Close() from OnConnect")
+	}
+
+	// The connection is closed without anything being written.
+	for line := range lines {
+		t.Fatalf("wrote %q after Client.Close() from OnConnect", line)
+	}
+}
+
+func TestReadLoopTeardown(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	if err := c.readLoop(context.Background()); err != ErrNotConnected {
+		t.Fatalf("Client.readLoop() without a connection = %v, want ErrNotConnected", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		c, conn, server := genMockConn()
+		mockReadLines(conn)
+
+		done := mockConnect(t, c, server)
+
+		go func() {
+			for j := 0; j < 5; j++ {
+				if _, err := conn.Write([]byte("PING :test\r\n")); err != nil {
+					return
+				}
+			}
+		}()
+
+		// Tear the connection down while reads are in flight.
+		go conn.Close()
+		c.Close()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for client to disconnect")
+		}
+
+		server.Close()
+	}
+}
+
+func TestDecoderEncoder(t *testing.T) {
+	input := "@time=2011-10-19T16:40:51.620Z :nick!user@host.com PRIVMSG #channel :hello world\r\n" +
+		"\r\n" +
+		":dummy.int 001 test :Welcome to the network\n" +
+		"PING :12345"
+
+	want := []string{
+		"@time=2011-10-19T16:40:51.620Z :nick!user@host.com PRIVMSG #channel :hello world",
+		":dummy.int 001 test :Welcome to the network",
+		"PING 12345",
+	}
+
+	var events []*Event
+	dec := NewDecoder(strings.NewReader(input))
+	for {
+		event, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decoder.Decode() returned error: %s", err)
+		}
+
+		events = append(events, event)
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("Decoder.Decode() returned %d events, want %d", len(events), len(want))
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			t.Fatalf("Encoder.Encode() returned error: %s", err)
+		}
+	}
+
+	if got := buf.String(); got != strings.Join(want, "\r\n")+"\r\n" {
+		t.Fatalf("Encoder.Encode() wrote %q", got)
+	}
+
+	// And back again.
+	dec = NewDecoder(&buf)
+	for i := range want {
+		event, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decoder.Decode() returned error: %s", err)
+		}
+
+		if !event.Equals(events[i]) {
+			t.Fatalf("round-tripped event %q, want %q", event, events[i])
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("Decoder.Decode() at end of stream = %v, want io.EOF", err)
+	}
+
+	if err := enc.Encode(nil); err == nil {
+		t.Fatal("Encoder.Encode(nil) returned nil error")
+	}
+}
+
+func TestDecoderInvalid(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(":nick!user@host\r\nPING :test\r\n"))
+
+	if _, err := dec.Decode(); err == nil {
+		t.Fatal("Decoder.Decode() with invalid line returned nil error")
+	} else if _, ok := err.(ErrParseEvent); !ok {
+		t.Fatalf("Decoder.Decode() with invalid line = %v, want ErrParseEvent", err)
+	}
+
+	event, err := dec.Decode()
+	if err != nil || event.Command != PING {
+		t.Fatalf("Decoder.Decode() after invalid line = %v, %v, want PING event", event, err)
+	}
+}
@@ -16,6 +16,7 @@ const (
 	CTCP_TIME       = "TIME"
 	CTCP_FINGER     = "FINGER"
 	CTCP_ERRMSG     = "ERRMSG"
+	CTCP_DCC        = "DCC"
 )
 
 // Emulated event commands used to allow easier hooks into the changing
@@ -30,6 +31,22 @@ const (
 	CLOSED           = "CLIENT_CLOSED"          // occurs when Client.Close() has been called
 	STS_UPGRADE_INIT = "STS_UPGRADE_INIT"       // when an STS upgrade initially happens.
 	STS_ERR_FALLBACK = "STS_ERR_FALLBACK"       // when an STS connection fails and fallbacks are supported.
+	BATCH_COMPLETE   = "CLIENT_BATCH_COMPLETE"  // when an IRCv3 batch has ended, see Event.Batch.
+	USER_AWAY        = "CLIENT_USER_AWAY"       // when a tracked user is marked as away, params are nick and away message.
+	USER_BACK        = "CLIENT_USER_BACK"       // when a tracked user is no longer away, params are nick.
+	SELF_AWAY        = "CLIENT_SELF_AWAY"       // when we've been marked as away (RPL_NOWAWAY), params are our away message, if known.
+	SELF_BACK        = "CLIENT_SELF_BACK"       // when we're no longer marked as away (RPL_UNAWAY).
+	INVITED          = "CLIENT_INVITED"         // when we're invited to a channel, params are inviter, our nick, and channel.
+	CHANNEL_INVITE   = "CLIENT_CHANNEL_INVITE"  // when someone else is invited to a channel we are an operator in (invite-notify), params are inviter, invitee, and channel.
+	OPER_UP          = "CLIENT_OPER_UP"         // when we've successfully authenticated with OPER, params are the server message.
+	OPER_FAILED      = "CLIENT_OPER_FAILED"     // when authenticating with OPER failed, params are the error numeric and message.
+	DCC_CHAT         = "CLIENT_DCC_CHAT"        // when a DCC CHAT request is received (see HandleCTCPDCC), params are nick and the raw DCC text.
+	DCC_SEND         = "CLIENT_DCC_SEND"        // when a DCC SEND request is received (see HandleCTCPDCC), params are nick and the raw DCC text.
+	DCC_RESUME       = "CLIENT_DCC_RESUME"      // when a DCC RESUME request is received (see HandleCTCPDCC), params are nick and the raw DCC text.
+	DCC_ACCEPT       = "CLIENT_DCC_ACCEPT"      // when a DCC ACCEPT reply is received (see HandleCTCPDCC), params are nick and the raw DCC text.
+	ECHO             = "CLIENT_ECHO"            // when a PRIVMSG/NOTICE we've sent is echoed back (echo-message), the event is the echoed event, with Event.Echo set.
+	CAPS_NEGOTIATED  = "CLIENT_CAPS_NEGOTIATED" // once capability negotiation (including SASL) has ended, or we've registered without it, params are the enabled capabilities.
+	STANDARD_REPLY   = "CLIENT_STANDARD_REPLY"  // when a FAIL, WARN or NOTE standard reply is received, params are the type (e.g. FAIL), followed by the params of the reply. See Event.StandardReply().
 )
 
 // User/channel prefixes :: RFC1459.
@@ -281,8 +298,13 @@ const (
 // IRCv3 commands and extensions :: http://ircv3.net/irc/.
 const (
 	AUTHENTICATE = "AUTHENTICATE"
+	BATCH        = "BATCH"
+	CHATHISTORY  = "CHATHISTORY"
+	FAIL         = "FAIL"
 	MONITOR      = "MONITOR"
+	NOTE         = "NOTE"
 	STARTTLS     = "STARTTLS"
+	WARN         = "WARN"
 
 	CAP       = "CAP"
 	CAP_ACK   = "ACK"
@@ -299,6 +321,7 @@ const (
 	CAP_AWAY    = "AWAY"
 	CAP_ACCOUNT = "ACCOUNT"
 	CAP_TAGMSG  = "TAGMSG"
+	CAP_SETNAME = "SETNAME"
 )
 
 // Numeric IRC reply mapping for ircv3 :: http://ircv3.net/irc/.
@@ -358,3 +381,210 @@ const (
 	RPL_WHOSPCRPL      = "354" // ircu, used on networks with WHOX support.
 	RPL_CREATIONTIME   = "329"
 )
+
+// numericNames maps numeric replies to the name of their constant. Where
+// multiple constants share the same numeric, the most common is used (e.g.
+// RPL_ISUPPORT rather than RPL_BOUNCE).
+var numericNames = map[string]string{
+	RPL_WELCOME:           "RPL_WELCOME",
+	RPL_YOURHOST:          "RPL_YOURHOST",
+	RPL_CREATED:           "RPL_CREATED",
+	RPL_MYINFO:            "RPL_MYINFO",
+	RPL_ISUPPORT:          "RPL_ISUPPORT",
+	RPL_USERHOST:          "RPL_USERHOST",
+	RPL_ISON:              "RPL_ISON",
+	RPL_AWAY:              "RPL_AWAY",
+	RPL_UNAWAY:            "RPL_UNAWAY",
+	RPL_NOWAWAY:           "RPL_NOWAWAY",
+	RPL_WHOISREGNICK:      "RPL_WHOISREGNICK",
+	RPL_WHOISUSER:         "RPL_WHOISUSER",
+	RPL_WHOISSERVER:       "RPL_WHOISSERVER",
+	RPL_WHOISOPERATOR:     "RPL_WHOISOPERATOR",
+	RPL_WHOISIDLE:         "RPL_WHOISIDLE",
+	RPL_ENDOFWHOIS:        "RPL_ENDOFWHOIS",
+	RPL_WHOISCHANNELS:     "RPL_WHOISCHANNELS",
+	RPL_WHOWASUSER:        "RPL_WHOWASUSER",
+	RPL_ENDOFWHOWAS:       "RPL_ENDOFWHOWAS",
+	RPL_WHOISSPECIAL:      "RPL_WHOISSPECIAL",
+	RPL_LISTSTART:         "RPL_LISTSTART",
+	RPL_LIST:              "RPL_LIST",
+	RPL_LISTEND:           "RPL_LISTEND",
+	RPL_UNIQOPIS:          "RPL_UNIQOPIS",
+	RPL_CHANNELMODEIS:     "RPL_CHANNELMODEIS",
+	RPL_WHOISACCOUNT:      "RPL_WHOISACCOUNT",
+	RPL_NOTOPIC:           "RPL_NOTOPIC",
+	RPL_TOPIC:             "RPL_TOPIC",
+	RPL_INVITELIST:        "RPL_INVITELIST",
+	RPL_ENDOFINVITELIST:   "RPL_ENDOFINVITELIST",
+	RPL_WHOISACTUALLY:     "RPL_WHOISACTUALLY",
+	RPL_INVITING:          "RPL_INVITING",
+	RPL_SUMMONING:         "RPL_SUMMONING",
+	RPL_INVEXLIST:         "RPL_INVEXLIST",
+	RPL_ENDOFINVEXLIST:    "RPL_ENDOFINVEXLIST",
+	RPL_EXCEPTLIST:        "RPL_EXCEPTLIST",
+	RPL_ENDOFEXCEPTLIST:   "RPL_ENDOFEXCEPTLIST",
+	RPL_VERSION:           "RPL_VERSION",
+	RPL_WHOREPLY:          "RPL_WHOREPLY",
+	RPL_ENDOFWHO:          "RPL_ENDOFWHO",
+	RPL_NAMREPLY:          "RPL_NAMREPLY",
+	RPL_ENDOFNAMES:        "RPL_ENDOFNAMES",
+	RPL_LINKS:             "RPL_LINKS",
+	RPL_ENDOFLINKS:        "RPL_ENDOFLINKS",
+	RPL_BANLIST:           "RPL_BANLIST",
+	RPL_ENDOFBANLIST:      "RPL_ENDOFBANLIST",
+	RPL_INFO:              "RPL_INFO",
+	RPL_ENDOFINFO:         "RPL_ENDOFINFO",
+	RPL_MOTDSTART:         "RPL_MOTDSTART",
+	RPL_MOTD:              "RPL_MOTD",
+	RPL_ENDOFMOTD:         "RPL_ENDOFMOTD",
+	RPL_WHOISHOST:         "RPL_WHOISHOST",
+	RPL_WHOISMODES:        "RPL_WHOISMODES",
+	RPL_YOUREOPER:         "RPL_YOUREOPER",
+	RPL_REHASHING:         "RPL_REHASHING",
+	RPL_YOURESERVICE:      "RPL_YOURESERVICE",
+	RPL_TIME:              "RPL_TIME",
+	RPL_USERSSTART:        "RPL_USERSSTART",
+	RPL_USERS:             "RPL_USERS",
+	RPL_ENDOFUSERS:        "RPL_ENDOFUSERS",
+	RPL_NOUSERS:           "RPL_NOUSERS",
+	RPL_TRACELINK:         "RPL_TRACELINK",
+	RPL_TRACECONNECTING:   "RPL_TRACECONNECTING",
+	RPL_TRACEHANDSHAKE:    "RPL_TRACEHANDSHAKE",
+	RPL_TRACEUNKNOWN:      "RPL_TRACEUNKNOWN",
+	RPL_TRACEOPERATOR:     "RPL_TRACEOPERATOR",
+	RPL_TRACEUSER:         "RPL_TRACEUSER",
+	RPL_TRACESERVER:       "RPL_TRACESERVER",
+	RPL_TRACESERVICE:      "RPL_TRACESERVICE",
+	RPL_TRACENEWTYPE:      "RPL_TRACENEWTYPE",
+	RPL_TRACECLASS:        "RPL_TRACECLASS",
+	RPL_TRACERECONNECT:    "RPL_TRACERECONNECT",
+	RPL_TRACELOG:          "RPL_TRACELOG",
+	RPL_TRACEEND:          "RPL_TRACEEND",
+	RPL_STATSLINKINFO:     "RPL_STATSLINKINFO",
+	RPL_STATSCOMMANDS:     "RPL_STATSCOMMANDS",
+	RPL_ENDOFSTATS:        "RPL_ENDOFSTATS",
+	RPL_STATSUPTIME:       "RPL_STATSUPTIME",
+	RPL_STATSOLINE:        "RPL_STATSOLINE",
+	RPL_UMODEIS:           "RPL_UMODEIS",
+	RPL_SERVLIST:          "RPL_SERVLIST",
+	RPL_SERVLISTEND:       "RPL_SERVLISTEND",
+	RPL_LUSERCLIENT:       "RPL_LUSERCLIENT",
+	RPL_LUSEROP:           "RPL_LUSEROP",
+	RPL_LUSERUNKNOWN:      "RPL_LUSERUNKNOWN",
+	RPL_LUSERCHANNELS:     "RPL_LUSERCHANNELS",
+	RPL_LUSERME:           "RPL_LUSERME",
+	RPL_ADMINME:           "RPL_ADMINME",
+	RPL_ADMINLOC1:         "RPL_ADMINLOC1",
+	RPL_ADMINLOC2:         "RPL_ADMINLOC2",
+	RPL_ADMINEMAIL:        "RPL_ADMINEMAIL",
+	RPL_TRYAGAIN:          "RPL_TRYAGAIN",
+	RPL_WHOISCERTFP:       "RPL_WHOISCERTFP",
+	ERR_NOSUCHNICK:        "ERR_NOSUCHNICK",
+	ERR_NOSUCHSERVER:      "ERR_NOSUCHSERVER",
+	ERR_NOSUCHCHANNEL:     "ERR_NOSUCHCHANNEL",
+	ERR_CANNOTSENDTOCHAN:  "ERR_CANNOTSENDTOCHAN",
+	ERR_TOOMANYCHANNELS:   "ERR_TOOMANYCHANNELS",
+	ERR_WASNOSUCHNICK:     "ERR_WASNOSUCHNICK",
+	ERR_TOOMANYTARGETS:    "ERR_TOOMANYTARGETS",
+	ERR_NOSUCHSERVICE:     "ERR_NOSUCHSERVICE",
+	ERR_NOORIGIN:          "ERR_NOORIGIN",
+	ERR_NORECIPIENT:       "ERR_NORECIPIENT",
+	ERR_NOTEXTTOSEND:      "ERR_NOTEXTTOSEND",
+	ERR_NOTOPLEVEL:        "ERR_NOTOPLEVEL",
+	ERR_WILDTOPLEVEL:      "ERR_WILDTOPLEVEL",
+	ERR_BADMASK:           "ERR_BADMASK",
+	ERR_INPUTTOOLONG:      "ERR_INPUTTOOLONG",
+	ERR_UNKNOWNCOMMAND:    "ERR_UNKNOWNCOMMAND",
+	ERR_NOMOTD:            "ERR_NOMOTD",
+	ERR_NOADMININFO:       "ERR_NOADMININFO",
+	ERR_FILEERROR:         "ERR_FILEERROR",
+	ERR_NONICKNAMEGIVEN:   "ERR_NONICKNAMEGIVEN",
+	ERR_ERRONEUSNICKNAME:  "ERR_ERRONEUSNICKNAME",
+	ERR_NICKNAMEINUSE:     "ERR_NICKNAMEINUSE",
+	ERR_NICKCOLLISION:     "ERR_NICKCOLLISION",
+	ERR_UNAVAILRESOURCE:   "ERR_UNAVAILRESOURCE",
+	ERR_USERNOTINCHANNEL:  "ERR_USERNOTINCHANNEL",
+	ERR_NOTONCHANNEL:      "ERR_NOTONCHANNEL",
+	ERR_USERONCHANNEL:     "ERR_USERONCHANNEL",
+	ERR_NOLOGIN:           "ERR_NOLOGIN",
+	ERR_SUMMONDISABLED:    "ERR_SUMMONDISABLED",
+	ERR_USERSDISABLED:     "ERR_USERSDISABLED",
+	ERR_NOTREGISTERED:     "ERR_NOTREGISTERED",
+	ERR_NEEDMOREPARAMS:    "ERR_NEEDMOREPARAMS",
+	ERR_ALREADYREGISTRED:  "ERR_ALREADYREGISTRED",
+	ERR_NOPERMFORHOST:     "ERR_NOPERMFORHOST",
+	ERR_PASSWDMISMATCH:    "ERR_PASSWDMISMATCH",
+	ERR_YOUREBANNEDCREEP:  "ERR_YOUREBANNEDCREEP",
+	ERR_YOUWILLBEBANNED:   "ERR_YOUWILLBEBANNED",
+	ERR_KEYSET:            "ERR_KEYSET",
+	ERR_CHANNELISFULL:     "ERR_CHANNELISFULL",
+	ERR_UNKNOWNMODE:       "ERR_UNKNOWNMODE",
+	ERR_INVITEONLYCHAN:    "ERR_INVITEONLYCHAN",
+	ERR_BANNEDFROMCHAN:    "ERR_BANNEDFROMCHAN",
+	ERR_BADCHANNELKEY:     "ERR_BADCHANNELKEY",
+	ERR_BADCHANMASK:       "ERR_BADCHANMASK",
+	ERR_NOCHANMODES:       "ERR_NOCHANMODES",
+	ERR_BANLISTFULL:       "ERR_BANLISTFULL",
+	ERR_NOPRIVILEGES:      "ERR_NOPRIVILEGES",
+	ERR_CHANOPRIVSNEEDED:  "ERR_CHANOPRIVSNEEDED",
+	ERR_CANTKILLSERVER:    "ERR_CANTKILLSERVER",
+	ERR_RESTRICTED:        "ERR_RESTRICTED",
+	ERR_UNIQOPPRIVSNEEDED: "ERR_UNIQOPPRIVSNEEDED",
+	ERR_NOOPERHOST:        "ERR_NOOPERHOST",
+	ERR_UMODEUNKNOWNFLAG:  "ERR_UMODEUNKNOWNFLAG",
+	ERR_USERSDONTMATCH:    "ERR_USERSDONTMATCH",
+	RPL_LOGGEDIN:          "RPL_LOGGEDIN",
+	RPL_LOGGEDOUT:         "RPL_LOGGEDOUT",
+	RPL_NICKLOCKED:        "RPL_NICKLOCKED",
+	RPL_SASLSUCCESS:       "RPL_SASLSUCCESS",
+	ERR_SASLFAIL:          "ERR_SASLFAIL",
+	ERR_SASLTOOLONG:       "ERR_SASLTOOLONG",
+	ERR_SASLABORTED:       "ERR_SASLABORTED",
+	ERR_SASLALREADY:       "ERR_SASLALREADY",
+	RPL_SASLMECHS:         "RPL_SASLMECHS",
+	RPL_STARTTLS:          "RPL_STARTTLS",
+	ERR_STARTTLS:          "ERR_STARTTLS",
+	RPL_MONONLINE:         "RPL_MONONLINE",
+	RPL_MONOFFLINE:        "RPL_MONOFFLINE",
+	RPL_MONLIST:           "RPL_MONLIST",
+	RPL_ENDOFMONLIST:      "RPL_ENDOFMONLIST",
+	ERR_MONLISTFULL:       "ERR_MONLISTFULL",
+	RPL_STATSCLINE:        "RPL_STATSCLINE",
+	RPL_STATSNLINE:        "RPL_STATSNLINE",
+	RPL_STATSILINE:        "RPL_STATSILINE",
+	RPL_STATSKLINE:        "RPL_STATSKLINE",
+	RPL_STATSQLINE:        "RPL_STATSQLINE",
+	RPL_STATSYLINE:        "RPL_STATSYLINE",
+	RPL_SERVICEINFO:       "RPL_SERVICEINFO",
+	RPL_ENDOFSERVICES:     "RPL_ENDOFSERVICES",
+	RPL_SERVICE:           "RPL_SERVICE",
+	RPL_STATSVLINE:        "RPL_STATSVLINE",
+	RPL_STATSLLINE:        "RPL_STATSLLINE",
+	RPL_STATSHLINE:        "RPL_STATSHLINE",
+	RPL_STATSSLINE:        "RPL_STATSSLINE",
+	RPL_STATSPING:         "RPL_STATSPING",
+	RPL_STATSBLINE:        "RPL_STATSBLINE",
+	RPL_STATSDLINE:        "RPL_STATSDLINE",
+	RPL_NONE:              "RPL_NONE",
+	RPL_WHOISCHANOP:       "RPL_WHOISCHANOP",
+	RPL_KILLDONE:          "RPL_KILLDONE",
+	RPL_CLOSING:           "RPL_CLOSING",
+	RPL_CLOSEEND:          "RPL_CLOSEEND",
+	RPL_INFOSTART:         "RPL_INFOSTART",
+	RPL_MYPORTIS:          "RPL_MYPORTIS",
+	ERR_NOSERVICEHOST:     "ERR_NOSERVICEHOST",
+	ERR_TOOMANYMATCHES:    "ERR_TOOMANYMATCHES",
+	RPL_GLOBALUSERS:       "RPL_GLOBALUSERS",
+	RPL_LOCALUSERS:        "RPL_LOCALUSERS",
+	RPL_TOPICWHOTIME:      "RPL_TOPICWHOTIME",
+	RPL_WHOSPCRPL:         "RPL_WHOSPCRPL",
+	RPL_CREATIONTIME:      "RPL_CREATIONTIME",
+}
+
+// NumericName returns the name of the constant for a numeric reply, e.g.
+// "001" returns "RPL_WELCOME". This is useful when logging or debugging
+// numeric replies. ok is false if the numeric is unknown.
+func NumericName(code string) (name string, ok bool) {
+	name, ok = numericNames[code]
+	return name, ok
+}
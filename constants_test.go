@@ -0,0 +1,30 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "testing"
+
+func TestNumericName(t *testing.T) {
+	tests := []struct {
+		code string
+		name string
+		ok   bool
+	}{
+		{code: "001", name: "RPL_WELCOME", ok: true},
+		{code: "005", name: "RPL_ISUPPORT", ok: true},
+		{code: "332", name: "RPL_TOPIC", ok: true},
+		{code: "433", name: "ERR_NICKNAMEINUSE", ok: true},
+		{code: "903", name: "RPL_SASLSUCCESS", ok: true},
+		{code: "999", ok: false},
+		{code: "PRIVMSG", ok: false},
+		{code: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		if name, ok := NumericName(tt.code); name != tt.name || ok != tt.ok {
+			t.Errorf("NumericName(%q) == (%q, %t), want (%q, %t)", tt.code, name, ok, tt.name, tt.ok)
+		}
+	}
+}
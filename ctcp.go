@@ -154,9 +154,15 @@ func (c *CTCP) call(client *Client, event *CTCPEvent) {
 			return
 		}
 
+		// CTCPs sent to a channel shouldn't be replied to with an error, as
+		// every client in the channel would do the same.
+		if event.Origin != nil && len(event.Origin.Params) > 0 && IsValidChannel(event.Origin.Params[0]) {
+			return
+		}
+
 		// Send a ERRMSG reply, if we know who sent it.
-		if !event.Reply && event.Source != nil && IsValidNick(event.Source.ID()) {
-			client.Cmd.SendCTCPReply(event.Source.ID(), CTCP_ERRMSG, "that is an unknown CTCP query")
+		if !event.Reply && event.Source != nil && IsValidNick(event.Source.Name) {
+			client.Cmd.SendCTCPReply(event.Source.Name, CTCP_ERRMSG, "that is an unknown CTCP query")
 		}
 		return
 	}
@@ -248,7 +254,7 @@ func handleCTCPPing(client *Client, ctcp CTCPEvent) {
 	if ctcp.Reply {
 		return
 	}
-	client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_PING, ctcp.Text)
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_PING, ctcp.Text)
 }
 
 // handleCTCPPong replies with a pong.
@@ -256,7 +262,7 @@ func handleCTCPPong(client *Client, ctcp CTCPEvent) {
 	if ctcp.Reply {
 		return
 	}
-	client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_PONG, "")
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_PONG, "")
 }
 
 // handleCTCPVersion replies with the name of the client, Go version, as well
@@ -268,12 +274,12 @@ func handleCTCPVersion(client *Client, ctcp CTCPEvent) {
 	}
 
 	if client.Config.Version != "" {
-		client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_VERSION, client.Config.Version)
+		client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_VERSION, client.Config.Version)
 		return
 	}
 
 	client.Cmd.SendCTCPReplyf(
-		ctcp.Source.ID(), CTCP_VERSION,
+		ctcp.Source.Name, CTCP_VERSION,
 		"girc (github.com/lrstanley/girc) using %s (%s, %s)",
 		runtime.Version(), runtime.GOOS, runtime.GOARCH,
 	)
@@ -285,7 +291,7 @@ func handleCTCPSource(client *Client, ctcp CTCPEvent) {
 		return
 	}
 
-	client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_SOURCE, "https://github.com/lrstanley/girc")
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_SOURCE, "https://github.com/lrstanley/girc")
 }
 
 // handleCTCPTime replies with a RFC 1123 (Z) formatted version of Go's
@@ -295,7 +301,7 @@ func handleCTCPTime(client *Client, ctcp CTCPEvent) {
 		return
 	}
 
-	client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_TIME, ":"+time.Now().Format(time.RFC1123Z))
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_TIME, ":"+time.Now().Format(time.RFC1123Z))
 }
 
 // handleCTCPFinger replies with the realname and idle time of the user. This
@@ -309,5 +315,5 @@ func handleCTCPFinger(client *Client, ctcp CTCPEvent) {
 	active := client.conn.lastActive
 	client.conn.mu.RUnlock()
 
-	client.Cmd.SendCTCPReply(ctcp.Source.ID(), CTCP_FINGER, fmt.Sprintf("%s -- idle %s", client.Config.Name, time.Since(active)))
+	client.Cmd.SendCTCPReply(ctcp.Source.Name, CTCP_FINGER, fmt.Sprintf("%s -- idle %s", client.Config.Name, time.Since(active)))
 }
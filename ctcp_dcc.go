@@ -0,0 +1,210 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DCC subcommands.
+const (
+	DCCChat   = "CHAT"
+	DCCSend   = "SEND"
+	DCCResume = "RESUME"
+	DCCAccept = "ACCEPT"
+)
+
+// ErrInvalidDCC is returned when a DCC request can't be parsed.
+type ErrInvalidDCC struct {
+	// Reason is why the DCC request is invalid.
+	Reason string
+}
+
+func (e ErrInvalidDCC) Error() string { return "invalid dcc request: " + e.Reason }
+
+// DCC is a parsed CTCP DCC request. See ParseDCC().
+type DCC struct {
+	// Type is the DCC subcommand, e.g. DCCChat, DCCSend, DCCResume or
+	// DCCAccept.
+	Type string `json:"type"`
+	// Filename is the name of the file being sent. For DCC CHAT, this is the
+	// chat protocol, usually "chat".
+	Filename string `json:"filename"`
+	// IP is the address to connect to. Not set for DCC RESUME and ACCEPT.
+	IP net.IP `json:"ip"`
+	// Port is the port to connect to. If 0, this is a passive (reverse) DCC
+	// request, and Token will be set.
+	Port int `json:"port"`
+	// Size is the size of the file being sent, for DCC SEND. -1 if unknown.
+	Size int64 `json:"size"`
+	// Position is the position to resume from, for DCC RESUME and ACCEPT.
+	Position int64 `json:"position"`
+	// Token is the token used for passive (reverse) DCC requests.
+	Token string `json:"token"`
+}
+
+// ParseDCC parses the text of a CTCP DCC request (e.g. from
+// CTCPEvent.Text), such as:
+//
+//	SEND "my file.txt" 3232235777 5000 1024
+//	CHAT chat 3232235777 5000
+//	RESUME "my file.txt" 5000 512
+//
+// IPv4 addresses are decoded from their big-endian integer form, and IPv6
+// addresses are used as-is. Filenames with spaces must be quoted.
+func ParseDCC(text string) (*DCC, error) {
+	args, err := splitDCCArgs(text)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) < 1 {
+		return nil, ErrInvalidDCC{Reason: "empty request"}
+	}
+
+	dcc := &DCC{Type: strings.ToUpper(args[0]), Size: -1}
+	args = args[1:]
+
+	switch dcc.Type {
+	case DCCChat, DCCSend:
+		// <filename> <ip> <port> [<size>] [<token>]
+		if len(args) < 3 {
+			return nil, ErrInvalidDCC{Reason: "not enough arguments for " + dcc.Type}
+		}
+
+		dcc.Filename = args[0]
+
+		if dcc.IP = parseDCCIP(args[1]); dcc.IP == nil {
+			return nil, ErrInvalidDCC{Reason: "invalid ip: " + args[1]}
+		}
+
+		if dcc.Port, err = parseDCCPort(args[2]); err != nil {
+			return nil, err
+		}
+
+		args = args[3:]
+
+		if dcc.Type == DCCSend && len(args) > 0 {
+			if dcc.Size, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				return nil, ErrInvalidDCC{Reason: "invalid size: " + args[0]}
+			}
+			args = args[1:]
+		}
+	case DCCResume, DCCAccept:
+		// <filename> <port> <position> [<token>]
+		if len(args) < 3 {
+			return nil, ErrInvalidDCC{Reason: "not enough arguments for " + dcc.Type}
+		}
+
+		dcc.Filename = args[0]
+
+		if dcc.Port, err = parseDCCPort(args[1]); err != nil {
+			return nil, err
+		}
+
+		if dcc.Position, err = strconv.ParseInt(args[2], 10, 64); err != nil || dcc.Position < 0 {
+			return nil, ErrInvalidDCC{Reason: "invalid position: " + args[2]}
+		}
+
+		args = args[3:]
+	default:
+		return nil, ErrInvalidDCC{Reason: "unsupported type: " + dcc.Type}
+	}
+
+	if len(args) > 0 {
+		dcc.Token = args[0]
+	}
+
+	if dcc.Port == 0 && dcc.Token == "" && (dcc.Type == DCCChat || dcc.Type == DCCSend) {
+		return nil, ErrInvalidDCC{Reason: "passive request without token"}
+	}
+
+	return dcc, nil
+}
+
+// splitDCCArgs splits the arguments of a DCC request by spaces, keeping
+// quoted arguments (e.g. filenames with spaces) together.
+func splitDCCArgs(text string) (args []string, err error) {
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimLeft(text, " ") {
+		if text[0] != '"' {
+			arg, rest, _ := strings.Cut(text, " ")
+			args = append(args, arg)
+			text = rest
+			continue
+		}
+
+		end := strings.IndexByte(text[1:], '"')
+		if end < 0 {
+			return nil, ErrInvalidDCC{Reason: "unterminated quote"}
+		}
+
+		args = append(args, text[1:end+1])
+		text = text[end+2:]
+	}
+
+	return args, nil
+}
+
+// parseDCCIP parses a DCC address, which is either an IPv4 address encoded as
+// a big-endian integer, or an IPv6 address.
+func parseDCCIP(raw string) net.IP {
+	if n, err := strconv.ParseUint(raw, 10, 32); err == nil {
+		return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	if ip := net.ParseIP(raw); ip != nil && ip.To4() == nil {
+		return ip
+	}
+
+	return nil
+}
+
+// parseDCCPort parses a DCC port, which may be 0 for passive requests.
+func parseDCCPort(raw string) (int, error) {
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, ErrInvalidDCC{Reason: "invalid port: " + raw}
+	}
+
+	return port, nil
+}
+
+// dccEvents maps DCC subcommands to the event fired by HandleCTCPDCC.
+var dccEvents = map[string]string{
+	DCCChat:   DCC_CHAT,
+	DCCSend:   DCC_SEND,
+	DCCResume: DCC_RESUME,
+	DCCAccept: DCC_ACCEPT,
+}
+
+// HandleCTCPDCC is a CTCP handler which parses incoming DCC requests, and
+// fires DCC_CHAT, DCC_SEND, DCC_RESUME or DCC_ACCEPT. The params of these
+// events are the nickname of the sender, and the raw DCC text, which can be
+// parsed with ParseDCC(). Invalid requests are ignored. This isn't enabled
+// by default, to enable it:
+//
+//	client.CTCP.SetBg(girc.CTCP_DCC, girc.HandleCTCPDCC)
+//
+// Note that this only parses requests; establishing DCC connections is left
+// to the user.
+func HandleCTCPDCC(client *Client, ctcp CTCPEvent) {
+	if ctcp.Source == nil {
+		return
+	}
+
+	dcc, err := ParseDCC(ctcp.Text)
+	if err != nil {
+		client.debug.Printf("ignoring dcc request from %s: %s", ctcp.Source.Name, err)
+		return
+	}
+
+	client.RunHandlers(&Event{
+		Command: dccEvents[dcc.Type],
+		Source:  ctcp.Source.Copy(),
+		Params:  []string{ctcp.Source.Name, ctcp.Text},
+	})
+}
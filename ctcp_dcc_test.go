@@ -0,0 +1,107 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDCC(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *DCC
+	}{
+		{
+			name: "send",
+			in:   "SEND file.txt 3232235777 5000 1024",
+			want: &DCC{Type: DCCSend, Filename: "file.txt", IP: net.IPv4(192, 168, 1, 1), Port: 5000, Size: 1024},
+		},
+		{
+			name: "send quoted filename",
+			in:   `SEND "my file.txt" 3232235777 5000`,
+			want: &DCC{Type: DCCSend, Filename: "my file.txt", IP: net.IPv4(192, 168, 1, 1), Port: 5000, Size: -1},
+		},
+		{
+			name: "send passive",
+			in:   "SEND file.txt 3232235777 0 1024 123",
+			want: &DCC{Type: DCCSend, Filename: "file.txt", IP: net.IPv4(192, 168, 1, 1), Size: 1024, Token: "123"},
+		},
+		{
+			name: "chat ipv6",
+			in:   "CHAT chat 2001:db8::1 5000",
+			want: &DCC{Type: DCCChat, Filename: "chat", IP: net.ParseIP("2001:db8::1"), Port: 5000, Size: -1},
+		},
+		{
+			name: "resume",
+			in:   `RESUME "my file.txt" 5000 512`,
+			want: &DCC{Type: DCCResume, Filename: "my file.txt", Port: 5000, Size: -1, Position: 512},
+		},
+		{
+			name: "accept",
+			in:   "ACCEPT file.txt 5000 512",
+			want: &DCC{Type: DCCAccept, Filename: "file.txt", Port: 5000, Size: -1, Position: 512},
+		},
+		{name: "empty", in: ""},
+		{name: "unknown type", in: "FOO file.txt 1 2"},
+		{name: "not enough args", in: "SEND file.txt 3232235777"},
+		{name: "invalid ip", in: "SEND file.txt invalid 5000"},
+		{name: "invalid port", in: "SEND file.txt 3232235777 70000"},
+		{name: "passive without token", in: "SEND file.txt 3232235777 0"},
+		{name: "unterminated quote", in: `SEND "file.txt 3232235777 5000`},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDCC(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: ParseDCC(%q) returned nil error", tt.name, tt.in)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: ParseDCC(%q) returned error: %s", tt.name, tt.in, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseDCC(%q) == %#v, want %#v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandleCTCPDCC(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	events := make(chan Event, 1)
+	c.Handlers.Add(DCC_SEND, func(c *Client, e Event) { events <- e })
+
+	// Not enabled by default.
+	if _, ok := c.CTCP.handlers[CTCP_DCC]; ok {
+		t.Fatal("DCC handler enabled by default")
+	}
+
+	c.CTCP.Set(CTCP_DCC, HandleCTCPDCC)
+	c.CTCP.call(c, DecodeCTCP(ParseEvent(":nick!user@host.com PRIVMSG test :\x01DCC SEND invalid\x01")))
+	c.CTCP.call(c, DecodeCTCP(ParseEvent(":nick!user@host.com PRIVMSG test :\x01DCC SEND file.txt 3232235777 5000 1024\x01")))
+
+	select {
+	case e := <-events:
+		want := []string{"nick", "SEND file.txt 3232235777 5000 1024"}
+		if !reflect.DeepEqual(e.Params, want) {
+			t.Fatalf("DCC_SEND params == %v, want %v", e.Params, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for DCC_SEND")
+	}
+}
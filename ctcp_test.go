@@ -6,6 +6,7 @@ package girc
 
 import (
 	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -222,3 +223,70 @@ func TestClearAll(t *testing.T) {
 		t.Fatalf("ctcp.ClearAll() didn't remove all handlers: 1: %v 2: %v", first, second)
 	}
 }
+
+func TestCallErrMsg(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Neither ACTION, nor unknown CTCPs sent to a channel, should be
+	// replied to with ERRMSG.
+	c.CTCP.call(c, DecodeCTCP(ParseEvent(":nick!user@host.com PRIVMSG test :\x01ACTION waves\x01")))
+	c.CTCP.call(c, DecodeCTCP(ParseEvent(":nick!user@host.com PRIVMSG #channel :\x01UNKNOWN\x01")))
+	c.Cmd.Message("nick", "sync")
+
+	for line := range lines {
+		if strings.Contains(line, CTCP_ERRMSG) {
+			t.Fatalf("unexpected ERRMSG reply: %q", line)
+		}
+
+		if line == "PRIVMSG nick sync" {
+			break
+		}
+	}
+
+	c.CTCP.call(c, DecodeCTCP(ParseEvent(":nick!user@host.com PRIVMSG test :\x01UNKNOWN\x01")))
+	expectLine(t, lines, "NOTICE nick :\x01ERRMSG that is an unknown CTCP query\x01")
+}
+
+func TestCTCPReplyRate(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.CTCPReplyRate = 2
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte(":nick1!user@host.com PRIVMSG test :\x01PING 1\x01\r\n"))
+	}
+	conn.Write([]byte(":nick2!user@host.com PRIVMSG test :\x01PING 2\x01\r\n"))
+
+	// The default CTCP handlers run in the background, so wait for any
+	// replies to be sent before checking.
+	time.Sleep(100 * time.Millisecond)
+	c.Cmd.Message("#other", "done")
+
+	replies := map[string]int{}
+	for line := range lines {
+		if strings.HasPrefix(line, "NOTICE ") {
+			replies[strings.Fields(line)[1]]++
+		}
+
+		if line == "PRIVMSG #other done" {
+			break
+		}
+	}
+
+	if replies["nick1"] != 2 || replies["nick2"] != 1 {
+		t.Fatalf("CTCP replies = %v, want 2 to nick1 and 1 to nick2", replies)
+	}
+}
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -55,6 +56,55 @@ func cutCRFunc(r rune) bool {
 	return r == '\r' || r == '\n'
 }
 
+// ErrPartialEvent is returned by ParseEvents() when the data ends with a
+// partial line (i.e. without a trailing newline). Remaining is the partial
+// line, which can be prepended to the next chunk of data.
+type ErrPartialEvent struct {
+	Remaining []byte
+}
+
+func (e ErrPartialEvent) Error() string {
+	return fmt.Sprintf("data ends with partial event: %q", e.Remaining)
+}
+
+// ParseEvents parses multiple events from data, split on CR-LF (or a lone
+// LF), skipping empty lines. This is useful for processing a chunk of a raw
+// IRC log at once. See also NewDecoder() for parsing a stream.
+//
+// If a line can't be parsed, the events before it are returned with an
+// ErrParseEvent. If data doesn't end with a newline, the last line isn't
+// parsed, and the events before it are returned with an ErrPartialEvent.
+func ParseEvents(data []byte) ([]*Event, error) {
+	var events []*Event
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, delim)
+		if i < 0 {
+			if len(bytes.TrimSpace(data)) == 0 {
+				break
+			}
+
+			return events, ErrPartialEvent{Remaining: data}
+		}
+
+		line := data[:i+1]
+		data = data[i+1:]
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		event := ParseEvent(string(line))
+		if event == nil {
+			return events, ErrParseEvent{Line: string(line)}
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
 // ParseEvent takes a string and attempts to create a Event struct. Returns
 // nil if the Event is invalid.
 func ParseEvent(raw string) (e *Event) {
@@ -75,12 +125,11 @@ func ParseEvent(raw string) (e *Event) {
 		}
 
 		e.Tags = ParseTags(raw[1:i])
-		if rawServerTime, ok := e.Tags.Get("time"); ok {
-			// Attempt to parse server-time. If we can't parse it, we just
-			// fall back to the time we received the message (locally.)
-			if stime, err := time.Parse(capServerTimeFormat, rawServerTime); err == nil {
-				e.Timestamp = stime.Local()
-			}
+
+		// Attempt to parse server-time. If we can't parse it, we just fall
+		// back to the time we received the message (locally.)
+		if stime, ok := e.ServerTime(); ok {
+			e.Timestamp = stime.Local()
 		}
 		raw = raw[i+1:]
 		i = 0
@@ -191,6 +240,10 @@ type Event struct {
 	Sensitive bool `json:"sensitive"`
 	// If the event is an echo-message response.
 	Echo bool `json:"echo"`
+	// Batch is only set on BATCH_COMPLETE events, and contains the events
+	// received within the batch. This is shared between copies of the event,
+	// and should be treated as read-only.
+	Batch *Batch `json:"batch,omitempty"`
 }
 
 // Last returns the last parameter in Event.Params if it exists.
@@ -201,6 +254,38 @@ func (e *Event) Last() string {
 	return ""
 }
 
+// ServerTime returns the time specified by the server with the IRCv3
+// "server-time" capability (the "time" message tag), parsed in UTC. ok will
+// be false if the tag doesn't exist or isn't a valid timestamp. When parsed
+// with ParseEvent(), Event.Timestamp is already set to this value (in local
+// time) when available.
+func (e *Event) ServerTime() (stime time.Time, ok bool) {
+	raw, ok := e.Tags.Get("time")
+	if !ok {
+		return stime, false
+	}
+
+	stime, err := time.Parse(capServerTimeFormat, raw)
+	if err != nil {
+		return stime, false
+	}
+
+	return stime, true
+}
+
+// Account returns the services account of the user who sent the event, from
+// the IRCv3 "account-tag" capability (the "account" message tag). ok will be
+// false if the tag doesn't exist, which usually means the user isn't logged
+// in, or the server doesn't support account-tag.
+func (e *Event) Account() (account string, ok bool) {
+	account, ok = e.Tags.Get("account")
+	if !ok || account == "" || account == "*" {
+		return "", false
+	}
+
+	return account, true
+}
+
 // Copy makes a deep copy of a given event, for use with allowing untrusted
 // functions/handlers edit the event without causing potential issues with
 // other handlers.
@@ -214,6 +299,7 @@ func (e *Event) Copy() *Event {
 		Command:   e.Command,
 		Sensitive: e.Sensitive,
 		Echo:      e.Echo,
+		Batch:     e.Batch,
 	}
 
 	// Copy Source field, as it's a pointer and needs to be dereferenced.
@@ -257,10 +343,66 @@ func (e *Event) Equals(ev *Event) bool {
 	return true
 }
 
+// ErrInvalidEvent is returned when an event is malformed, and would be
+// corrupted if sent to the server. See Event.IsValid() for details.
+type ErrInvalidEvent struct {
+	Reason string
+}
+
+func (e ErrInvalidEvent) Error() string { return "invalid event: " + e.Reason }
+
+// IsValid checks if the event can be safely sent to the server, returning
+// ErrInvalidEvent if not. The command must be non-empty, and either entirely
+// alphabetic or a three digit numeric. All parameters except the last must be
+// non-empty, contain no spaces, and not start with ":". No parameter may
+// contain newlines, carriage returns, or NUL characters.
+func (e *Event) IsValid() error {
+	if e.Command == "" {
+		return ErrInvalidEvent{Reason: "empty command"}
+	}
+
+	var numeric, alpha bool
+	for i := 0; i < len(e.Command); i++ {
+		switch {
+		case e.Command[i] >= '0' && e.Command[i] <= '9':
+			numeric = true
+		case (e.Command[i] >= 'A' && e.Command[i] <= 'Z') || (e.Command[i] >= 'a' && e.Command[i] <= 'z'):
+			alpha = true
+		default:
+			return ErrInvalidEvent{Reason: fmt.Sprintf("invalid character in command %q", e.Command)}
+		}
+	}
+
+	if numeric && (alpha || len(e.Command) != 3) {
+		return ErrInvalidEvent{Reason: fmt.Sprintf("invalid command %q", e.Command)}
+	}
+
+	for i := 0; i < len(e.Params); i++ {
+		if strings.ContainsAny(e.Params[i], "\r\n\x00") {
+			return ErrInvalidEvent{Reason: fmt.Sprintf("parameter %d contains newline or NUL characters", i)}
+		}
+
+		if i == len(e.Params)-1 {
+			break
+		}
+
+		if e.Params[i] == "" {
+			return ErrInvalidEvent{Reason: fmt.Sprintf("parameter %d is empty", i)}
+		}
+
+		if strings.Contains(e.Params[i], " ") || e.Params[i][0] == messagePrefix {
+			return ErrInvalidEvent{Reason: fmt.Sprintf("parameter %d contains spaces or starts with ':'", i)}
+		}
+	}
+
+	return nil
+}
+
 // split will split a potentially large event that is larger than what the server
 // supports, into multiple events. split will ignore events that cannot be split, and
 // if the event isn't longer than what the server supports, it will just return an array
-// with 1 entry, the original event.
+// with 1 entry, the original event. Tags are excluded from the length calculation
+// (see Client.MaxEventLength()), and are copied to every split event.
 func (e *Event) split(maxLength int) []*Event {
 	if len(e.Params) < 1 || (e.Command != PRIVMSG && e.Command != NOTICE) {
 		return []*Event{e}
@@ -331,7 +473,7 @@ func (e *Event) Len() (length int) {
 // supports), which may be useful if you are trying to check and see if a message is
 // too long, to trim it down yourself.
 func (e *Event) LenOpts(includeTags bool) (length int) {
-	if e.Tags != nil {
+	if includeTags && e.Tags != nil {
 		// Include tags and trailing space.
 		length = e.Tags.Len() + 1
 	}
@@ -412,6 +554,52 @@ func (e *Event) String() string {
 	return string(e.Bytes())
 }
 
+// eventJSON is the JSON representation of an Event. The alias prevents
+// Event.MarshalJSON() from recursing.
+type eventJSON struct {
+	*eventAlias
+	// Raw is the raw IRC line of the event, see Event.String().
+	Raw string `json:"raw"`
+}
+
+type eventAlias Event
+
+// MarshalJSON implements json.Marshaler. Along with the fields of the event,
+// the raw IRC line (see Event.String()) is included as "raw", for consumers
+// which would rather parse the line themselves. This has a value receiver,
+// so that Event values (e.g. as passed to handlers) are also encoded this way.
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(eventJSON{eventAlias: (*eventAlias)(&e), Raw: e.String()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. If the command isn't supplied,
+// the event is instead parsed from the raw IRC line ("raw"), if supplied,
+// allowing events to be created from only their raw line.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	decoded := eventJSON{eventAlias: (*eventAlias)(e)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	if e.Command != "" || decoded.Raw == "" {
+		return nil
+	}
+
+	event := ParseEvent(decoded.Raw)
+	if event == nil {
+		return ErrParseEvent{Line: decoded.Raw}
+	}
+
+	if !e.Timestamp.IsZero() {
+		event.Timestamp = e.Timestamp
+	}
+
+	event.Sensitive, event.Echo = e.Sensitive, e.Echo
+	*e = *event
+
+	return nil
+}
+
 // Pretty returns a prettified string of the event. If the event doesn't
 // support prettification, ok is false. Pretty is not just useful to make
 // an event prettier, but also to filter out events that most don't visually
@@ -445,16 +633,20 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return fmt.Sprintf("[*] successfully connected to %s", e.Last()), true
 	}
 
+	if e.IsWallops() {
+		return fmt.Sprintf("[*] wallops from %s: %s", e.Source.Name, e.Last()), true
+	}
+
+	if text, ok := e.ActionText(); ok {
+		return fmt.Sprintf("[%s] * %s %s", e.Params[0], e.Source.Name, text), true
+	}
+
 	if (e.Command == PRIVMSG || e.Command == NOTICE) && len(e.Params) > 0 {
 		if ctcp := DecodeCTCP(e); ctcp != nil {
 			if ctcp.Reply {
 				return
 			}
 
-			if ctcp.Command == CTCP_ACTION {
-				return fmt.Sprintf("[%s] **%s** %s", strings.Join(e.Params[0:len(e.Params)-1], ","), ctcp.Source.Name, ctcp.Text), true
-			}
-
 			return fmt.Sprintf("[*] CTCP query from %s: %s%s", ctcp.Source.Name, ctcp.Command, " "+ctcp.Text), true
 		}
 
@@ -486,8 +678,8 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return fmt.Sprintf("[*] %s has quit (%s)", e.Source.Name, e.Last()), true
 	}
 
-	if e.Command == INVITE && len(e.Params) == 1 {
-		return fmt.Sprintf("[*] %s invited to %s by %s", e.Params[0], e.Last(), e.Source.Name), true
+	if e.Command == INVITE && len(e.Params) >= 2 {
+		return fmt.Sprintf("[*] %s invited to %s by %s", e.Params[0], e.Params[1], e.Source.Name), true
 	}
 
 	if e.Command == KICK && len(e.Params) >= 2 {
@@ -525,6 +717,10 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return fmt.Sprintf("[*] %s has changed their host to %s (was %s)", e.Source.Name, e.Params[1], e.Source.Host), true
 	}
 
+	if e.Command == CAP_SETNAME && len(e.Params) == 1 {
+		return fmt.Sprintf("[*] %s has changed their realname to %s", e.Source.Name, e.Params[0]), true
+	}
+
 	if e.Command == CAP_ACCOUNT && len(e.Params) == 1 {
 		if e.Params[0] == "*" {
 			return fmt.Sprintf("[*] %s has become un-authenticated", e.Source.Name), true
@@ -537,6 +733,20 @@ func (e *Event) Pretty() (out string, ok bool) {
 		return "[*] enabling capabilities: " + e.Last(), true
 	}
 
+	// Error numerics, e.g. "<client> <channel> :Cannot join channel (+k)".
+	if len(e.Command) == 3 && (e.Command[0] == '4' || e.Command[0] == '5') && len(e.Params) >= 2 {
+		name, ok := NumericName(e.Command)
+		if !ok {
+			name = e.Command
+		}
+
+		if len(e.Params) > 2 {
+			return fmt.Sprintf("[!] %s: %s: %s", name, strings.Join(e.Params[1:len(e.Params)-1], " "), e.Last()), true
+		}
+
+		return fmt.Sprintf("[!] %s: %s", name, e.Last()), true
+	}
+
 	return "", false
 }
 
@@ -571,6 +781,104 @@ func (e *Event) IsFromChannel() bool {
 	return true
 }
 
+// Target returns where a reply to the event should be sent: the channel
+// (i.e. Params[0]) if the event was sent to a channel, otherwise the source
+// of the event, e.g. the user who sent a private message. Returns an empty
+// string if the event wasn't sent to a channel, and has no source.
+func (e *Event) Target() string {
+	if len(e.Params) > 0 && IsValidChannel(e.Params[0]) {
+		return e.Params[0]
+	}
+
+	if e.Source == nil {
+		return ""
+	}
+
+	return e.Source.Name
+}
+
+// IsWallops checks to see if the event is a WALLOPS, which is a message
+// broadcast to all users with the wallops user mode (+w), usually from
+// operators or the server itself.
+func (e *Event) IsWallops() bool {
+	return e.Command == WALLOPS && len(e.Params) > 0
+}
+
+// IsServerNotice checks to see if the event is a NOTICE sent by a server
+// (e.g. ":irc.example.com NOTICE nick :*** Looking up your hostname"), or a
+// global NOTICE sent to a server or host mask (e.g. "$$*", or "$#*.net"),
+// rather than a regular channel or user NOTICE.
+func (e *Event) IsServerNotice() bool {
+	if e.Command != NOTICE || len(e.Params) < 2 {
+		return false
+	}
+
+	if strings.HasPrefix(e.Params[0], "$") {
+		return true
+	}
+
+	// Nicknames can't contain ".", but server names usually do.
+	return e.Source != nil && e.Source.IsServer() && strings.Contains(e.Source.Name, ".")
+}
+
+// IsBot checks to see if the event was sent by a bot, using the IRCv3 "bot"
+// message tag, which servers add to messages from users with the bot user
+// mode set.
+func (e *Event) IsBot() bool {
+	if e.Tags == nil {
+		return false
+	}
+
+	_, ok := e.Tags["bot"]
+	if !ok {
+		_, ok = e.Tags["draft/bot"]
+	}
+
+	return ok
+}
+
+// StandardReply is an IRCv3 standard reply (FAIL, WARN or NOTE), which
+// servers use to report errors, warnings and notices about a command, e.g.
+// "FAIL JOIN CHANNEL_IS_FULL #channel :Channel is full". See
+// Event.StandardReply().
+type StandardReply struct {
+	// Type is the type of the reply, one of FAIL, WARN or NOTE.
+	Type string `json:"type"`
+	// Command is the command the reply relates to (e.g. JOIN), or "*" if it
+	// doesn't relate to a specific command.
+	Command string `json:"command"`
+	// Code is a machine-readable code for the reply (e.g.
+	// CHANNEL_IS_FULL).
+	Code string `json:"code"`
+	// Context are any additional parameters which are specific to the code
+	// (e.g. the channel). May be empty.
+	Context []string `json:"context"`
+	// Description is the human-readable description of the reply.
+	Description string `json:"description"`
+}
+
+// StandardReply parses an IRCv3 standard reply from the event, which may be
+// a FAIL, WARN or NOTE event, or a STANDARD_REPLY event. ok is false if the
+// event isn't a valid standard reply.
+func (e *Event) StandardReply() (reply *StandardReply, ok bool) {
+	typ, params := e.Command, e.Params
+	if e.Command == STANDARD_REPLY && len(e.Params) > 0 {
+		typ, params = e.Params[0], e.Params[1:]
+	}
+
+	if (typ != FAIL && typ != WARN && typ != NOTE) || len(params) < 3 {
+		return nil, false
+	}
+
+	return &StandardReply{
+		Type:        typ,
+		Command:     params[0],
+		Code:        params[1],
+		Context:     append([]string{}, params[2:len(params)-1]...),
+		Description: params[len(params)-1],
+	}, true
+}
+
 // IsFromUser checks to see if a message was from a user (rather than a
 // channel).
 func (e *Event) IsFromUser() bool {
@@ -585,15 +893,30 @@ func (e *Event) IsFromUser() bool {
 	return true
 }
 
+// ActionText returns the text of a PRIVMSG ACTION (/me), without the CTCP
+// encoding. ok is false if the event isn't an ACTION.
+func (e *Event) ActionText() (text string, ok bool) {
+	if e.Command != PRIVMSG {
+		return "", false
+	}
+
+	ctcp := DecodeCTCP(e)
+	if ctcp == nil || ctcp.Command != CTCP_ACTION {
+		return "", false
+	}
+
+	return ctcp.Text, true
+}
+
 // StripAction returns the stripped version of the action encoding from a
-// PRIVMSG ACTION (/me).
+// PRIVMSG ACTION (/me). If the event isn't an ACTION, the trailing text is
+// returned as-is. See also Event.ActionText().
 func (e *Event) StripAction() string {
-	if !e.IsAction() {
-		return e.Last()
+	if text, ok := e.ActionText(); ok {
+		return text
 	}
 
-	msg := e.Last()
-	return msg[8 : len(msg)-1]
+	return e.Last()
 }
 
 const (
@@ -616,7 +939,13 @@ type Source struct {
 }
 
 // ID is the nickname, server name, or service name, in it's converted
-// and comparable) form.
+// and comparable) form. This always uses the rfc1459 casemapping, as the
+// source isn't aware of the casemapping advertised by the server.
+//
+// Deprecated: comparing ID with Client.GetID() fails on servers which
+// advertise a different casemapping. Use Client.IsSelf() to check if the
+// source is us, or Client.CaseMap() with Source.Name to honor the server
+// casemapping.
 func (s *Source) ID() string {
 	return ToRFC1459(s.Name)
 }
@@ -629,7 +958,7 @@ func (s *Source) Equals(ss *Source) bool {
 	if s != nil && ss == nil || s == nil && ss != nil {
 		return false
 	}
-	if s.ID() != ss.ID() || s.Ident != ss.Ident || s.Host != ss.Host {
+	if ToRFC1459(s.Name) != ToRFC1459(ss.Name) || s.Ident != ss.Ident || s.Host != ss.Host {
 		return false
 	}
 	return true
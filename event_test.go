@@ -5,8 +5,11 @@
 package girc
 
 import (
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 	"unicode/utf8"
 )
 
@@ -213,6 +216,109 @@ func TestParseEvent(t *testing.T) {
 	}
 }
 
+func TestParseEvents(t *testing.T) {
+	data := []byte(":nick!user@host.com PRIVMSG #channel :hello\r\n\r\nPING :1234\n\n:dummy.int 001 test :Welcome\r\n")
+
+	events, err := ParseEvents(data)
+	if err != nil {
+		t.Fatalf("ParseEvents() returned error: %s", err)
+	}
+
+	want := []string{":nick!user@host.com PRIVMSG #channel hello", "PING 1234", ":dummy.int 001 test Welcome"}
+	if len(events) != len(want) {
+		t.Fatalf("ParseEvents() returned %d events, want %d", len(events), len(want))
+	}
+
+	for i := range events {
+		if got := events[i].String(); got != want[i] {
+			t.Errorf("ParseEvents()[%d] = %q, want %q", i, got, want[i])
+		}
+	}
+
+	if events, err := ParseEvents([]byte("\r\n \r\n")); err != nil || len(events) != 0 {
+		t.Fatalf("ParseEvents() with only empty lines = %v, %v, want no events", events, err)
+	}
+
+	// Partial trailing lines are returned as remaining data.
+	events, err = ParseEvents([]byte("PING :1234\r\nPRIVMSG #chan"))
+	if len(events) != 1 || events[0].Command != PING {
+		t.Fatalf("ParseEvents() with partial line returned %v, want PING event", events)
+	}
+
+	partial, ok := err.(ErrPartialEvent)
+	if !ok || string(partial.Remaining) != "PRIVMSG #chan" {
+		t.Fatalf("ParseEvents() with partial line returned error %v, want ErrPartialEvent", err)
+	}
+
+	// Invalid lines stop parsing.
+	events, err = ParseEvents([]byte("PING :1234\r\n:nick!user@host\r\nPING :5678\r\n"))
+	if len(events) != 1 {
+		t.Fatalf("ParseEvents() with invalid line returned %d events, want 1", len(events))
+	}
+
+	if _, ok := err.(ErrParseEvent); !ok {
+		t.Fatalf("ParseEvents() with invalid line returned error %v, want ErrParseEvent", err)
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	lines := []string{
+		"@time=2011-10-19T16:40:51.620Z;msgid=abc :nick!user@host.com PRIVMSG #channel :hello world",
+		":nick!user@host.com PRIVMSG #channel :",
+		":dummy.int 001 test :Welcome to the network",
+		"PING 12345",
+		":nick!user@host.com JOIN #channel",
+	}
+
+	for _, line := range lines {
+		event := ParseEvent(line)
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			t.Fatalf("json.Marshal(%q) returned error: %s", line, err)
+		}
+
+		decoded := &Event{}
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatalf("json.Unmarshal(%s) returned error: %s", data, err)
+		}
+
+		if !decoded.Equals(event) || !decoded.Timestamp.Equal(event.Timestamp) {
+			t.Errorf("JSON round-trip of %q = %q, want %q", line, decoded, event)
+		}
+
+		if parsed := ParseEvent(event.String()); !parsed.Equals(decoded) {
+			t.Errorf("ParseEvent(%q) = %q, want %q", event.String(), parsed, decoded)
+		}
+	}
+
+	// Event values (as passed to handlers) should be encoded the same way.
+	event := ParseEvent(lines[0])
+	want, _ := json.Marshal(event)
+	data, err := json.Marshal(*event)
+	if err != nil || string(data) != string(want) {
+		t.Fatalf("json.Marshal(Event) = %s (%v), want %s", data, err, want)
+	}
+
+	if data, _ = json.Marshal(struct{ Event Event }{*event}); !strings.Contains(string(data), `"raw":`) {
+		t.Fatalf("json.Marshal() with Event field = %s, want the raw line included", data)
+	}
+
+	// Events can also be created from only their raw line.
+	decoded := &Event{}
+	if err := json.Unmarshal([]byte(`{"raw": ":nick!user@host.com PRIVMSG #channel :hello world", "echo": true}`), decoded); err != nil {
+		t.Fatalf("json.Unmarshal() with raw line returned error: %s", err)
+	}
+
+	if want := ParseEvent(":nick!user@host.com PRIVMSG #channel :hello world"); !decoded.Equals(want) || !decoded.Echo {
+		t.Fatalf("json.Unmarshal() with raw line = %#v, want %#v", decoded, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"raw": ":nick!user@host.com"}`), &Event{}); err == nil {
+		t.Fatal("json.Unmarshal() with invalid raw line returned nil error")
+	}
+}
+
 func TestEventCopy(t *testing.T) {
 	var nilEvent *Event
 
@@ -336,6 +442,46 @@ func TestEventSourceTagEquals(t *testing.T) {
 	}
 }
 
+func TestEventServerTime(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{
+			in:   "@time=2011-10-19T16:40:51.620Z :nick!user@host PRIVMSG #test :test",
+			want: time.Date(2011, 10, 19, 16, 40, 51, 620000000, time.UTC),
+			ok:   true,
+		},
+		{
+			in:   "@aaa=bbb;time=2011-10-19T16:40:51Z :nick!user@host PRIVMSG #test :test",
+			want: time.Date(2011, 10, 19, 16, 40, 51, 0, time.UTC),
+			ok:   true,
+		},
+		{in: ":nick!user@host PRIVMSG #test :test", ok: false},
+		{in: "@aaa=bbb :nick!user@host PRIVMSG #test :test", ok: false},
+		{in: "@time=yesterday :nick!user@host PRIVMSG #test :test", ok: false},
+		{in: "@time :nick!user@host PRIVMSG #test :test", ok: false},
+	}
+
+	for _, tt := range cases {
+		event := ParseEvent(tt.in)
+
+		got, ok := event.ServerTime()
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Fatalf("Event.ServerTime() == (%v, %t), want (%v, %t) from %q", got, ok, tt.want, tt.ok, tt.in)
+		}
+
+		if ok && !event.Timestamp.Equal(tt.want) {
+			t.Fatalf("Event.Timestamp == %v, want %v from %q", event.Timestamp, tt.want, tt.in)
+		}
+
+		if !ok && time.Since(event.Timestamp) > time.Minute {
+			t.Fatalf("Event.Timestamp == %v, want local receive time from %q", event.Timestamp, tt.in)
+		}
+	}
+}
+
 // // Some of these are pulled from https://github.com/ircdocs/parser-tests.
 var testsIRCDocs = []string{
 	"foo bar baz asdf",
@@ -399,9 +545,305 @@ var testsIRCDocs = []string{
 	":SomeOp MODE #channel +oo SomeUser :AnotherUser",
 }
 
+func TestEventIsValid(t *testing.T) {
+	cases := []struct {
+		event *Event
+		valid bool
+	}{
+		{event: &Event{Command: PRIVMSG, Params: []string{"#channel", "test message"}}, valid: true},
+		{event: &Event{Command: PRIVMSG, Params: []string{"#channel", ""}}, valid: true},
+		{event: &Event{Command: PRIVMSG, Params: []string{"#channel", ":test"}}, valid: true},
+		{event: &Event{Command: "001", Params: []string{"nick", "welcome"}}, valid: true},
+		{event: &Event{Command: PING}, valid: true},
+		{event: &Event{Command: ""}, valid: false},
+		{event: &Event{Command: "PRIV MSG"}, valid: false},
+		{event: &Event{Command: "PRIV1"}, valid: false},
+		{event: &Event{Command: "0001"}, valid: false},
+		{event: &Event{Command: PRIVMSG, Params: []string{"#chan nel", "test"}}, valid: false},
+		{event: &Event{Command: PRIVMSG, Params: []string{":channel", "test"}}, valid: false},
+		{event: &Event{Command: PRIVMSG, Params: []string{"", "test"}}, valid: false},
+		{event: &Event{Command: PRIVMSG, Params: []string{"#channel", "test\r\nQUIT"}}, valid: false},
+		{event: &Event{Command: PRIVMSG, Params: []string{"#channel\n", "test"}}, valid: false},
+	}
+
+	for _, tt := range cases {
+		err := tt.event.IsValid()
+		if (err == nil) != tt.valid {
+			t.Fatalf("Event.IsValid() == %v, want valid: %t, for %#v", err, tt.valid, tt.event)
+		}
+
+		if err != nil {
+			if _, ok := err.(ErrInvalidEvent); !ok {
+				t.Fatalf("Event.IsValid() returned %T, want ErrInvalidEvent", err)
+			}
+		}
+	}
+}
+
+func TestEventSplitMultibyte(t *testing.T) {
+	text := strings.Repeat("😀", 150) + " " + strings.Repeat("héllo wörld ", 30)
+
+	for _, command := range []string{PRIVMSG, NOTICE} {
+		event := &Event{Command: command, Params: []string{"#channel", text}}
+		maxLength := 100
+
+		split := event.split(maxLength)
+		if len(split) < 2 {
+			t.Fatalf("Event.split() returned %d events for %s, want > 1", len(split), command)
+		}
+
+		var joined string
+		for _, e := range split {
+			if e.Command != command {
+				t.Fatalf("Event.split() changed command to %q, want %q", e.Command, command)
+			}
+
+			if e.LenOpts(false) > maxLength {
+				t.Fatalf("Event.split() returned event of length %d, want <= %d: %q", e.LenOpts(false), maxLength, e.String())
+			}
+
+			if !utf8.ValidString(e.Last()) || strings.Contains(e.Last(), "?") {
+				t.Fatalf("Event.split() mangled multi-byte characters: %q", e.Last())
+			}
+
+			joined += e.Last()
+		}
+
+		if strings.ReplaceAll(joined, " ", "") != strings.ReplaceAll(text, " ", "") {
+			t.Fatalf("Event.split() lost text for %s, got %q", command, joined)
+		}
+	}
+}
+
+func TestEventSplitTagged(t *testing.T) {
+	maxLength := 100
+	tags := Tags{"+example.com/long": strings.Repeat("x", 200), "+draft/reply": "abc"}
+
+	// Right at the boundary, tags should not cause the event to be split.
+	event := &Event{Tags: tags, Command: PRIVMSG, Params: []string{"#channel", ""}}
+	event.Params[1] = strings.Repeat("a", maxLength-1-event.LenOpts(false))
+
+	if split := event.split(maxLength); len(split) != 1 {
+		t.Fatalf("Event.split() at the boundary returned %d events, want 1", len(split))
+	}
+
+	event.Params[1] += strings.Repeat(" b", 10)
+	split := event.split(maxLength)
+	if len(split) < 2 {
+		t.Fatalf("Event.split() past the boundary returned %d events, want > 1", len(split))
+	}
+
+	for _, e := range split {
+		if e.LenOpts(false) > maxLength {
+			t.Fatalf("Event.split() returned event of length %d, want <= %d", e.LenOpts(false), maxLength)
+		}
+
+		if !reflect.DeepEqual(e.Tags, tags) {
+			t.Fatalf("Event.split() returned tags %v, want %v", e.Tags, tags)
+		}
+	}
+}
+
+func TestEventWallopsServerNotice(t *testing.T) {
+	tests := []struct {
+		in           string
+		wallops      bool
+		serverNotice bool
+	}{
+		{in: ":oper!user@host.com WALLOPS :server going down for maintenance", wallops: true},
+		{in: ":irc.example.com WALLOPS :netsplit detected", wallops: true},
+		{in: ":oper!user@host.com NOTICE $$* :global announcement", serverNotice: true},
+		{in: ":oper!user@host.com NOTICE $#*.example.com :host announcement", serverNotice: true},
+		{in: ":irc.example.com NOTICE test :*** Looking up your hostname...", serverNotice: true},
+		{in: ":nick!user@host.com NOTICE test :hello", serverNotice: false},
+		{in: ":nick!user@host.com NOTICE #channel :hello", serverNotice: false},
+		{in: ":NickServ NOTICE test :This nickname is registered", serverNotice: false},
+		{in: ":irc.example.com PRIVMSG test :hello", serverNotice: false},
+	}
+
+	for _, tt := range tests {
+		e := ParseEvent(tt.in)
+		if e == nil {
+			t.Fatalf("ParseEvent(%q) returned nil", tt.in)
+		}
+
+		if got := e.IsWallops(); got != tt.wallops {
+			t.Errorf("Event.IsWallops() == %t, want %t for %q", got, tt.wallops, tt.in)
+		}
+
+		if got := e.IsServerNotice(); got != tt.serverNotice {
+			t.Errorf("Event.IsServerNotice() == %t, want %t for %q", got, tt.serverNotice, tt.in)
+		}
+	}
+}
+
+func TestEventActionText(t *testing.T) {
+	tests := []struct {
+		in   string
+		text string
+		ok   bool
+	}{
+		{in: ":nick!user@host PRIVMSG #test :\x01ACTION waves hello\x01", text: "waves hello", ok: true},
+		{in: ":nick!user@host PRIVMSG nick2 :\x01ACTION waves\x01", text: "waves", ok: true},
+		{in: ":nick!user@host PRIVMSG #test :\x01ACTION\x01", text: "", ok: true},
+		{in: ":nick!user@host NOTICE #test :\x01ACTION waves\x01", ok: false},
+		{in: ":nick!user@host PRIVMSG #test :\x01VERSION\x01", ok: false},
+		{in: ":nick!user@host PRIVMSG #test :ACTION waves", ok: false},
+	}
+
+	for _, tt := range tests {
+		e := ParseEvent(tt.in)
+
+		text, ok := e.ActionText()
+		if text != tt.text || ok != tt.ok {
+			t.Errorf("Event.ActionText() == (%q, %t), want (%q, %t) for %q", text, ok, tt.text, tt.ok, tt.in)
+		}
+
+		if ok && e.StripAction() != tt.text {
+			t.Errorf("Event.StripAction() == %q, want %q for %q", e.StripAction(), tt.text, tt.in)
+		}
+	}
+}
+
+func TestEventPretty(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: ":nick!user@host.com PRIVMSG #channel :\x01ACTION waves\x01", want: "[#channel] * nick waves"},
+		{in: ":nick!user@host.com NICK newnick", want: "[*] nick is now known as newnick"},
+		{in: ":nick!user@host.com AWAY :gone fishing", want: "[*] nick is now away: gone fishing"},
+		{in: ":nick!user@host.com AWAY", want: "[*] nick is no longer away"},
+		{in: ":nick!user@host.com INVITE test #channel", want: "[*] test invited to #channel by nick"},
+		{in: ":oper!user@host.com WALLOPS :server restarting", want: "[*] wallops from oper: server restarting"},
+		{in: ":dummy.int 475 test #channel :Cannot join channel (+k)", want: "[!] ERR_BADCHANNELKEY: #channel: Cannot join channel (+k)"},
+		{in: ":dummy.int 433 test nick :Nickname is already in use", want: "[!] ERR_NICKNAMEINUSE: nick: Nickname is already in use"},
+		{in: ":dummy.int 451 test :You have not registered", want: "[!] ERR_NOTREGISTERED: You have not registered"},
+		{in: ":dummy.int 599 test :Unknown error", want: "[!] 599: Unknown error"},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseEvent(tt.in).Pretty()
+		if !ok || got != tt.want {
+			t.Errorf("Event.Pretty() == (%q, %t), want %q for %q", got, ok, tt.want, tt.in)
+		}
+	}
+}
+
 func TestEventIRCDocsParseTests(t *testing.T) {
 	for _, tt := range testsIRCDocs {
 		// Basic test to just verify it doesn't panic.
 		_ = ParseEvent(tt)
 	}
 }
+
+func TestEventTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{":nick!user@host.com PRIVMSG #channel :hello", "#channel"},
+		{":nick!user@host.com PRIVMSG &local :hello", "&local"},
+		{":nick!user@host.com PRIVMSG test :hello", "nick"},
+		{":nick!user@host.com NOTICE test :hello", "nick"},
+		{":nick!user@host.com NOTICE #channel :hello", "#channel"},
+		{":nick!user@host.com JOIN #channel", "#channel"},
+		{"PRIVMSG test :hello", ""},
+	}
+
+	for _, tt := range tests {
+		if got := ParseEvent(tt.in).Target(); got != tt.want {
+			t.Errorf("Event.Target() = %q, want %q, for %q", got, tt.want, tt.in)
+		}
+	}
+}
+
+func TestEventIsBot(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"@bot :bot!user@host.com PRIVMSG #channel :beep", true},
+		{"@draft/bot;msgid=abc :bot!user@host.com PRIVMSG #channel :beep", true},
+		{"@msgid=abc :nick!user@host.com PRIVMSG #channel :hello", false},
+		{":nick!user@host.com PRIVMSG #channel :hello", false},
+	}
+
+	for _, tt := range tests {
+		if got := ParseEvent(tt.in).IsBot(); got != tt.want {
+			t.Errorf("Event.IsBot() = %t, want %t, for %q", got, tt.want, tt.in)
+		}
+	}
+}
+
+func TestEventStandardReply(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *StandardReply
+	}{
+		{
+			in:   ":irc.example.com FAIL JOIN CHANNEL_IS_FULL #channel :Channel is full",
+			want: &StandardReply{Type: FAIL, Command: JOIN, Code: "CHANNEL_IS_FULL", Context: []string{"#channel"}, Description: "Channel is full"},
+		},
+		{
+			in:   ":irc.example.com WARN REHASH CERTS_EXPIRED cert.pem key.pem :Certificate has expired",
+			want: &StandardReply{Type: WARN, Command: "REHASH", Code: "CERTS_EXPIRED", Context: []string{"cert.pem", "key.pem"}, Description: "Certificate has expired"},
+		},
+		{
+			in:   ":irc.example.com NOTE * OPER_MESSAGE :The message",
+			want: &StandardReply{Type: NOTE, Command: "*", Code: "OPER_MESSAGE", Context: []string{}, Description: "The message"},
+		},
+		{in: ":irc.example.com FAIL JOIN :Not enough params", want: nil},
+		{in: ":nick!user@host.com PRIVMSG #channel :hello there", want: nil},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseEvent(tt.in).StandardReply()
+		if ok != (tt.want != nil) {
+			t.Errorf("Event.StandardReply() ok = %t, want %t, for %q", ok, tt.want != nil, tt.in)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Event.StandardReply() = %#v, want %#v, for %q", got, tt.want, tt.in)
+		}
+	}
+}
+
+func TestStandardReplyEvent(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	replies := make(chan *StandardReply, 2)
+	c.Handlers.Add(STANDARD_REPLY, func(c *Client, e Event) {
+		reply, ok := e.StandardReply()
+		if !ok {
+			t.Errorf("STANDARD_REPLY handler got invalid reply %q", e.String())
+			return
+		}
+		replies <- reply
+	})
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":irc.example.com FAIL JOIN CHANNEL_IS_FULL #channel :Channel is full\r\n"))
+	conn.Write([]byte(":irc.example.com WARN JOIN :Not a valid reply\r\n"))
+	conn.Write([]byte(":irc.example.com NOTE * OPER_MESSAGE :The message\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	close(replies)
+
+	var got []string
+	for reply := range replies {
+		got = append(got, reply.Type+" "+reply.Code)
+	}
+
+	if want := []string{"FAIL CHANNEL_IS_FULL", "NOTE OPER_MESSAGE"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("STANDARD_REPLY events = %v, want %v", got, want)
+	}
+}
@@ -21,36 +21,67 @@ const (
 
 var (
 	reCode  = regexp.MustCompile(`(\x02|\x1d|\x0f|\x03|\x16|\x1f|\x01)`)
-	reColor = regexp.MustCompile(`\x03([019]?\d(,[019]?\d)?)`)
+	reColor = regexp.MustCompile(`\x03([019]?\d(,[019]?\d)?)|\x04[0-9a-fA-F]{6}(,[0-9a-fA-F]{6})?`)
+
+	// reHexToken matches "{#rrggbb}" and "{#rrggbb,#rrggbb}" hex color tokens.
+	reHexToken = regexp.MustCompile(`\{#[0-9a-fA-F]{6}(,#[0-9a-fA-F]{6})?\}`)
+)
+
+// fmtHexColor is the control code for hex (RGB) colors, which is followed by
+// the foreground color, and optionally a comma and the background color, as
+// "RRGGBB". Supported by most modern clients.
+const fmtHexColor = "\x04"
+
+// Color is an IRC color code, for use with Formatter.
+type Color int
+
+// IRC colors, as supported by most clients.
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Purple
+	Orange
+	Yellow
+	LightGreen
+	Teal
+	Cyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
 )
 
-var fmtColors = map[string]int{
-	"white":       0,
-	"black":       1,
-	"blue":        2,
-	"navy":        2,
-	"green":       3,
-	"red":         4,
-	"brown":       5,
-	"maroon":      5,
-	"purple":      6,
-	"gold":        7,
-	"olive":       7,
-	"orange":      7,
-	"yellow":      8,
-	"lightgreen":  9,
-	"lime":        9,
-	"teal":        10,
-	"cyan":        11,
-	"lightblue":   12,
-	"royal":       12,
-	"fuchsia":     13,
-	"lightpurple": 13,
-	"pink":        13,
-	"gray":        14,
-	"grey":        14,
-	"lightgrey":   15,
-	"silver":      15,
+var fmtColors = map[string]Color{
+	"white":       White,
+	"black":       Black,
+	"blue":        Blue,
+	"navy":        Blue,
+	"green":       Green,
+	"red":         Red,
+	"brown":       Brown,
+	"maroon":      Brown,
+	"purple":      Purple,
+	"gold":        Orange,
+	"olive":       Orange,
+	"orange":      Orange,
+	"yellow":      Yellow,
+	"lightgreen":  LightGreen,
+	"lime":        LightGreen,
+	"teal":        Teal,
+	"cyan":        Cyan,
+	"lightblue":   LightBlue,
+	"royal":       LightBlue,
+	"fuchsia":     Pink,
+	"lightpurple": Pink,
+	"pink":        Pink,
+	"gray":        Grey,
+	"grey":        Grey,
+	"lightgrey":   LightGrey,
+	"silver":      LightGrey,
 }
 
 var fmtCodes = map[string]string{
@@ -70,7 +101,10 @@ var fmtCodes = map[string]string{
 
 // Fmt takes format strings like "{red}" or "{red,blue}" (for background
 // colors) and turns them into the resulting ASCII format/color codes for IRC.
-// See format.go for the list of supported format codes allowed.
+// See format.go for the list of supported format codes allowed. Hex colors are
+// also supported, as "{#ff8800}" or "{#ff8800,#000000}", though not all clients
+// support them. Hex and named colors can't be mixed (e.g. "{#ff8800,blue}"),
+// and such tags are left as-is.
 //
 // For example:
 //
@@ -96,6 +130,27 @@ func Fmt(text string) string {
 
 			var repl string
 
+			if strings.HasPrefix(code, "#") {
+				hex, ok := parseHexColor(code)
+				if !ok {
+					// Leave things like "{#channel}" alone.
+					last = -1
+					continue
+				}
+
+				repl = fmtHexColor + hex
+				if secondary != "" {
+					// Hex colors can't be mixed with named colors, so leave
+					// things like "{#ff8800,blue}" alone.
+					if hex, ok = parseHexColor(secondary); !ok {
+						last = -1
+						continue
+					}
+
+					repl += "," + hex
+				}
+			}
+
 			if color, ok := fmtColors[code]; ok {
 				repl = fmt.Sprintf("\x03%02d", color)
 			}
@@ -120,6 +175,11 @@ func Fmt(text string) string {
 		}
 
 		if last > -1 {
+			// Hex colors, "#" and 0-9 are also allowed.
+			if text[last+1] == '#' && (text[i] == '#' || (text[i] >= '0' && text[i] <= '9')) {
+				continue
+			}
+
 			// A-Z, a-z, and ","
 			if text[i] != ',' && (text[i] < 'A' || text[i] > 'Z') && (text[i] < 'a' || text[i] > 'z') {
 				last = -1
@@ -131,9 +191,27 @@ func Fmt(text string) string {
 	return text
 }
 
+// parseHexColor parses a "#rrggbb" hex color, returning the color without
+// the "#".
+func parseHexColor(color string) (hex string, ok bool) {
+	if len(color) != 7 || color[0] != '#' {
+		return "", false
+	}
+
+	for i := 1; i < len(color); i++ {
+		if (color[i] < '0' || color[i] > '9') && (color[i] < 'a' || color[i] > 'f') && (color[i] < 'A' || color[i] > 'F') {
+			return "", false
+		}
+	}
+
+	return color[1:], true
+}
+
 // TrimFmt strips all "{fmt}" formatting strings from the input text.
 // See Fmt() for more information.
 func TrimFmt(text string) string {
+	text = reHexToken.ReplaceAllString(text, "")
+
 	for color := range fmtColors {
 		text = strings.ReplaceAll(text, string(fmtOpenChar)+color+string(fmtCloseChar), "")
 	}
@@ -150,6 +228,7 @@ func TrimFmt(text string) string {
 // in order to ensure no truncation of other non-irc formatting.
 func StripRaw(text string) string {
 	text = reColor.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, fmtHexColor, "")
 
 	for _, code := range fmtCodes {
 		text = strings.ReplaceAll(text, code, "")
@@ -158,6 +237,85 @@ func StripRaw(text string) string {
 	return text
 }
 
+// DisplayLen returns the number of visible characters in text, ignoring any
+// IRC format and color codes (see StripRaw()). This is the number of runes,
+// rather than bytes, so it's useful for padding or aligning output. Note that
+// combining characters and wide characters (e.g. emoji) may still be displayed
+// differently depending on the client.
+func DisplayLen(text string) int {
+	return utf8.RuneCountInString(StripRaw(text))
+}
+
+// Formatter is a builder for formatted IRC text, as an alternative to Fmt()
+// for programmatically generated output. Unlike Fmt(), text added with
+// Formatter.Text() is never interpreted, so user supplied data can't
+// accidentally contain format tokens. Use Format() to create one.
+//
+// For example:
+//
+//	client.Cmd.Message("#channel", girc.Format().Color(girc.Red).Bold().Text("Hello").Reset().String())
+type Formatter struct {
+	buf strings.Builder
+}
+
+// Format returns a new Formatter.
+func Format() *Formatter {
+	return &Formatter{}
+}
+
+// Text appends text as-is, without interpreting any format tokens.
+func (f *Formatter) Text(text string) *Formatter {
+	f.buf.WriteString(text)
+	return f
+}
+
+// Color sets the foreground color.
+func (f *Formatter) Color(fg Color) *Formatter {
+	fmt.Fprintf(&f.buf, "\x03%02d", fg)
+	return f
+}
+
+// ColorBg sets the foreground and background colors.
+func (f *Formatter) ColorBg(fg, bg Color) *Formatter {
+	fmt.Fprintf(&f.buf, "\x03%02d,%02d", fg, bg)
+	return f
+}
+
+// Bold toggles bold text.
+func (f *Formatter) Bold() *Formatter {
+	return f.Text(fmtCodes["bold"])
+}
+
+// Italic toggles italic text.
+func (f *Formatter) Italic() *Formatter {
+	return f.Text(fmtCodes["italic"])
+}
+
+// Underline toggles underlined text.
+func (f *Formatter) Underline() *Formatter {
+	return f.Text(fmtCodes["underline"])
+}
+
+// Reverse toggles reversed foreground and background colors.
+func (f *Formatter) Reverse() *Formatter {
+	return f.Text(fmtCodes["reverse"])
+}
+
+// Clear clears any colors.
+func (f *Formatter) Clear() *Formatter {
+	return f.Text(fmtCodes["clear"])
+}
+
+// Reset resets all formatting.
+func (f *Formatter) Reset() *Formatter {
+	return f.Text(fmtCodes["reset"])
+}
+
+// String returns the formatted text.
+func (f *Formatter) String() string {
+	return f.buf.String()
+}
+
 // IsValidChannel validates if channel is an RFC compliant channel or not.
 //
 // NOTE: If you are using this to validate a channel that contains a channel
@@ -290,6 +448,20 @@ func IsValidUser(name string) bool {
 	return true
 }
 
+// Casemappings which may be advertised by the server with the CASEMAPPING
+// ISUPPORT token, defining which characters are considered equivalent when
+// comparing nicknames and channels. See ToCaseMapping().
+const (
+	// CaseMappingASCII only considers the letters A-Z equivalent to a-z.
+	CaseMappingASCII = "ascii"
+	// CaseMappingRFC1459 additionally considers "[]\^" equivalent to
+	// "{}|~". This is the default if the server doesn't advertise one.
+	CaseMappingRFC1459 = "rfc1459"
+	// CaseMappingRFC1459Strict is the same as CaseMappingRFC1459, except
+	// that "^" and "~" are not considered equivalent.
+	CaseMappingRFC1459Strict = "rfc1459-strict"
+)
+
 // ToRFC1459 converts a string to the stripped down conversion within RFC
 // 1459. This will do things like replace an "A" with an "a", "[]" with "{}",
 // and so forth. Useful to compare two nicknames or channels. Note that this
@@ -297,10 +469,44 @@ func IsValidUser(name string) bool {
 // valid input characters to non-rfc-valid characters. As such, it's main use
 // is for comparing two nicks.
 func ToRFC1459(input string) string {
+	return toLowerRange(input, '^')
+}
+
+// ToRFC1459Strict is the same as ToRFC1459(), however "^" is not converted
+// to "~", per the "rfc1459-strict" casemapping.
+func ToRFC1459Strict(input string) string {
+	return toLowerRange(input, ']')
+}
+
+// ToASCII converts only the letters A-Z in a string to lowercase, per the
+// "ascii" casemapping.
+func ToASCII(input string) string {
+	return toLowerRange(input, 'Z')
+}
+
+// ToCaseMapping converts a string using the given casemapping (e.g.
+// CaseMappingASCII), for comparing two nicknames or channels. Unknown
+// casemappings fall back to CaseMappingRFC1459. Client.CaseMap() can be
+// used to do this with the casemapping advertised by the server.
+func ToCaseMapping(casemapping, input string) string {
+	switch casemapping {
+	case CaseMappingASCII:
+		return ToASCII(input)
+	case CaseMappingRFC1459Strict:
+		return ToRFC1459Strict(input)
+	default:
+		return ToRFC1459(input)
+	}
+}
+
+// toLowerRange converts all characters between "A" and max (inclusive) to
+// their lowercase equivalent, which are 32 characters later in the ascii
+// table (e.g. "[" to "{").
+func toLowerRange(input string, max byte) string {
 	var out string
 
 	for i := 0; i < len(input); i++ {
-		if input[i] >= 65 && input[i] <= 94 {
+		if input[i] >= 'A' && input[i] <= max {
 			out += string(rune(input[i]) + 32)
 		} else {
 			out += string(input[i])
@@ -356,6 +562,69 @@ func Glob(input, match string) bool {
 	return trailingGlob || strings.HasSuffix(input, parts[last])
 }
 
+// MatchMask tests an IRC hostmask pattern (e.g. "*!*@*.example.com"),
+// potentially containing "*" and "?" wildcards, against a target hostmask
+// (e.g. "nick!user@host.example.com"), as used by bans and ACLs. The nick,
+// user and host components are matched separately, where the nick is
+// matched case-insensitively per RFC1459, and the user and host are matched
+// case-insensitively. Components missing from mask are treated as "*".
+func MatchMask(mask, target string) bool {
+	mnick, muser, mhost := splitMask(mask, globChar)
+	tnick, tuser, thost := splitMask(target, "")
+
+	return matchWildcard(ToRFC1459(mnick), ToRFC1459(tnick)) &&
+		matchWildcard(strings.ToLower(muser), strings.ToLower(tuser)) &&
+		matchWildcard(strings.ToLower(mhost), strings.ToLower(thost))
+}
+
+// splitMask splits a "nick!user@host" mask into its components, using
+// missing for any components which are missing.
+func splitMask(mask, missing string) (nick, user, host string) {
+	nick, user, host = mask, missing, missing
+
+	if i := strings.LastIndexByte(nick, '@'); i >= 0 {
+		nick, host = nick[:i], nick[i+1:]
+	}
+
+	if i := strings.IndexByte(nick, '!'); i >= 0 {
+		nick, user = nick[:i], nick[i+1:]
+	}
+
+	return nick, user, host
+}
+
+// matchWildcard tests pattern, potentially containing "*" (zero or more
+// characters) and "?" (exactly one character) wildcards, against input.
+func matchWildcard(pattern, input string) bool {
+	p, in := []rune(pattern), []rune(input)
+	var pi, ii int
+	star, mark := -1, 0
+
+	for ii < len(in) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == in[ii]):
+			pi++
+			ii++
+		case pi < len(p) && p[pi] == '*':
+			// Remember the position, initially matching nothing.
+			star, mark = pi, ii
+			pi++
+		case star >= 0:
+			// Backtrack, letting the last "*" match one more character.
+			mark++
+			pi, ii = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(p)
+}
+
 // sliceInsert inserts a string into a slice at a specific index, while trying
 // to avoid as many allocations as possible.
 func sliceInsert(input []string, i int, v ...string) []string {
@@ -373,6 +642,25 @@ func sliceInsert(input []string, i int, v ...string) []string {
 	return output
 }
 
+// runeBoundary returns the largest index in s which is <= n, and falls on
+// a UTF-8 rune boundary, so s can be cut without splitting a multi-byte
+// character.
+func runeBoundary(s string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	if n >= len(s) {
+		return len(s)
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return n
+}
+
 // splitMessage is a text splitter that takes into consideration a few things:
 //   - Ensuring the returned text is no longer than maxWidth.
 //   - Attempting to split at the closest word boundary, while still staying inside
@@ -468,8 +756,9 @@ func splitMessage(input string, maxWidth int) (output []string) {
 
 	checkappend:
 
-		// Check if we can append, otherwise we must split.
-		if 1+utf8.RuneCountInString(word)+utf8.RuneCountInString(output[len(output)-1]) < maxWidth {
+		// Check if we can append, otherwise we must split. Lengths are in
+		// bytes, as that's what the server limits lines by.
+		if 1+len(word)+len(output[len(output)-1]) < maxWidth {
 			if output[len(output)-1] != "" {
 				output[len(output)-1] += " "
 			}
@@ -479,7 +768,7 @@ func splitMessage(input string, maxWidth int) (output []string) {
 
 		// If the word can fit on a line by itself, check if it's a url. If it is,
 		// put it on it's own line.
-		if utf8.RuneCountInString(word+strings.Join(codes, "")+lastColor) < maxWidth {
+		if len(word+strings.Join(codes, "")+lastColor) < maxWidth {
 			if _, err := url.Parse(word); err == nil {
 				output = append(output, strings.Join(codes, "")+lastColor+word)
 				continue
@@ -488,7 +777,7 @@ func splitMessage(input string, maxWidth int) (output []string) {
 
 		// Check to see if we can split by misc symbols, but must be at least a few
 		// characters long to be split by it.
-		if j := strings.IndexAny(word, "-+_=|/~:;,."); j > 3 && 1+utf8.RuneCountInString(word[0:j])+utf8.RuneCountInString(output[len(output)-1]) < maxWidth {
+		if j := strings.IndexAny(word, "-+_=|/~:;,."); j > 3 && 1+len(word[0:j])+len(output[len(output)-1]) < maxWidth {
 			if output[len(output)-1] != "" {
 				output[len(output)-1] += " "
 			}
@@ -500,8 +789,8 @@ func splitMessage(input string, maxWidth int) (output []string) {
 		// If the word is longer than is acceptable to just put on the next line,
 		// split it into chunks. Also don't split the word if only a few characters
 		// left of the word would be on the next line.
-		if 1+utf8.RuneCountInString(word) > maxWordSplitLength && maxWidth-utf8.RuneCountInString(output[len(output)-1]) > 5 {
-			left := maxWidth - utf8.RuneCountInString(output[len(output)-1]) - 1 // -1 for the space
+		if 1+len(word) > maxWordSplitLength && maxWidth-len(output[len(output)-1]) > 5 {
+			left := runeBoundary(word, maxWidth-len(output[len(output)-1])-1) // -1 for the space
 
 			if output[len(output)-1] != "" {
 				output[len(output)-1] += " "
@@ -511,7 +800,12 @@ func splitMessage(input string, maxWidth int) (output []string) {
 			goto checkappend
 		}
 
-		left := maxWidth - utf8.RuneCountInString(output[len(output)-1])
+		left := runeBoundary(word, maxWidth-len(output[len(output)-1]))
+		if left == 0 && output[len(output)-1] == strings.Join(codes, "")+lastColor {
+			// Nothing fits on an otherwise empty line, so force at least one
+			// character onto it to guarantee progress.
+			_, left = utf8.DecodeRuneInString(word)
+		}
 		output[len(output)-1] += word[0:left]
 
 		output = append(output, strings.Join(codes, "")+lastColor)
@@ -64,6 +64,13 @@ var testsFormat = []struct {
 	{name: "just bg", test: "{,yellow}test{c}", want: "test\x03"},
 	{name: "just red", test: "{red}test", want: "\x0304test"},
 	{name: "just cyan", test: "{cyan}test", want: "\x0311test"},
+	{name: "hex fg", test: "{#ff8800}test{c}", want: "\x04ff8800test\x03"},
+	{name: "hex fg uppercase", test: "{#FF8800}test", want: "\x04ff8800test"},
+	{name: "hex fg and bg", test: "{#ff8800,#000000}test", want: "\x04ff8800,000000test"},
+	{name: "hex invalid", test: "{#ff88}test {#channel}", want: "{#ff88}test {#channel}"},
+	{name: "hex fg named bg", test: "{#ff8800,blue}test", want: "{#ff8800,blue}test"},
+	{name: "named fg hex bg", test: "{red,#000000}test", want: "{red,#000000}test"},
+	{name: "hex invalid bg", test: "{#ff8800,#0000}test", want: "{#ff8800,#0000}test"},
 }
 
 func FuzzSplit(f *testing.F) {
@@ -119,6 +126,26 @@ func TestFormat(t *testing.T) {
 	}
 }
 
+func TestFormatter(t *testing.T) {
+	tests := []struct {
+		name string
+		got  *Formatter
+		want string
+	}{
+		{name: "color bold", got: Format().Color(Red).Bold().Text("hi").Clear(), want: Fmt("{red}{b}hi{c}")},
+		{name: "background", got: Format().ColorBg(Red, Blue).Text("hi").Reset(), want: Fmt("{red,blue}hi{r}")},
+		{name: "styles", got: Format().Italic().Underline().Reverse().Text("hi"), want: Fmt("{i}{ul}{reverse}hi")},
+		{name: "tokens in text", got: Format().Bold().Text("{red}hi"), want: "\x02{red}hi"},
+		{name: "empty", got: Format(), want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.got.String(); got != tt.want {
+			t.Errorf("%s: Formatter.String() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
 var testsStripFormat = []struct {
 	name string
 	test string
@@ -129,6 +156,9 @@ var testsStripFormat = []struct {
 	{name: "partial", test: "{redtest{c}", want: "{redtest"},
 	{name: "inside", test: "{re{c}d}test{c}", want: "{red}test"},
 	{name: "nothing", test: "this is a test.", want: "this is a test."},
+	{name: "hex fg", test: "{#ff8800}test{c}", want: "test"},
+	{name: "hex fg and bg", test: "{#ff8800,#000000}test", want: "test"},
+	{name: "hex fg named bg", test: "{#ff8800,blue}test", want: "{#ff8800,blue}test"},
 }
 
 func FuzzStripFormat(f *testing.F) {
@@ -176,6 +206,9 @@ var testsStripRaw = []struct {
 	{name: "bg colors start", test: "{,yellow}test{c}", want: "test"},
 	{name: "inside", test: "{re{c}d}test{c}", want: "{red}test"},
 	{name: "nothing", test: "this is a test.", want: "this is a test."},
+	{name: "hex fg", test: "{#ff8800}test{c}", want: "test"},
+	{name: "hex fg and bg", test: "{#ff8800,#000000}1234{c}", want: "1234"},
+	{name: "hex and legacy", test: "{#ff8800}te{red}st{c}", want: "test"},
 }
 
 func FuzzStripRaw(f *testing.F) {
@@ -207,6 +240,28 @@ func TestStripRaw(t *testing.T) {
 	}
 }
 
+func TestDisplayLen(t *testing.T) {
+	tests := []struct {
+		name string
+		test string
+		want int
+	}{
+		{name: "plain", test: "test", want: 4},
+		{name: "empty", test: "", want: 0},
+		{name: "color and bold", test: Fmt("{red}{b}test{c}"), want: 4},
+		{name: "fg+bg numbers", test: Fmt("{red,yellow}1234{c}"), want: 4},
+		{name: "hex color", test: Fmt("{#ff8800}test{r}"), want: 4},
+		{name: "multibyte", test: Fmt("{b}héllo wörld{b}"), want: 11},
+		{name: "emoji", test: Fmt("{green}😀😀{c}"), want: 2},
+	}
+
+	for _, tt := range tests {
+		if got := DisplayLen(tt.test); got != tt.want {
+			t.Errorf("%s: DisplayLen(%q) = %d, want %d", tt.name, tt.test, got, tt.want)
+		}
+	}
+}
+
 var testsValidNick = []struct {
 	name string
 	test string
@@ -353,6 +408,26 @@ func TestToRFC1459(t *testing.T) {
 	}
 }
 
+func TestToCaseMapping(t *testing.T) {
+	tests := []struct {
+		casemapping string
+		in          string
+		want        string
+	}{
+		{CaseMappingASCII, "ABC[]\\^~", "abc[]\\^~"},
+		{CaseMappingRFC1459, "ABC[]\\^~", "abc{}|~~"},
+		{CaseMappingRFC1459Strict, "ABC[]\\^~", "abc{}|^~"},
+		{"", "ABC[]\\^~", "abc{}|~~"},
+		{"unknown", "ABC[]\\^~", "abc{}|~~"},
+	}
+
+	for _, tt := range tests {
+		if got := ToCaseMapping(tt.casemapping, tt.in); got != tt.want {
+			t.Errorf("ToCaseMapping(%q, %q) = %q, want %q", tt.casemapping, tt.in, got, tt.want)
+		}
+	}
+}
+
 func BenchmarkGlob(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		if !Glob("*quick*fox*dog", "The quick brown fox jumped over the lazy dog") {
@@ -467,3 +542,39 @@ func TestGlob(t *testing.T) {
 		testGlobNoMatch(t, "this is a test", pattern)
 	}
 }
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask   string
+		target string
+		want   bool
+	}{
+		{"*!*@*", "nick!user@host.example.com", true},
+		{"*!*@host.example.com", "nick!~user@host.example.com", true},
+		{"*!*@*.example.com", "nick!user@host.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"*!*@HOST.Example.COM", "nick!user@host.example.com", true},
+		{"*!~user@*", "nick!~user@host.example.com", true},
+		{"*!~user@*", "nick!user@host.example.com", false},
+		{"nick!*@*", "NICK!user@host.example.com", true},
+		{"nick[away]!*@*", "Nick{AWAY}!user@host.example.com", true},
+		{"ni?k!*@*", "nick!user@host.example.com", true},
+		{"ni?k!*@*", "niick!user@host.example.com", false},
+		{"*!*@192.0.2.*", "nick!user@192.0.2.15", true},
+		{"*!*@192.0.2.?", "nick!user@192.0.2.15", false},
+		{"*!*@2001:db8::*", "nick!user@2001:db8::1", true},
+		{"nick", "nick!user@host.example.com", true},
+		{"nick", "other!user@host.example.com", false},
+		// Wildcards in one component must not match across components.
+		{"*!user*", "nick!other@user.example.com", false},
+		{"*@host.example.com", "nick!user@host.example.com", true},
+		{"nick!*@*", "nick", true},
+		{"*!*@host.example.com", "nick", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchMask(tt.mask, tt.target); got != tt.want {
+			t.Errorf("MatchMask(%q, %q) = %t, want %t", tt.mask, tt.target, got, tt.want)
+		}
+	}
+}
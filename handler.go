@@ -5,11 +5,13 @@
 package girc
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,11 @@ func (c *Client) RunHandlers(event *Event) {
 		return
 	}
 
+	if c.Config.EventFilter != nil && !c.Config.EventFilter(event) {
+		c.debug.Print("< [filtered] " + StripRaw(event.String()))
+		return
+	}
+
 	// Log the event.
 	prefix := "< "
 	if event.Echo {
@@ -33,20 +40,42 @@ func (c *Client) RunHandlers(event *Event) {
 		}
 	}
 
+	// Unless events are shared, each set of handlers gets its own copy of
+	// the event, so handlers can't modify the event for other handlers.
+	copyEvent := event.Copy
+	if c.Config.ShareEventPointers {
+		copyEvent = func() *Event { return event }
+	}
+
+	// Messages from ignored users are only passed to internal handlers.
+	ignored := (event.Command == PRIVMSG || event.Command == NOTICE || event.Command == CAP_TAGMSG) && c.IsIgnored(event.Source)
+
 	// Background handlers first. If the event is an echo-message, then only
-	// send the echo version to ALL_EVENTS.
-	c.Handlers.exec(ALL_EVENTS, true, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, true, c, event.Copy())
+	// send the echo version to ALL_EVENTS, and ECHO handlers.
+	command := event.Command
+	if event.Echo {
+		command = ""
+		if !c.Config.disableTracking && c.HasCapability("echo-message") {
+			command = ECHO
+		}
+	}
+
+	c.Handlers.exec(ALL_EVENTS, true, ignored, c, copyEvent())
+	if command != "" {
+		c.Handlers.exec(command, true, ignored, c, copyEvent())
 	}
 
-	c.Handlers.exec(ALL_EVENTS, false, c, event.Copy())
-	if !event.Echo {
-		c.Handlers.exec(event.Command, false, c, event.Copy())
+	c.Handlers.exec(ALL_EVENTS, false, ignored, c, copyEvent())
+	if command != "" {
+		c.Handlers.exec(command, false, ignored, c, copyEvent())
+	}
+
+	if ignored {
+		return
 	}
 
 	// Check if it's a CTCP.
-	if ctcp := DecodeCTCP(event.Copy()); ctcp != nil {
+	if ctcp := DecodeCTCP(copyEvent()); ctcp != nil {
 		// Execute it.
 		c.CTCP.call(c, ctcp)
 	}
@@ -67,6 +96,25 @@ func (f HandlerFunc) Execute(client *Client, event Event) {
 	f(client, event)
 }
 
+// HandlerFuncContext is a type that represents a handler function which is
+// also supplied with the context of the current connection. The context is
+// cancelled when the client is closed (e.g. with Client.Close()), or the
+// connection is torn down, allowing long-running (e.g. background) handlers
+// to abort promptly.
+type HandlerFuncContext func(ctx context.Context, client *Client, event Event)
+
+// Execute calls the HandlerFuncContext with the connection context, sender
+// and irc message.
+func (f HandlerFuncContext) Execute(client *Client, event Event) {
+	f(client.context(), client, event)
+}
+
+// Middleware wraps a handler with additional functionality, such as
+// logging, panic recovery, rate limiting or authentication. next is the
+// handler being wrapped, and should be called to continue the chain. See
+// Caller.Use().
+type Middleware func(next HandlerFunc) HandlerFunc
+
 // Caller manages internal and external (user facing) handlers.
 type Caller struct {
 	// mu is the mutex that should be used when accessing handlers.
@@ -80,6 +128,9 @@ type Caller struct {
 	external map[string]map[string]Handler
 	// internal is a map of internally used handlers for the client.
 	internal map[string]map[string]Handler
+	// middleware is the stack of middleware which is applied to external
+	// handlers as they are registered. See Caller.Use().
+	middleware []Middleware
 	// debug is the clients logger used for debugging.
 	debug *log.Logger
 }
@@ -164,15 +215,39 @@ func (c *Caller) cuidToID(input string) (cmd, uid string) {
 
 type execStack struct {
 	Handler
-	cuid string
+	cuid     string
+	priority int
+	internal bool
+}
+
+// DefaultHandlerPriority is the priority tier that handlers are executed in,
+// unless added with Caller.AddPriority().
+const DefaultHandlerPriority = 0
+
+// priorityHandler wraps a handler which should be executed within a specific
+// priority tier. See Caller.AddPriority().
+type priorityHandler struct {
+	Handler
+	priority int
+}
+
+// handlerPriority returns the priority tier of the handler.
+func handlerPriority(handler Handler) int {
+	if ph, ok := handler.(priorityHandler); ok {
+		return ph.priority
+	}
+
+	return DefaultHandlerPriority
 }
 
 // exec executes all handlers pertaining to specified event. Internal first,
-// then external.
+// then external (unless internalOnly is true).
 //
-// Please note that there is no specific order/priority for which the handlers
-// are executed.
-func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
+// Handlers are executed in priority tiers (see Caller.AddPriority()), lowest
+// first, where each tier completes before the next one starts. Please note
+// that there is no specific order/priority for which the handlers within the
+// same tier are executed.
+func (c *Caller) exec(command string, bg, internalOnly bool, client *Client, event *Event) {
 	// Build a stack of handlers which can be executed concurrently.
 	var stack []execStack
 
@@ -184,28 +259,37 @@ func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
 				continue
 			}
 
-			stack = append(stack, execStack{c.internal[command][cuid], cuid})
+			stack = append(stack, execStack{c.internal[command][cuid], cuid, handlerPriority(c.internal[command][cuid]), true})
 		}
 	}
 
 	// Then external handlers.
-	if _, ok := c.external[command]; ok {
+	if _, ok := c.external[command]; ok && !internalOnly {
 		for cuid := range c.external[command] {
 			if (strings.HasSuffix(cuid, ":bg") && !bg) || (!strings.HasSuffix(cuid, ":bg") && bg) {
 				continue
 			}
 
-			stack = append(stack, execStack{c.external[command][cuid], cuid})
+			stack = append(stack, execStack{c.external[command][cuid], cuid, handlerPriority(c.external[command][cuid]), false})
 		}
 	}
 	c.mu.RUnlock()
 
-	// Run all handlers concurrently across the same event. This should
-	// still help prevent mis-ordered events, while speeding up the
-	// execution speed.
+	sort.SliceStable(stack, func(i, j int) bool {
+		return stack[i].priority < stack[j].priority
+	})
+
+	// Run all handlers concurrently across the same event (within the same
+	// priority tier). This should still help prevent mis-ordered events,
+	// while speeding up the execution speed.
 	var wg sync.WaitGroup
-	wg.Add(len(stack))
 	for i := 0; i < len(stack); i++ {
+		// Wait for the previous tier to complete before starting the next.
+		if i > 0 && stack[i].priority != stack[i-1].priority {
+			wg.Wait()
+		}
+
+		wg.Add(1)
 		go func(index int) {
 			defer wg.Done()
 			c.debug.Printf("[%d/%d] exec %s => %s", index+1, len(stack), stack[index].cuid, command)
@@ -224,6 +308,36 @@ func (c *Caller) exec(command string, bg bool, client *Client, event *Event) {
 				return
 			}
 
+			// Builtin handlers are expected to be quick, and may rely on
+			// being completed before the next event is processed.
+			if client.Config.HandlerTimeout > 0 && !stack[index].internal {
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+
+					if client.Config.RecoverFunc != nil {
+						defer recoverHandlerPanic(client, event, stack[index].cuid, 3)
+					}
+
+					stack[index].Execute(client, *event)
+					c.debug.Printf("[%d/%d] done %s == %s", index+1, len(stack), stack[index].cuid, time.Since(start))
+				}()
+
+				timer := time.NewTimer(client.Config.HandlerTimeout)
+				defer timer.Stop()
+
+				select {
+				case <-done:
+				case <-timer.C:
+					// Leave the handler running, so further events aren't
+					// stalled waiting on it.
+					client.logger().Warn("handler timed out, continuing in background", "id", stack[index].cuid, "command", command, "timeout", client.Config.HandlerTimeout)
+					c.debug.Printf("[%d/%d] timed out %s after %s, continuing in background", index+1, len(stack), stack[index].cuid, client.Config.HandlerTimeout)
+				}
+
+				return
+			}
+
 			if client.Config.RecoverFunc != nil {
 				defer recoverHandlerPanic(client, event, stack[index].cuid, 3)
 			}
@@ -331,6 +445,10 @@ func (c *Caller) register(internal, bg bool, cmd string, handler Handler) (cuid
 		cuid += ":bg"
 	}
 
+	if !internal {
+		handler = c.wrap(handler)
+	}
+
 	if internal {
 		if _, ok := c.internal[cmd]; !ok {
 			c.internal[cmd] = map[string]Handler{}
@@ -352,6 +470,63 @@ func (c *Caller) register(internal, bg bool, cmd string, handler Handler) (cuid
 	return cuid
 }
 
+// Use adds middleware to the handler stack. Middleware is only applied to
+// handlers added by the user after Use is called (including those added
+// with AddBg(), AddTmp(), etc), and never to internal handlers, or handlers
+// the library registers to wait on responses (e.g. for queries like
+// Client.BanList(), or Client.QuitWithTimeout()). Middleware
+// is applied in the order it was added, meaning the first middleware added
+// is the outermost, and is the first to be executed. For example:
+//
+//	client.Handlers.Use(func(next girc.HandlerFunc) girc.HandlerFunc {
+//		return func(c *girc.Client, e girc.Event) {
+//			start := time.Now()
+//			next(c, e)
+//			log.Printf("handled %s in %s", e.Command, time.Since(start))
+//		}
+//	})
+func (c *Caller) Use(middleware Middleware) {
+	c.mu.Lock()
+	c.middleware = append(c.middleware, middleware)
+	c.mu.Unlock()
+}
+
+// libraryHandler marks an external handler which the library itself depends
+// on (e.g. see Client.request()), which middleware isn't applied to, so
+// that it can't drop or delay the events being waited on.
+type libraryHandler struct {
+	Handler
+}
+
+// wrap applies the current middleware stack to handler. Unsafe (you must
+// lock c.mu yourself!)
+func (c *Caller) wrap(handler Handler) Handler {
+	if lh, ok := handler.(libraryHandler); ok {
+		return lh.Handler
+	}
+
+	if len(c.middleware) == 0 {
+		return handler
+	}
+
+	// Keep the priority tier of the wrapped handler intact.
+	if ph, ok := handler.(priorityHandler); ok {
+		ph.Handler = c.wrap(ph.Handler)
+		return ph
+	}
+
+	next, ok := handler.(HandlerFunc)
+	if !ok {
+		next = handler.Execute
+	}
+
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		next = c.middleware[i](next)
+	}
+
+	return next
+}
+
 // AddHandler registers a handler (matching the handler interface) for the
 // given event. cuid is the handler uid which can be used to remove the
 // handler with Caller.Remove().
@@ -372,6 +547,61 @@ func (c *Caller) AddBg(cmd string, handler func(client *Client, event Event)) (c
 	return c.sregister(false, true, cmd, HandlerFunc(handler))
 }
 
+// AddContext registers the handler function for the given event, which is
+// supplied with the context of the current connection. See
+// HandlerFuncContext for more information. cuid is the handler uid which can
+// be used to remove the handler with Caller.Remove().
+func (c *Caller) AddContext(cmd string, handler func(ctx context.Context, client *Client, event Event)) (cuid string) {
+	return c.sregister(false, false, cmd, HandlerFuncContext(handler))
+}
+
+// AddBgContext registers the handler function for the given event, which is
+// supplied with the context of the current connection, and executes it in a
+// go-routine. See HandlerFuncContext for more information. cuid is the
+// handler uid which can be used to remove the handler with Caller.Remove().
+func (c *Caller) AddBgContext(cmd string, handler func(ctx context.Context, client *Client, event Event)) (cuid string) {
+	return c.sregister(false, true, cmd, HandlerFuncContext(handler))
+}
+
+// AddPriority registers the handler function for the given event, within
+// the given priority tier. Tiers are executed sequentially, lowest first,
+// with each tier completing before the next tier starts. Handlers within the
+// same tier are still executed concurrently. Handlers added with Add() (and
+// all builtin handlers) are executed in the DefaultHandlerPriority tier.
+// For example, an authentication handler which must complete before any
+// command handlers are executed:
+//
+//	client.Handlers.AddPriority(girc.PRIVMSG, -10, authHandler)
+//
+// cuid is the handler uid which can be used to remove the handler with
+// Caller.Remove().
+func (c *Caller) AddPriority(cmd string, priority int, handler func(client *Client, event Event)) (cuid string) {
+	return c.sregister(false, false, cmd, priorityHandler{Handler: HandlerFunc(handler), priority: priority})
+}
+
+// Once registers the handler function for the given event, which will only
+// be executed once, on the next matching event, after which it is removed.
+// If multiple matching events are executed concurrently, only one of them
+// will execute the handler. cuid is the handler uid which can be used to
+// remove the handler with Caller.Remove(), before it has been executed.
+func (c *Caller) Once(cmd string, handler func(client *Client, event Event)) (cuid string) {
+	var once sync.Once
+
+	// Hold c.mu until cuid is assigned, as the handler can't be executed
+	// until it's released.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cuid = c.register(false, false, cmd, HandlerFunc(func(client *Client, event Event) {
+		once.Do(func() {
+			c.Remove(cuid)
+			handler(client, event)
+		})
+	}))
+
+	return cuid
+}
+
 // AddTmp adds a "temporary" handler, which is good for one-time or few-time
 // uses. This supports a deadline and/or manual removal, as this differs
 // much from how normal handlers work. An example of a good use for this
@@ -396,16 +626,32 @@ func (c *Caller) AddBg(cmd string, handler func(client *Client, event Event)) (c
 // stack, bypassing the timeout or waiting for the handler to return that it
 // wants to be removed from the stack.
 func (c *Caller) AddTmp(cmd string, deadline time.Duration, handler func(client *Client, event Event) bool) (cuid string, done chan struct{}) {
+	return c.addTmp(false, cmd, deadline, handler)
+}
+
+// addTmp is much like Caller.AddTmp(), however if library is true,
+// middleware isn't applied to the handler (see libraryHandler).
+func (c *Caller) addTmp(library bool, cmd string, deadline time.Duration, handler func(client *Client, event Event) bool) (cuid string, done chan struct{}) {
 	done = make(chan struct{})
 
-	cuid = c.sregister(false, true, cmd, HandlerFunc(func(client *Client, event Event) {
+	var tmp Handler = HandlerFunc(func(client *Client, event Event) {
 		remove := handler(client, event)
 		if remove {
 			if ok := c.Remove(cuid); ok {
 				close(done)
 			}
 		}
-	}))
+	})
+
+	if library {
+		tmp = libraryHandler{tmp}
+	}
+
+	// Hold c.mu until cuid is assigned, as the handler can't be executed
+	// until it's released.
+	c.mu.Lock()
+	cuid = c.register(false, true, cmd, tmp)
+	c.mu.Unlock()
 
 	if deadline > 0 {
 		go func() {
@@ -423,6 +669,44 @@ func (c *Caller) AddTmp(cmd string, deadline time.Duration, handler func(client
 	return cuid, done
 }
 
+// AddSafe registers the handler function for the given event, like Add(),
+// however a panic in the handler is always recovered (and logged), even if
+// Config.RecoverFunc is unset, isolating it from the rest of the client. If
+// errs is non-nil, the recovered panic is also sent to errs, if it's ready to
+// receive it. cuid is the handler uid which can be used to remove the
+// handler with Caller.Remove().
+func (c *Caller) AddSafe(cmd string, handler func(client *Client, event Event), errs chan<- *HandlerError) (cuid string) {
+	// Hold c.mu until cuid is assigned, as the handler can't be executed
+	// until it's released.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cuid = c.register(false, false, cmd, HandlerFunc(func(client *Client, event Event) {
+		defer func() {
+			perr := recover()
+			if perr == nil {
+				return
+			}
+
+			err := newHandlerError(&event, cuid, perr, 4)
+			client.logger().Error("recovered handler panic", "id", cuid, "command", event.Command, "error", perr)
+			client.debug.Println(err.Error())
+			client.debug.Println(err.String())
+
+			if errs != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+
+		handler(client, event)
+	}))
+
+	return cuid
+}
+
 // recoverHandlerPanic is used to catch all handler panics, and re-route
 // them if necessary.
 func recoverHandlerPanic(client *Client, event *Event, id string, skip int) {
@@ -431,22 +715,35 @@ func recoverHandlerPanic(client *Client, event *Event, id string, skip int) {
 		return
 	}
 
+	client.Config.RecoverFunc(client, newHandlerError(event, id, perr, skip+1))
+}
+
+// newHandlerError creates a HandlerError from a recovered panic, skipping
+// skip stack frames (see runtime.Callers) to find where the panic originated.
+func newHandlerError(event *Event, id string, perr interface{}, skip int) *HandlerError {
 	var file, function string
 	var line int
 	var ok bool
 
-	var pcs [10]uintptr
+	var pcs [20]uintptr
 	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip, pcs[:])])
 	for {
-		frame, _ := frames.Next()
+		frame, more := frames.Next()
 		file = frame.File
 		line = frame.Line
 		function = frame.Function
 
-		break
+		// Runtime errors (e.g. nil pointer dereferences) are raised from
+		// within the runtime (e.g. runtime.panicmem, runtime.sigpanic), so
+		// skip those to find the handler which caused the panic. This also
+		// makes the result independent of how the handler was invoked (e.g.
+		// from an extra goroutine when using Config.HandlerTimeout).
+		if !more || !strings.HasPrefix(function, "runtime.") {
+			break
+		}
 	}
 
-	err := &HandlerError{
+	return &HandlerError{
 		Event:  *event,
 		ID:     id,
 		File:   file,
@@ -456,8 +753,6 @@ func recoverHandlerPanic(client *Client, event *Event, id string, skip int) {
 		Stack:  debug.Stack(),
 		callOk: ok,
 	}
-
-	client.Config.RecoverFunc(client, err)
 }
 
 // HandlerError is the error returned when a panic is intentionally recovered
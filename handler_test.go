@@ -0,0 +1,496 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func benchmarkRunHandlers(b *testing.B, share bool) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+	c.Config.ShareEventPointers = share
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {})
+
+	event := ParseEvent("@time=2011-10-19T16:40:51.620Z;msgid=abc :nick!user@host PRIVMSG #channel :hello world")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.RunHandlers(event)
+	}
+}
+
+func BenchmarkRunHandlersCopy(b *testing.B)  { benchmarkRunHandlers(b, false) }
+func BenchmarkRunHandlersShare(b *testing.B) { benchmarkRunHandlers(b, true) }
+
+func TestCallerAddPriority(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	c.Handlers.AddPriority(PRIVMSG, 10, func(c *Client, e Event) { record("10") })
+	c.Handlers.AddPriority(PRIVMSG, 10, func(c *Client, e Event) { record("10") })
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		// Slow handler, which must still complete before the next tier.
+		time.Sleep(50 * time.Millisecond)
+		record("0")
+	})
+	c.Handlers.AddPriority(PRIVMSG, -5, func(c *Client, e Event) { record("-5") })
+
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"-5", "0", "10", "10"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("handlers executed in order %v, want %v", order, want)
+	}
+}
+
+func TestCallerOnce(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+
+	var mu sync.Mutex
+	var calls int
+	c.Handlers.Once(PRIVMSG, func(c *Client, e Event) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+		}()
+	}
+	wg.Wait()
+
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if calls != 1 {
+		t.Fatalf("Caller.Once() handler executed %d times, want 1", calls)
+	}
+
+	if count := c.Handlers.Count(PRIVMSG); count != 0 {
+		t.Fatalf("Caller.Count() == %d after Caller.Once() handler executed, want 0", count)
+	}
+}
+
+func TestCallerOnceConcurrentDispatch(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+
+	// Dispatch events while the handler is being registered, which shouldn't
+	// race with the assignment of the cuid used to remove it.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+			}
+		}
+	}()
+
+	var calls int32
+	for i := 0; i < 50; i++ {
+		c.Handlers.Once(PRIVMSG, func(c *Client, e Event) { atomic.AddInt32(&calls, 1) })
+	}
+
+	waitFor(t, "Caller.Once() handlers to be removed", func() bool {
+		return c.Handlers.Count(PRIVMSG) == 0
+	})
+	close(stop)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 50 {
+		t.Fatalf("Caller.Once() handlers executed %d times, want 50", got)
+	}
+}
+
+func TestCallerAddContext(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	c.Handlers.AddBgContext(PRIVMSG, func(ctx context.Context, c *Client, e Event) {
+		close(started)
+
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	})
+
+	errchan := mockConnect(t, c, server)
+
+	conn.Write([]byte(":nick!user@host PRIVMSG test :hello\r\n"))
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for context handler to start")
+	}
+
+	c.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context wasn't cancelled when the client was closed")
+	}
+
+	select {
+	case <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.MockConnect() didn't return after close")
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		EventFilter: func(e *Event) bool {
+			return e.Source == nil || e.Source.Name != "spammer"
+		},
+	})
+
+	var mu sync.Mutex
+	var received []string
+	record := func(c *Client, e Event) {
+		mu.Lock()
+		received = append(received, e.Command+" "+e.Source.Name)
+		mu.Unlock()
+	}
+	c.Handlers.Add(PRIVMSG, record)
+	c.Handlers.AddBg(PRIVMSG, record)
+	c.Handlers.Add(ALL_EVENTS, record)
+
+	var ctcps int32
+	c.CTCP.Set("FOO", func(client *Client, ctcp CTCPEvent) { atomic.AddInt32(&ctcps, 1) })
+
+	c.RunHandlers(ParseEvent(":spammer!user@host.com PRIVMSG #channel :buy now"))
+	c.RunHandlers(ParseEvent(":spammer!user@host.com PRIVMSG test :\x01FOO\x01"))
+	c.RunHandlers(ParseEvent(":nick!user@host.com PRIVMSG #channel :hello"))
+
+	// Allow the background handler to run.
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := []string{"PRIVMSG nick", "PRIVMSG nick", "PRIVMSG nick"}; !reflect.DeepEqual(received, want) {
+		t.Fatalf("handlers received %q, want %q", received, want)
+	}
+
+	if n := atomic.LoadInt32(&ctcps); n != 0 {
+		t.Fatalf("CTCP handler called %d times for a filtered event", n)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	var mu sync.Mutex
+	var received []string
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		mu.Lock()
+		received = append(received, e.Source.Name+": "+e.Last())
+		mu.Unlock()
+	})
+
+	c.Ignore("*!*@spam.example.com")
+	c.Ignore("*!*@SPAM.example.com")
+	c.Ignore("troll!*@*")
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if !c.IsIgnored(&Source{Name: "Troll", Ident: "user", Host: "host.com"}) || c.IsIgnored(&Source{Name: "nick", Ident: "user", Host: "host.com"}) {
+		t.Fatal("Client.IsIgnored() returned unexpected result")
+	}
+
+	conn.Write([]byte(":test!user@host.com JOIN #channel\r\n"))
+	conn.Write([]byte(":spammer!user@spam.example.com JOIN #channel\r\n"))
+	conn.Write([]byte(":spammer!user@spam.example.com PRIVMSG #channel :buy now\r\n"))
+	conn.Write([]byte(":spammer!user@spam.example.com PRIVMSG test :\x01VERSION\x01\r\n"))
+	conn.Write([]byte(":nick!user@host.com PRIVMSG #channel :hello\r\n"))
+
+	// State tracking still processes events from ignored users.
+	waitFor(t, "ignored user tracked", func() bool {
+		user := c.LookupUser("spammer")
+		return user != nil && user.InChannel("#channel")
+	})
+
+	// No CTCP VERSION reply should have been sent to the ignored user. CTCP
+	// handlers run in the background, so give them time to run.
+	time.Sleep(50 * time.Millisecond)
+	c.Cmd.Message("#other", "done")
+
+	for line := range lines {
+		if strings.HasPrefix(line, "NOTICE spammer") {
+			t.Fatalf("replied to ignored user: %q", line)
+		}
+
+		if line == "PRIVMSG #other done" {
+			break
+		}
+	}
+
+	c.Unignore("*!*@spam.example.com")
+	conn.Write([]byte(":spammer!user@spam.example.com PRIVMSG #channel :unignored\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := []string{"nick: hello", "spammer: unignored"}; !reflect.DeepEqual(received, want) {
+		t.Fatalf("handlers received %q, want %q", received, want)
+	}
+}
+
+func TestCallerUse(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	// Registered before any middleware, so should not be wrapped.
+	c.Handlers.Add(NOTICE, func(c *Client, e Event) {})
+
+	var count int32
+	c.Handlers.Use(func(next HandlerFunc) HandlerFunc {
+		return func(c *Client, e Event) {
+			atomic.AddInt32(&count, 1)
+			record("outer")
+			next(c, e)
+		}
+	})
+	c.Handlers.Use(func(next HandlerFunc) HandlerFunc {
+		return func(c *Client, e Event) {
+			record("inner")
+			next(c, e)
+		}
+	})
+
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { record("handler") })
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+	c.RunHandlers(ParseEvent(":nick!user@host NOTICE #channel :hello"))
+
+	mu.Lock()
+	want := []string{"outer", "inner", "handler"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("middleware executed in order %v, want %v", order, want)
+	}
+	mu.Unlock()
+
+	done := make(chan struct{})
+	c.Handlers.AddBg(JOIN, func(c *Client, e Event) { close(done) })
+	c.RunHandlers(ParseEvent(":nick!user@host JOIN #channel"))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for background handler")
+	}
+
+	if got := atomic.LoadInt32(&count); got != 2 {
+		t.Fatalf("middleware executed %d times, want 2", got)
+	}
+}
+
+func TestCallerAddSafe(t *testing.T) {
+	c := New(Config{
+		Server: "dummy.int",
+		Port:   6667,
+		Nick:   "test",
+		User:   "test",
+		Name:   "Testing123",
+	})
+
+	errs := make(chan *HandlerError, 1)
+	cuid := c.Handlers.AddSafe(PRIVMSG, func(c *Client, e Event) {
+		panic("boom")
+	}, errs)
+
+	var count int32
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) { atomic.AddInt32(&count, 1) })
+
+	// Without Config.RecoverFunc, this would take down the client.
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+
+	if got := atomic.LoadInt32(&count); got != 2 {
+		t.Fatalf("other handler executed %d times, want 2", got)
+	}
+
+	select {
+	case err := <-errs:
+		if err.ID != cuid || err.Panic != "boom" {
+			t.Fatalf("got HandlerError{ID: %q, Panic: %v}, want HandlerError{ID: %q, Panic: boom}", err.ID, err.Panic, cuid)
+		}
+
+		if !strings.Contains(err.Func, "TestCallerAddSafe") {
+			t.Fatalf("HandlerError.Func = %q, want the panicking handler", err.Func)
+		}
+	default:
+		t.Fatal("recovered panic wasn't sent to errs")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	c := New(Config{
+		Server:         "dummy.int",
+		Port:           6667,
+		Nick:           "test",
+		User:           "test",
+		Name:           "Testing123",
+		HandlerTimeout: 50 * time.Millisecond,
+	})
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	c.Handlers.Add(PRIVMSG, func(c *Client, e Event) {
+		<-release
+		close(finished)
+	})
+
+	start := time.Now()
+	c.RunHandlers(ParseEvent(":nick!user@host PRIVMSG #channel :hello"))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("RunHandlers() blocked for %s, want it to give up after the timeout", elapsed)
+	}
+
+	// The slow handler should still be running in the background.
+	select {
+	case <-finished:
+		t.Fatal("slow handler finished before being released")
+	default:
+	}
+
+	close(release)
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for slow handler to finish")
+	}
+
+	// Handlers that complete within the timeout should still be waited on.
+	var count int32
+	c.Handlers.Add(NOTICE, func(c *Client, e Event) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&count, 1)
+	})
+	c.RunHandlers(ParseEvent(":nick!user@host NOTICE #channel :hello"))
+
+	if got := atomic.LoadInt32(&count); got != 1 {
+		t.Fatalf("fast handler executed %d times before RunHandlers() returned, want 1", got)
+	}
+
+	// Builtin handlers should always be waited on, regardless of the timeout.
+	var builtin int32
+	c.Handlers.register(true, false, "TEST_BUILTIN", HandlerFunc(func(c *Client, e Event) {
+		time.Sleep(150 * time.Millisecond)
+		atomic.AddInt32(&builtin, 1)
+	}))
+	c.RunHandlers(&Event{Command: "TEST_BUILTIN"})
+
+	if got := atomic.LoadInt32(&builtin); got != 1 {
+		t.Fatalf("builtin handler executed %d times before RunHandlers() returned, want 1", got)
+	}
+
+	// Panics should be attributed to the handler, even when running it in
+	// another goroutine, and for runtime errors.
+	errs := make(chan *HandlerError, 1)
+	c.Config.RecoverFunc = func(c *Client, e *HandlerError) { errs <- e }
+	c.Handlers.Add(TOPIC, func(c *Client, e Event) {
+		var event *Event
+		_ = event.Command
+	})
+	c.RunHandlers(ParseEvent(":nick!user@host TOPIC #channel :hello"))
+
+	select {
+	case err := <-errs:
+		if !strings.HasSuffix(err.File, "handler_test.go") || !strings.Contains(err.Func, "TestHandlerTimeout") {
+			t.Fatalf("HandlerError at %s:%d (%s), want the panicking handler", err.File, err.Line, err.Func)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for recovered panic")
+	}
+}
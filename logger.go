@@ -0,0 +1,47 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+// StructuredLogger is used to log connection lifecycle and error events
+// (e.g. connecting, disconnects, reconnects, STS upgrades and ping timeouts)
+// with levels and fields. See Config.StructuredLogger. keyvals are
+// alternating keys and values, e.g. "server", "irc.example.com:6697".
+// Methods are called synchronously from the clients internal loops, and as
+// such, should not block.
+//
+// *slog.Logger (Go 1.21+) implements StructuredLogger, see also
+// NewSlogLogger(). Raw line logging is still done using Config.Debug.
+type StructuredLogger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NopLogger is a StructuredLogger implementation which does nothing. This is
+// the default if Config.StructuredLogger is nil.
+type NopLogger struct{}
+
+// Debug implements StructuredLogger.
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+
+// Info implements StructuredLogger.
+func (NopLogger) Info(msg string, keyvals ...interface{}) {}
+
+// Warn implements StructuredLogger.
+func (NopLogger) Warn(msg string, keyvals ...interface{}) {}
+
+// Error implements StructuredLogger.
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// logger returns the configured structured logger, or NopLogger if one isn't
+// configured.
+func (c *Client) logger() StructuredLogger {
+	if c.Config.StructuredLogger == nil {
+		return NopLogger{}
+	}
+
+	return c.Config.StructuredLogger
+}
@@ -0,0 +1,21 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build go1.21
+
+package girc
+
+import "log/slog"
+
+var _ StructuredLogger = (*slog.Logger)(nil)
+
+// NewSlogLogger returns a StructuredLogger which logs to l, for use with
+// Config.StructuredLogger. If l is nil, slog.Default() is used.
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	if l == nil {
+		return slog.Default()
+	}
+
+	return l
+}
@@ -0,0 +1,29 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build go1.21
+
+package girc
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	logger.Warn("ping timeout", "delay", "1m0s")
+
+	if out := buf.String(); !strings.Contains(out, `level=WARN msg="ping timeout" delay=1m0s`) {
+		t.Fatalf("NewSlogLogger() logged %q", out)
+	}
+
+	if NewSlogLogger(nil) == nil {
+		t.Fatal("NewSlogLogger(nil) returned nil")
+	}
+}
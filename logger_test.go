@@ -0,0 +1,83 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *recordingLogger) log(level, msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	l.entries = append(l.entries, fmt.Sprintf("%s %s %v", level, msg, keyvals))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("DEBUG", msg, keyvals...) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("INFO", msg, keyvals...) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.log("WARN", msg, keyvals...) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("ERROR", msg, keyvals...) }
+
+// has returns true if an entry starting with prefix was logged.
+func (l *recordingLogger) has(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range l.entries {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestStructuredLogger(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	logger := &recordingLogger{}
+	c.Config.StructuredLogger = logger
+
+	errchan := mockConnect(t, c, server)
+	if !logger.has("INFO connected [server dummy.int:6667]") {
+		t.Fatalf("missing connected log entry, got: %q", logger.entries)
+	}
+
+	// The server dropping the connection should be logged as an error.
+	conn.Close()
+	select {
+	case <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	if !logger.has("ERROR disconnected [server dummy.int:6667 error ") {
+		t.Fatalf("missing disconnected log entry, got: %q", logger.entries)
+	}
+
+	conn2, server2 := net.Pipe()
+	defer conn2.Close()
+	defer server2.Close()
+	go mockReadBuffer(conn2)
+
+	mockConnect(t, c, server2)
+	defer c.Close()
+
+	if !logger.has("INFO reconnected [server dummy.int:6667]") {
+		t.Fatalf("missing reconnected log entry, got: %q", logger.entries)
+	}
+}
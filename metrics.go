@@ -0,0 +1,50 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "time"
+
+// Metrics is used to observe the activity of the client, e.g. to export
+// statistics to a monitoring system. See Config.Metrics. Methods are called
+// synchronously from the clients internal loops, and as such, should not
+// block.
+type Metrics interface {
+	// OnEventReceived is called for each event received from the server.
+	OnEventReceived(command string)
+	// OnEventSent is called for each event written to the server.
+	OnEventSent(command string)
+	// OnLatency is called each time the latency to the server is measured
+	// (when a PONG is received in response to the clients PING).
+	OnLatency(d time.Duration)
+	// OnReconnect is called when the client connects to the server, after
+	// having previously been connected (including STS upgrades).
+	OnReconnect()
+}
+
+// NopMetrics is a Metrics implementation which does nothing. This is the
+// default if Config.Metrics is nil.
+type NopMetrics struct{}
+
+// OnEventReceived implements Metrics.
+func (NopMetrics) OnEventReceived(command string) {}
+
+// OnEventSent implements Metrics.
+func (NopMetrics) OnEventSent(command string) {}
+
+// OnLatency implements Metrics.
+func (NopMetrics) OnLatency(d time.Duration) {}
+
+// OnReconnect implements Metrics.
+func (NopMetrics) OnReconnect() {}
+
+// metrics returns the configured metrics implementation, or NopMetrics if
+// one isn't configured.
+func (c *Client) metrics() Metrics {
+	if c.Config.Metrics == nil {
+		return NopMetrics{}
+	}
+
+	return c.Config.Metrics
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mu         sync.Mutex
+	received   map[string]int
+	sent       map[string]int
+	latency    int
+	reconnects int
+}
+
+func (m *recordingMetrics) OnEventReceived(command string) {
+	m.mu.Lock()
+	m.received[command]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) OnEventSent(command string) {
+	m.mu.Lock()
+	m.sent[command]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) OnLatency(d time.Duration) {
+	m.mu.Lock()
+	m.latency++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) OnReconnect() {
+	m.mu.Lock()
+	m.reconnects++
+	m.mu.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	metrics := &recordingMetrics{received: map[string]int{}, sent: map[string]int{}}
+	c.Config.Metrics = metrics
+
+	errchan := mockConnect(t, c, server)
+
+	conn.Write([]byte(":dummy.int PONG dummy.int :12345\r\n"))
+	conn.Write([]byte(":nick!user@host PRIVMSG test :hello\r\n"))
+	conn.Write([]byte(":nick!user@host PRIVMSG test :hello again\r\n"))
+
+	c.Cmd.Message("#channel", "test message")
+	expectLine(t, lines, "PRIVMSG #channel :test message")
+
+	waitFor(t, "metrics", func() bool {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.received[PRIVMSG] == 2 && metrics.sent[PRIVMSG] == 1 && metrics.latency == 1
+	})
+
+	metrics.mu.Lock()
+	if metrics.received[PONG] != 1 {
+		t.Fatalf("Metrics.OnEventReceived(PONG) called %d times, want 1", metrics.received[PONG])
+	}
+
+	for _, cmd := range []string{NICK, USER, PRIVMSG} {
+		if metrics.sent[cmd] != 1 {
+			t.Fatalf("Metrics.OnEventSent(%s) called %d times, want 1", cmd, metrics.sent[cmd])
+		}
+	}
+
+	if metrics.reconnects != 0 {
+		t.Fatalf("Metrics.OnReconnect() called %d times, want 0", metrics.reconnects)
+	}
+	metrics.mu.Unlock()
+
+	c.Close()
+	<-errchan
+
+	// Connecting again should be counted as a reconnect.
+	conn2, server2 := net.Pipe()
+	defer conn2.Close()
+	defer server2.Close()
+	go mockReadBuffer(conn2)
+
+	mockConnect(t, c, server2)
+	defer c.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.reconnects != 1 {
+		t.Fatalf("Metrics.OnReconnect() called %d times, want 1", metrics.reconnects)
+	}
+}
@@ -6,6 +6,7 @@ package girc
 
 import (
 	"encoding/json"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -117,6 +118,35 @@ func (c *CModes) Get(mode string) (args string, ok bool) {
 	return "", false
 }
 
+// cmodesJSON is the JSON representation of CModes.
+type cmodesJSON struct {
+	Supported string `json:"supported"`
+	Prefixes  string `json:"prefixes"`
+	Modes     string `json:"modes"`
+}
+
+// MarshalJSON implements json.Marshaler. The modes are encoded along with
+// the modes supported by the server, so they can be parsed when decoded.
+func (c CModes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cmodesJSON{Supported: c.raw, Prefixes: c.prefixes, Modes: c.String()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *CModes) UnmarshalJSON(data []byte) error {
+	var raw cmodesJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*c = NewCModes(raw.Supported, raw.Prefixes)
+
+	if fields := strings.Fields(raw.Modes); len(fields) > 0 {
+		c.Apply(c.Parse(fields[0], fields[1:]))
+	}
+
+	return nil
+}
+
 // hasArg checks to see if the mode supports arguments. What ones support this?:
 //
 //	A = Mode that adds or removes a nick or address to a list. Always has a parameter.
@@ -166,11 +196,17 @@ func (c *CModes) Apply(modes []CMode) {
 			if !modes[i].setting {
 				continue
 			}
-			if c.modes[j].name == modes[i].name && modes[i].add {
+			if c.modes[j].name != modes[i].name {
+				continue
+			}
+
+			// Replace the mode when re-set (e.g. a new limit), or drop it
+			// when removed.
+			if modes[i].add {
 				newModes = append(newModes, modes[i])
-				isin = true
-				break
 			}
+			isin = true
+			break
 		}
 
 		if !isin {
@@ -328,9 +364,22 @@ func handleMODE(c *Client, e Event) {
 		// RPL_CHANNELMODEIS sends the user as the first param, skip it.
 		e.Params = e.Params[1:]
 	}
-	// Should be at least MODE <target> <flags>, to be useful. As well, only
-	// tracking channel modes at the moment.
-	if len(e.Params) < 2 || !IsValidChannel(e.Params[0]) {
+	// Should be at least MODE <target> <flags>, to be useful.
+	if len(e.Params) < 2 {
+		return
+	}
+
+	if !IsValidChannel(e.Params[0]) {
+		// Our own user modes.
+		c.state.Lock()
+		if c.state.id(e.Params[0]) != c.state.id(c.state.nick) {
+			c.state.Unlock()
+			return
+		}
+
+		c.state.userModes = applyUserModes(c.state.userModes, e.Params[1])
+		c.state.Unlock()
+		c.state.notify(c, UPDATE_GENERAL)
 		return
 	}
 
@@ -394,6 +443,9 @@ func (s *state) userPrefixes() string {
 type UserPerms struct {
 	mu       sync.RWMutex
 	channels map[string]Perms
+	// casemapping is the casemapping used to normalize channel names (see
+	// state.id()).
+	casemapping string
 }
 
 // Copy returns a deep copy of the channel permissions.
@@ -403,6 +455,7 @@ func (p *UserPerms) Copy() (perms *UserPerms) {
 	}
 
 	p.mu.RLock()
+	np.casemapping = p.casemapping
 	for key := range p.channels {
 		np.channels[key] = p.channels[key]
 	}
@@ -420,11 +473,41 @@ func (p *UserPerms) MarshalJSON() ([]byte, error) {
 	return out, err
 }
 
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *UserPerms) UnmarshalJSON(data []byte) error {
+	channels := make(map[string]Perms)
+	if err := json.Unmarshal(data, &channels); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.channels = make(map[string]Perms, len(channels))
+	for name, perms := range channels {
+		p.channels[ToCaseMapping(p.casemapping, name)] = perms
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+// setCaseMapping changes the casemapping used to normalize channel names,
+// re-normalizing any existing channels.
+func (p *UserPerms) setCaseMapping(casemapping string) {
+	p.mu.Lock()
+	channels := make(map[string]Perms, len(p.channels))
+	for name, perms := range p.channels {
+		channels[ToCaseMapping(casemapping, name)] = perms
+	}
+	p.channels = channels
+	p.casemapping = casemapping
+	p.mu.Unlock()
+}
+
 // Lookup looks up the users permissions for a given channel. ok is false
 // if the user is not in the given channel.
 func (p *UserPerms) Lookup(channel string) (perms Perms, ok bool) {
 	p.mu.RLock()
-	perms, ok = p.channels[ToRFC1459(channel)]
+	perms, ok = p.channels[ToCaseMapping(p.casemapping, channel)]
 	p.mu.RUnlock()
 
 	return perms, ok
@@ -432,13 +515,13 @@ func (p *UserPerms) Lookup(channel string) (perms Perms, ok bool) {
 
 func (p *UserPerms) set(channel string, perms Perms) {
 	p.mu.Lock()
-	p.channels[ToRFC1459(channel)] = perms
+	p.channels[ToCaseMapping(p.casemapping, channel)] = perms
 	p.mu.Unlock()
 }
 
 func (p *UserPerms) remove(channel string) {
 	p.mu.Lock()
-	delete(p.channels, ToRFC1459(channel))
+	delete(p.channels, ToCaseMapping(p.casemapping, channel))
 	p.mu.Unlock()
 }
 
@@ -549,3 +632,50 @@ func parseUserPrefix(raw string) (modes, nick string, success bool) {
 
 	return
 }
+
+// handleUMODEIS handles RPL_UMODEIS, which contains our current user modes,
+// e.g. in response to "MODE <our nick>".
+func handleUMODEIS(c *Client, e Event) {
+	// <client> <user modes>
+	if len(e.Params) < 2 {
+		return
+	}
+
+	c.state.Lock()
+	c.state.userModes = applyUserModes("", e.Params[1])
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_GENERAL)
+}
+
+// applyUserModes applies the user mode changes in flags (e.g. "+iw-x") to
+// modes (e.g. "ix"), returning the sorted result (e.g. "iw").
+func applyUserModes(modes, flags string) string {
+	set := make(map[rune]bool, len(modes))
+	for _, mode := range modes {
+		set[mode] = true
+	}
+
+	add := true
+	for _, mode := range flags {
+		switch mode {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			if add {
+				set[mode] = true
+			} else {
+				delete(set, mode)
+			}
+		}
+	}
+
+	out := make([]rune, 0, len(set))
+	for mode := range set {
+		out = append(out, mode)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+
+	return string(out)
+}
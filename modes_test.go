@@ -0,0 +1,152 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import "testing"
+
+func TestCModesApply(t *testing.T) {
+	modes := NewCModes(ModeDefaults, DefaultPrefixes)
+
+	modes.Apply(modes.Parse("+ntlk", []string{"50", "secret"}))
+	if got := modes.String(); got != "+ntlk 50 secret" {
+		t.Fatalf("CModes.String() == %q, want %q", got, "+ntlk 50 secret")
+	}
+
+	// Bans and user prefixes aren't settings, so aren't stored.
+	modes.Apply(modes.Parse("+bo", []string{"*!*@host", "nick"}))
+	if modes.HasMode("b") || modes.HasMode("o") {
+		t.Fatalf("CModes.Apply() stored non-setting modes: %q", modes.String())
+	}
+
+	modes.Apply(modes.Parse("+l-k", []string{"100", "secret"}))
+	if got := modes.String(); got != "+ntl 100" {
+		t.Fatalf("CModes.String() == %q, want %q", got, "+ntl 100")
+	}
+
+	modes.Apply(modes.Parse("-tl", nil))
+	if got := modes.String(); got != "+n" {
+		t.Fatalf("CModes.String() == %q, want %q", got, "+n")
+	}
+}
+
+func TestChannelLimitKey(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	c.state.Lock()
+	c.state.createChannel("#channel")
+	c.state.Unlock()
+
+	check := func(wantLimit int, limitOK bool, wantKey string, keyOK bool) {
+		t.Helper()
+
+		ch := c.LookupChannel("#channel")
+		if ch == nil {
+			t.Fatal("channel not found in state")
+		}
+
+		if limit, ok := ch.Limit(); limit != wantLimit || ok != limitOK {
+			t.Fatalf("Channel.Limit() == (%d, %t), want (%d, %t)", limit, ok, wantLimit, limitOK)
+		}
+
+		if key, ok := ch.Key(); key != wantKey || ok != keyOK {
+			t.Fatalf("Channel.Key() == (%q, %t), want (%q, %t)", key, ok, wantKey, keyOK)
+		}
+	}
+
+	check(0, false, "", false)
+
+	c.RunHandlers(ParseEvent(":dummy.int 324 test #channel +ntlk 50 secret"))
+	check(50, true, "secret", true)
+
+	c.RunHandlers(ParseEvent(":op!user@host MODE #channel +l 100"))
+	check(100, true, "secret", true)
+
+	c.RunHandlers(ParseEvent(":op!user@host MODE #channel -lk secret"))
+	check(0, false, "", false)
+}
+
+func TestChannelHasModeArg(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	c.state.Lock()
+	c.state.createChannel("#channel")
+	c.state.Unlock()
+
+	c.RunHandlers(ParseEvent(":dummy.int 324 test #channel +ntl 50"))
+	c.RunHandlers(ParseEvent(":op!user@host MODE #channel +b *!*@host"))
+
+	ch := c.LookupChannel("#channel")
+	if ch == nil {
+		t.Fatal("channel not found in state")
+	}
+
+	tests := []struct {
+		name    string
+		mode    byte
+		has     bool
+		wantArg string
+		argOK   bool
+	}{
+		{name: "with argument", mode: 'l', has: true, wantArg: "50", argOK: true},
+		{name: "without argument", mode: 'n', has: true},
+		{name: "absent", mode: 'm'},
+		{name: "list mode", mode: 'b'},
+	}
+
+	for _, tt := range tests {
+		if has := ch.HasMode(tt.mode); has != tt.has {
+			t.Errorf("%s: Channel.HasMode(%q) == %t, want %t", tt.name, tt.mode, has, tt.has)
+		}
+
+		if arg, ok := ch.ModeArg(tt.mode); arg != tt.wantArg || ok != tt.argOK {
+			t.Errorf("%s: Channel.ModeArg(%q) == (%q, %t), want (%q, %t)", tt.name, tt.mode, arg, ok, tt.wantArg, tt.argOK)
+		}
+	}
+}
+
+func TestApplyUserModes(t *testing.T) {
+	tests := []struct {
+		modes, flags, want string
+	}{
+		{"", "+iw", "iw"},
+		{"iw", "-w", "i"},
+		{"i", "+x-i+B", "Bx"},
+		{"iw", "+i", "iw"},
+		{"", "-i", ""},
+	}
+
+	for _, tt := range tests {
+		if got := applyUserModes(tt.modes, tt.flags); got != tt.want {
+			t.Errorf("applyUserModes(%q, %q) = %q, want %q", tt.modes, tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestClientUserModes(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	conn.Write([]byte(":test MODE test :+iw\r\n"))
+	waitFor(t, "user modes", func() bool { return c.UserModes() == "+iw" })
+
+	// Modes targeting other users don't affect us.
+	conn.Write([]byte(":dummy.int MODE other :-i\r\n"))
+	conn.Write([]byte(":test MODE test :-w\r\n"))
+	waitFor(t, "user modes", func() bool { return c.UserModes() == "+i" })
+}
@@ -0,0 +1,447 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueryTimedOut is returned when a query sent to the server (e.g.
+// Client.BanList()) doesn't receive a complete response before the supplied
+// timeout. This is separate from ErrTimedOut, which is specific to keep-alive
+// PINGs (and whose fields only describe PINGs), and means the connection
+// itself is likely dead, whereas a query timing out doesn't.
+var ErrQueryTimedOut = errors.New("timed out waiting for query response")
+
+// ErrQueryFailed is returned when the server responds to a query (e.g.
+// Client.SetTopic()) with an error numeric. Event is the error numeric
+// returned by the server.
+type ErrQueryFailed struct {
+	Event *Event
+}
+
+func (e ErrQueryFailed) Error() string {
+	if e.Event == nil {
+		return "query failed"
+	}
+
+	return fmt.Sprintf("query failed: %s (%s)", e.Event.Last(), e.Event.Command)
+}
+
+// Request sends event, and collects all events with the command collect
+// (e.g. RPL_LINKS), until an event with the command terminator (e.g.
+// RPL_ENDOFLINKS) is received. The collected events are returned, excluding
+// the terminator. This is useful for queries which receive a numeric reply
+// per result, like LINKS, STATS or MAP. Returns ErrQueryTimedOut if the
+// terminator wasn't received before timeout.
+//
+// Note that responses are matched by command only, so concurrent queries
+// using the same commands may receive each others responses.
+func (c *Client) Request(event *Event, collect, terminator string, timeout time.Duration) ([]*Event, error) {
+	return c.request([]*Event{event}, timeout, func(e *Event) (bool, bool) {
+		return e.Command == collect, e.Command == terminator
+	})
+}
+
+// lastLabel is used to generate unique labels for Client.LabeledRequest().
+var lastLabel uint64
+
+// LabeledRequest sends event with a unique "label" tag, using the IRCv3
+// labeled-response capability, and waits for the response(s) to it. Unlike
+// Client.Request(), responses are matched precisely using the label, so
+// concurrent queries can't receive each others responses. If the server
+// responds with a batch, the events within it (including those within
+// nested batches) are returned. If the server has no response, no events
+// are returned. Returns ErrCapNotEnabled if the server doesn't support
+// labeled-response, or ErrQueryTimedOut if the response wasn't received
+// before timeout.
+func (c *Client) LabeledRequest(event *Event, timeout time.Duration) ([]*Event, error) {
+	if err := c.requireCap("labeled-response"); err != nil {
+		return nil, err
+	}
+
+	label := "girc" + strconv.FormatUint(atomic.AddUint64(&lastLabel, 1), 10)
+
+	event = event.Copy()
+	if event.Tags == nil {
+		event.Tags = Tags{}
+	}
+	event.Tags["label"] = label
+
+	var mu sync.Mutex
+	var outer string
+	batches := map[string]bool{}
+
+	return c.request([]*Event{event}, timeout, func(e *Event) (collect, done bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var start, end string
+		if e.Command == BATCH && len(e.Params) > 0 && len(e.Params[0]) > 1 {
+			switch e.Params[0][0] {
+			case '+':
+				start = e.Params[0][1:]
+			case '-':
+				end = e.Params[0][1:]
+			}
+		}
+
+		if l, _ := e.Tags.Get("label"); l == label && outer == "" {
+			switch {
+			case e.Command == CAP_ACK:
+				// The server has no response.
+				return false, true
+			case start != "":
+				outer = start
+				batches[start] = true
+				return false, false
+			default:
+				return true, true
+			}
+		}
+
+		if outer != "" && end == outer {
+			return false, true
+		}
+
+		if ref, _ := e.Tags.Get("batch"); ref == "" || !batches[ref] {
+			return false, false
+		}
+
+		if start != "" {
+			batches[start] = true
+		}
+
+		return true, false
+	})
+}
+
+// request sends events, and passes all incoming events to match, until match
+// returns done. Events for which match returns collect are returned. match
+// may be called concurrently. Returns ErrQueryTimedOut if match doesn't
+// return done before timeout.
+func (c *Client) request(events []*Event, timeout time.Duration, match func(e *Event) (collect, done bool)) ([]*Event, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	var mu sync.Mutex
+	var once sync.Once
+	collected := []*Event{}
+	done := make(chan struct{})
+
+	// Middleware shouldn't be able to drop or delay the responses we're
+	// waiting on.
+	cuid := c.Handlers.AddHandler(ALL_EVENTS, libraryHandler{HandlerFunc(func(c *Client, e Event) {
+		collect, end := match(&e)
+
+		if collect {
+			mu.Lock()
+			collected = append(collected, e.Copy())
+			mu.Unlock()
+		}
+
+		if end {
+			once.Do(func() { close(done) })
+		}
+	})})
+	defer c.Handlers.Remove(cuid)
+
+	if err := c.SendBulk(events...); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return nil, ErrQueryTimedOut
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return collected, nil
+}
+
+// BanEntry is a single entry within a channels ban list. See
+// Client.BanList().
+type BanEntry struct {
+	// Mask is the mask that is banned.
+	Mask string `json:"mask"`
+	// SetBy is who set the ban. This may be empty if the server doesn't
+	// provide it.
+	SetBy string `json:"set_by"`
+	// SetAt is when the ban was set. This may be the zero value if the server
+	// doesn't provide it.
+	SetAt time.Time `json:"set_at"`
+}
+
+// BanList queries the server for the ban list of the given channel, and
+// waits for the full response (RPL_BANLIST, until RPL_ENDOFBANLIST). Returns
+// ErrQueryTimedOut if the full ban list wasn't received before timeout.
+// Note that you may need to be in the channel, or have elevated permissions
+// within the channel, to see the ban list.
+func (c *Client) BanList(channel string, timeout time.Duration) ([]BanEntry, error) {
+	if !IsValidChannel(channel) {
+		return nil, ErrInvalidTarget{Target: channel}
+	}
+
+	events, err := c.request([]*Event{{Command: MODE, Params: []string{channel, "+b"}}}, timeout, func(e *Event) (collect, done bool) {
+		if len(e.Params) < 3 || c.CaseMap(e.Params[1]) != c.CaseMap(channel) {
+			return false, false
+		}
+
+		return e.Command == RPL_BANLIST, e.Command == RPL_ENDOFBANLIST
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []BanEntry{}
+	for _, e := range events {
+		// <client> <channel> <mask> [<who> <set-ts>]
+		entry := BanEntry{Mask: e.Params[2]}
+
+		if len(e.Params) > 4 {
+			entry.SetBy = e.Params[3]
+
+			if ts, err := strconv.ParseInt(e.Params[4], 10, 64); err == nil {
+				entry.SetAt = time.Unix(ts, 0)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// IsOn queries the server to check which of the given nicknames are currently
+// online, using ISON. This is useful for networks which don't support
+// MONITOR. The nicknames are split across multiple ISON queries if needed.
+// The returned map contains every (deduplicated) nickname supplied, and if
+// they are online. Returns ErrQueryTimedOut if the server doesn't respond to
+// all queries before timeout.
+func (c *Client) IsOn(timeout time.Duration, nicks ...string) (map[string]bool, error) {
+	online := make(map[string]bool)
+	lookup := make(map[string]string)
+
+	var queries []*Event
+	query := &Event{Command: ISON}
+	max := c.MaxEventLength()
+
+	for _, nick := range nicks {
+		if !IsValidNick(nick) {
+			return nil, ErrInvalidTarget{Target: nick}
+		}
+
+		if _, ok := lookup[c.CaseMap(nick)]; ok {
+			continue
+		}
+
+		lookup[c.CaseMap(nick)] = nick
+		online[nick] = false
+
+		if len(query.Params) > 0 && query.Len()+len(nick)+1 > max {
+			queries = append(queries, query)
+			query = &Event{Command: ISON}
+		}
+
+		query.Params = append(query.Params, nick)
+	}
+
+	if len(query.Params) > 0 {
+		queries = append(queries, query)
+	}
+
+	if len(queries) == 0 {
+		return online, nil
+	}
+
+	var mu sync.Mutex
+	var responses int
+
+	events, err := c.request(queries, timeout, func(e *Event) (collect, done bool) {
+		if e.Command != RPL_ISON {
+			return false, false
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		responses++
+		return true, responses >= len(queries)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		// <client> :[<nickname>{ <nickname>}]
+		if len(e.Params) < 2 {
+			continue
+		}
+
+		for _, nick := range strings.Fields(e.Last()) {
+			if orig, ok := lookup[c.CaseMap(nick)]; ok {
+				online[orig] = true
+			}
+		}
+	}
+
+	return online, nil
+}
+
+// Names queries the server for the current members of channel using NAMES,
+// and waits for the full response (RPL_NAMREPLY, until RPL_ENDOFNAMES). The
+// returned nicknames have any user prefixes (e.g. "@" or "+") stripped. This
+// works even when tracking is disabled. Returns ErrQueryTimedOut if the full
+// response wasn't received before timeout.
+func (c *Client) Names(channel string, timeout time.Duration) ([]string, error) {
+	if !IsValidChannel(channel) {
+		return nil, ErrInvalidTarget{Target: channel}
+	}
+
+	events, err := c.request([]*Event{{Command: NAMES, Params: []string{channel}}}, timeout, func(e *Event) (collect, done bool) {
+		switch e.Command {
+		case RPL_NAMREPLY:
+			// <client> <symbol> <channel> :[prefix]<nick>{ [prefix]<nick>}
+			return len(e.Params) >= 4 && c.CaseMap(e.Params[2]) == c.CaseMap(channel), false
+		case RPL_ENDOFNAMES:
+			// <client> <channel> :End of /NAMES list
+			return false, len(e.Params) >= 2 && c.CaseMap(e.Params[1]) == c.CaseMap(channel)
+		}
+
+		return false, false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nicks := []string{}
+	for _, e := range events {
+		for _, raw := range strings.Fields(e.Last()) {
+			_, nick, ok := parseUserPrefix(raw)
+			if !ok {
+				continue
+			}
+
+			// Servers supporting userhost-in-names send "nick!user@host".
+			if src := ParseSource(nick); src != nil {
+				nick = src.Name
+			}
+
+			nicks = append(nicks, nick)
+		}
+	}
+
+	return nicks, nil
+}
+
+// SetTopic sets the topic of channel, and waits for the server to confirm the
+// change (by echoing the TOPIC back to us). Returns ErrQueryFailed if the
+// server refuses the change (e.g. ERR_CHANOPRIVSNEEDED, when we're not a
+// channel operator), ErrTooLong if the topic is longer than the server
+// supports, or ErrQueryTimedOut if no response is received before timeout.
+func (c *Client) SetTopic(channel, topic string, timeout time.Duration) error {
+	if !IsValidChannel(channel) {
+		return ErrInvalidTarget{Target: channel}
+	}
+
+	event := &Event{Command: TOPIC, Params: []string{channel, topic}}
+	if err := c.Cmd.checkLength("topic", "TOPICLEN", topic, event); err != nil {
+		return err
+	}
+
+	events, err := c.request([]*Event{event}, timeout, func(e *Event) (collect, done bool) {
+		switch e.Command {
+		case TOPIC:
+			// :<source> TOPIC <channel> :<topic>
+			if len(e.Params) < 2 || c.CaseMap(e.Params[0]) != c.CaseMap(channel) {
+				return false, false
+			}
+
+			if !c.IsSelf(e.Source) {
+				return false, false
+			}
+
+			return true, true
+		case ERR_CHANOPRIVSNEEDED, ERR_NOTONCHANNEL, ERR_NOSUCHCHANNEL:
+			// <client> <channel> :<reason>
+			if len(e.Params) < 2 || c.CaseMap(e.Params[1]) != c.CaseMap(channel) {
+				return false, false
+			}
+
+			return true, true
+		}
+
+		return false, false
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 && events[0].Command != TOPIC {
+		return ErrQueryFailed{Event: events[0]}
+	}
+
+	return nil
+}
+
+// requireAccountTimeout is how long Client.RequireAccount() waits for a WHOIS
+// response, when the account of a user isn't already known.
+const requireAccountTimeout = 5 * time.Second
+
+// RequireAccount returns the services account the source of e is logged in
+// to, and true, if they're logged in. This is useful to only allow commands
+// from authenticated users. The account is taken from the account-tag of
+// the event, or the tracked user (see User.Extras.Account), falling back to
+// a WHOIS if it's unknown.
+//
+// As this may block while waiting for a WHOIS response, this should be
+// called from a background handler (see Caller.AddBg()), otherwise the
+// response can't be processed, and this will time out.
+func (c *Client) RequireAccount(e Event) (account string, ok bool) {
+	if e.Source == nil || e.Source.Name == "" || e.Source.IsServer() {
+		return "", false
+	}
+
+	if account, ok = e.Tags.Get("account"); ok && account != "" && account != "*" {
+		return account, true
+	}
+
+	if !c.Config.disableTracking {
+		if user := c.LookupUser(e.Source.Name); user != nil && user.Extras.Account != "" {
+			return user.Extras.Account, true
+		}
+	}
+
+	nick := c.CaseMap(e.Source.Name)
+	events, err := c.request([]*Event{{Command: WHOIS, Params: []string{e.Source.Name}}}, requireAccountTimeout, func(r *Event) (collect, done bool) {
+		if len(r.Params) < 2 || c.CaseMap(r.Params[1]) != nick {
+			return false, false
+		}
+
+		switch r.Command {
+		case RPL_WHOISACCOUNT:
+			return len(r.Params) > 2, false
+		case RPL_ENDOFWHOIS, ERR_NOSUCHNICK:
+			return false, true
+		}
+
+		return false, false
+	})
+	if err != nil || len(events) == 0 {
+		return "", false
+	}
+
+	return events[0].Params[2], true
+}
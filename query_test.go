@@ -0,0 +1,493 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	type result struct {
+		entries []BanEntry
+		err     error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		entries, err := c.BanList("#channel", 5*time.Second)
+		results <- result{entries: entries, err: err}
+	}()
+
+	expectLine(t, lines, "MODE #channel +b")
+
+	conn.Write([]byte(":dummy.int 367 test #channel *!*@host1 nick!user@host 1500000000\r\n"))
+	conn.Write([]byte(":dummy.int 367 test #other *!*@host2\r\n"))
+	conn.Write([]byte(":dummy.int 367 test #channel *!*@host3\r\n"))
+	conn.Write([]byte(":dummy.int 368 test #channel :End of channel ban list\r\n"))
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.BanList()")
+	}
+
+	if res.err != nil {
+		t.Fatalf("Client.BanList() returned error: %s", res.err)
+	}
+
+	want := []BanEntry{
+		{Mask: "*!*@host1", SetBy: "nick!user@host", SetAt: time.Unix(1500000000, 0)},
+		{Mask: "*!*@host3"},
+	}
+
+	if len(res.entries) != len(want) {
+		t.Fatalf("Client.BanList() == %#v, want %#v", res.entries, want)
+	}
+
+	for i := range want {
+		if res.entries[i].Mask != want[i].Mask || res.entries[i].SetBy != want[i].SetBy ||
+			!res.entries[i].SetAt.Equal(want[i].SetAt) {
+			t.Fatalf("Client.BanList()[%d] == %#v, want %#v", i, res.entries[i], want[i])
+		}
+	}
+
+	if _, err := c.BanList("#channel", 100*time.Millisecond); err != ErrQueryTimedOut {
+		t.Fatalf("Client.BanList() error == %v, want %v", err, ErrQueryTimedOut)
+	}
+}
+
+func TestIsOn(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Enough nicknames to require multiple ISON queries.
+	nicks := []string{"nick1", "NICK1", "nick2"}
+	for i := 0; i < 60; i++ {
+		nicks = append(nicks, fmt.Sprintf("othernick%d", i))
+	}
+
+	type result struct {
+		online map[string]bool
+		err    error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		online, err := c.IsOn(5*time.Second, nicks...)
+		results <- result{online: online, err: err}
+	}()
+
+	var queries int
+	for queries < 2 {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, "ISON ") {
+				continue
+			}
+
+			if len(line) > c.MaxEventLength() {
+				t.Fatalf("ISON query too long (%d > %d): %q", len(line), c.MaxEventLength(), line)
+			}
+
+			queries++
+			if queries == 1 {
+				conn.Write([]byte(":dummy.int 303 test :Nick1 othernick5\r\n"))
+			} else {
+				conn.Write([]byte(":dummy.int 303 test :\r\n"))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for ISON queries")
+		}
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.IsOn()")
+	}
+
+	if res.err != nil {
+		t.Fatalf("Client.IsOn() returned error: %s", res.err)
+	}
+
+	if len(res.online) != len(nicks)-1 {
+		t.Fatalf("Client.IsOn() returned %d nicks, want %d", len(res.online), len(nicks)-1)
+	}
+
+	for nick, want := range map[string]bool{"nick1": true, "nick2": false, "othernick5": true, "othernick6": false} {
+		if res.online[nick] != want {
+			t.Fatalf("Client.IsOn()[%q] == %t, want %t", nick, res.online[nick], want)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	type result struct {
+		nicks []string
+		err   error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		nicks, err := c.Names("#channel", 5*time.Second)
+		results <- result{nicks: nicks, err: err}
+	}()
+
+	expectLine(t, lines, "NAMES #channel")
+
+	conn.Write([]byte(":dummy.int 353 test = #other :nick9\r\n"))
+	conn.Write([]byte(":dummy.int 353 test = #channel :@nick1 +nick2 nick3\r\n"))
+	conn.Write([]byte(":dummy.int 353 test = #channel :@+nick4!user@host.com\r\n"))
+	conn.Write([]byte(":dummy.int 366 test #channel :End of /NAMES list.\r\n"))
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.Names()")
+	}
+
+	if res.err != nil {
+		t.Fatalf("Client.Names() returned error: %s", res.err)
+	}
+
+	want := []string{"nick1", "nick2", "nick3", "nick4"}
+	if !reflect.DeepEqual(res.nicks, want) {
+		t.Fatalf("Client.Names() == %v, want %v", res.nicks, want)
+	}
+}
+
+func TestSetTopic(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	results := make(chan error, 1)
+	go func() { results <- c.SetTopic("#channel", "new topic", 5*time.Second) }()
+
+	expectLine(t, lines, "TOPIC #channel :new topic")
+
+	// Topic changes by other users, or in other channels, are ignored.
+	conn.Write([]byte(":other!user@host.com TOPIC #channel :other topic\r\n"))
+	conn.Write([]byte(":test!user@host.com TOPIC #other :new topic\r\n"))
+	conn.Write([]byte(":test!user@host.com TOPIC #channel :new topic\r\n"))
+
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatalf("Client.SetTopic() returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.SetTopic()")
+	}
+
+	go func() { results <- c.SetTopic("#channel", "another topic", 5*time.Second) }()
+
+	expectLine(t, lines, "TOPIC #channel :another topic")
+	conn.Write([]byte(":dummy.int 482 test #channel :You're not channel operator\r\n"))
+
+	select {
+	case err := <-results:
+		e, ok := err.(ErrQueryFailed)
+		if !ok || e.Event.Command != ERR_CHANOPRIVSNEEDED {
+			t.Fatalf("Client.SetTopic() when refused returned %v, want ErrQueryFailed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.SetTopic()")
+	}
+
+	if err := c.SetTopic("invalid", "topic", time.Second); err == nil {
+		t.Fatal("Client.SetTopic() with invalid channel returned nil error")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	type result struct {
+		events []*Event
+		err    error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		events, err := c.Request(&Event{Command: LINKS}, RPL_LINKS, RPL_ENDOFLINKS, 5*time.Second)
+		results <- result{events: events, err: err}
+	}()
+
+	expectLine(t, lines, "LINKS")
+
+	conn.Write([]byte(":dummy.int 364 test * dummy.int :0 Dummy server\r\n"))
+	conn.Write([]byte(":dummy.int NOTICE test :unrelated\r\n"))
+	conn.Write([]byte(":dummy.int 364 test * leaf.int :1 Leaf server\r\n"))
+	conn.Write([]byte(":dummy.int 365 test * :End of /LINKS list.\r\n"))
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.Request()")
+	}
+
+	if res.err != nil {
+		t.Fatalf("Client.Request() returned error: %s", res.err)
+	}
+
+	if len(res.events) != 2 || res.events[0].Params[2] != "dummy.int" || res.events[1].Params[2] != "leaf.int" {
+		t.Fatalf("Client.Request() == %v, want 2 RPL_LINKS events", res.events)
+	}
+
+	if _, err := c.Request(&Event{Command: LINKS}, RPL_LINKS, RPL_ENDOFLINKS, 50*time.Millisecond); err != ErrQueryTimedOut {
+		t.Fatalf("Client.Request() without response = %v, want ErrQueryTimedOut", err)
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Middleware which drops everything shouldn't affect the library's own
+	// handlers.
+	c.Handlers.Use(func(next HandlerFunc) HandlerFunc {
+		return func(c *Client, e Event) {}
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Request(&Event{Command: LINKS}, RPL_LINKS, RPL_ENDOFLINKS, 5*time.Second)
+		errs <- err
+	}()
+
+	expectLine(t, lines, "LINKS")
+	conn.Write([]byte(":dummy.int 365 test * :End of /LINKS list.\r\n"))
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Client.Request() with middleware returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Client.Request()")
+	}
+}
+
+func TestLabeledRequest(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if _, err := c.LabeledRequest(&Event{Command: WHOIS, Params: []string{"nick"}}, time.Second); err == nil {
+		t.Fatal("Client.LabeledRequest() without labeled-response returned nil error")
+	}
+
+	c.state.Lock()
+	c.state.enabledCap["labeled-response"] = nil
+	c.state.Unlock()
+
+	type result struct {
+		events []*Event
+		err    error
+	}
+
+	// request sends event, and returns the label it was sent with, and the
+	// result of the request.
+	request := func(event *Event) (string, <-chan result) {
+		results := make(chan result, 1)
+		go func() {
+			events, err := c.LabeledRequest(event, 5*time.Second)
+			results <- result{events: events, err: err}
+		}()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				sent := ParseEvent(line)
+				if sent.Command != event.Command {
+					continue
+				}
+
+				label, ok := sent.Tags.Get("label")
+				if !ok || len(sent.Tags) != 1 {
+					t.Fatalf("Client.LabeledRequest() sent %q, want only label tag", line)
+				}
+
+				return label, results
+			case <-timeout:
+				t.Fatal("timed out waiting for labeled request")
+			}
+		}
+	}
+
+	wait := func(results <-chan result) []*Event {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				t.Fatalf("Client.LabeledRequest() returned error: %s", res.err)
+			}
+
+			return res.events
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Client.LabeledRequest()")
+		}
+
+		return nil
+	}
+
+	// Single response.
+	label, results := request(&Event{Command: MODE, Params: []string{"#channel"}})
+	conn.Write([]byte(":dummy.int 324 test #other +nt\r\n"))
+	conn.Write([]byte("@label=" + label + " :dummy.int 324 test #channel +nt\r\n"))
+
+	if events := wait(results); len(events) != 1 || events[0].Params[1] != "#channel" {
+		t.Fatalf("Client.LabeledRequest() == %v, want labeled RPL_CHANNELMODEIS", events)
+	}
+
+	// Batched response.
+	label, results = request(&Event{Command: WHOIS, Params: []string{"nick"}, Tags: Tags{"+example": "tag"}})
+	conn.Write([]byte("@label=" + label + " :dummy.int BATCH +abc labeled-response\r\n"))
+	conn.Write([]byte("@batch=abc :dummy.int 311 test nick user host.com * :realname\r\n"))
+	conn.Write([]byte(":dummy.int NOTICE test :unrelated\r\n"))
+	conn.Write([]byte("@batch=abc :dummy.int 318 test nick :End of /WHOIS list.\r\n"))
+	conn.Write([]byte(":dummy.int BATCH -abc\r\n"))
+
+	events := wait(results)
+	if len(events) != 2 || events[0].Command != RPL_WHOISUSER || events[1].Command != RPL_ENDOFWHOIS {
+		t.Fatalf("Client.LabeledRequest() == %v, want RPL_WHOISUSER and RPL_ENDOFWHOIS", events)
+	}
+
+	// No response.
+	label, results = request(&Event{Command: NICK, Params: []string{"test"}})
+	conn.Write([]byte("@label=" + label + " :dummy.int ACK\r\n"))
+
+	if events := wait(results); len(events) != 0 {
+		t.Fatalf("Client.LabeledRequest() with ACK == %v, want no events", events)
+	}
+}
+
+func TestRequireAccount(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	c.state.Lock()
+	c.state.createUser(&Source{Name: "known", Ident: "user", Host: "host.com"})
+	c.state.lookupUser("known").Extras.Account = "knownacct"
+	c.state.createUser(&Source{Name: "unknown", Ident: "user", Host: "host.com"})
+	c.state.Unlock()
+
+	if account, ok := c.RequireAccount(*ParseEvent(":known!user@host.com PRIVMSG #channel :!cmd")); !ok || account != "knownacct" {
+		t.Fatalf("Client.RequireAccount(tracked) = %q, %t, want knownacct", account, ok)
+	}
+
+	if account, ok := c.RequireAccount(*ParseEvent("@account=tagacct :other!user@host.com PRIVMSG #channel :!cmd")); !ok || account != "tagacct" {
+		t.Fatalf("Client.RequireAccount(account-tag) = %q, %t, want tagacct", account, ok)
+	}
+
+	type result struct {
+		account string
+		ok      bool
+	}
+
+	for _, tt := range []struct {
+		replies []string
+		want    result
+	}{
+		{
+			replies: []string{
+				":dummy.int 311 test unknown user host.com * :Real Name\r\n",
+				":dummy.int 330 test unknown whoisacct :is logged in as\r\n",
+				":dummy.int 318 test unknown :End of /WHOIS list.\r\n",
+			},
+			want: result{account: "whoisacct", ok: true},
+		},
+		{
+			replies: []string{":dummy.int 318 test unknown :End of /WHOIS list.\r\n"},
+			want:    result{},
+		},
+	} {
+		results := make(chan result, 1)
+		go func() {
+			account, ok := c.RequireAccount(*ParseEvent(":unknown!user@host.com PRIVMSG #channel :!cmd"))
+			results <- result{account: account, ok: ok}
+		}()
+
+		expectLine(t, lines, "WHOIS unknown")
+		for _, reply := range tt.replies {
+			conn.Write([]byte(reply))
+		}
+
+		select {
+		case res := <-results:
+			if res != tt.want {
+				t.Fatalf("Client.RequireAccount(whois) = %v, want %v", res, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Client.RequireAccount()")
+		}
+
+		// Forget the account learned from the WHOIS response.
+		c.state.Lock()
+		c.state.lookupUser("unknown").Extras.Account = ""
+		c.state.Unlock()
+	}
+}
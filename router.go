@@ -0,0 +1,195 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strings"
+	"sync"
+)
+
+// RouterCommand is a command parsed from a message by a CommandRouter.
+type RouterCommand struct {
+	// Name is the (lowercase) name of the command, without the prefix, e.g.
+	// "hello" for "!hello world".
+	Name string
+	// Args are the arguments supplied to the command. Arguments are split
+	// by whitespace, and may be quoted with double or single quotes to
+	// include whitespace, e.g. `!cmd "foo bar" baz` has the arguments
+	// "foo bar" and "baz".
+	Args []string
+	// RawArgs is the unparsed text after the command name.
+	RawArgs string
+	// Target is where replies to the command should be sent, see
+	// Event.Target().
+	Target string
+}
+
+// RouterHandler is a handler for a command, see CommandRouter.On().
+type RouterHandler func(client *Client, event Event, cmd *RouterCommand)
+
+// CommandRouter dispatches prefixed commands (e.g. "!hello world") sent in
+// channels or private messages, to the handler registered for the command.
+// For example:
+//
+//	router := girc.NewRouter("!")
+//	router.On("hello", func(c *girc.Client, e girc.Event, cmd *girc.RouterCommand) {
+//		c.Cmd.Message(cmd.Target, "hello, "+e.Source.Name)
+//	})
+//	client.Handlers.Add(girc.PRIVMSG, router.Handle)
+//
+// See also the cmdhandler package, which provides help generation and
+// argument checks.
+type CommandRouter struct {
+	prefix string
+
+	mu       sync.RWMutex
+	handlers map[string]RouterHandler
+	fallback RouterHandler
+}
+
+// NewRouter returns a new CommandRouter, which handles commands starting
+// with prefix (e.g. "!").
+func NewRouter(prefix string) *CommandRouter {
+	return &CommandRouter{prefix: prefix, handlers: make(map[string]RouterHandler)}
+}
+
+// On registers handler for the command name (case-insensitive), replacing
+// any existing handler for the command.
+func (r *CommandRouter) On(name string, handler RouterHandler) {
+	r.mu.Lock()
+	r.handlers[strings.ToLower(name)] = handler
+	r.mu.Unlock()
+}
+
+// Default registers handler to be called for commands which don't have a
+// registered handler, e.g. to reply that the command is unknown.
+func (r *CommandRouter) Default(handler RouterHandler) {
+	r.mu.Lock()
+	r.fallback = handler
+	r.mu.Unlock()
+}
+
+// Handle parses the command from a PRIVMSG event, and dispatches it to the
+// registered handler. Events which aren't commands (including CTCPs and
+// echo-messages) are ignored. Handle is a HandlerFunc, and should be
+// registered with Caller.Add() for PRIVMSG.
+func (r *CommandRouter) Handle(client *Client, event Event) {
+	cmd := r.parse(&event)
+	if cmd == nil {
+		return
+	}
+
+	r.mu.RLock()
+	handler, ok := r.handlers[cmd.Name]
+	if !ok {
+		handler = r.fallback
+	}
+	r.mu.RUnlock()
+
+	if handler != nil {
+		handler(client, event, cmd)
+	}
+}
+
+// parse returns the command in the event, or nil if the event isn't a
+// command.
+func (r *CommandRouter) parse(event *Event) *RouterCommand {
+	if event.Command != PRIVMSG || event.Echo || event.Source == nil || len(event.Params) < 2 {
+		return nil
+	}
+
+	text := event.Last()
+	if !strings.HasPrefix(text, r.prefix) || strings.HasPrefix(text, string(ctcpDelim)) {
+		return nil
+	}
+
+	text = strings.TrimPrefix(text, r.prefix)
+	name, raw := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, raw = text[:i], strings.TrimSpace(text[i+1:])
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	return &RouterCommand{
+		Name:    strings.ToLower(name),
+		Args:    splitArgs(raw),
+		RawArgs: raw,
+		Target:  event.Target(),
+	}
+}
+
+// splitArgs splits text by whitespace, keeping text quoted with double or
+// single quotes together. Quotes are only treated as such at the start of an
+// argument, and if they have a matching closing quote at the end of an
+// argument, otherwise they're kept as-is (e.g. "don't"). Within quotes, a
+// backslash escapes the following character.
+func splitArgs(text string) []string {
+	args := []string{}
+	runes := []rune(text)
+
+	var buf strings.Builder
+	var inArg bool
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case !inArg && (r == '"' || r == '\''):
+			end := closingQuote(runes, i)
+			if end < 0 {
+				buf.WriteRune(r)
+				inArg = true
+				continue
+			}
+
+			for j := i + 1; j < end; j++ {
+				if runes[j] == '\\' && j+1 < end {
+					j++
+				}
+				buf.WriteRune(runes[j])
+			}
+
+			args = append(args, buf.String())
+			buf.Reset()
+			i = end
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, buf.String())
+				buf.Reset()
+				inArg = false
+			}
+		default:
+			buf.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, buf.String())
+	}
+
+	return args
+}
+
+// closingQuote returns the index of the quote which closes the quote at
+// start, which must be followed by whitespace or the end of the text.
+// Returns -1 if there is no closing quote.
+func closingQuote(runes []rune, start int) int {
+	for i := start + 1; i < len(runes); i++ {
+		if runes[i] == '\\' {
+			i++
+			continue
+		}
+
+		if runes[i] == runes[start] && (i+1 == len(runes) || runes[i+1] == ' ' || runes[i+1] == '\t') {
+			return i
+		}
+	}
+
+	return -1
+}
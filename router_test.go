@@ -0,0 +1,77 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"foo", []string{"foo"}},
+		{"  foo   bar\tbaz ", []string{"foo", "bar", "baz"}},
+		{`"foo bar" baz`, []string{"foo bar", "baz"}},
+		{`'foo "bar"' baz`, []string{`foo "bar"`, "baz"}},
+		{`"say \"hi\"" now`, []string{`say "hi"`, "now"}},
+		{`foo"bar baz"`, []string{`foo"bar`, `baz"`}},
+		{`""`, []string{""}},
+		{`"unterminated quote`, []string{`"unterminated`, "quote"}},
+		{`don't`, []string{"don't"}},
+		{`don't do that`, []string{"don't", "do", "that"}},
+		{`'don't stop' now`, []string{"don't stop", "now"}},
+		{`"a\\b" c`, []string{`a\b`, "c"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitArgs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCommandRouter(t *testing.T) {
+	c := New(Config{Server: "dummy.int", Nick: "test", User: "test"})
+	router := NewRouter("!")
+
+	var got []*RouterCommand
+	record := func(client *Client, event Event, cmd *RouterCommand) { got = append(got, cmd) }
+	router.On("Hello", record)
+
+	events := []string{
+		":nick!user@host.com PRIVMSG #channel :!hello world \"foo bar\"",
+		":nick!user@host.com PRIVMSG test :!HELLO",
+		":nick!user@host.com PRIVMSG #channel :hello world",
+		":nick!user@host.com PRIVMSG #channel :!unknown arg",
+		":nick!user@host.com PRIVMSG #channel :!",
+		":nick!user@host.com NOTICE #channel :!hello",
+		":nick!user@host.com PRIVMSG #channel :\x01ACTION !hello\x01",
+	}
+	for _, e := range events {
+		router.Handle(c, *ParseEvent(e))
+	}
+
+	want := []*RouterCommand{
+		{Name: "hello", Args: []string{"world", "foo bar"}, RawArgs: "world \"foo bar\"", Target: "#channel"},
+		{Name: "hello", Args: []string{}, RawArgs: "", Target: "nick"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dispatched %+v, want %+v", got, want)
+	}
+
+	// Unknown commands are passed to the default handler, if set.
+	got = nil
+	router.Default(record)
+	router.Handle(c, *ParseEvent(":nick!user@host.com PRIVMSG #channel :!unknown arg"))
+
+	want = []*RouterCommand{{Name: "unknown", Args: []string{"arg"}, RawArgs: "arg", Target: "#channel"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("default handler dispatched %+v, want %+v", got, want)
+	}
+}
@@ -5,8 +5,12 @@
 package girc
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,6 +22,23 @@ type state struct {
 	sync.RWMutex
 	// nick, ident, and host are the internal trackers for our user.
 	nick, ident, host string
+	// oper is true if we've successfully authenticated with OPER, and
+	// operPending is true while we're waiting for a response to OPER.
+	oper, operPending bool
+	// userModes are our own user modes (e.g. "iw"), see Client.UserModes().
+	userModes string
+	// away is true if the server has marked us as away, with awayMessage
+	// being our away message. awayPending is the away message we've most
+	// recently sent with AWAY, until the server confirms it.
+	away                     bool
+	awayMessage, awayPending string
+	// authenticated is true once we've successfully authenticated with SASL
+	// (or the server has told us we already are), so we don't authenticate
+	// again if sasl is re-advertised with cap-notify.
+	authenticated bool
+	// capsNegotiated is true once capability negotiation has ended (see
+	// CAPS_NEGOTIATED).
+	capsNegotiated bool
 	// channels represents all channels we're active in.
 	channels map[string]*Channel
 	// users represents all of users that we're tracking.
@@ -46,12 +67,32 @@ type state struct {
 	// motd is the servers message of the day.
 	motd string
 
+	// batches are the IRCv3 batches which have been started, but have not
+	// yet ended, keyed by their reference tag.
+	batches map[string]*Batch
+
 	// sts are strict transport security configurations, if specified by the
-	// server.
-	//
-	// TODO: ideally, this would be a configurable policy store that the user could
-	// optionally override (to store STS information on disk, memory, etc).
+	// server. These are optionally persisted with Config.STSStore.
 	sts strictTransport
+
+	// kickRejoins are the times we've rejoined channels after being kicked
+	// (see Config.AutoRejoinOnKick), keyed by the normalized channel name
+	// (see state.id()).
+	kickRejoins map[string][]time.Time
+
+	// rejoin are the channels (and their keys, if known) we were in when we
+	// were last disconnected, to be rejoined once connected again (see
+	// Config.AutoRejoin). This is not cleared by reset().
+	rejoin map[string]string
+
+	// ctcpReplies are the times we've sent CTCP replies within the last
+	// ctcpReplyWindow (see Config.CTCPReplyRate), keyed by the normalized
+	// target (see state.id()).
+	ctcpReplies map[string][]time.Time
+
+	// ready is closed once the CONNECTED event has fired for the current
+	// connection (see Client.WaitForConnect()).
+	ready chan struct{}
 }
 
 // reset resets the state back to it's original form.
@@ -60,6 +101,14 @@ func (s *state) reset(initial bool) {
 	s.nick = ""
 	s.ident = ""
 	s.host = ""
+	s.oper = false
+	s.operPending = false
+	s.userModes = ""
+	s.away = false
+	s.awayMessage = ""
+	s.awayPending = ""
+	s.authenticated = false
+	s.capsNegotiated = false
 	s.channels = make(map[string]*Channel)
 	s.users = make(map[string]*User)
 	s.enabledCap = make(map[string]map[string]string)
@@ -68,6 +117,10 @@ func (s *state) reset(initial bool) {
 	s.maxLineLength = DefaultMaxLineLength
 	s.maxPrefixLength = DefaultMaxPrefixLength
 	s.motd = ""
+	s.batches = make(map[string]*Batch)
+	s.kickRejoins = make(map[string][]time.Time)
+	s.ctcpReplies = make(map[string][]time.Time)
+	s.resetReady()
 
 	if initial {
 		s.sts.reset()
@@ -75,6 +128,23 @@ func (s *state) reset(initial bool) {
 	s.Unlock()
 }
 
+// resetReady ensures that the ready channel is open (i.e. we're waiting for
+// the CONNECTED event). If it's already open, it's left as-is, so anyone
+// already waiting on it is notified of the next connection. Unsafe (you must
+// lock s yourself!)
+func (s *state) resetReady() {
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+		return
+	}
+
+	select {
+	case <-s.ready:
+		s.ready = make(chan struct{})
+	default:
+	}
+}
+
 // User represents an IRC user and the state attached to them.
 type User struct {
 	// Nick is the users current nickname. rfc1459 compliant.
@@ -90,7 +160,8 @@ type User struct {
 	Host string `json:"host"`
 
 	// ChannelList is a sorted list of all channels that we are currently
-	// tracking the user in. Each channel name is rfc1459 compliant. See
+	// tracking the user in. Each channel name is normalized with the
+	// casemapping advertised by the server (rfc1459 by default). See
 	// User.Channels() for a shorthand if you're looking for the *Channel
 	// version of the channel list.
 	ChannelList []string `json:"channels"`
@@ -121,10 +192,16 @@ type User struct {
 		Account string `json:"account"`
 		// Away refers to the away status of the user. An empty string
 		// indicates that they are active, otherwise the string is what they
-		// set as their away message. May also be empty if unsupported by the
-		// server/tracking is disabled.
+		// set as their away message. If the user is known to be away, but
+		// their away message is not (e.g. it was determined from a WHO
+		// reply), this will be "away". May also be empty if unsupported by
+		// the server/tracking is disabled. See also USER_AWAY and USER_BACK.
 		Away string `json:"away"`
 	} `json:"extras"`
+
+	// casemapping is the casemapping used to normalize ChannelList (see
+	// ToCaseMapping()).
+	casemapping string
 }
 
 // Channels returns a reference of *Channels that the client knows the user
@@ -171,7 +248,7 @@ func (u *User) addChannel(name string) {
 		return
 	}
 
-	u.ChannelList = append(u.ChannelList, ToRFC1459(name))
+	u.ChannelList = append(u.ChannelList, ToCaseMapping(u.casemapping, name))
 	sort.Strings(u.ChannelList)
 
 	u.Perms.set(name, Perms{})
@@ -179,7 +256,7 @@ func (u *User) addChannel(name string) {
 
 // deleteChannel removes an existing channel from the users channel list.
 func (u *User) deleteChannel(name string) {
-	name = ToRFC1459(name)
+	name = ToCaseMapping(u.casemapping, name)
 
 	j := -1
 	for i := 0; i < len(u.ChannelList); i++ {
@@ -198,7 +275,7 @@ func (u *User) deleteChannel(name string) {
 
 // InChannel checks to see if a user is in the given channel.
 func (u *User) InChannel(name string) bool {
-	name = ToRFC1459(name)
+	name = ToCaseMapping(u.casemapping, name)
 
 	for i := 0; i < len(u.ChannelList); i++ {
 		if u.ChannelList[i] == name {
@@ -226,20 +303,104 @@ func (u *User) IsActive() bool {
 	return u.Active() < (time.Minute * 30)
 }
 
+// Ban mask styles, used with User.BanMask().
+const (
+	// BanMaskHost bans the users host, e.g. "*!*@host.example.com".
+	BanMaskHost = iota
+	// BanMaskUserHost bans the users ident on their host, e.g.
+	// "*!*user@host.example.com".
+	BanMaskUserHost
+	// BanMaskDomain bans the users domain (or subnet, for IPv4 addresses),
+	// e.g. "*!*@*.example.com" or "*!*@192.0.2.*".
+	BanMaskDomain
+	// BanMaskNick bans the users nickname, e.g. "nick!*@*".
+	BanMaskNick
+	// BanMaskFull bans the users exact mask, e.g.
+	// "nick!user@host.example.com".
+	BanMaskFull
+)
+
+// BanMask returns a ban mask for the user, in the given style (e.g.
+// BanMaskHost). Empty fields (e.g. if the ident or host of the user isn't
+// known yet) are replaced with wildcards. Unknown styles default to
+// BanMaskHost. Idents prefixed with "~" (no identd) are matched regardless of
+// the prefix, e.g. "*!*user@host".
+func (u *User) BanMask(style int) string {
+	nick, ident, host := u.Nick, strings.TrimPrefix(u.Ident, "~"), u.Host
+	if nick == "" {
+		nick = "*"
+	}
+	if ident == "" {
+		ident = "*"
+	} else {
+		ident = "*" + ident
+	}
+	if host == "" {
+		host = "*"
+	}
+
+	switch style {
+	case BanMaskUserHost:
+		return "*!" + ident + "@" + host
+	case BanMaskDomain:
+		return "*!*@" + banMaskDomain(host)
+	case BanMaskNick:
+		return nick + "!*@*"
+	case BanMaskFull:
+		if u.Ident == "" {
+			return nick + "!*@" + host
+		}
+		return nick + "!" + u.Ident + "@" + host
+	default:
+		return "*!*@" + host
+	}
+}
+
+// banMaskDomain returns a wildcard mask for the domain of host, e.g.
+// "*.example.com" for "host.example.com", or "192.0.2.*" for "192.0.2.15".
+// Hosts which can't be reduced (e.g. IPv6 addresses, cloaks, or top-level
+// hosts) are returned as-is.
+func banMaskDomain(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil && !strings.Contains(host, ":") {
+			return host[:strings.LastIndexByte(host, '.')] + ".*"
+		}
+		return host
+	}
+
+	if strings.Count(host, ".") < 2 || strings.Contains(host, "/") {
+		return host
+	}
+
+	return "*" + host[strings.IndexByte(host, '.'):]
+}
+
 // Channel represents an IRC channel and the state attached to it.
 type Channel struct {
 	// Name of the channel. Must be rfc1459 compliant.
 	Name string `json:"name"`
 	// Topic of the channel.
 	Topic string `json:"topic"`
+	// TopicSetBy is who set the topic of the channel. Depending on the
+	// server, this may be a nickname or a full mask. May be empty if the
+	// server hasn't supplied it.
+	TopicSetBy string `json:"topic_set_by"`
+	// TopicSetAt is when the topic of the channel was set. May be the zero
+	// value if the server hasn't supplied it.
+	TopicSetAt time.Time `json:"topic_set_at"`
 
 	// UserList is a sorted list of all users we are currently tracking within
-	// the channel. Each is the nickname, and is rfc1459 compliant.
+	// the channel. Each is the nickname, normalized with the casemapping
+	// advertised by the server (rfc1459 by default).
 	UserList []string `json:"user_list"`
 	// Joined represents the first time that the client joined the channel.
 	Joined time.Time `json:"joined"`
 	// Modes are the known channel modes that the bot has captured.
 	Modes CModes `json:"modes"`
+
+	// casemapping is the casemapping used to normalize UserList (see
+	// ToCaseMapping()).
+	casemapping string
 }
 
 // Users returns a reference of *Users that the client knows the channel has
@@ -322,13 +483,13 @@ func (ch *Channel) addUser(nick string) {
 		return
 	}
 
-	ch.UserList = append(ch.UserList, ToRFC1459(nick))
+	ch.UserList = append(ch.UserList, ToCaseMapping(ch.casemapping, nick))
 	sort.Strings(ch.UserList)
 }
 
 // deleteUser removes an existing user from the users list.
 func (ch *Channel) deleteUser(nick string) {
-	nick = ToRFC1459(nick)
+	nick = ToCaseMapping(ch.casemapping, nick)
 
 	j := -1
 	for i := 0; i < len(ch.UserList); i++ {
@@ -352,7 +513,7 @@ func (ch *Channel) Copy() *Channel {
 	nc := &Channel{}
 	*nc = *ch
 
-	_ = copy(nc.UserList, ch.UserList)
+	nc.UserList = append([]string(nil), ch.UserList...)
 
 	// And modes.
 	nc.Modes = ch.Modes.Copy()
@@ -367,7 +528,7 @@ func (ch *Channel) Len() int {
 
 // UserIn checks to see if a given user is in a channel.
 func (ch *Channel) UserIn(name string) bool {
-	name = ToRFC1459(name)
+	name = ToCaseMapping(ch.casemapping, name)
 
 	for i := 0; i < len(ch.UserList); i++ {
 		if ch.UserList[i] == name {
@@ -384,20 +545,57 @@ func (ch *Channel) Lifetime() time.Duration {
 	return time.Since(ch.Joined)
 }
 
+// HasMode checks to see if the given mode is currently set on the channel.
+// For example, ch.HasMode('m') checks if the channel is moderated.
+func (ch *Channel) HasMode(mode byte) bool {
+	return ch.Modes.HasMode(string(mode))
+}
+
+// ModeArg returns the argument of the given mode if it's currently set on
+// the channel. For example, ch.ModeArg('l') returns the user limit. ok will
+// be false if the mode isn't set, or the mode doesn't have an argument.
+func (ch *Channel) ModeArg(mode byte) (arg string, ok bool) {
+	return ch.Modes.Get(string(mode))
+}
+
+// Limit returns the user limit of the channel (+l). ok will be false if no
+// limit is set.
+func (ch *Channel) Limit() (limit int, ok bool) {
+	arg, ok := ch.ModeArg('l')
+	if !ok {
+		return 0, false
+	}
+
+	limit, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, false
+	}
+
+	return limit, true
+}
+
+// Key returns the key (password) of the channel (+k). ok will be false if no
+// key is set. Note that some servers hide the key from users who aren't
+// channel operators (e.g. "*").
+func (ch *Channel) Key() (key string, ok bool) {
+	return ch.ModeArg('k')
+}
+
 // createChannel creates the channel in state, if not already done.
 func (s *state) createChannel(name string) (ok bool) {
 	supported := s.chanModes()
 	prefixes, _ := parsePrefixes(s.userPrefixes())
 
-	if _, ok := s.channels[ToRFC1459(name)]; ok {
+	if _, ok := s.channels[s.id(name)]; ok {
 		return false
 	}
 
-	s.channels[ToRFC1459(name)] = &Channel{
-		Name:     name,
-		UserList: []string{},
-		Joined:   time.Now(),
-		Modes:    NewCModes(supported, prefixes),
+	s.channels[s.id(name)] = &Channel{
+		Name:        name,
+		UserList:    []string{},
+		Joined:      time.Now(),
+		Modes:       NewCModes(supported, prefixes),
+		casemapping: s.casemapping(),
 	}
 
 	return true
@@ -405,7 +603,7 @@ func (s *state) createChannel(name string) (ok bool) {
 
 // deleteChannel removes the channel from state, if not already done.
 func (s *state) deleteChannel(name string) {
-	name = ToRFC1459(name)
+	name = s.id(name)
 
 	_, ok := s.channels[name]
 	if !ok {
@@ -429,29 +627,101 @@ func (s *state) deleteChannel(name string) {
 // lookupChannel returns a reference to a channel, nil returned if no results
 // found.
 func (s *state) lookupChannel(name string) *Channel {
-	return s.channels[ToRFC1459(name)]
+	return s.channels[s.id(name)]
+}
+
+// ctcpReplyWindow is the window that Config.CTCPReplyRate applies to.
+const ctcpReplyWindow = time.Minute
+
+// allowCTCPReply returns true if a CTCP reply to target is allowed, given
+// the maximum number of replies per target within ctcpReplyWindow, and if
+// so, records the reply. A rate of 0 allows all replies.
+func (s *state) allowCTCPReply(target string, rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	id := s.id(target)
+
+	var recent []time.Time
+	for _, t := range s.ctcpReplies[id] {
+		if now.Sub(t) < ctcpReplyWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= rate {
+		s.ctcpReplies[id] = recent
+		return false
+	}
+
+	s.ctcpReplies[id] = append(recent, now)
+
+	// Forget targets we haven't replied to recently, so this doesn't grow
+	// unbounded with the number of users sending CTCPs.
+	for key, times := range s.ctcpReplies {
+		if now.Sub(times[len(times)-1]) >= ctcpReplyWindow {
+			delete(s.ctcpReplies, key)
+		}
+	}
+
+	return true
+}
+
+// saveRejoin stores the channels we're currently in, along with their keys if
+// known, to be rejoined once connected again. See Config.AutoRejoin.
+func (s *state) saveRejoin() {
+	s.Lock()
+	s.rejoin = make(map[string]string, len(s.channels))
+	for _, ch := range s.channels {
+		key, _ := ch.Key()
+		// Servers may hide the key from users who aren't channel operators.
+		if key == "*" {
+			key = ""
+		}
+
+		s.rejoin[ch.Name] = key
+	}
+	s.Unlock()
+}
+
+// casemapping returns the casemapping advertised by the server, if any (see
+// ToCaseMapping()).
+func (s *state) casemapping() string {
+	return s.serverOptions["CASEMAPPING"]
+}
+
+// id normalizes a nickname or channel name with the casemapping advertised
+// by the server, for use as a key within state.
+func (s *state) id(name string) string {
+	return ToCaseMapping(s.casemapping(), name)
 }
 
 // lookupUser returns a reference to a user, nil returned if no results
 // found.
 func (s *state) lookupUser(name string) *User {
-	return s.users[ToRFC1459(name)]
+	return s.users[s.id(name)]
 }
 
 // createUser creates the user in state, if not already done.
 func (s *state) createUser(src *Source) (ok bool) {
-	if _, ok := s.users[src.ID()]; ok {
+	if _, ok := s.users[s.id(src.Name)]; ok {
 		// User already exists.
 		return false
 	}
 
-	s.users[src.ID()] = &User{
-		Nick:       src.Name,
-		Host:       src.Host,
-		Ident:      src.Ident,
-		FirstSeen:  time.Now(),
-		LastActive: time.Now(),
-		Perms:      &UserPerms{channels: make(map[string]Perms)},
+	s.users[s.id(src.Name)] = &User{
+		Nick:        src.Name,
+		Host:        src.Host,
+		Ident:       src.Ident,
+		FirstSeen:   time.Now(),
+		LastActive:  time.Now(),
+		Perms:       &UserPerms{channels: make(map[string]Perms), casemapping: s.casemapping()},
+		casemapping: s.casemapping(),
 	}
 
 	return true
@@ -469,7 +739,7 @@ func (s *state) deleteUser(channelName, nick string) {
 			s.channels[user.ChannelList[i]].deleteUser(nick)
 		}
 
-		delete(s.users, ToRFC1459(nick))
+		delete(s.users, s.id(nick))
 		return
 	}
 
@@ -485,16 +755,16 @@ func (s *state) deleteUser(channelName, nick string) {
 		// This means they are no longer in any channels we track, delete
 		// them from state.
 
-		delete(s.users, ToRFC1459(nick))
+		delete(s.users, s.id(nick))
 	}
 }
 
 // renameUser renames the user in state, in all locations where relevant.
 func (s *state) renameUser(from, to string) {
-	from = ToRFC1459(from)
+	from = s.id(from)
 
 	// Update our nickname.
-	if from == ToRFC1459(s.nick) {
+	if from == s.id(s.nick) {
 		s.nick = to
 	}
 
@@ -507,12 +777,12 @@ func (s *state) renameUser(from, to string) {
 
 	user.Nick = to
 	user.LastActive = time.Now()
-	s.users[ToRFC1459(to)] = user
+	s.users[s.id(to)] = user
 
 	for i := 0; i < len(user.ChannelList); i++ {
 		for j := 0; j < len(s.channels[user.ChannelList[i]].UserList); j++ {
 			if s.channels[user.ChannelList[i]].UserList[j] == from {
-				s.channels[user.ChannelList[i]].UserList[j] = ToRFC1459(to)
+				s.channels[user.ChannelList[i]].UserList[j] = s.id(to)
 
 				sort.Strings(s.channels[user.ChannelList[i]].UserList)
 				break
@@ -556,6 +826,100 @@ func (e ErrSTSUpgradeFailed) Error() string {
 	return fmt.Sprintf("fail to upgrade to secure (sts) connection: %v", e.Err)
 }
 
+// stateSnapshot is the JSON representation of the tracked channels and
+// users. See Client.ExportState() and Client.ImportState().
+type stateSnapshot struct {
+	Channels []*Channel `json:"channels"`
+	Users    []*User    `json:"users"`
+}
+
+// ExportState returns the tracked channels and users, encoded as JSON. This
+// can later be restored with Client.ImportState(), e.g. to allow a bouncer
+// to survive restarts without re-querying every channel. Panics if tracking
+// is disabled.
+func (c *Client) ExportState() ([]byte, error) {
+	c.panicIfNotTracking()
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	snapshot := stateSnapshot{
+		Channels: make([]*Channel, 0, len(c.state.channels)),
+		Users:    make([]*User, 0, len(c.state.users)),
+	}
+
+	for _, ch := range c.state.channels {
+		snapshot.Channels = append(snapshot.Channels, ch)
+	}
+
+	for _, user := range c.state.users {
+		snapshot.Users = append(snapshot.Users, user)
+	}
+
+	sort.Slice(snapshot.Channels, func(i, j int) bool {
+		return snapshot.Channels[i].Name < snapshot.Channels[j].Name
+	})
+	sort.Slice(snapshot.Users, func(i, j int) bool {
+		return snapshot.Users[i].Nick < snapshot.Users[j].Nick
+	})
+
+	return json.Marshal(snapshot)
+}
+
+// ImportState replaces the tracked channels and users with those previously
+// returned by Client.ExportState(). As state is reset when connecting, this
+// should be called once connected (e.g. from a CONNECTED handler). Panics if
+// tracking is disabled.
+func (c *Client) ImportState(data []byte) error {
+	c.panicIfNotTracking()
+
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	c.state.RLock()
+	casemapping := c.state.casemapping()
+	c.state.RUnlock()
+
+	channels := make(map[string]*Channel, len(snapshot.Channels))
+	for _, ch := range snapshot.Channels {
+		if ch == nil || ch.Name == "" {
+			return fmt.Errorf("invalid state: channel without name")
+		}
+
+		if ch.UserList == nil {
+			ch.UserList = []string{}
+		}
+
+		ch.casemapping = casemapping
+		channels[ToCaseMapping(casemapping, ch.Name)] = ch
+	}
+
+	users := make(map[string]*User, len(snapshot.Users))
+	for _, user := range snapshot.Users {
+		if user == nil || user.Nick == "" {
+			return fmt.Errorf("invalid state: user without nickname")
+		}
+
+		if user.Perms == nil {
+			user.Perms = &UserPerms{channels: make(map[string]Perms)}
+		}
+
+		user.casemapping = casemapping
+		user.Perms.setCaseMapping(casemapping)
+		users[ToCaseMapping(casemapping, user.Nick)] = user
+	}
+
+	c.state.Lock()
+	c.state.channels = channels
+	c.state.users = users
+	c.state.Unlock()
+	c.state.notify(c, UPDATE_STATE)
+
+	return nil
+}
+
 // notify sends state change notifications so users can update their refs
 // when state changes.
 func (s *state) notify(c *Client, ntype string) {
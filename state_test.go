@@ -6,6 +6,7 @@ package girc
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -38,15 +39,15 @@ const mockConnStartState = `:dummy.int NOTICE * :*** Looking up your hostname...
 :dummy.int 332 nick #channel :example topic
 :dummy.int 353 nick = #channel :nick!~user@local.int @nick2!nick2@other.int
 :dummy.int 366 nick #channel :End of /NAMES list.
-:dummy.int 354 nick 1 #channel ~user local.int nick 0 :realname
-:dummy.int 354 nick 1 #channel nick2 other.int nick2 nick2 :realname2
+:dummy.int 354 nick 1 #channel ~user local.int nick H 0 :realname
+:dummy.int 354 nick 1 #channel nick2 other.int nick2 G nick2 :realname2
 :dummy.int 315 nick #channel :End of /WHO list.
 :nick!~user@local.int JOIN #channel2 * :realname
 :dummy.int 332 nick #channel2 :example topic
 :dummy.int 353 nick = #channel2 :nick!~user@local.int @nick2!nick2@other.int
 :dummy.int 366 nick #channel2 :End of /NAMES list.
-:dummy.int 354 nick 1 #channel2 ~user local.int nick 0 :realname
-:dummy.int 354 nick 1 #channel2 nick2 other.int nick2 nick2 :realname2
+:dummy.int 354 nick 1 #channel2 ~user local.int nick H 0 :realname
+:dummy.int 354 nick 1 #channel2 nick2 other.int nick2 G nick2 :realname2
 :dummy.int 315 nick #channel2 :End of /WHO list.
 `
 
@@ -259,3 +260,617 @@ func TestState(t *testing.T) {
 	}
 	c.Handlers.Remove(cuid)
 }
+
+func TestTopicMetadata(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":test!~user@local.int JOIN #channel\r\n"))
+	conn.Write([]byte(":dummy.int 332 test #channel :example topic\r\n"))
+	conn.Write([]byte(":dummy.int 333 test #channel nick2!nick2@other.int 1700000000\r\n"))
+
+	waitFor(t, "topic metadata", func() bool {
+		ch := c.LookupChannel("#channel")
+		return ch != nil && ch.TopicSetBy != ""
+	})
+
+	ch := c.LookupChannel("#channel")
+	if ch.Topic != "example topic" {
+		t.Fatalf("Channel.Topic == %q, want %q", ch.Topic, "example topic")
+	}
+
+	if ch.TopicSetBy != "nick2!nick2@other.int" {
+		t.Fatalf("Channel.TopicSetBy == %q, want %q", ch.TopicSetBy, "nick2!nick2@other.int")
+	}
+
+	if !ch.TopicSetAt.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("Channel.TopicSetAt == %s, want %s", ch.TopicSetAt, time.Unix(1700000000, 0))
+	}
+
+	// Topic changes should update the metadata too.
+	conn.Write([]byte(":nick3!nick3@other.int TOPIC #channel :new topic\r\n"))
+
+	waitFor(t, "topic change", func() bool {
+		return c.LookupChannel("#channel").Topic == "new topic"
+	})
+
+	if ch = c.LookupChannel("#channel"); ch.TopicSetBy != "nick3" {
+		t.Fatalf("Channel.TopicSetBy == %q, want %q", ch.TopicSetBy, "nick3")
+	}
+}
+
+func TestInviteEvents(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	events := make(chan Event, 10)
+	c.Handlers.Add(INVITED, func(c *Client, e Event) { events <- e })
+	c.Handlers.Add(CHANNEL_INVITE, func(c *Client, e Event) { events <- e })
+
+	expect := func(command string, params ...string) {
+		t.Helper()
+
+		select {
+		case e := <-events:
+			if e.Command != command || !reflect.DeepEqual(e.Params, params) {
+				t.Fatalf("got event %s %v, want %s %v", e.Command, e.Params, command, params)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", command)
+		}
+	}
+
+	c.RunHandlers(ParseEvent(":nick1!user@host INVITE test #channel"))
+	expect(INVITED, "nick1", "test", "#channel")
+
+	c.state.Lock()
+	c.state.nick = "test"
+	c.state.createChannel("#channel")
+	c.state.createUser(&Source{Name: "test"})
+	c.state.lookupUser("test").addChannel("#channel")
+	c.state.Unlock()
+
+	// Without invite-notify, invites for others shouldn't be seen.
+	c.RunHandlers(ParseEvent(":nick1!user@host INVITE nick2 #channel"))
+
+	c.state.Lock()
+	c.state.enabledCap["invite-notify"] = nil
+	c.state.Unlock()
+
+	// Channels we aren't in are ignored.
+	c.RunHandlers(ParseEvent(":nick1!user@host INVITE nick2 #other"))
+
+	// As are channels we aren't an operator in.
+	c.RunHandlers(ParseEvent(":nick1!user@host INVITE nick2 #channel"))
+
+	c.state.Lock()
+	c.state.lookupUser("test").Perms.set("#channel", Perms{Op: true})
+	c.state.Unlock()
+
+	c.RunHandlers(ParseEvent(":nick1!user@host INVITE nick2 #channel"))
+	expect(CHANNEL_INVITE, "nick1", "nick2", "#channel")
+
+	select {
+	case e := <-events:
+		t.Fatalf("got unexpected event %s %v", e.Command, e.Params)
+	default:
+	}
+}
+
+func TestAutoRejoinOnKick(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.AutoRejoinOnKick = true
+	c.Config.AutoRejoinDelay = 10 * time.Millisecond
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	c.state.Lock()
+	c.state.createChannel("#channel")
+	c.state.Unlock()
+
+	conn.Write([]byte(":dummy.int 324 test #channel +k secret\r\n"))
+	waitFor(t, "channel key", func() bool {
+		ch := c.LookupChannel("#channel")
+		if ch == nil {
+			return false
+		}
+
+		key, _ := ch.Key()
+		return key == "secret"
+	})
+
+	// Kicks of other users should be ignored.
+	conn.Write([]byte(":op!user@host.com KICK #channel nick1 :bye\r\n"))
+
+	conn.Write([]byte(":op!user@host.com KICK #channel test :bye\r\n"))
+	expectLine(t, lines, "JOIN #channel secret")
+
+	for i := 0; i < maxKickRejoins-1; i++ {
+		conn.Write([]byte(":op!user@host.com KICK #channel test :bye\r\n"))
+		expectLine(t, lines, "JOIN #channel")
+	}
+
+	// We've rejoined too many times, so this kick shouldn't cause a rejoin.
+	conn.Write([]byte(":op!user@host.com KICK #channel test :bye\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	c.Cmd.Message("#other", "done")
+
+	for line := range lines {
+		if strings.HasPrefix(line, "JOIN") {
+			t.Fatalf("rejoined after too many kicks: %q", line)
+		}
+
+		if line == "PRIVMSG #other done" {
+			break
+		}
+	}
+}
+
+func TestAutoRejoin(t *testing.T) {
+	c, conn, server := genMockConn()
+	c.Config.AllowFlood = true
+	c.Config.AutoRejoin = true
+	lines := mockReadLines(conn)
+
+	errchan := mockConnect(t, c, server)
+
+	conn.Write([]byte(":test!user@host.com JOIN #a\r\n"))
+	conn.Write([]byte(":test!user@host.com JOIN #b\r\n"))
+	conn.Write([]byte(":test!user@host.com JOIN #c\r\n"))
+	conn.Write([]byte(":dummy.int 324 test #b +k secret\r\n"))
+	conn.Write([]byte(":test!user@host.com PART #c\r\n"))
+	waitFor(t, "channel state", func() bool {
+		ch := c.LookupChannel("#b")
+		if ch == nil || c.LookupChannel("#a") == nil || c.LookupChannel("#c") != nil {
+			return false
+		}
+
+		key, _ := ch.Key()
+		return key == "secret"
+	})
+
+	// Drop the connection.
+	conn.Close()
+	select {
+	case <-errchan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+	server.Close()
+
+	_, conn, server = genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	lines = mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	expectLine(t, lines, "JOIN #b secret")
+	expectLine(t, lines, "JOIN #a")
+
+	c.Cmd.Message("#other", "done")
+	for line := range lines {
+		if strings.HasPrefix(line, "JOIN #c") {
+			t.Fatalf("rejoined parted channel: %q", line)
+		}
+
+		if line == "PRIVMSG #other done" {
+			break
+		}
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	c := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	c.RunHandlers(ParseEvent(":test!user@host.com JOIN #channel"))
+	c.RunHandlers(ParseEvent(":nick1!user@host.com JOIN #channel"))
+	c.RunHandlers(ParseEvent(":dummy.int 324 test #channel +ntk secret"))
+	c.RunHandlers(ParseEvent(":op!user@host.com MODE #channel +o nick1"))
+	c.RunHandlers(ParseEvent(":nick1!user@host.com AWAY :gone fishing"))
+
+	data, err := c.ExportState()
+	if err != nil {
+		t.Fatalf("Client.ExportState() returned error: %s", err)
+	}
+
+	restored := New(Config{
+		Server: "irc.example.com",
+		Nick:   "test",
+		User:   "user",
+	})
+
+	if err = restored.ImportState(data); err != nil {
+		t.Fatalf("Client.ImportState() returned error: %s", err)
+	}
+
+	if got, want := restored.ChannelList(), c.ChannelList(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Client.ChannelList() after import == %v, want %v", got, want)
+	}
+
+	if got, want := restored.UserList(), c.UserList(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Client.UserList() after import == %v, want %v", got, want)
+	}
+
+	ch := restored.LookupChannel("#channel")
+	if key, _ := ch.Key(); key != "secret" || !ch.HasMode('n') {
+		t.Fatalf("channel modes after import == %q, want +ntk secret", ch.Modes.String())
+	}
+
+	user := restored.LookupUser("nick1")
+	if perms, ok := user.Perms.Lookup("#channel"); !ok || !perms.Op {
+		t.Fatalf("User.Perms after import == %#v, want op in #channel", perms)
+	}
+
+	if user.Extras.Away != "gone fishing" || !user.InChannel("#channel") {
+		t.Fatalf("user after import == %#v", user)
+	}
+
+	// Exporting again should give the same result.
+	again, err := restored.ExportState()
+	if err != nil {
+		t.Fatalf("Client.ExportState() returned error: %s", err)
+	}
+
+	if string(again) != string(data) {
+		t.Fatalf("Client.ExportState() after import == %s, want %s", again, data)
+	}
+
+	if err = restored.ImportState([]byte(`{"channels":[{"name":""}]}`)); err == nil {
+		t.Fatal("Client.ImportState() with invalid state returned nil error")
+	}
+}
+
+func TestWhoisAccount(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	c.state.Lock()
+	c.state.createUser(&Source{Name: "nick1", Ident: "user", Host: "host.com"})
+	c.state.Unlock()
+
+	c.Cmd.Whois("nick1")
+	expectLine(t, lines, "WHOIS nick1")
+
+	conn.Write([]byte(":dummy.int 311 test nick1 user host.com * :realname\r\n"))
+	conn.Write([]byte(":dummy.int 330 test nick1 account1 :is logged in as\r\n"))
+	conn.Write([]byte(":dummy.int 318 test nick1 :End of /WHOIS list.\r\n"))
+
+	waitFor(t, "account to be updated", func() bool {
+		user := c.LookupUser("nick1")
+		return user != nil && user.Extras.Account == "account1"
+	})
+}
+
+func TestStateCaseMapping(t *testing.T) {
+	for _, tt := range []struct {
+		casemapping string
+		distinct    bool
+	}{
+		{CaseMappingRFC1459, false},
+		{CaseMappingASCII, true},
+	} {
+		c, conn, server := genMockConn()
+		c.Config.AllowFlood = true
+		mockReadLines(conn)
+
+		mockConnect(t, c, server)
+
+		conn.Write([]byte(":dummy.int 005 test CASEMAPPING=" + tt.casemapping + " :are supported by this server\r\n"))
+		waitFor(t, "casemapping to be set", func() bool {
+			casemapping, _ := c.GetServerOption("CASEMAPPING")
+			return casemapping == tt.casemapping
+		})
+
+		conn.Write([]byte(":test!user@host.com JOIN #chan[1]\r\n"))
+		conn.Write([]byte(":foo[]!user@host.com JOIN #chan[1]\r\n"))
+		conn.Write([]byte(":FOO{}!user@host.com JOIN #CHAN[1]\r\n"))
+		waitFor(t, "users to join", func() bool {
+			return c.LookupUser("foo{}") != nil
+		})
+
+		if !c.IsInChannel("#chan[1]") || !c.IsInChannel("#CHAN[1]") {
+			t.Fatalf("%s: Client.IsInChannel() == false, want true", tt.casemapping)
+		}
+
+		if distinct := c.LookupUser("FOO[]") == nil; distinct {
+			t.Fatalf("%s: Client.LookupUser() didn't match case-insensitively", tt.casemapping)
+		}
+
+		users := c.LookupChannel("#chan[1]").Users(c)
+		if distinct := len(users) == 3; distinct != tt.distinct {
+			t.Fatalf("%s: tracked %d users in channel, want distinct users == %t", tt.casemapping, len(users), tt.distinct)
+		}
+
+		if got, want := c.CaseMap("Foo[]"), ToCaseMapping(tt.casemapping, "Foo[]"); got != want {
+			t.Fatalf("Client.CaseMap() = %q, want %q", got, want)
+		}
+
+		if !c.IsSelf(&Source{Name: "TEST"}) || c.IsSelf(&Source{Name: "foo[]"}) {
+			t.Fatalf("%s: Client.IsSelf() didn't match our nickname", tt.casemapping)
+		}
+
+		perms := c.LookupUser("foo[]").Perms.Copy()
+		perms.set("#a[", Perms{Op: true})
+		if _, ok := perms.Lookup("#a{"); ok != !tt.distinct {
+			t.Fatalf("%s: UserPerms.Lookup() == %t, want %t", tt.casemapping, ok, !tt.distinct)
+		}
+
+		c.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestOper(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	events := make(chan Event, 10)
+	c.Handlers.Add(OPER_UP, func(c *Client, e Event) { events <- e })
+	c.Handlers.Add(OPER_FAILED, func(c *Client, e Event) { events <- e })
+
+	expect := func(command string, params ...string) {
+		t.Helper()
+
+		select {
+		case e := <-events:
+			if e.Command != command || !reflect.DeepEqual(e.Params, params) {
+				t.Fatalf("got event %s %v, want %s %v", e.Command, e.Params, command, params)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", command)
+		}
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Not in response to OPER, so should be ignored.
+	conn.Write([]byte(":dummy.int 464 test :Password incorrect\r\n"))
+	conn.Write([]byte("PING :sync\r\n"))
+	expectLine(t, lines, "PONG sync")
+
+	c.Cmd.Oper("user", "wrong")
+	expectLine(t, lines, "OPER user wrong")
+	conn.Write([]byte(":dummy.int 464 test :Password incorrect\r\n"))
+	expect(OPER_FAILED, ERR_PASSWDMISMATCH, "Password incorrect")
+
+	if c.IsOper() {
+		t.Fatal("Client.IsOper() == true after failed OPER")
+	}
+
+	c.Cmd.Oper("user", "pass")
+	expectLine(t, lines, "OPER user pass")
+	conn.Write([]byte(":dummy.int 381 test :You are now an IRC operator\r\n"))
+	expect(OPER_UP, "You are now an IRC operator")
+
+	if !c.IsOper() {
+		t.Fatal("Client.IsOper() == false after successful OPER")
+	}
+}
+
+func TestSelfAway(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	events := make(chan Event, 10)
+	c.Handlers.Add(SELF_AWAY, func(c *Client, e Event) { events <- e })
+	c.Handlers.Add(SELF_BACK, func(c *Client, e Event) { events <- e })
+
+	expect := func(command string, params ...string) {
+		t.Helper()
+
+		select {
+		case e := <-events:
+			if e.Command != command || !reflect.DeepEqual(e.Params, params) {
+				t.Fatalf("got event %s %v, want %s %v", e.Command, e.Params, command, params)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", command)
+		}
+	}
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	if c.IsAway() {
+		t.Fatal("Client.IsAway() == true before AWAY")
+	}
+
+	if err := c.Cmd.Away("gone fishing"); err != nil {
+		t.Fatalf("Commands.Away() returned error: %v", err)
+	}
+	expectLine(t, lines, "AWAY :gone fishing")
+
+	// Not yet confirmed by the server.
+	if c.IsAway() {
+		t.Fatal("Client.IsAway() == true before RPL_NOWAWAY")
+	}
+
+	conn.Write([]byte(":dummy.int 306 test :You have been marked as being away\r\n"))
+	expect(SELF_AWAY, "gone fishing")
+
+	if !c.IsAway() {
+		t.Fatal("Client.IsAway() == false after RPL_NOWAWAY")
+	}
+
+	if got := c.AwayMessage(); got != "gone fishing" {
+		t.Fatalf("Client.AwayMessage() = %q, want %q", got, "gone fishing")
+	}
+
+	c.Cmd.Back()
+	expectLine(t, lines, "AWAY")
+	conn.Write([]byte(":dummy.int 305 test :You are no longer marked as being away\r\n"))
+	expect(SELF_BACK)
+
+	if c.IsAway() || c.AwayMessage() != "" {
+		t.Fatalf("Client.IsAway() = %t, Client.AwayMessage() = %q after RPL_UNAWAY", c.IsAway(), c.AwayMessage())
+	}
+}
+
+func TestRegainNick(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	c.Config.RegainNick = true
+	c.Config.RegainNickInterval = 20 * time.Millisecond
+	c.Config.NickServGhost = "GHOST"
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	// Registered with a different nick, e.g. after a collision.
+	conn.Write([]byte(":dummy.int 001 test_ :Welcome\r\n"))
+	expectLine(t, lines, "PRIVMSG NickServ :GHOST test")
+	expectLine(t, lines, "NICK test")
+
+	// The nick is still in use, which shouldn't change our current nick.
+	conn.Write([]byte(":dummy.int 433 test_ test :Nickname is already in use\r\n"))
+	expectLine(t, lines, "NICK test")
+
+	if nick := c.GetNick(); nick != "test_" {
+		t.Fatalf("Client.GetNick() after failed regain = %q, want test_", nick)
+	}
+
+	conn.Write([]byte(":test_!user@host.com NICK test\r\n"))
+	waitFor(t, "nick regained", func() bool { return c.GetNick() == "test" })
+
+	// Drain any attempts sent before the nick change was processed.
+	time.Sleep(100 * time.Millisecond)
+	c.Cmd.Message("#other", "done")
+	expectLine(t, lines, "PRIVMSG #other done")
+
+	time.Sleep(100 * time.Millisecond)
+	c.Cmd.Message("#other", "done")
+
+	for line := range lines {
+		if strings.HasPrefix(line, "NICK") || strings.HasPrefix(line, "PRIVMSG NickServ") {
+			t.Fatalf("attempted to regain nick after success: %q", line)
+		}
+
+		if line == "PRIVMSG #other done" {
+			break
+		}
+	}
+}
+
+func TestNickCollisionLength(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	c.Config.AllowFlood = true
+	lines := mockReadLines(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 433 * test :Nickname is already in use\r\n"))
+	expectLine(t, lines, "NICK test_")
+
+	c.state.Lock()
+	c.state.serverOptions["NICKLEN"] = "4"
+	c.state.Unlock()
+
+	// Without Config.ValidateLimits, the server is left to handle the length.
+	conn.Write([]byte(":dummy.int 433 * test :Nickname is already in use\r\n"))
+	expectLine(t, lines, "NICK test_")
+
+	// Otherwise, the fallback nick should be trimmed to the servers nickname
+	// length.
+	c.Config.ValidateLimits = true
+	conn.Write([]byte(":dummy.int 433 * test :Nickname is already in use\r\n"))
+	expectLine(t, lines, "NICK tes_")
+}
+
+func TestUserBanMask(t *testing.T) {
+	user := &User{Nick: "nick", Ident: "~user", Host: "host.example.com"}
+
+	tests := []struct {
+		user  *User
+		style int
+		want  string
+	}{
+		{user, BanMaskHost, "*!*@host.example.com"},
+		{user, BanMaskUserHost, "*!*user@host.example.com"},
+		{user, BanMaskDomain, "*!*@*.example.com"},
+		{user, BanMaskNick, "nick!*@*"},
+		{user, BanMaskFull, "nick!~user@host.example.com"},
+		{user, 100, "*!*@host.example.com"},
+		{&User{Nick: "nick", Ident: "user", Host: "192.0.2.15"}, BanMaskDomain, "*!*@192.0.2.*"},
+		{&User{Nick: "nick", Ident: "user", Host: "2001:db8::1"}, BanMaskDomain, "*!*@2001:db8::1"},
+		{&User{Nick: "nick", Ident: "user", Host: "user/nick"}, BanMaskDomain, "*!*@user/nick"},
+		{&User{Nick: "nick", Ident: "user", Host: "example.com"}, BanMaskDomain, "*!*@example.com"},
+		{&User{Nick: "nick"}, BanMaskHost, "*!*@*"},
+		{&User{Nick: "nick"}, BanMaskUserHost, "*!*@*"},
+		{&User{Nick: "nick"}, BanMaskDomain, "*!*@*"},
+		{&User{Nick: "nick"}, BanMaskFull, "nick!*@*"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.user.BanMask(tt.style); got != tt.want {
+			t.Errorf("User{%q, %q, %q}.BanMask(%d) = %q, want %q", tt.user.Nick, tt.user.Ident, tt.user.Host, tt.style, got, tt.want)
+		}
+
+		if !MatchMask(tt.user.BanMask(tt.style), tt.user.Nick+"!"+tt.user.Ident+"@"+tt.user.Host) {
+			t.Errorf("User{%q, %q, %q}.BanMask(%d) doesn't match the user", tt.user.Nick, tt.user.Ident, tt.user.Host, tt.style)
+		}
+	}
+}
+
+func TestStateUserModes(t *testing.T) {
+	c, conn, server := genMockConn()
+	defer conn.Close()
+	defer server.Close()
+	go mockReadBuffer(conn)
+
+	mockConnect(t, c, server)
+	defer c.Close()
+
+	conn.Write([]byte(":dummy.int 001 test :Welcome\r\n"))
+	conn.Write([]byte(":dummy.int 221 test +Bi\r\n"))
+	waitFor(t, "user modes from RPL_UMODEIS", func() bool { return c.UserModes() == "+Bi" })
+
+	conn.Write([]byte(":test MODE test :+w\r\n"))
+	waitFor(t, "user mode added", func() bool { return c.UserModes() == "+Biw" })
+
+	conn.Write([]byte(":dummy.int MODE test :-B\r\n"))
+	waitFor(t, "user mode removed", func() bool { return c.UserModes() == "+iw" })
+
+	// RPL_UMODEIS replaces our modes entirely.
+	conn.Write([]byte(":dummy.int 221 test +w\r\n"))
+	waitFor(t, "user modes replaced", func() bool { return c.UserModes() == "+w" })
+}
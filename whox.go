@@ -0,0 +1,150 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// WHOXField is a single field which can be requested in a WHOX query. See
+// https://ircv3.net/specs/extensions/whox for details.
+type WHOXField byte
+
+// WHOX fields, in the order in which the server will reply with them.
+const (
+	WHOXToken    WHOXField = 't' // the query token.
+	WHOXChannel  WHOXField = 'c' // a channel the user is in.
+	WHOXUser     WHOXField = 'u' // the users ident/username.
+	WHOXIP       WHOXField = 'i' // the users IP address.
+	WHOXHost     WHOXField = 'h' // the users hostname.
+	WHOXServer   WHOXField = 's' // the server the user is on.
+	WHOXNick     WHOXField = 'n' // the users nickname.
+	WHOXFlags    WHOXField = 'f' // the users flags (e.g. "H", "G*@").
+	WHOXHops     WHOXField = 'd' // the hop count (distance) to the users server.
+	WHOXIdle     WHOXField = 'l' // the users idle time, in seconds.
+	WHOXAccount  WHOXField = 'a' // the users account, or "0" if not logged in.
+	WHOXOpLevel  WHOXField = 'o' // the users channel op level.
+	WHOXRealname WHOXField = 'r' // the users realname.
+)
+
+// whoxOrder is the order in which the server replies with WHOX fields,
+// regardless of the order they were requested in.
+const whoxOrder = "tcuihsnfdlaor"
+
+// WHOXFields is a set of fields to request in a WHOX query. The token field
+// is always requested, as it's required to tell WHOX replies apart.
+type WHOXFields []WHOXField
+
+// String returns the fields in the order in which the server will reply
+// with them, without duplicates or unknown fields.
+func (f WHOXFields) String() string {
+	var out []byte
+
+	for i := 0; i < len(whoxOrder); i++ {
+		field := WHOXField(whoxOrder[i])
+		if field == WHOXToken {
+			out = append(out, whoxOrder[i])
+			continue
+		}
+
+		for j := 0; j < len(f); j++ {
+			if f[j] == field {
+				out = append(out, whoxOrder[i])
+				break
+			}
+		}
+	}
+
+	return string(out)
+}
+
+// query returns the WHOX query parameter for the fields, e.g. "%tcuhnr,2".
+func (f WHOXFields) query(token string) string {
+	return "%" + f.String() + "," + token
+}
+
+// WHOXReply is a parsed RPL_WHOSPCRPL (354) WHOX reply. Only the fields
+// which were requested will be set.
+type WHOXReply struct {
+	Token    string
+	Channel  string
+	User     string
+	IP       string
+	Host     string
+	Server   string
+	Nick     string
+	Flags    string
+	Hops     int
+	Idle     int
+	Account  string
+	OpLevel  string
+	Realname string
+}
+
+// Away returns true if the user was marked as away (gone) in the reply.
+// Only valid if WHOXFlags was requested.
+func (r *WHOXReply) Away() bool {
+	return strings.HasPrefix(r.Flags, "G")
+}
+
+// ParseWHOX parses a RPL_WHOSPCRPL (354) event, which was sent in response to
+// a WHOX query requesting fields. Values are matched to fields based on the
+// order in which the server replies with them, rather than fixed indexes.
+// ok is false if the event isn't a WHOX reply, or doesn't match the fields.
+func ParseWHOX(e *Event, fields WHOXFields) (reply *WHOXReply, ok bool) {
+	order := fields.String()
+
+	// The first parameter is our nickname.
+	if e.Command != RPL_WHOSPCRPL || len(e.Params) != len(order)+1 {
+		return nil, false
+	}
+
+	reply = &WHOXReply{}
+	for i := 0; i < len(order); i++ {
+		value := e.Params[i+1]
+
+		switch WHOXField(order[i]) {
+		case WHOXToken:
+			reply.Token = value
+		case WHOXChannel:
+			reply.Channel = value
+		case WHOXUser:
+			reply.User = value
+		case WHOXIP:
+			reply.IP = value
+		case WHOXHost:
+			reply.Host = value
+		case WHOXServer:
+			reply.Server = value
+		case WHOXNick:
+			reply.Nick = value
+		case WHOXFlags:
+			reply.Flags = value
+		case WHOXHops:
+			reply.Hops, _ = strconv.Atoi(value)
+		case WHOXIdle:
+			reply.Idle, _ = strconv.Atoi(value)
+		case WHOXAccount:
+			reply.Account = value
+		case WHOXOpLevel:
+			reply.OpLevel = value
+		case WHOXRealname:
+			reply.Realname = value
+		}
+	}
+
+	return reply, true
+}
+
+const (
+	// whoxTrackingToken is the WHOX token used by girc's builtin tracking.
+	whoxTrackingToken = "1"
+	// whoxUserToken is the WHOX token used for user-requested queries.
+	whoxUserToken = "2"
+)
+
+// whoxTrackingFields are the WHOX fields used by girc's builtin tracking.
+var whoxTrackingFields = WHOXFields{WHOXChannel, WHOXUser, WHOXHost, WHOXNick, WHOXFlags, WHOXAccount, WHOXRealname}
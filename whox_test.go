@@ -0,0 +1,62 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package girc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWHOXFields(t *testing.T) {
+	cases := []struct {
+		fields WHOXFields
+		want   string
+	}{
+		{fields: nil, want: "t"},
+		{fields: WHOXFields{WHOXRealname, WHOXNick, WHOXChannel}, want: "tcnr"},
+		{fields: WHOXFields{WHOXIdle, WHOXToken, WHOXIdle, WHOXOpLevel}, want: "tlo"},
+		{fields: whoxTrackingFields, want: "tcuhnfar"},
+		{fields: whoDefaultFields, want: "tcuhnr"},
+	}
+
+	for _, tt := range cases {
+		if got := tt.fields.String(); got != tt.want {
+			t.Fatalf("WHOXFields.String() == %q, want %q", got, tt.want)
+		}
+	}
+
+	if got := whoDefaultFields.query(whoxUserToken); got != "%tcuhnr,2" {
+		t.Fatalf("WHOXFields.query() == %q, want %q", got, "%tcuhnr,2")
+	}
+}
+
+func TestParseWHOX(t *testing.T) {
+	fields := WHOXFields{WHOXNick, WHOXIdle, WHOXAccount, WHOXHops}
+
+	reply, ok := ParseWHOX(ParseEvent(":dummy.int 354 test 2 nick1 3 120 account1"), fields)
+	if !ok {
+		t.Fatal("ParseWHOX() failed to parse valid reply")
+	}
+
+	want := &WHOXReply{Token: "2", Nick: "nick1", Hops: 3, Idle: 120, Account: "account1"}
+	if !reflect.DeepEqual(reply, want) {
+		t.Fatalf("ParseWHOX() == %#v, want %#v", reply, want)
+	}
+
+	// Mismatched fields.
+	if _, ok = ParseWHOX(ParseEvent(":dummy.int 354 test 2 nick1 120"), fields); ok {
+		t.Fatal("ParseWHOX() parsed reply with missing fields")
+	}
+
+	// Not a WHOX reply.
+	if _, ok = ParseWHOX(ParseEvent(":dummy.int 352 test 2 nick1 3 120 account1"), fields); ok {
+		t.Fatal("ParseWHOX() parsed non-WHOX reply")
+	}
+
+	reply, ok = ParseWHOX(ParseEvent(":dummy.int 354 test 1 #channel user host nick G@ 0 :real name"), whoxTrackingFields)
+	if !ok || !reply.Away() || reply.Realname != "real name" || reply.Channel != "#channel" {
+		t.Fatalf("ParseWHOX() == %#v, want tracking reply", reply)
+	}
+}